@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+var analyticsPath = flag.String("analytics", "", "after each session, append a JSON analytics report (turns, interruptions, silence, latency) to `file`, \"-\" for stdout, and print a summary to stderr")
+
+// TurnStats describes one exchange of a session: an utterance of the user and
+// the reply of the bot. Either part may be missing, e.g. for a greeting.
+type TurnStats struct {
+	UserText    string  `json:"user_text,omitempty"`
+	UserSeconds float64 `json:"user_seconds,omitempty"`
+	BotText     string  `json:"bot_text,omitempty"`
+	BotSeconds  float64 `json:"bot_seconds,omitempty"`
+	// ASRLatencySeconds is the time from the end of the user speech to the
+	// first final recognition result.
+	ASRLatencySeconds float64 `json:"asr_latency_seconds,omitempty"`
+	// LatencySeconds is the time from the end of the user speech to the first
+	// bot audio of the reply.
+	LatencySeconds float64 `json:"latency_seconds,omitempty"`
+	Interrupted    bool    `json:"interrupted,omitempty"`
+
+	userStart, userEnd, asrFinal time.Time
+	botDone                      bool
+}
+
+// AnalyticsReport summarizes the conversation of a session. Durations are
+// on the playback timeline: interrupted bot audio counts until the
+// interruption only.
+type AnalyticsReport struct {
+	SessionID          string      `json:"session_id"`
+	StartedAt          time.Time   `json:"started_at"`
+	DurationSeconds    float64     `json:"duration_seconds"`
+	UserTurns          int         `json:"user_turns"`
+	BotTurns           int         `json:"bot_turns"`
+	AvgUserTurnSeconds float64     `json:"avg_user_turn_seconds"`
+	AvgBotTurnSeconds  float64     `json:"avg_bot_turn_seconds"`
+	AvgUserTurnChars   float64     `json:"avg_user_turn_chars"`
+	AvgBotTurnChars    float64     `json:"avg_bot_turn_chars"`
+	Interruptions      int         `json:"interruptions"`
+	UserSpeechRatio    float64     `json:"user_speech_ratio"`
+	BotSpeechRatio     float64     `json:"bot_speech_ratio"`
+	SilenceRatio       float64     `json:"silence_ratio"`
+	AvgLatencySeconds  float64     `json:"avg_latency_seconds"`
+	MaxLatencySeconds  float64     `json:"max_latency_seconds"`
+	Turns              []TurnStats `json:"turns"`
+}
+
+// interval is a span of a session timeline, in seconds from its start.
+type interval struct{ start, end float64 }
+
+// conversationAnalytics is a Handler computing an AnalyticsReport for every
+// session.
+type conversationAnalytics struct {
+	NopHandler
+	enc     *json.Encoder
+	summary io.Writer
+
+	mu         sync.Mutex
+	session    SessionInfo
+	started    time.Time
+	turns      []*TurnStats
+	user       []interval
+	bot        []interval
+	botCursor  float64 // end of the scheduled bot audio
+	interrupts int
+	reply      strings.Builder
+}
+
+func newConversationAnalytics(report, summary io.Writer) *conversationAnalytics {
+	enc := json.NewEncoder(report)
+	enc.SetEscapeHTML(false)
+	return &conversationAnalytics{enc: enc, summary: summary}
+}
+
+func (a *conversationAnalytics) elapsed(now time.Time) float64 {
+	return now.Sub(a.started).Seconds()
+}
+
+// current returns the turn in progress, or nil.
+func (a *conversationAnalytics) current() *TurnStats {
+	if len(a.turns) == 0 {
+		return nil
+	}
+	return a.turns[len(a.turns)-1]
+}
+
+func (a *conversationAnalytics) OnSessionStart(session SessionInfo) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.session, a.started = session, time.Now()
+	a.turns, a.user, a.bot = nil, nil, nil
+	a.botCursor, a.interrupts = 0, 0
+	a.reply.Reset()
+}
+
+func (a *conversationAnalytics) OnASRStart(ASRInfoPayload) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	t := a.elapsed(now)
+	if a.botCursor > t {
+		// 用户打断机器人：截断尚未播放的音频
+		a.interrupts++
+		if cur := a.current(); cur != nil {
+			cur.Interrupted = true
+			cur.BotSeconds = max(cur.BotSeconds-(a.botCursor-t), 0)
+			cur.botDone = true
+		}
+		for i := range a.bot {
+			a.bot[i].end = min(a.bot[i].end, t)
+		}
+		a.botCursor = t
+	}
+	if cur := a.current(); cur != nil && !cur.userStart.IsZero() && cur.userEnd.IsZero() {
+		return // 同一句话的重复检测
+	}
+	a.turns = append(a.turns, &TurnStats{userStart: now})
+}
+
+func (a *conversationAnalytics) OnASRFinal(result ASRResult) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cur := a.current(); cur != nil && !cur.userStart.IsZero() {
+		cur.UserText += result.Text
+		if cur.asrFinal.IsZero() {
+			cur.asrFinal = time.Now()
+		}
+	}
+}
+
+func (a *conversationAnalytics) OnASREnd() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cur := a.current()
+	if cur == nil || cur.userStart.IsZero() || !cur.userEnd.IsZero() {
+		return
+	}
+	cur.userEnd = time.Now()
+	cur.UserSeconds = cur.userEnd.Sub(cur.userStart).Seconds()
+	a.user = append(a.user, interval{a.elapsed(cur.userStart), a.elapsed(cur.userEnd)})
+}
+
+func (a *conversationAnalytics) OnBotText(text string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reply.WriteString(text)
+}
+
+func (a *conversationAnalytics) OnBotTextEnd() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cur := a.current()
+	if cur == nil || cur.botDone {
+		cur = &TurnStats{}
+		a.turns = append(a.turns, cur)
+	}
+	if cur.BotText == "" {
+		cur.BotText = a.reply.String()
+	}
+	a.reply.Reset()
+}
+
+func (a *conversationAnalytics) OnBotSpeechEnd() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cur := a.current(); cur != nil {
+		cur.botDone = true
+	}
+}
+
+func (a *conversationAnalytics) OnAudioChunk(data []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	cur := a.current()
+	if cur == nil || cur.botDone {
+		// 没有对应用户发言的回复，例如开场白
+		cur = &TurnStats{}
+		a.turns = append(a.turns, cur)
+	}
+	if cur.LatencySeconds == 0 && !cur.userEnd.IsZero() {
+		cur.LatencySeconds = now.Sub(cur.userEnd).Seconds()
+	}
+	t := a.elapsed(now)
+	bytesPerSecond := audioSettings.OutputSampleRate * audioSettings.OutputChannels * audioSettings.outputBytesPerSample()
+	d := float64(len(data)) / float64(bytesPerSecond)
+	a.botCursor = max(a.botCursor, t)
+	a.bot = append(a.bot, interval{a.botCursor, a.botCursor + d})
+	a.botCursor += d
+	cur.BotSeconds += d
+}
+
+func (a *conversationAnalytics) OnSessionEnd(int32, []byte) {
+	a.mu.Lock()
+	report := a.report(time.Now())
+	a.mu.Unlock()
+	for i := range report.Turns {
+		report.Turns[i].UserText = redactText(report.Turns[i].UserText)
+		report.Turns[i].BotText = redactText(report.Turns[i].BotText)
+	}
+	if err := a.enc.Encode(report); err != nil {
+		glog.Errorf("Write analytics report: %v", err)
+	}
+	report.WriteSummary(a.summary)
+}
+
+// report computes the report of the session, as of now.
+func (a *conversationAnalytics) report(now time.Time) *AnalyticsReport {
+	r := &AnalyticsReport{
+		SessionID:       a.session.ID,
+		StartedAt:       a.started,
+		DurationSeconds: a.elapsed(now),
+		Interruptions:   a.interrupts,
+		Turns:           []TurnStats{},
+	}
+	var userSeconds, botSeconds, latency float64
+	var userChars, botChars, latencies int
+	for _, t := range a.turns {
+		if t.UserText != "" || t.UserSeconds > 0 {
+			r.UserTurns++
+			userSeconds += t.UserSeconds
+			userChars += utf8.RuneCountInString(t.UserText)
+		}
+		if t.BotSeconds > 0 || t.BotText != "" {
+			r.BotTurns++
+			botSeconds += t.BotSeconds
+			botChars += utf8.RuneCountInString(t.BotText)
+		}
+		if !t.asrFinal.IsZero() && !t.userEnd.IsZero() {
+			t.ASRLatencySeconds = max(t.asrFinal.Sub(t.userEnd).Seconds(), 0)
+		}
+		if t.LatencySeconds > 0 {
+			latencies++
+			latency += t.LatencySeconds
+			r.MaxLatencySeconds = max(r.MaxLatencySeconds, t.LatencySeconds)
+		}
+		r.Turns = append(r.Turns, *t)
+	}
+	ratio := func(a, b float64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return math.Round(a/b*1000) / 1000
+	}
+	r.AvgUserTurnSeconds = ratio(userSeconds, float64(r.UserTurns))
+	r.AvgBotTurnSeconds = ratio(botSeconds, float64(r.BotTurns))
+	r.AvgUserTurnChars = ratio(float64(userChars), float64(r.UserTurns))
+	r.AvgBotTurnChars = ratio(float64(botChars), float64(r.BotTurns))
+	r.AvgLatencySeconds = ratio(latency, float64(latencies))
+
+	// 只统计会话时长内的部分：结束时尚未播放的音频不计入
+	clip := func(spans []interval) []interval {
+		var out []interval
+		for _, s := range spans {
+			if s.end = min(s.end, r.DurationSeconds); s.end > s.start {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	user, bot := clip(a.user), clip(a.bot)
+	r.UserSpeechRatio = ratio(coverage(user), r.DurationSeconds)
+	r.BotSpeechRatio = ratio(coverage(bot), r.DurationSeconds)
+	r.SilenceRatio = ratio(r.DurationSeconds-coverage(append(user, bot...)), r.DurationSeconds)
+	return r
+}
+
+// coverage returns the total length of the union of spans.
+func coverage(spans []interval) float64 {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var total, end float64
+	for _, s := range spans {
+		if s.start > end {
+			end = s.start
+		}
+		if s.end > end {
+			total += s.end - end
+			end = s.end
+		}
+	}
+	return total
+}
+
+// WriteSummary writes the report to w in human-readable form.
+func (r *AnalyticsReport) WriteSummary(w io.Writer) {
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second)).Round(10 * time.Millisecond)
+	}
+	percent := func(v float64) string { return fmt.Sprintf("%.0f%%", v*100) }
+	fmt.Fprintf(w, "Session %s analytics: %v\n", r.SessionID, seconds(r.DurationSeconds))
+	fmt.Fprintf(w, "  user turns: %d, avg %v, %.1f chars\n", r.UserTurns, seconds(r.AvgUserTurnSeconds), r.AvgUserTurnChars)
+	fmt.Fprintf(w, "  bot turns: %d, avg %v, %.1f chars\n", r.BotTurns, seconds(r.AvgBotTurnSeconds), r.AvgBotTurnChars)
+	fmt.Fprintf(w, "  interruptions: %d\n", r.Interruptions)
+	fmt.Fprintf(w, "  talk time: user %s, bot %s, silence %s\n", percent(r.UserSpeechRatio), percent(r.BotSpeechRatio), percent(r.SilenceRatio))
+	fmt.Fprintf(w, "  latency: avg %v, max %v\n", seconds(r.AvgLatencySeconds), seconds(r.MaxLatencySeconds))
+	for i, t := range r.Turns {
+		line := fmt.Sprintf("  #%d", i+1)
+		if t.UserSeconds > 0 {
+			line += fmt.Sprintf(" user %v", seconds(t.UserSeconds))
+		}
+		if t.ASRLatencySeconds > 0 {
+			line += fmt.Sprintf(" asr %v", seconds(t.ASRLatencySeconds))
+		}
+		if t.LatencySeconds > 0 {
+			line += fmt.Sprintf(" latency %v", seconds(t.LatencySeconds))
+		}
+		if t.BotSeconds > 0 {
+			line += fmt.Sprintf(" bot %v", seconds(t.BotSeconds))
+		}
+		if t.Interrupted {
+			line += " (interrupted)"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// openAnalytics returns the writer of the -analytics reports and a function
+// closing it. With -encrypt-at-rest the encrypted file cannot be appended
+// to: it is written anew, starting with the reports it held.
+func openAnalytics(path string) (io.Writer, func(), error) {
+	if path == "-" {
+		return os.Stdout, func() {}, nil
+	}
+	if aead, err := atRestKey(); err != nil || aead != nil {
+		if err != nil {
+			return nil, nil, err
+		}
+		return openSealedAnalytics(path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open analytics file: %w", err)
+	}
+	return f, func() {
+		if err := f.Close(); err != nil {
+			glog.Errorf("Close analytics file: %v", err)
+		}
+	}, nil
+}
+
+func openSealedAnalytics(path string) (io.Writer, func(), error) {
+	old, _, err := readOutput(path + encSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("read analytics file: %w", err)
+	}
+	f, err := createAtomicOutput(path)
+	if err == nil {
+		if _, err = f.Write(old); err != nil {
+			f.Abort()
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("open analytics file: %w", err)
+	}
+	return f, func() {
+		if err := f.Close(); err != nil {
+			glog.Errorf("Close analytics file: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// 识别置信度：服务端在识别结果中给出 confidence（0 到 1）时，它随 ASRResult
+// 交给各处理器，并写入 -json 事件、录制目录的 transcript.txt 与实时字幕。
+// -min-confidence 设置阈值：低于阈值的识别结果在字幕与 transcript.txt 中标出；
+// -llm 模式下，-min-confidence-action flag 在发给外部大模型的用户文本后附上
+// 识别可能有误的提示，drop 则不把这一轮发给大模型。没有置信度的结果不受影响。
+
+var (
+	minConfidence       = flag.Float64("min-confidence", 0, "flag the ASR results with a confidence below this, from 0 to 1 (0 disables); see -min-confidence-action")
+	minConfidenceAction = flag.String("min-confidence-action", "flag", "what the -llm pipeline does with the ASR results below -min-confidence: flag them to the LLM as possibly misrecognized or drop them")
+)
+
+// lowConfidenceNote is appended to the user text of a low confidence result
+// sent to the LLM.
+const lowConfidenceNote = "（语音识别置信度低，以上内容可能有误，必要时请用户重复）"
+
+// validateConfidence checks -min-confidence and -min-confidence-action.
+func validateConfidence() error {
+	if *minConfidence < 0 || *minConfidence > 1 {
+		return fmt.Errorf("invalid -min-confidence %g, expect 0 to 1", *minConfidence)
+	}
+	if *minConfidenceAction != "flag" && *minConfidenceAction != "drop" {
+		return fmt.Errorf("invalid -min-confidence-action %q, expect flag or drop", *minConfidenceAction)
+	}
+	return nil
+}
+
+// lowConfidence reports whether the server reported a confidence of result
+// below -min-confidence.
+func lowConfidence(result ASRResult) bool {
+	return result.Confidence > 0 && result.Confidence < *minConfidence
+}
+
+// confidenceLabel returns the annotation of the text of result in the
+// transcripts: its confidence if it is low, otherwise "".
+func confidenceLabel(result ASRResult) string {
+	if !lowConfidence(result) {
+		return ""
+	}
+	return fmt.Sprintf(" (low confidence %.2f)", result.Confidence)
+}
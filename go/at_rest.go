@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// 静态加密：-encrypt-at-rest 打开后，保存的音频（output.wav、-sink 文件）、
+// 录制目录中除 metadata.json 以外的文件、-analytics 报告、export 导出的
+// Markdown 与音频、-batch-out 结果以及 -conversation 对话历史用 AES-256-GCM
+// 加密，文件名加上 .enc 后缀（对话历史原地加密，加载时自动解密）。文件在写入
+// 时即分块加密，磁盘上不出现明文；无法回填的 WAV 文件头以 0xFFFFFFFF 表示长度
+// 未知，FLAC 的 STREAMINFO 不含总样本数与 MD5。密钥为 32 字节，以 base64 或十六进制表示，-encrypt-at-rest=env 时
+// 取自 DIALOG_ENCRYPTION_KEY 环境变量，keyring 时取自系统钥匙串（Linux 的
+// secret-tool、macOS 的 security，服务名 realtimedialog，账户 encryption-key）。
+// decrypt 子命令解密文件。
+//
+// 加密文件由 encMagic、8 字节随机 nonce 前缀以及若干分块组成，每块为 4 字节
+// 大端长度加密文；第 i 块的 nonce 为前缀加 4 字节 i，附加数据标记是否最后一块，
+// 截断、重排与末尾附加的数据都无法通过校验。decrypt 先写入临时文件，解密失败时
+// 删除，不留下部分明文。
+
+var encryptAtRest = flag.String("encrypt-at-rest", "", "encrypt the saved audio, recordings and conversation with AES-256-GCM, with the key from `source`: env ($DIALOG_ENCRYPTION_KEY) or keyring (the system keyring)")
+
+const (
+	// encryptionKeyEnv is the environment variable holding the key.
+	encryptionKeyEnv = "DIALOG_ENCRYPTION_KEY"
+	// encMagic starts the encrypted files.
+	encMagic = "RDENC1"
+	// encChunk is the size of the cleartext chunks.
+	encChunk = 1 << 20
+	// encSuffix is appended to the names of the encrypted files.
+	encSuffix = ".enc"
+)
+
+// atRestKey returns the AEAD of the -encrypt-at-rest key, nil when the
+// encryption is off. The key is read once.
+var atRestKey = sync.OnceValues(func() (cipher.AEAD, error) {
+	if *encryptAtRest == "" {
+		return nil, nil
+	}
+	var encoded string
+	switch *encryptAtRest {
+	case "env":
+		encoded = os.Getenv(encryptionKeyEnv)
+		if encoded == "" {
+			return nil, fmt.Errorf("%s is not set", encryptionKeyEnv)
+		}
+	case "keyring":
+		var err error
+		if encoded, err = keyringKey(); err != nil {
+			return nil, fmt.Errorf("read the key from the keyring: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown -encrypt-at-rest key source %q, expect env or keyring", *encryptAtRest)
+	}
+	key, err := decodeKey(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+})
+
+// decodeKey decodes a 32-byte key in base64 or hex.
+func decodeKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("the encryption key must be 32 bytes in base64 or hex")
+}
+
+// keyringKey reads the key from the system keyring.
+func keyringKey() (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(context.Background(), "security", "find-generic-password", "-s", "realtimedialog", "-a", "encryption-key", "-w")
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.CommandContext(context.Background(), "secret-tool", "lookup", "service", "realtimedialog", "account", "encryption-key")
+	default:
+		return "", fmt.Errorf("no keyring support on %s", runtime.GOOS)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", cmd.Path, err)
+	}
+	return string(out), nil
+}
+
+// checkEncryptionKey fails early when -encrypt-at-rest is set without a
+// usable key.
+func checkEncryptionKey() error {
+	_, err := atRestKey()
+	return err
+}
+
+// sealFile encrypts the file at path to path.enc and removes it, when
+// -encrypt-at-rest is set.
+func sealFile(path string) error {
+	aead, err := atRestKey()
+	if err != nil || aead == nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + encSuffix + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	err = encryptStream(aead, w, in)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+encSuffix)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("encrypt %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// sealDir encrypts the files of dir but those in keep.
+func sealDir(dir string, keep ...string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasSuffix(name, encSuffix) || slices.Contains(keep, name) {
+			continue
+		}
+		if err := sealFile(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealBytes returns data encrypted when -encrypt-at-rest is set, else data.
+func sealBytes(data []byte) ([]byte, error) {
+	aead, err := atRestKey()
+	if err != nil || aead == nil {
+		return data, err
+	}
+	var b bytes.Buffer
+	if err := encryptStream(aead, &b, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// openBytes decrypts data if it is encrypted.
+func openBytes(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encMagic)) {
+		return data, nil
+	}
+	aead, err := atRestKey()
+	if err == nil && aead == nil {
+		err = errors.New("the data is encrypted, set -encrypt-at-rest")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := decryptStream(aead, &b, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func chunkNonce(prefix []byte, i uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(nil), prefix...), i)
+}
+
+func encryptStream(aead cipher.AEAD, w io.Writer, r io.Reader) error {
+	ew, err := newEncryptWriter(aead, w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ew, r); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// encryptWriter encrypts what is written to it as encryptStream does, a
+// chunk at a time: at most a chunk of cleartext is held, in memory. Close
+// writes the last chunk; it does not close the underlying writer.
+type encryptWriter struct {
+	aead   cipher.AEAD
+	w      io.Writer
+	prefix []byte
+	buf    []byte // cleartext of the next chunk
+	i      uint32 // index of the next chunk
+	err    error
+}
+
+func newEncryptWriter(aead cipher.AEAD, w io.Writer) (*encryptWriter, error) {
+	prefix := make([]byte, aead.NonceSize()-4)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{aead: aead, w: w, prefix: prefix}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// 有更多数据时才知道已满的块不是最后一块
+		if len(e.buf) == encChunk {
+			if e.err = e.seal(false); e.err != nil {
+				return n - len(p), e.err
+			}
+		}
+		k := min(len(p), encChunk-len(e.buf))
+		e.buf = append(e.buf, p[:k]...)
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Close writes the last chunk. Further writes fail.
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.err = e.seal(true); e.err != nil {
+		return e.err
+	}
+	e.err = os.ErrClosed
+	return nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.i), e.buf, []byte{boolByte(last)})
+	e.i++
+	clear(e.buf)
+	e.buf = e.buf[:0]
+	if err := binary.Write(e.w, binary.BigEndian, uint32(len(sealed))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// outputFile is a file written by the client, such as a recording or a
+// report. With -encrypt-at-rest it is created at its path with the .enc
+// suffix and encrypted as it is written, so that no cleartext reaches the
+// disk. The writes go to the embedded Writer: the file itself, which headers
+// can be written back to, or the encrypting writer.
+type outputFile struct {
+	io.Writer
+	file  *os.File
+	enc   *encryptWriter // nil without encryption
+	path  string
+	close func() error // closes the file
+}
+
+// createOutput creates the output file at path.
+func createOutput(path string) (*outputFile, error) {
+	return openOutput(path, func(path string) (*os.File, func() error, error) {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f.Close, nil
+	})
+}
+
+// createAtomicOutput creates the output file at path through a temporary
+// file renamed by Close, see createAtomic.
+func createAtomicOutput(path string) (*outputFile, error) {
+	return openOutput(path, func(path string) (*os.File, func() error, error) {
+		f, err := createAtomic(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f.File, f.Close, nil
+	})
+}
+
+func openOutput(path string, create func(path string) (*os.File, func() error, error)) (*outputFile, error) {
+	aead, err := atRestKey()
+	if err != nil {
+		return nil, err
+	}
+	if aead != nil {
+		path += encSuffix
+	}
+	f, closeFile, err := create(path)
+	if err != nil {
+		return nil, err
+	}
+	o := &outputFile{Writer: f, file: f, path: path, close: closeFile}
+	if aead == nil {
+		return o, nil
+	}
+	err = f.Chmod(0600)
+	if err == nil {
+		o.enc, err = newEncryptWriter(aead, f)
+	}
+	if err != nil {
+		o.Abort()
+		return nil, err
+	}
+	o.Writer = o.enc
+	return o, nil
+}
+
+// Path returns the path of the complete file, with the .enc suffix when
+// encrypted.
+func (o *outputFile) Path() string {
+	return o.path
+}
+
+// Close completes the file. A file that cannot be completed is removed.
+func (o *outputFile) Close() error {
+	if o.enc != nil {
+		if err := o.enc.Close(); err != nil {
+			o.Abort()
+			return err
+		}
+	}
+	return o.close()
+}
+
+// Abort closes and removes the incomplete file.
+func (o *outputFile) Abort() {
+	o.file.Close()
+	os.Remove(o.file.Name())
+}
+
+// writeOutput writes data to the output file at path, atomically.
+func writeOutput(path string, data []byte) error {
+	o, err := createAtomicOutput(path)
+	if err != nil {
+		return err
+	}
+	if _, err := o.Write(data); err != nil {
+		o.Abort()
+		return err
+	}
+	return o.Close()
+}
+
+// readSealedPrefix returns the cleartext of the complete chunks of the
+// encrypted file at path, which may have been cut short by a crash while it
+// was written.
+func readSealedPrefix(path string) ([]byte, error) {
+	aead, err := atRestKey()
+	if err == nil && aead == nil {
+		err = errors.New("the file is encrypted, set -encrypt-at-rest")
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var b bytes.Buffer
+	if err := decryptStream(aead, &b, bufio.NewReader(f)); err != nil && !errors.Is(err, errTruncated) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b.Bytes(), nil
+}
+
+// readOutput returns the content of the output file at path, or of path.enc
+// decrypted, and the path read.
+func readOutput(path string) ([]byte, string, error) {
+	return readBundleFile(filepath.Dir(path), filepath.Base(path))
+}
+
+// removeOutput removes the output file at path, encrypted or not.
+func removeOutput(path string) error {
+	for _, p := range []string{path, path + encSuffix} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputExists reports whether the output file at path exists, encrypted or
+// not.
+func outputExists(path string) bool {
+	for _, p := range []string{path, path + encSuffix} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// errTruncated is returned by decryptStream for an encrypted file cut short,
+// after the cleartext of its complete chunks.
+var errTruncated = errors.New("truncated encrypted file")
+
+func decryptStream(aead cipher.AEAD, w io.Writer, r io.Reader) error {
+	header := make([]byte, len(encMagic)+aead.NonceSize()-4)
+	n, err := io.ReadFull(r, header)
+	// 只写出了部分文件头的文件同样是截断的
+	if m := min(n, len(encMagic)); n == 0 || string(header[:m]) != encMagic[:m] {
+		return errors.New("not an encrypted file")
+	}
+	if err != nil {
+		return errTruncated
+	}
+	prefix := header[len(encMagic):]
+	for i := uint32(0); ; i++ {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return errTruncated
+		}
+		if size > encChunk+uint32(aead.Overhead()) {
+			return errors.New("corrupt encrypted file")
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return errTruncated
+		}
+		plain, err := aead.Open(nil, chunkNonce(prefix, i), sealed, []byte{0})
+		last := false
+		if err != nil {
+			if plain, err = aead.Open(nil, chunkNonce(prefix, i), sealed, []byte{1}); err != nil {
+				return errors.New("decrypt: wrong key or corrupt file")
+			}
+			last = true
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	switch _, err := io.ReadFull(r, make([]byte, 1)); err {
+	case io.EOF:
+		return nil
+	case nil:
+		return errors.New("trailing data after the encrypted file")
+	default:
+		return err
+	}
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	commands["decrypt"] = runDecrypt
+}
+
+// runDecrypt implements the `decrypt <file.enc> [out]` subcommand.
+func runDecrypt(ctx context.Context, cfg *Config) error {
+	path := flag.Arg(1)
+	if path == "" {
+		return errors.New("usage: decrypt <file.enc> [output file, - for stdout]")
+	}
+	if *encryptAtRest == "" {
+		*encryptAtRest = "env"
+	}
+	aead, err := atRestKey()
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	outPath := flag.Arg(2)
+	if outPath == "" {
+		outPath = strings.TrimSuffix(path, encSuffix)
+		if outPath == path {
+			return errors.New("give the output file")
+		}
+	}
+	if outPath != "-" {
+		if err := decryptFile(aead, outPath, in); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := decryptStream(aead, w, bufio.NewReader(in)); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return w.Flush()
+}
+
+// decryptFile decrypts r to a new file at path, through a temporary file
+// removed if the decryption fails, so that no partial cleartext is left.
+func decryptFile(aead cipher.AEAD, path string, r io.Reader) error {
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	f, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = f.Chmod(0600)
+	if err == nil {
+		err = decryptStream(aead, w, bufio.NewReader(r))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testAEAD(t *testing.T) cipher.AEAD {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func testEncrypt(t *testing.T, aead cipher.AEAD, plain []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := encryptStream(aead, &b, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	aead := testAEAD(t)
+	for _, size := range []int{0, 1, 1000, encChunk, encChunk + 1, 2*encChunk + 17} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+		var out bytes.Buffer
+		if err := decryptStream(aead, &out, bytes.NewReader(testEncrypt(t, aead, plain))); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Fatalf("%d bytes: decrypted %d different bytes", size, out.Len())
+		}
+	}
+}
+
+func TestDecryptRejectsDamage(t *testing.T) {
+	aead := testAEAD(t)
+	plain := make([]byte, 2*encChunk+100)
+	sealed := testEncrypt(t, aead, plain)
+	// 第一块之后的位置：长度前缀与密文
+	firstEnd := len(encMagic) + aead.NonceSize() - 4 + 4 + encChunk + aead.Overhead()
+	wrongKey, err := aes.NewCipher(bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongAEAD, _ := cipher.NewGCM(wrongKey)
+
+	tampered := func(i int) []byte {
+		b := bytes.Clone(sealed)
+		b[i] ^= 1
+		return b
+	}
+	for name, tc := range map[string]struct {
+		aead cipher.AEAD
+		data []byte
+	}{
+		"truncated at a chunk boundary": {aead, sealed[:firstEnd]},
+		"truncated in a chunk":          {aead, sealed[:firstEnd+100]},
+		"truncated in the last chunk":   {aead, sealed[:len(sealed)-1]},
+		"truncated header":              {aead, sealed[:len(encMagic)+2]},
+		"tampered ciphertext":           {aead, tampered(firstEnd + 10)},
+		"tampered nonce":                {aead, tampered(len(encMagic))},
+		"tampered length":               {aead, tampered(firstEnd - encChunk - aead.Overhead() - 1)},
+		"trailing data":                 {aead, append(bytes.Clone(sealed), 0)},
+		"appended file":                 {aead, append(bytes.Clone(sealed), testEncrypt(t, aead, []byte("x"))...)},
+		"wrong key":                     {wrongAEAD, sealed},
+	} {
+		if err := decryptStream(tc.aead, &bytes.Buffer{}, bytes.NewReader(tc.data)); err == nil {
+			t.Errorf("%s: decrypted", name)
+		}
+	}
+}
+
+func TestDecryptFileLeavesNoPartialOutput(t *testing.T) {
+	aead := testAEAD(t)
+	dir := t.TempDir()
+	plain := make([]byte, encChunk+100)
+	sealed := testEncrypt(t, aead, plain)
+
+	path := filepath.Join(dir, "truncated.wav")
+	if err := decryptFile(aead, path, bytes.NewReader(sealed[:len(sealed)-10])); err == nil {
+		t.Fatal("decrypted a truncated file")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("left %s after a failed decryption", entries[0].Name())
+	}
+
+	path = filepath.Join(dir, "ok.wav")
+	if err := decryptFile(aead, path, bytes.NewReader(sealed)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, plain) {
+		t.Fatalf("decrypted %d bytes, %v", len(data), err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("decrypted file mode %v, %v", info.Mode(), err)
+	}
+	if err := decryptFile(aead, path, bytes.NewReader(sealed)); err == nil {
+		t.Fatal("overwrote an existing file")
+	}
+}
+
+// useTestKey turns -encrypt-at-rest on with the key of testAEAD for the test.
+func useTestKey(t *testing.T) cipher.AEAD {
+	aead := testAEAD(t)
+	saved := atRestKey
+	atRestKey = func() (cipher.AEAD, error) { return aead, nil }
+	t.Cleanup(func() { atRestKey = saved })
+	return aead
+}
+
+func TestEncryptWriterSplits(t *testing.T) {
+	aead := testAEAD(t)
+	for _, size := range []int{0, 1, encChunk - 1, encChunk, encChunk + 1, 2 * encChunk} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+		// 写入的大小不同，分块相同
+		for _, step := range []int{1000, encChunk - 3, encChunk, 3 * encChunk} {
+			var sealed bytes.Buffer
+			w, err := newEncryptWriter(aead, &sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for p := plain; len(p) > 0; {
+				k := min(step, len(p))
+				if n, err := w.Write(p[:k]); n != k || err != nil {
+					t.Fatalf("Write wrote %d of %d bytes: %v", n, k, err)
+				}
+				p = p[k:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte{1}); err == nil {
+				t.Error("wrote after Close")
+			}
+			var out bytes.Buffer
+			if err := decryptStream(aead, &out, &sealed); err != nil {
+				t.Fatalf("%d bytes by %d: %v", size, step, err)
+			}
+			if !bytes.Equal(out.Bytes(), plain) {
+				t.Fatalf("%d bytes by %d: decrypted %d different bytes", size, step, out.Len())
+			}
+		}
+	}
+}
+
+func TestReadSealedPrefix(t *testing.T) {
+	aead := useTestKey(t)
+	plain := make([]byte, 2*encChunk+100)
+	_, _ = rand.Read(plain)
+	sealed := testEncrypt(t, aead, plain)
+	firstEnd := len(encMagic) + aead.NonceSize() - 4 + 4 + encChunk + aead.Overhead()
+
+	path := filepath.Join(t.TempDir(), "events.jsonl.enc")
+	for cut, want := range map[int]int{
+		len(encMagic) + 2: 0,
+		firstEnd:          encChunk,
+		firstEnd + 100:    encChunk, // 第二块不完整
+		len(sealed):       len(plain),
+	} {
+		if err := os.WriteFile(path, sealed[:cut], 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readSealedPrefix(path)
+		if err != nil {
+			t.Fatalf("cut at %d: %v", cut, err)
+		}
+		if !bytes.Equal(got, plain[:want]) {
+			t.Errorf("cut at %d: read %d bytes, want %d", cut, len(got), want)
+		}
+	}
+}
+
+// TestEncryptedWAVSink checks that an encrypted sink writes no cleartext
+// and that its file decrypts to a WAV file of unknown length.
+func TestEncryptedWAVSink(t *testing.T) {
+	useTestKey(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.wav")
+	header := func(size int) []byte { return encodeWAVHeader(wavFormatPCM, 1, 16000, 2, size) }
+	w, err := createWAV(path, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio := make([]byte, 4000)
+	for i := range audio {
+		audio[i] = byte(i)
+	}
+	if _, err := w.Write(audio); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		data, _ := os.ReadFile(filepath.Join(dir, e.Name()))
+		if bytes.Contains(data, []byte("RIFF")) || bytes.Contains(data, audio[:64]) {
+			t.Errorf("%s holds cleartext while written", e.Name())
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cleartext %s exists: %v", path, err)
+	}
+	data, read, err := readOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != path+encSuffix {
+		t.Errorf("read %s", read)
+	}
+	if !bytes.Equal(data[44:], audio) {
+		t.Fatalf("decrypted %d bytes of audio, want %d", len(data)-44, len(audio))
+	}
+	if _, _, _, err := decodeWAV(data); err != nil {
+		t.Fatal(err)
+	}
+}
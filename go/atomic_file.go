@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// 崩溃安全的写入：音频、文本与元数据先写入同目录下带 .part 后缀的临时文件
+// （录制目录整体以 .part 后缀的目录录制），完成并同步到磁盘后再原子地改名，
+// 下游工具看到的文件要么完整、要么不存在。正常退出（Ctrl-C、SIGTERM）时照常
+// 回填 WAV 文件头后改名；被强行中断时留下的 .part 文件不会冒充完整的文件。
+
+// partSuffix is appended to the names of the files and recording bundles
+// being written.
+const partSuffix = ".part"
+
+// atomicFile is a file written under a temporary name and renamed to its
+// path once complete.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+// createAtomic creates the file to be renamed to path by Close.
+func createAtomic(path string) (*atomicFile, error) {
+	f, err := os.Create(path + partSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, path: path}, nil
+}
+
+// Close syncs the file and renames it to its path.
+func (f *atomicFile) Close() error {
+	err := f.File.Sync()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.File.Name(), f.path)
+}
+
+// Abort closes and removes the incomplete file.
+func (f *atomicFile) Abort() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+// Path returns the name of the complete file.
+func (f *atomicFile) Path() string {
+	return f.path
+}
+
+// writeFileAtomic writes data to path through a temporary file, so that path
+// holds either its previous content or data.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+partSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// 音频后端：播放与采集只通过 AudioBackend 访问声卡，由 -audio-backend 选择：
+// portaudio（默认，需要系统的 PortAudio 库）或 malgo（miniaudio，随程序一起
+// 编译，无需安装系统库，便于 Windows 与交叉编译；以 go build -tags malgo 构建）。
+// 两者都需要 cgo；CGO_ENABLED=0 的构建没有音频后端，只能使用文件、网络与标准
+// 输入输出的音频。
+
+var audioBackendName = flag.String("audio-backend", "portaudio", "library playing and capturing the audio: portaudio, or malgo (miniaudio) when built with -tags malgo")
+
+// AudioDevice is an audio device of an AudioBackend.
+type AudioDevice struct {
+	Name    string
+	HostAPI string
+	// The channel counts and the sample rate are 0 when unknown.
+	MaxInputChannels  int
+	MaxOutputChannels int
+	DefaultSampleRate float64
+	DefaultInput      bool
+	DefaultOutput     bool
+	// handle identifies the device to its backend.
+	handle any
+}
+
+// AudioBackend plays and captures audio through a sound library.
+type AudioBackend interface {
+	// Devices lists the audio devices.
+	Devices() ([]*AudioDevice, error)
+	// Play calls fill with each buffer of interleaved samples to play on
+	// device, of framesPerBuffer frames at rate and channels, until ctx is
+	// done. fill is called on the audio thread.
+	Play(ctx context.Context, device *AudioDevice, rate, channels, framesPerBuffer int, fill func(out []float32)) error
+	// Capture calls deliver with each buffer of interleaved 16-bit samples
+	// captured from device, at rate and channels, until ctx is done. The
+	// audio is resampled if the device does not support rate. The buffer is
+	// only valid during the call.
+	Capture(ctx context.Context, device *AudioDevice, rate, channels, framesPerBuffer int, deliver func(in []int16)) error
+	// Close releases the library.
+	Close() error
+}
+
+// audioBackends open the AudioBackend implementations by -audio-backend
+// name. They are registered by files built with cgo.
+var audioBackends = map[string]func() (AudioBackend, error){}
+
+// audioBackend is the backend opened for the local microphone and speaker.
+var audioBackend AudioBackend
+
+// openAudioBackend opens the -audio-backend implementation.
+func openAudioBackend() (AudioBackend, error) {
+	open, ok := audioBackends[*audioBackendName]
+	switch {
+	case len(audioBackends) == 0:
+		return nil, errors.New("no audio backend in this build, which has no cgo: use -input wav:, rtp: or stdin and a -sink other than speaker")
+	case !ok:
+		return nil, fmt.Errorf("unknown audio backend %q", *audioBackendName)
+	}
+	return open()
+}
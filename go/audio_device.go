@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	outputDeviceName = flag.String("output-device", "", "play the bot audio on the output device whose name contains this, e.g. a virtual device like \"CABLE Input\" or \"BlackHole\"; \"pulse:<sink>\" plays to a PulseAudio sink (see the `devices` command); remembered in the config file")
+	inputDeviceName  = flag.String("input-device", "", "capture the microphone from the input device whose name contains this (see the `devices` command); remembered in the config file")
+)
+
+func init() {
+	commands["devices"] = runDevices
+}
+
+// outputDevice returns the device selected by -output-device, else the
+// output device saved in the config file, else the default output device.
+func outputDevice() (*AudioDevice, error) {
+	devices, err := audioBackend.Devices()
+	if err != nil {
+		return nil, err
+	}
+	name := *outputDeviceName
+	if name == "" {
+		return savedDevice(devices, true)
+	}
+	// PulseAudio 的 sink 无法直接作为 PortAudio 设备打开，通过 pulse 设备和 PULSE_SINK 环境变量选择
+	sink, isPulse := strings.CutPrefix(name, "pulse:")
+	if isPulse {
+		if err := os.Setenv("PULSE_SINK", sink); err != nil {
+			return nil, fmt.Errorf("select pulse sink: %w", err)
+		}
+		name = "pulse"
+	}
+	d, err := findDevice(devices, name, true)
+	if err != nil {
+		return nil, err
+	}
+	rememberDevice(true, DeviceRef{Name: d.Name, HostAPI: d.HostAPI, PulseSink: sink})
+	return d, nil
+}
+
+// inputDevice returns the device selected by -input-device, else the input
+// device saved in the config file, else the default input device.
+func inputDevice() (*AudioDevice, error) {
+	devices, err := audioBackend.Devices()
+	if err != nil {
+		return nil, err
+	}
+	if *inputDeviceName == "" {
+		return savedDevice(devices, false)
+	}
+	d, err := findDevice(devices, *inputDeviceName, false)
+	if err != nil {
+		return nil, err
+	}
+	rememberDevice(false, DeviceRef{Name: d.Name, HostAPI: d.HostAPI})
+	return d, nil
+}
+
+// hasDirection reports whether d is an output or input device.
+func (d *AudioDevice) hasDirection(output bool) bool {
+	if output {
+		return d.MaxOutputChannels > 0
+	}
+	return d.MaxInputChannels > 0
+}
+
+// findDevice returns the output or input device named name, or else the first
+// whose name contains it, ignoring case.
+func findDevice(devices []*AudioDevice, name string, output bool) (*AudioDevice, error) {
+	var match *AudioDevice
+	for _, d := range devices {
+		if !d.hasDirection(output) {
+			continue
+		}
+		if strings.EqualFold(d.Name, name) {
+			return d, nil
+		}
+		if match == nil && strings.Contains(strings.ToLower(d.Name), strings.ToLower(name)) {
+			match = d
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no %s device matches %q, run the `devices` command to list them", directionName(output), name)
+	}
+	return match, nil
+}
+
+// defaultDevice returns the default output or input device.
+func defaultDevice(devices []*AudioDevice, output bool) (*AudioDevice, error) {
+	for _, d := range devices {
+		if output && d.DefaultOutput || !output && d.DefaultInput {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("no default %s device", directionName(output))
+}
+
+func directionName(output bool) string {
+	if output {
+		return "output"
+	}
+	return "input"
+}
+
+// runDevices implements the `devices` subcommand: it lists the audio devices,
+// so that a virtual device can be picked with -output-device.
+func runDevices(context.Context, *Config) error {
+	backend, err := openAudioBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	devices, err := backend.Devices()
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		mark := " "
+		if d.DefaultInput || d.DefaultOutput {
+			mark = "*"
+		}
+		fmt.Printf("%s %-40s in=%d out=%d rate=%v (%s)\n", mark, d.Name, d.MaxInputChannels, d.MaxOutputChannels, d.DefaultSampleRate, d.HostAPI)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+var inputSpec = flag.String("input", "mic", "source of the user audio: mic, wav:<file> (PCM, µ-law or A-law WAV), rtp:<addr> (listen for RTP with PCMU, PCMA or L16) or stdin (raw PCM S16LE at the input rate and channels)")
+
+// openInput returns the source given with -input.
+func openInput() (AudioSource, error) {
+	kind, arg, _ := strings.Cut(*inputSpec, ":")
+	switch kind {
+	case "mic":
+		if *captureChannelList != "" {
+			if _, err := validateCaptureChannels(); err != nil {
+				return nil, err
+			}
+		}
+		return micSource{}, nil
+	case "wav":
+		return newWAVSource(arg)
+	case "rtp":
+		return rtpSource{addr: arg}, nil
+	case "stdin":
+		return newStdinSource(), nil
+	}
+	return nil, fmt.Errorf("unknown input %q", *inputSpec)
+}
+
+// inputConverter converts audio of any rate and channel count to the input
+// format.
+type inputConverter struct {
+	channels int
+	rs       *resampler
+}
+
+func newInputConverter(rate, channels int) *inputConverter {
+	c := &inputConverter{channels: channels}
+	if rate != audioSettings.InputSampleRate {
+		c.rs = newResampler(rate, audioSettings.InputSampleRate, audioSettings.InputChannels)
+	}
+	return c
+}
+
+func (c *inputConverter) convert(samples []int16) []byte {
+	samples = pcm.ConvertChannels(samples, c.channels, audioSettings.InputChannels)
+	if c.rs != nil {
+		samples = c.rs.Process(samples)
+	}
+	return pcm.Int16ToBytes(samples)
+}
+
+// pcmSource streams recorded audio in real time, then silence, as a muted
+// microphone would, until ctx is done or done is closed.
+type pcmSource struct {
+	pcm  []byte // in the input format
+	done <-chan struct{}
+}
+
+// newWAVSource reads a 16-bit PCM, float, µ-law or A-law WAV file.
+func newWAVSource(path string) (AudioSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	samples, rate, channels, err := decodeWAV(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	glog.V(vEvent).Infof("Streaming %s: %d Hz, %d channels, %v", path, rate, channels,
+		time.Duration(len(samples)/channels)*time.Second/time.Duration(rate))
+	return pcmSource{pcm: newInputConverter(rate, channels).convert(samples)}, nil
+}
+
+// Sample rates accepted by decodeWAV.
+const (
+	wavMinRate = 4000
+	wavMaxRate = 384000
+)
+
+// decodeWAV returns the samples, rate and channels of a WAV file.
+func decodeWAV(data []byte) (samples []int16, rate, channels int, err error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, 0, errors.New("not a WAV file")
+	}
+	format, bits := 0, 0
+	for off := 12; off+8 <= len(data); {
+		id := string(data[off : off+4])
+		// 以 uint64 比较，32 位平台上 off+8+size 可能溢出；长度未知（0xFFFFFFFF）
+		// 的块延续到文件末尾
+		size := uint64(binary.LittleEndian.Uint32(data[off+4:]))
+		body := data[off+8:]
+		if size < uint64(len(body)) {
+			body = body[:size]
+		}
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, 0, errors.New("short fmt chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:]))
+			channels = int(binary.LittleEndian.Uint16(body[2:]))
+			rate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			// WAVE_FORMAT_EXTENSIBLE 的实际格式在子格式 GUID 的前两个字节
+			if format == 0xFFFE && len(body) >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:]))
+			}
+		case "data":
+			if channels <= 0 || rate <= 0 {
+				return nil, 0, 0, errors.New("data chunk before fmt chunk")
+			}
+			// 过低的采样率在转换时会把数据放大成千上万倍
+			if rate < wavMinRate || rate > wavMaxRate {
+				return nil, 0, 0, fmt.Errorf("unsupported sample rate %d Hz", rate)
+			}
+			switch {
+			case format == wavFormatPCM && bits == 16:
+				return pcm.BytesToInt16(body), rate, channels, nil
+			case format == wavFormatMuLaw && bits == 8:
+				return decodeG711(codecPCMU, body), rate, channels, nil
+			case format == wavFormatALaw && bits == 8:
+				return decodeG711(codecPCMA, body), rate, channels, nil
+			case format == wavFormatFloat && bits == 32:
+				return pcm.Float32ToInt16(pcm.BytesToFloat32(body)), rate, channels, nil
+			}
+			return nil, 0, 0, fmt.Errorf("unsupported format %d with %d bits per sample", format, bits)
+		}
+		if size+size%2 >= uint64(len(data)-off-8) {
+			break
+		}
+		off += 8 + int(size+size%2)
+	}
+	return nil, 0, 0, errors.New("no data chunk")
+}
+
+func (s pcmSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	chunk := audioSettings.InputSampleRate * audioSettings.InputChannels * 2 * audioSettings.InputBufferMs / 1000
+	silence := make([]byte, chunk)
+	ticker := time.NewTicker(time.Duration(audioSettings.InputBufferMs) * time.Millisecond)
+	defer ticker.Stop()
+	for off := 0; ; off += chunk {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		case <-ticker.C:
+		}
+		if off < len(s.pcm) {
+			send(s.pcm[off:min(off+chunk, len(s.pcm))])
+		} else {
+			send(silence)
+		}
+	}
+}
+
+// RTP payload types of the G.711 codecs.
+const (
+	rtpPayloadPCMU = 0
+	rtpPayloadPCMA = 8
+)
+
+// rtpSource listens for RTP on addr: PCMU or PCMA at 8 kHz mono, or L16
+// (payload type 96) in the input rate and channels.
+type rtpSource struct {
+	addr string
+}
+
+func (s rtpSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("listen for RTP: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	defer conn.Close()
+	glog.V(vEvent).Infof("Listening for RTP audio on %s", conn.LocalAddr())
+
+	g711 := newInputConverter(g711Rate, 1)
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("read RTP: %w", err)
+		}
+		pt, payload, err := parseRTP(buf[:n])
+		if err != nil {
+			glog.V(vFrame).Infof("Drop RTP packet: %v", err)
+			continue
+		}
+		switch pt {
+		case rtpPayloadPCMU:
+			send(g711.convert(decodeG711(codecPCMU, payload)))
+		case rtpPayloadPCMA:
+			send(g711.convert(decodeG711(codecPCMA, payload)))
+		case rtpPayloadType:
+			pcm := make([]byte, len(payload)&^1)
+			for i := 0; i < len(pcm); i += 2 {
+				pcm[i], pcm[i+1] = payload[i+1], payload[i]
+			}
+			send(pcm)
+		default:
+			glog.V(vFrame).Infof("Drop RTP packet with payload type %d", pt)
+		}
+	}
+}
+
+// parseRTP returns the payload type and the payload of an RTP packet.
+func parseRTP(packet []byte) (int, []byte, error) {
+	if len(packet) < 12 || packet[0]>>6 != 2 {
+		return 0, nil, errors.New("not an RTP packet")
+	}
+	off := 12 + int(packet[0]&0x0F)*4
+	if packet[0]&0x10 != 0 && off+4 <= len(packet) {
+		off += 4 + int(binary.BigEndian.Uint16(packet[off+2:]))*4
+	}
+	end := len(packet)
+	if packet[0]&0x20 != 0 && end > 0 {
+		end -= int(packet[end-1])
+	}
+	if off > end {
+		return 0, nil, errors.New("malformed RTP packet")
+	}
+	return int(packet[1] & 0x7F), packet[off:end], nil
+}
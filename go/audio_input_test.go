@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// FuzzDecodeWAV feeds arbitrary files to the WAV decoder and the input
+// conversion of the -input wav: source.
+func FuzzDecodeWAV(f *testing.F) {
+	var err error
+	if audioSettings, err = resolveAudioSettings(AudioSettings{}); err != nil {
+		f.Fatal(err)
+	}
+	for _, format := range []struct{ tag, bits int }{
+		{wavFormatPCM, 16}, {wavFormatMuLaw, 8}, {wavFormatALaw, 8}, {wavFormatFloat, 32},
+	} {
+		f.Add(testWAV(format.tag, format.bits, 8000, 2, make([]byte, 64)))
+	}
+	f.Add(unknownSizeWAV(testWAV(wavFormatPCM, 16, 8000, 1, make([]byte, 64))))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		samples, rate, channels, err := decodeWAV(data)
+		if err != nil {
+			return
+		}
+		if rate <= 0 || channels <= 0 {
+			t.Fatalf("decoded %d Hz, %d channels", rate, channels)
+		}
+		newInputConverter(rate, channels).convert(samples)
+	})
+}
+
+// TestDecodeWAVUnknownSize decodes the audio of a WAV file written as a
+// stream, whose sizes are 0xFFFFFFFF, up to the end of the file.
+func TestDecodeWAVUnknownSize(t *testing.T) {
+	data := unknownSizeWAV(testWAV(wavFormatPCM, 16, 8000, 1, []byte{1, 0, 2, 0, 3, 0}))
+	samples, rate, channels, err := decodeWAV(data)
+	if err != nil || rate != 8000 || channels != 1 || len(samples) != 3 || samples[2] != 3 {
+		t.Fatalf("decoded %v at %d Hz, %d channels: %v", samples, rate, channels, err)
+	}
+
+	// 长度未知的其他块之后没有数据
+	list := append([]byte("RIFF\xff\xff\xff\xffWAVELIST\xff\xff\xff\xff"), make([]byte, 16)...)
+	if _, _, _, err := decodeWAV(list); err == nil {
+		t.Fatal("decoded a file without a data chunk")
+	}
+}
+
+// unknownSizeWAV sets the sizes of the header of wav to 0xFFFFFFFF.
+func unknownSizeWAV(wav []byte) []byte {
+	binary.LittleEndian.PutUint32(wav[4:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(wav[40:], 0xFFFFFFFF)
+	return wav
+}
+
+// FuzzParseRTP feeds arbitrary packets to the RTP parser.
+func FuzzParseRTP(f *testing.F) {
+	f.Add([]byte{0x80, 0x00, 0, 1, 0, 0, 0, 160, 0, 0, 0, 1, 0xFF, 0xFF})
+	f.Add([]byte{0xB1, 0x08, 0, 1, 0, 0, 0, 160, 0, 0, 0, 1, 0, 0, 0, 2, 0xBE, 0xDE, 0, 1, 1, 2, 3, 4, 0x55, 0, 2})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		_, payload, err := parseRTP(packet)
+		if err == nil && len(payload) > len(packet)-12 {
+			t.Fatalf("payload of %d bytes in a packet of %d bytes", len(payload), len(packet))
+		}
+	})
+}
+
+func testWAV(format, bits, rate, channels int, body []byte) []byte {
+	b := []byte("RIFF\x00\x00\x00\x00WAVEfmt ")
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, uint16(format))
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate*channels*bits/8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels*bits/8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(bits))
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
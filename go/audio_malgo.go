@@ -0,0 +1,130 @@
+//go:build malgo
+
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/gen2brain/malgo"
+	"github.com/golang/glog"
+)
+
+// miniaudio 后端（malgo）：miniaudio 随程序一起编译，不依赖系统安装的音频库；
+// 采样率与格式由 miniaudio 转换，设备不支持所需采样率时无需另行重采样。
+
+func init() {
+	audioBackends["malgo"] = openMalgo
+}
+
+// malgoBackend is the AudioBackend of miniaudio.
+type malgoBackend struct {
+	ctx *malgo.AllocatedContext
+}
+
+func openMalgo() (AudioBackend, error) {
+	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, func(message string) {
+		glog.V(vTrace).Infof("miniaudio: %s", strings.TrimSpace(message))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("miniaudio initialize: %w", err)
+	}
+	return &malgoBackend{ctx: ctx}, nil
+}
+
+func (b *malgoBackend) Close() error {
+	err := b.ctx.Uninit()
+	b.ctx.Free()
+	return err
+}
+
+// Devices lists the playback and the capture devices; miniaudio lists a
+// device with both directions twice.
+func (b *malgoBackend) Devices() ([]*AudioDevice, error) {
+	var list []*AudioDevice
+	for _, kind := range []malgo.DeviceType{malgo.Playback, malgo.Capture} {
+		infos, err := b.ctx.Devices(kind)
+		if err != nil {
+			return nil, fmt.Errorf("list audio devices: %w", err)
+		}
+		for _, info := range infos {
+			d := &AudioDevice{Name: info.Name(), HostAPI: "miniaudio", handle: info.ID}
+			// 声道数与采样率需要逐个查询；查询失败时按立体声处理
+			channels := 2
+			if full, err := b.ctx.DeviceInfo(kind, info.ID, malgo.Shared); err == nil {
+				for _, f := range full.Formats {
+					channels = max(channels, int(f.Channels))
+					if d.DefaultSampleRate == 0 {
+						d.DefaultSampleRate = float64(f.SampleRate)
+					}
+				}
+			}
+			if kind == malgo.Playback {
+				d.MaxOutputChannels, d.DefaultOutput = channels, info.IsDefault != 0
+			} else {
+				d.MaxInputChannels, d.DefaultInput = channels, info.IsDefault != 0
+			}
+			list = append(list, d)
+		}
+	}
+	return list, nil
+}
+
+func (b *malgoBackend) Play(ctx context.Context, device *AudioDevice, rate, channels, framesPerBuffer int, fill func(out []float32)) error {
+	cfg := malgo.DefaultDeviceConfig(malgo.Playback)
+	cfg.Playback.Format = malgo.FormatF32
+	cfg.Playback.Channels = uint32(channels)
+	id := b.deviceID(device)
+	defer C.free(id)
+	cfg.Playback.DeviceID = id
+	return b.run(ctx, cfg, rate, framesPerBuffer, "output", func(out, _ []byte, _ uint32) {
+		if len(out) == 0 {
+			return
+		}
+		fill(unsafe.Slice((*float32)(unsafe.Pointer(&out[0])), len(out)/4))
+	})
+}
+
+func (b *malgoBackend) Capture(ctx context.Context, device *AudioDevice, rate, channels, framesPerBuffer int, deliver func(in []int16)) error {
+	cfg := malgo.DefaultDeviceConfig(malgo.Capture)
+	cfg.Capture.Format = malgo.FormatS16
+	cfg.Capture.Channels = uint32(channels)
+	id := b.deviceID(device)
+	defer C.free(id)
+	cfg.Capture.DeviceID = id
+	return b.run(ctx, cfg, rate, framesPerBuffer, "microphone input", func(_, in []byte, _ uint32) {
+		if len(in) == 0 {
+			return
+		}
+		deliver(unsafe.Slice((*int16)(unsafe.Pointer(&in[0])), len(in)/2))
+	})
+}
+
+// deviceID returns a C copy of the ID of device, to be freed.
+func (b *malgoBackend) deviceID(device *AudioDevice) unsafe.Pointer {
+	id := device.handle.(malgo.DeviceID)
+	return id.Pointer()
+}
+
+// run streams the device of cfg until ctx is done.
+func (b *malgoBackend) run(ctx context.Context, cfg malgo.DeviceConfig, rate, framesPerBuffer int, name string, data malgo.DataProc) error {
+	cfg.SampleRate = uint32(rate)
+	cfg.PeriodSizeInFrames = uint32(framesPerBuffer)
+	dev, err := malgo.InitDevice(b.ctx.Context, cfg, malgo.DeviceCallbacks{Data: data})
+	if err != nil {
+		return fmt.Errorf("open miniaudio %s stream: %w", name, err)
+	}
+	defer dev.Uninit()
+	if err := dev.Start(); err != nil {
+		return fmt.Errorf("start miniaudio %s stream: %w", name, err)
+	}
+	glog.V(vEvent).Infof("miniaudio %s stream started.", name)
+	<-ctx.Done()
+	glog.V(vEvent).Infof("miniaudio %s stream stopped.", name)
+	return nil
+}
@@ -0,0 +1,173 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gordonklaus/portaudio"
+)
+
+// PortAudio 后端：默认的音频后端，需要系统安装 PortAudio 库。输入设备不支持
+// 所需采样率时，以最接近的采样率采集再重采样。
+
+func init() {
+	audioBackends["portaudio"] = openPortAudio
+}
+
+// portAudioBackend is the AudioBackend of PortAudio.
+type portAudioBackend struct{}
+
+func openPortAudio() (AudioBackend, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return nil, fmt.Errorf("portaudio initialize: %w", err)
+	}
+	return portAudioBackend{}, nil
+}
+
+func (portAudioBackend) Close() error {
+	return portaudio.Terminate()
+}
+
+func (portAudioBackend) Devices() ([]*AudioDevice, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("list audio devices: %w", err)
+	}
+	defaultIn, _ := portaudio.DefaultInputDevice()
+	defaultOut, _ := portaudio.DefaultOutputDevice()
+	list := make([]*AudioDevice, 0, len(devices))
+	for _, d := range devices {
+		list = append(list, &AudioDevice{
+			Name:              d.Name,
+			HostAPI:           d.HostApi.Name,
+			MaxInputChannels:  d.MaxInputChannels,
+			MaxOutputChannels: d.MaxOutputChannels,
+			DefaultSampleRate: d.DefaultSampleRate,
+			DefaultInput:      d == defaultIn,
+			DefaultOutput:     d == defaultOut,
+			handle:            d,
+		})
+	}
+	return list, nil
+}
+
+func (portAudioBackend) Play(ctx context.Context, device *AudioDevice, rate, channels, framesPerBuffer int, fill func(out []float32)) error {
+	params := portaudio.StreamParameters{
+		Output: portaudio.StreamDeviceParameters{
+			Device:   device.handle.(*portaudio.DeviceInfo),
+			Channels: channels,
+			Latency:  10 * time.Millisecond,
+		},
+		SampleRate:      float64(rate),
+		FramesPerBuffer: framesPerBuffer,
+	}
+	stream, err := portaudio.OpenStream(params, fill)
+	if err != nil {
+		return fmt.Errorf("open PortAudio output stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Start(); err != nil {
+		return fmt.Errorf("start PortAudio output stream: %w", err)
+	}
+	glog.V(vEvent).Info("PortAudio output stream started for playback.")
+	<-ctx.Done()
+	glog.V(vEvent).Info("PortAudio output stream stopped.")
+	return nil
+}
+
+func (portAudioBackend) Capture(ctx context.Context, device *AudioDevice, rate, channels, framesPerBuffer int, deliver func(in []int16)) error {
+	info := device.handle.(*portaudio.DeviceInfo)
+	deviceRate, err := negotiateInputRate(info, channels, float64(rate))
+	if err != nil {
+		return fmt.Errorf("no supported sample rate on input device %s: %w", info.Name, err)
+	}
+	var rs *resampler
+	if int(deviceRate) != rate {
+		glog.Warningf("Input device %s does not support %d Hz, capturing at %v Hz and resampling to %d Hz",
+			info.Name, rate, deviceRate, rate)
+		rs = newResampler(int(deviceRate), rate, channels)
+	}
+	params := portaudio.StreamParameters{
+		Input: portaudio.StreamDeviceParameters{
+			Device:   info,
+			Channels: channels,
+			Latency:  info.DefaultLowInputLatency,
+		},
+		SampleRate:      deviceRate,
+		FramesPerBuffer: framesPerBuffer * int(deviceRate) / rate,
+	}
+
+	stream, err := portaudio.OpenStream(params, func(in []int16) {
+		if rs != nil {
+			in = rs.Process(in)
+		}
+		deliver(in)
+	})
+	if err != nil {
+		return fmt.Errorf("open microphone input stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Start(); err != nil {
+		return fmt.Errorf("start microphone input stream: %w", err)
+	}
+	glog.V(vEvent).Info("Microphone input stream started. please speak...")
+
+	// 保持运行以允许回调处理音频
+	<-ctx.Done()
+	glog.V(vEvent).Info("Stopping microphone input stream...")
+	if err := stream.Stop(); err != nil {
+		return fmt.Errorf("stop microphone input stream: %w", err)
+	}
+	glog.V(vEvent).Info("Microphone input stream stopped.")
+	return nil
+}
+
+// standardSampleRates are the rates probed when a device does not support the
+// requested one.
+var standardSampleRates = []float64{8000, 11025, 16000, 22050, 32000, 44100, 48000, 88200, 96000}
+
+// negotiateInputRate returns the sample rate to open the input device with:
+// the requested rate if the device supports it, otherwise the supported rate
+// nearest to it.
+func negotiateInputRate(device *portaudio.DeviceInfo, channels int, requested float64) (float64, error) {
+	params := func(rate float64) portaudio.StreamParameters {
+		return portaudio.StreamParameters{
+			Input: portaudio.StreamDeviceParameters{
+				Device:   device,
+				Channels: channels,
+				Latency:  device.DefaultLowInputLatency,
+			},
+			SampleRate: rate,
+		}
+	}
+	noop := func([]int16) {}
+	if err := portaudio.IsFormatSupported(params(requested), noop); err == nil {
+		return requested, nil
+	}
+
+	candidates := append([]float64{device.DefaultSampleRate}, standardSampleRates...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		di, dj := math.Abs(candidates[i]-requested), math.Abs(candidates[j]-requested)
+		if di != dj {
+			return di < dj
+		}
+		// Prefer upsampled capture over losing bandwidth.
+		return candidates[i] > candidates[j]
+	})
+	var lastErr error
+	for _, rate := range candidates {
+		if lastErr = portaudio.IsFormatSupported(params(rate), noop); lastErr == nil {
+			glog.V(vFrame).Infof("Input device %s supports %v Hz", device.Name, rate)
+			return rate, nil
+		}
+	}
+	return 0, lastErr
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"RealtimeDialog/pcm"
+)
+
+// 可插拔的音频处理链：-capture-chain 处理送往服务端的用户音频，-playback-chain
+// 处理本地播放的机器人音频，按顺序执行逗号分隔的处理级，例如 gain:6,denoise,vad。
+// 内置 gain、denoise、vad、highpass 与 resample；处理级改变了采样率时，链的末尾
+// 自动转换回原采样率。自定义处理级在单独文件的 init 中注册到 audioProcessors
+// 即可，无需修改采集与播放代码。廉价麦克风的直流偏置与低频隆隆声影响识别，
+// 用户音频默认先经过 80 Hz 的 highpass 处理级，-highpass=false 关闭。
+
+var (
+	captureChain  = flag.String("capture-chain", "", "comma-separated `stages` processing the user audio before it is sent, in order: gain:<dB>, denoise[:<dB>], vad[:<dBFS>], resample:<rate> or the stages registered in audioProcessors")
+	playbackChain = flag.String("playback-chain", "", "comma-separated `stages` processing the bot audio before it is played, as for -capture-chain")
+	highPass      = flag.Bool("highpass", true, "remove the DC offset and the rumble below 80 Hz of the user audio before -capture-chain")
+)
+
+const (
+	// processorBlock is the duration over which the level-driven stages
+	// measure the audio.
+	processorBlock = 10 * time.Millisecond
+	// processorRamp is how long the level-driven stages take to change their
+	// gain, to avoid clicks.
+	processorRamp = 5 * time.Millisecond
+	// vadRelease is how long the vad stage stays open after the level falls
+	// below the threshold.
+	vadRelease = 300 * time.Millisecond
+	// denoiseOpen is the ratio of the level to the noise floor above which
+	// the denoise stage lets the audio through, 12 dB.
+	denoiseOpen = 4
+	// denoiseFloorRise is how fast the noise floor estimate follows the level
+	// up, in dB per second.
+	denoiseFloorRise = 3
+	// highPassCutoff is the default cutoff frequency of the highpass stage,
+	// in Hz, below the voice.
+	highPassCutoff = 80
+)
+
+// AudioFormat is the sample rate and channel count of interleaved audio.
+type AudioFormat struct {
+	Rate     int
+	Channels int
+}
+
+// AudioProcessor is a stage of an audio-processing chain.
+type AudioProcessor interface {
+	// Process takes interleaved samples in [-1, 1] and returns the processed
+	// samples, which may reuse in.
+	Process(in []float32) []float32
+}
+
+// audioProcessors creates the stages of the chains by name, given the
+// argument after the colon and the format of the audio they receive, and
+// returns the format of the audio they produce.
+var audioProcessors = map[string]func(arg string, format AudioFormat) (AudioProcessor, AudioFormat, error){}
+
+func init() {
+	audioProcessors["gain"] = newGainStage
+	audioProcessors["denoise"] = newDenoiseStage
+	audioProcessors["vad"] = newVADStage
+	audioProcessors["highpass"] = newHighPassStage
+	audioProcessors["resample"] = newResampleStage
+}
+
+// processorChain runs its stages in order. The nil chain passes the audio
+// through.
+type processorChain []AudioProcessor
+
+func (c processorChain) Process(in []float32) []float32 {
+	for _, p := range c {
+		in = p.Process(in)
+	}
+	return in
+}
+
+// newProcessorChain creates the chain of stages given by spec for audio in
+// format, nil if spec is empty.
+func newProcessorChain(spec string, format AudioFormat) (processorChain, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var chain processorChain
+	current := format
+	for _, stage := range strings.Split(spec, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(stage), ":")
+		newStage, ok := audioProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown audio processor %q", name)
+		}
+		p, out, err := newStage(arg, current)
+		if err != nil {
+			return nil, fmt.Errorf("audio processor %s: %w", name, err)
+		}
+		chain = append(chain, p)
+		current = out
+	}
+	if current.Channels != format.Channels {
+		return nil, fmt.Errorf("chain ends with %d channels instead of %d", current.Channels, format.Channels)
+	}
+	if current.Rate != format.Rate {
+		chain = append(chain, &resampleStage{rs: newResampler(current.Rate, format.Rate, format.Channels)})
+	}
+	return chain, nil
+}
+
+// processCapture wraps src so that its audio goes through -highpass and
+// -capture-chain.
+func processCapture(src AudioSource) (AudioSource, error) {
+	spec := *captureChain
+	if *highPass {
+		spec = strings.TrimSuffix("highpass,"+spec, ",")
+	}
+	chain, err := newProcessorChain(spec, AudioFormat{audioSettings.InputSampleRate, audioSettings.InputChannels})
+	if err != nil {
+		return nil, fmt.Errorf("capture chain: %w", err)
+	}
+	if chain == nil {
+		return src, nil
+	}
+	return processedSource{src: src, chain: chain}, nil
+}
+
+// processedSource runs the audio of a source through a chain.
+type processedSource struct {
+	src   AudioSource
+	chain processorChain
+}
+
+func (s processedSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	return s.src.Stream(ctx, func(chunk []byte) {
+		if out := s.chain.Process(pcm.Int16ToFloat32(pcm.BytesToInt16(chunk))); len(out) > 0 {
+			send(pcm.Int16ToBytes(pcm.Float32ToInt16(out)))
+		}
+	})
+}
+
+// gainStage amplifies the audio by a fixed gain, clipping it.
+type gainStage struct {
+	gain float32
+}
+
+func newGainStage(arg string, format AudioFormat) (AudioProcessor, AudioFormat, error) {
+	db, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return nil, format, fmt.Errorf("gain in dB: %w", err)
+	}
+	return &gainStage{gain: float32(math.Pow(10, db/20))}, format, nil
+}
+
+func (g *gainStage) Process(in []float32) []float32 {
+	for i, s := range in {
+		in[i] = max(min(s*g.gain, 1), -1)
+	}
+	return in
+}
+
+// levelGate applies a gain chosen from the level of each block of audio,
+// ramping between the gains.
+type levelGate struct {
+	format AudioFormat
+	block  int     // samples per block
+	step   float32 // gain change per frame
+	gain   float32
+	// target returns the gain for a block of duration d at level rms.
+	target func(rms float64, d time.Duration) float32
+}
+
+func newLevelGate(format AudioFormat, target func(rms float64, d time.Duration) float32) *levelGate {
+	return &levelGate{
+		format: format,
+		block:  max(format.Rate*int(processorBlock/time.Millisecond)/1000, 1) * format.Channels,
+		step:   float32(time.Second/processorRamp) / float32(format.Rate),
+		gain:   1,
+		target: target,
+	}
+}
+
+func (g *levelGate) Process(in []float32) []float32 {
+	for start := 0; start < len(in); start += g.block {
+		block := in[start:min(start+g.block, len(in))]
+		var sum float64
+		for _, s := range block {
+			sum += float64(s) * float64(s)
+		}
+		frames := len(block) / g.format.Channels
+		d := time.Duration(frames) * time.Second / time.Duration(g.format.Rate)
+		target := g.target(math.Sqrt(sum/float64(max(len(block), 1))), d)
+		for i := range frames {
+			if g.gain < target {
+				g.gain = min(g.gain+g.step, target)
+			} else if g.gain > target {
+				g.gain = max(g.gain-g.step, target)
+			}
+			for ch := range g.format.Channels {
+				block[i*g.format.Channels+ch] *= g.gain
+			}
+		}
+	}
+	return in
+}
+
+// newDenoiseStage creates a noise suppressor: it tracks the noise floor as
+// the lowest recent level and lowers the audio by the given dB, 12 by
+// default, while the level stays close to the floor.
+func newDenoiseStage(arg string, format AudioFormat) (AudioProcessor, AudioFormat, error) {
+	db := 12.0
+	if arg != "" {
+		var err error
+		if db, err = strconv.ParseFloat(arg, 64); err != nil || db < 0 {
+			return nil, format, fmt.Errorf("invalid reduction %q in dB", arg)
+		}
+	}
+	reduction := float32(math.Pow(10, -db/20))
+	floor := 1.0
+	return newLevelGate(format, func(rms float64, d time.Duration) float32 {
+		if rms < floor {
+			floor = max(rms, 1e-5)
+		} else {
+			floor *= math.Pow(10, denoiseFloorRise*d.Seconds()/20)
+		}
+		if rms > floor*denoiseOpen {
+			return 1
+		}
+		return reduction
+	}), format, nil
+}
+
+// newVADStage creates a voice activity gate: it silences the audio unless
+// the level exceeds the threshold in dBFS, -45 by default, or did within
+// vadRelease.
+func newVADStage(arg string, format AudioFormat) (AudioProcessor, AudioFormat, error) {
+	dbfs := -45.0
+	if arg != "" {
+		var err error
+		if dbfs, err = strconv.ParseFloat(arg, 64); err != nil || dbfs > 0 {
+			return nil, format, fmt.Errorf("invalid threshold %q in dBFS", arg)
+		}
+	}
+	threshold := math.Pow(10, dbfs/20)
+	below := vadRelease
+	return newLevelGate(format, func(rms float64, d time.Duration) float32 {
+		if rms >= threshold {
+			below = 0
+		} else {
+			below += d
+		}
+		if below < vadRelease {
+			return 1
+		}
+		return 0
+	}), format, nil
+}
+
+// highPassStage is a second-order Butterworth high-pass filter, removing the
+// DC offset and the rumble below its cutoff.
+type highPassStage struct {
+	channels   int
+	b0, b1, b2 float64
+	a1, a2     float64
+	// x1, x2, y1 and y2 are the last inputs and outputs of each channel.
+	x1, x2, y1, y2 []float64
+}
+
+// newHighPassStage creates a high-pass filter at the given cutoff in Hz,
+// highPassCutoff by default.
+func newHighPassStage(arg string, format AudioFormat) (AudioProcessor, AudioFormat, error) {
+	cutoff := float64(highPassCutoff)
+	if arg != "" {
+		var err error
+		if cutoff, err = strconv.ParseFloat(arg, 64); err != nil || cutoff <= 0 || cutoff >= float64(format.Rate)/2 {
+			return nil, format, fmt.Errorf("invalid cutoff %q in Hz", arg)
+		}
+	}
+	w := 2 * math.Pi * cutoff / float64(format.Rate)
+	alpha := math.Sin(w) / math.Sqrt2 // Q = 1/√2
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+	return &highPassStage{
+		channels: format.Channels,
+		b0:       (1 + cos) / 2 / a0,
+		b1:       -(1 + cos) / a0,
+		b2:       (1 + cos) / 2 / a0,
+		a1:       -2 * cos / a0,
+		a2:       (1 - alpha) / a0,
+		x1:       make([]float64, format.Channels),
+		x2:       make([]float64, format.Channels),
+		y1:       make([]float64, format.Channels),
+		y2:       make([]float64, format.Channels),
+	}, format, nil
+}
+
+func (h *highPassStage) Process(in []float32) []float32 {
+	for i, s := range in {
+		ch := i % h.channels
+		x := float64(s)
+		y := h.b0*x + h.b1*h.x1[ch] + h.b2*h.x2[ch] - h.a1*h.y1[ch] - h.a2*h.y2[ch]
+		h.x2[ch], h.x1[ch] = h.x1[ch], x
+		h.y2[ch], h.y1[ch] = h.y1[ch], y
+		in[i] = float32(max(min(y, 1), -1))
+	}
+	return in
+}
+
+// resampleStage converts the audio to another sample rate.
+type resampleStage struct {
+	rs *resampler
+}
+
+func newResampleStage(arg string, format AudioFormat) (AudioProcessor, AudioFormat, error) {
+	rate, err := strconv.Atoi(arg)
+	if err != nil || rate <= 0 {
+		return nil, format, fmt.Errorf("invalid sample rate %q", arg)
+	}
+	out := AudioFormat{Rate: rate, Channels: format.Channels}
+	return &resampleStage{rs: newResampler(format.Rate, rate, format.Channels)}, out, nil
+}
+
+func (r *resampleStage) Process(in []float32) []float32 {
+	return pcm.Int16ToFloat32(r.rs.Process(pcm.Float32ToInt16(in)))
+}
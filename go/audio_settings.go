@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Audio formats of the uplink microphone audio, both 16-bit.
+const (
+	inputFormatPCM      = "pcm"       // 16-bit signed integer little-endian
+	inputFormatPCMS16LE = "pcm_s16le" // the same, by its explicit name
+)
+
+// Audio formats of the downlink TTS audio.
+const (
+	outputFormatPCM      = "pcm"       // 32-bit float little-endian
+	outputFormatPCMS16LE = "pcm_s16le" // 16-bit signed integer little-endian
+)
+
+var (
+	inputSampleRate  = flag.Int("input-rate", 16000, "sample rate of the captured microphone audio in Hz")
+	inputChannels    = flag.Int("input-channels", 1, "number of captured microphone channels")
+	inputFormat      = flag.String("input-format", inputFormatPCM, "format of the uploaded audio (16-bit PCM)")
+	outputSampleRate = flag.Int("output-rate", 24000, "sample rate of the TTS audio in Hz")
+	outputChannels   = flag.Int("output-channels", 1, "number of TTS audio channels")
+	outputFormat     = flag.String("output-format", outputFormatPCM, "format of the TTS audio: pcm (float32) or pcm_s16le")
+	inputBufferMs    = flag.Int("input-buffer-ms", 10, "duration of each captured microphone buffer in milliseconds")
+	outputBufferMs   = flag.Int("output-buffer-ms", 20, "duration of each playback buffer in milliseconds")
+	audioProfile     = flag.String("profile", "default", "audio preset setting the rates, formats and buffer sizes at once: telephony, default or hifi; the individual flags override it")
+
+	// audioSettings holds the effective audio settings, resolved in main from
+	// the flags and the config file.
+	audioSettings AudioSettings
+)
+
+// AudioSettings describes the uplink (input) and downlink (output) audio.
+type AudioSettings struct {
+	InputSampleRate  int    `json:"input_sample_rate,omitempty"`
+	InputChannels    int    `json:"input_channels,omitempty"`
+	InputFormat      string `json:"input_format,omitempty"`
+	OutputSampleRate int    `json:"output_sample_rate,omitempty"`
+	OutputChannels   int    `json:"output_channels,omitempty"`
+	OutputFormat     string `json:"output_format,omitempty"`
+	InputBufferMs    int    `json:"input_buffer_ms,omitempty"`
+	OutputBufferMs   int    `json:"output_buffer_ms,omitempty"`
+	// Profile names the preset the other settings default to.
+	Profile string `json:"profile,omitempty"`
+}
+
+// audioProfiles are the presets of -profile.
+var audioProfiles = map[string]AudioSettings{
+	// 电话：8 kHz 上行，16 kHz 16 位下行，按 20ms 帧传输
+	"telephony": {
+		InputSampleRate: 8000, InputChannels: 1, InputFormat: inputFormatPCM, InputBufferMs: 20,
+		OutputSampleRate: 16000, OutputChannels: 1, OutputFormat: outputFormatPCMS16LE, OutputBufferMs: 20,
+	},
+	"default": {
+		InputSampleRate: 16000, InputChannels: 1, InputFormat: inputFormatPCM, InputBufferMs: 10,
+		OutputSampleRate: 24000, OutputChannels: 1, OutputFormat: outputFormatPCM, OutputBufferMs: 20,
+	},
+	// 高保真：48 kHz 浮点下行，加大播放缓冲以避免断续
+	"hifi": {
+		InputSampleRate: 16000, InputChannels: 1, InputFormat: inputFormatPCM, InputBufferMs: 10,
+		OutputSampleRate: 48000, OutputChannels: 1, OutputFormat: outputFormatPCM, OutputBufferMs: 40,
+	},
+}
+
+// flagIsSet reports whether the named flag was given on the command line.
+func flagIsSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// resolveAudioSettings merges the audio settings of the config file with the
+// flags. Flags given on the command line take precedence, then values from
+// the config file, then the audio profile.
+func resolveAudioSettings(file AudioSettings) (AudioSettings, error) {
+	s := file
+	if flagIsSet("profile") || s.Profile == "" {
+		s.Profile = *audioProfile
+	}
+	profile, ok := audioProfiles[s.Profile]
+	if !ok {
+		return s, fmt.Errorf("unknown audio profile: %s", s.Profile)
+	}
+	pickInt := func(dst *int, name string, value, preset int) {
+		switch {
+		case flagIsSet(name):
+			*dst = value
+		case *dst == 0:
+			*dst = preset
+		}
+	}
+	pickString := func(dst *string, name string, value, preset string) {
+		switch {
+		case flagIsSet(name):
+			*dst = value
+		case *dst == "":
+			*dst = preset
+		}
+	}
+	pickInt(&s.InputSampleRate, "input-rate", *inputSampleRate, profile.InputSampleRate)
+	pickInt(&s.InputChannels, "input-channels", *inputChannels, profile.InputChannels)
+	pickString(&s.InputFormat, "input-format", *inputFormat, profile.InputFormat)
+	pickInt(&s.InputBufferMs, "input-buffer-ms", *inputBufferMs, profile.InputBufferMs)
+	pickInt(&s.OutputSampleRate, "output-rate", *outputSampleRate, profile.OutputSampleRate)
+	pickInt(&s.OutputChannels, "output-channels", *outputChannels, profile.OutputChannels)
+	pickString(&s.OutputFormat, "output-format", *outputFormat, profile.OutputFormat)
+	pickInt(&s.OutputBufferMs, "output-buffer-ms", *outputBufferMs, profile.OutputBufferMs)
+
+	if s.InputFormat != inputFormatPCM && s.InputFormat != inputFormatPCMS16LE {
+		return s, fmt.Errorf("unsupported input format: %s", s.InputFormat)
+	}
+	if s.OutputFormat != outputFormatPCM && s.OutputFormat != outputFormatPCMS16LE {
+		return s, fmt.Errorf("unsupported output format: %s", s.OutputFormat)
+	}
+	if s.InputSampleRate <= 0 || s.OutputSampleRate <= 0 || s.InputChannels <= 0 || s.OutputChannels <= 0 {
+		return s, fmt.Errorf("sample rates and channels must be positive: %+v", s)
+	}
+	if s.InputBufferMs <= 0 || s.OutputBufferMs <= 0 {
+		return s, fmt.Errorf("buffer sizes must be positive: %+v", s)
+	}
+	return s, nil
+}
+
+// outputBytesPerSample returns the size of one downlink sample in bytes.
+func (s AudioSettings) outputBytesPerSample() int {
+	if s.OutputFormat == outputFormatPCMS16LE {
+		return 2
+	}
+	return 4
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// sinkQueueSize is the number of chunks each sink buffers before dropping.
+const sinkQueueSize = 512
+
+// sinkFactories opens the sinks implemented in files built with tags, by
+// kind.
+var sinkFactories = map[string]func(arg string) (AudioSink, error){}
+
+var (
+	sinkSpecs       sinkFlag
+	audioFileFormat = flag.String("format", "", "format of saved audio files, file: sinks and -record-dir bundles: wav or flac; by default from the file extension, else wav")
+)
+
+func init() {
+	flag.Var(&sinkSpecs, "sink", "send the bot audio to `sink` (repeatable): speaker, file:<file>, wav:<file>, flac:<file>, ogg:<file> (built with -tags opus), rtp:<host:port>, ws:<addr> or stdout (raw PCM S16LE); wav-pcmu, wav-pcma, rtp-pcmu and rtp-pcma use G.711 at 8 kHz mono; defaults to speaker")
+}
+
+// sinkFlag collects the -sink flags.
+type sinkFlag []string
+
+func (f *sinkFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *sinkFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// AudioSink consumes the bot audio of a session, in the configured output
+// format.
+type AudioSink interface {
+	// Write queues a chunk of bot audio. It must not block, and copies the
+	// chunk if it keeps it after returning.
+	Write(chunk []byte)
+	// Flush drops the queued audio: the user interrupted the bot.
+	Flush()
+	Close() error
+}
+
+// openSinks opens the sinks given with -sink. It reports whether the speaker
+// is one of them, in which case the caller must run startPlayer.
+func openSinks() (sinks []AudioSink, speaker bool, err error) {
+	switch *audioFileFormat {
+	case "", "wav", "flac":
+	default:
+		return nil, false, fmt.Errorf("unknown audio file format %q", *audioFileFormat)
+	}
+	specs := sinkSpecs
+	if len(specs) == 0 {
+		specs = sinkFlag{"speaker"}
+	}
+	for _, spec := range specs {
+		kind, arg, _ := strings.Cut(spec, ":")
+		var sink AudioSink
+		switch kind {
+		case "speaker":
+			sink, speaker = localPlayback{}, true
+		case "file", "wav", "flac", "wav-pcmu", "wav-pcma":
+			sink, err = openFileSink(kind, arg)
+		case "rtp":
+			sink, err = newRTPSink(arg, "")
+		case "rtp-pcmu", "rtp-pcma":
+			sink, err = newRTPSink(arg, strings.TrimPrefix(kind, "rtp-"))
+		case "ws":
+			sink, err = newWebsocketSink(arg)
+		case "stdout":
+			if *jsonOutput {
+				err = errors.New("-json writes to stdout too")
+			} else {
+				sink = newStdoutSink()
+			}
+		default:
+			if open, ok := sinkFactories[kind]; ok {
+				sink, err = open(arg)
+			} else {
+				err = fmt.Errorf("unknown sink %q", spec)
+			}
+		}
+		if err != nil {
+			closeSinks(sinks)
+			return nil, false, fmt.Errorf("open sink %s: %w", spec, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, speaker, nil
+}
+
+// openFileSink opens a sink recording to a file, or to the files named by a
+// path template.
+func openFileSink(kind, path string) (AudioSink, error) {
+	open := func(path string) (AudioSink, error) {
+		switch {
+		case kind == "flac", kind == "file" && fileFormat(path) == "flac":
+			return newFLACSink(path)
+		case kind == "wav-pcmu", kind == "wav-pcma":
+			return newWAVSink(path, strings.TrimPrefix(kind, "wav-"))
+		}
+		return newWAVSink(path, "")
+	}
+	if hasPathPlaceholders(path) {
+		return newTemplatedSink(path, open)
+	}
+	return open(path)
+}
+
+func closeSinks(sinks []AudioSink) {
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			glog.Errorf("Close audio sink: %v", err)
+		}
+	}
+}
+
+// sinkFanout is a Handler feeding the bot audio to every sink.
+type sinkFanout struct {
+	NopHandler
+	sinks []AudioSink
+}
+
+func (f sinkFanout) OnASRStart(ASRInfoPayload) {
+	for _, s := range f.sinks {
+		s.Flush()
+	}
+}
+
+func (f sinkFanout) OnAudioChunk(data []byte) {
+	for _, s := range f.sinks {
+		s.Write(data)
+	}
+}
+
+// OnBotSpeechEnd tells the sinks that care that the reply is complete.
+func (f sinkFanout) OnBotSpeechEnd() {
+	for _, s := range f.sinks {
+		if e, ok := s.(interface{ OnBotSpeechEnd() }); ok {
+			e.OnBotSpeechEnd()
+		}
+	}
+}
+
+// queuedSink buffers chunks for a blocking writer, run on a goroutine of its
+// own so that a slow sink does not hold back the others.
+type queuedSink struct {
+	name   string
+	queue  chan []byte
+	done   chan struct{}
+	write  func([]byte) error
+	close  func() error
+	closed sync.Once
+}
+
+func newQueuedSink(name string, write func([]byte) error, closeFn func() error) *queuedSink {
+	s := &queuedSink{
+		name:  name,
+		queue: make(chan []byte, sinkQueueSize),
+		done:  make(chan struct{}),
+		write: write,
+		close: closeFn,
+	}
+	bufferMetrics.Set("sink_"+name, expvar.Func(func() any { return len(s.queue) }))
+	go func() {
+		defer close(s.done)
+		failed := false
+		for chunk := range s.queue {
+			if err := s.write(chunk); err != nil && !failed {
+				// 只记录第一次写入失败，避免刷屏
+				glog.Errorf("Write to audio sink %s: %v", s.name, err)
+				failed = true
+			}
+		}
+	}()
+	return s
+}
+
+func (s *queuedSink) Write(chunk []byte) {
+	select {
+	case s.queue <- bytes.Clone(chunk):
+	default:
+		glog.V(vFrame).Infof("Drop %d bytes of audio: sink %s is not keeping up", len(chunk), s.name)
+	}
+}
+
+func (s *queuedSink) Flush() {
+	for {
+		select {
+		case <-s.queue:
+		default:
+			return
+		}
+	}
+}
+
+func (s *queuedSink) Close() error {
+	var err error
+	s.closed.Do(func() {
+		bufferMetrics.Delete("sink_" + s.name)
+		close(s.queue)
+		<-s.done
+		if s.close != nil {
+			err = s.close()
+		}
+	})
+	return err
+}
+
+func (localPlayback) Write(chunk []byte) {
+	handleIncomingAudio(chunk)
+}
+
+func (p localPlayback) Flush() {
+	p.OnASRStart(ASRInfoPayload{})
+}
+
+func (localPlayback) Close() error { return nil }
+
+// newWAVSink records the bot audio to a WAV file. Interrupted audio is kept,
+// as received. With a G.711 codec the audio is converted to 8 kHz mono.
+func newWAVSink(path, codec string) (AudioSink, error) {
+	header := wavHeader
+	convert := func(chunk []byte) []byte { return chunk }
+	if codec != "" {
+		format := wavFormatMuLaw
+		if codec == codecPCMA {
+			format = wavFormatALaw
+		}
+		header = func(size int) []byte { return encodeWAVHeader(format, 1, g711Rate, 1, size) }
+		convert = newG711Encoder(codec)
+	}
+	w, err := createWAV(path, header)
+	if err != nil {
+		return nil, err
+	}
+	s := newQueuedSink("wav:"+path, func(chunk []byte) error {
+		_, err := w.Write(convert(chunk))
+		return err
+	}, w.Close)
+	return fileSink{s}, nil
+}
+
+// wavWriter writes a WAV file incrementally, so that memory stays flat
+// however long the audio is. The file appears at its path once closed.
+type wavWriter struct {
+	f      *outputFile
+	header func(dataSize int) []byte
+	size   int
+}
+
+// createWAV creates a WAV file whose header is given by header.
+func createWAV(path string, header func(dataSize int) []byte) (*wavWriter, error) {
+	f, err := createAtomicOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(initialWAVHeader(f, header)); err != nil {
+		f.Abort()
+		return nil, err
+	}
+	return &wavWriter{f: f, header: header}, nil
+}
+
+// initialWAVHeader returns the header to start the WAV file f with: with a
+// length of 0, filled in once complete, or an unknown length if the header
+// cannot be written back, as in an encrypted file.
+func initialWAVHeader(f *outputFile, header func(dataSize int) []byte) []byte {
+	if _, ok := f.Writer.(io.WriterAt); ok {
+		return header(0)
+	}
+	return header(wavUnknownSize)
+}
+
+func (w *wavWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.size += n
+	return n, err
+}
+
+// Close fills in the sizes in the header, if possible, and closes the file.
+func (w *wavWriter) Close() error {
+	if wa, ok := w.f.Writer.(io.WriterAt); ok {
+		if _, err := wa.WriteAt(w.header(w.size), 0); err != nil {
+			w.f.Abort()
+			return err
+		}
+	}
+	return w.f.Close()
+}
+
+// newFLACSink records the bot audio to a FLAC file, as 16-bit samples.
+func newFLACSink(path string) (AudioSink, error) {
+	f, err := createAtomicOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	fw, err := newFLACWriter(f.Writer, audioSettings.OutputSampleRate, audioSettings.OutputChannels)
+	if err != nil {
+		f.Abort()
+		return nil, err
+	}
+	s := newQueuedSink("flac:"+path, func(chunk []byte) error {
+		return fw.Write(pcm.Float32ToInt16(decodeOutputAudio(chunk)))
+	}, func() error {
+		if err := fw.Close(); err != nil {
+			f.Abort()
+			return err
+		}
+		return f.Close()
+	})
+	return fileSink{s}, nil
+}
+
+// fileSink ignores Flush: the recording keeps all received audio.
+type fileSink struct {
+	*queuedSink
+}
+
+func (fileSink) Flush() {}
+
+// fileFormat returns the format of the audio file at path: -format if set,
+// else from its extension.
+func fileFormat(path string) string {
+	if *audioFileFormat != "" {
+		return *audioFileFormat
+	}
+	if strings.EqualFold(filepath.Ext(path), ".flac") {
+		return "flac"
+	}
+	return "wav"
+}
+
+// wavToFLAC converts the WAV file at path, encrypted or not, to a FLAC file
+// with the extension replaced, and removes the WAV file.
+func wavToFLAC(path string) error {
+	data, path, err := readOutput(path)
+	if err != nil {
+		return err
+	}
+	samples, rate, channels, err := decodeWAV(data)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	wavPath := strings.TrimSuffix(path, encSuffix)
+	flacPath := strings.TrimSuffix(wavPath, filepath.Ext(wavPath)) + ".flac"
+	f, err := createAtomicOutput(flacPath)
+	if err != nil {
+		return err
+	}
+	fw, err := newFLACWriter(f.Writer, rate, channels)
+	if err == nil {
+		err = fw.Write(samples)
+	}
+	if err == nil {
+		err = fw.Close()
+	}
+	if err != nil {
+		f.Abort()
+		return fmt.Errorf("write %s: %w", flacPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", flacPath, err)
+	}
+	return os.Remove(path)
+}
+
+// WAV sample formats.
+const (
+	wavFormatPCM   = 1
+	wavFormatFloat = 3
+	wavFormatALaw  = 6
+	wavFormatMuLaw = 7
+)
+
+// wavUnknownSize is the data size of the header of a WAV file written as a
+// stream, whose length is not known: readers take the audio up to the end of
+// the file.
+const wavUnknownSize = -1
+
+// wavHeader returns the header of a WAV file with dataSize bytes of audio in
+// the output format.
+func wavHeader(dataSize int) []byte {
+	format := wavFormatFloat
+	if audioSettings.OutputFormat == outputFormatPCMS16LE {
+		format = wavFormatPCM
+	}
+	return encodeWAVHeader(format, audioSettings.OutputChannels, audioSettings.OutputSampleRate, audioSettings.outputBytesPerSample(), dataSize)
+}
+
+// encodeWAVHeader returns the header of a WAV file, with sizes of 0xFFFFFFFF
+// for wavUnknownSize.
+func encodeWAVHeader(format, channels, rate, bytesPerSample, dataSize int) []byte {
+	riffSize, chunkSize := uint32(36+dataSize), uint32(dataSize)
+	if dataSize == wavUnknownSize {
+		riffSize, chunkSize = math.MaxUint32, math.MaxUint32
+	}
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], riffSize)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], uint16(format))
+	binary.LittleEndian.PutUint16(h[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(rate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(rate*channels*bytesPerSample))
+	binary.LittleEndian.PutUint16(h[32:], uint16(channels*bytesPerSample))
+	binary.LittleEndian.PutUint16(h[34:], uint16(bytesPerSample*8))
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], chunkSize)
+	return h
+}
+
+// rtpPayloadType is the dynamic payload type used for L16 audio.
+const rtpPayloadType = 96
+
+// newG711Encoder returns a function encoding chunks of bot audio with codec,
+// at 8 kHz mono.
+func newG711Encoder(codec string) func(chunk []byte) []byte {
+	rs := newResampler(audioSettings.OutputSampleRate, g711Rate, 1)
+	return func(chunk []byte) []byte {
+		samples := pcm.ConvertChannels(pcm.Float32ToInt16(decodeOutputAudio(chunk)), audioSettings.OutputChannels, 1)
+		return encodeG711(codec, rs.Process(samples))
+	}
+}
+
+// newRTPSink streams the bot audio to addr as RTP in 20ms packets, paced in
+// real time: L16 (16-bit big-endian PCM at the output rate and channels) by
+// default, or PCMU/PCMA at 8 kHz mono with a G.711 codec.
+func newRTPSink(addr, codec string) (AudioSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	samplesPerPacket := audioSettings.OutputSampleRate / 50
+	packetBytes := samplesPerPacket * audioSettings.OutputChannels * 2
+	payloadType := byte(rtpPayloadType)
+	encode := func(chunk []byte) []byte {
+		var b []byte
+		for _, s := range pcm.Float32ToInt16(decodeOutputAudio(chunk)) {
+			b = binary.BigEndian.AppendUint16(b, uint16(s))
+		}
+		return b
+	}
+	switch codec {
+	case codecPCMU, codecPCMA:
+		samplesPerPacket, packetBytes = g711Rate/50, g711Rate/50
+		payloadType = rtpPayloadPCMU
+		if codec == codecPCMA {
+			payloadType = rtpPayloadPCMA
+		}
+		encode = newG711Encoder(codec)
+	}
+	var (
+		seq       = uint16(rand.Intn(1 << 16))
+		timestamp = rand.Uint32()
+		ssrc      = rand.Uint32()
+		pending   []byte
+		next      time.Time
+	)
+	return newQueuedSink("rtp:"+addr, func(chunk []byte) error {
+		pending = append(pending, encode(chunk)...)
+		for len(pending) >= packetBytes {
+			packet := make([]byte, 12, 12+packetBytes)
+			packet[0] = 0x80 // version 2
+			packet[1] = payloadType
+			binary.BigEndian.PutUint16(packet[2:], seq)
+			binary.BigEndian.PutUint32(packet[4:], timestamp)
+			binary.BigEndian.PutUint32(packet[8:], ssrc)
+			packet = append(packet, pending[:packetBytes]...)
+			pending = pending[packetBytes:]
+			seq++
+			timestamp += uint32(samplesPerPacket)
+
+			// 按实时速率发送，空闲后重新对齐时钟
+			if now := time.Now(); now.After(next) {
+				next = now
+			}
+			time.Sleep(time.Until(next))
+			next = next.Add(20 * time.Millisecond)
+			if _, err := conn.Write(packet); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, conn.Close), nil
+}
+
+// websocketSink serves the bot audio to every websocket listener connected
+// to its address, each with a queue of its own.
+type websocketSink struct {
+	srv *http.Server
+
+	mu        sync.Mutex
+	listeners map[*queuedSink]struct{}
+}
+
+func newWebsocketSink(addr string) (AudioSink, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &websocketSink{listeners: make(map[*queuedSink]struct{})}
+	upgrader := websocket.Upgrader{}
+	s.srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			glog.Errorf("Upgrade audio listener %s: %v", r.RemoteAddr, err)
+			return
+		}
+		glog.V(vEvent).Infof("Audio listener %s connected", r.RemoteAddr)
+		l := newQueuedSink("ws:"+r.RemoteAddr, func(chunk []byte) error {
+			return ws.WriteMessage(websocket.BinaryMessage, chunk)
+		}, ws.Close)
+		s.mu.Lock()
+		s.listeners[l] = struct{}{}
+		s.mu.Unlock()
+		// 监听端只接收音频，读取到错误即视为断开
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				break
+			}
+		}
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		_ = l.Close()
+		glog.V(vEvent).Infof("Audio listener %s disconnected", r.RemoteAddr)
+	})}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			glog.Errorf("Serve audio listeners: %v", err)
+		}
+	}()
+	glog.V(vEvent).Infof("Serving bot audio to websocket listeners on %s", ln.Addr())
+	return s, nil
+}
+
+func (s *websocketSink) each(f func(*queuedSink)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		f(l)
+	}
+}
+
+func (s *websocketSink) Write(chunk []byte) {
+	s.each(func(l *queuedSink) { l.Write(chunk) })
+}
+
+func (s *websocketSink) Flush() {
+	s.each(func(l *queuedSink) { l.Flush() })
+}
+
+func (s *websocketSink) Close() error {
+	err := s.srv.Close()
+	s.each(func(l *queuedSink) { _ = l.Close() })
+	return err
+}
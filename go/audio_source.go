@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+// AudioSource produces the uplink audio of a session: 16-bit little-endian
+// PCM at the configured input rate and channels.
+type AudioSource interface {
+	// Stream calls send with each chunk of audio until ctx is done or the
+	// source is exhausted.
+	Stream(ctx context.Context, send func(chunk []byte)) error
+}
+
+// micSource captures audio from the input device, see inputDevice.
+type micSource struct{}
+
+func (micSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	device, err := inputDevice()
+	if err != nil {
+		return fmt.Errorf("get input device: %w", err)
+	}
+	glog.V(vEvent).Infof("Using input device: %s", device.Name)
+	selector, channels, err := newChannelSelector(device.MaxInputChannels)
+	if err != nil {
+		return err
+	}
+	rate := audioSettings.InputSampleRate
+	return audioBackend.Capture(ctx, device, rate, channels, rate*audioSettings.InputBufferMs/1000, func(in []int16) {
+		if selector != nil {
+			in = selector.Select(in)
+		}
+		send(pcm.Int16ToBytes(in))
+	})
+}
+
+// chanSource streams the chunks received from a channel, until the channel
+// is closed.
+type chanSource <-chan []byte
+
+func (ch chanSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case chunk, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			send(chunk)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sync/errgroup"
+)
+
+// 批量处理：batch 子命令把目录中的每个 WAV 文件各送入一个一次性会话（并发数由
+// -batch-concurrency 控制），每个文件的识别结果与机器人回复写到 -batch-out 目录
+// 下的同名 JSON 文件，用于在测试语料上离线评估。
+
+var (
+	batchConcurrency = flag.Int("batch-concurrency", 4, "in the `batch` command, how many files to process at once")
+	batchOut         = flag.String("batch-out", "batch-results", "in the `batch` command, `directory` where the result of each file is written as <name>.json")
+)
+
+func init() {
+	commands["batch"] = runBatch
+}
+
+// BatchResult is the outcome of the session of a file of a batch.
+type BatchResult struct {
+	File     string  `json:"file"`
+	Duration float64 `json:"duration"` // of the audio, in seconds
+	// Latency is the time from the end of each user turn to the first bot
+	// audio of the reply.
+	Latency LatencyStats `json:"latency"`
+	User    []string     `json:"user"`
+	Bot     []string     `json:"bot"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// runBatch implements the `batch <directory>` subcommand.
+func runBatch(ctx context.Context, cfg *Config) error {
+	dir := flag.Arg(1)
+	if dir == "" {
+		return errors.New("usage: batch <directory of WAV files>")
+	}
+	if *batchConcurrency < 1 {
+		return fmt.Errorf("invalid -batch-concurrency %d", *batchConcurrency)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read batch directory: %w", err)
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.EqualFold(filepath.Ext(e.Name()), ".wav") {
+			files = append(files, e.Name())
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no WAV files in %s", dir)
+	}
+	if err := os.MkdirAll(*batchOut, 0o755); err != nil {
+		return fmt.Errorf("create batch output directory: %w", err)
+	}
+
+	results := make([]BatchResult, len(files))
+	var g errgroup.Group
+	g.SetLimit(*batchConcurrency)
+	for i, name := range files {
+		g.Go(func() error {
+			results[i] = batchFile(ctx, cfg, filepath.Join(dir, name))
+			return writeBatchResult(results[i])
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		writeBatchSummary(os.Stdout, results)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(results))
+	}
+	return nil
+}
+
+// batchFile runs the audio of a file through a one-shot session.
+func batchFile(ctx context.Context, cfg *Config, path string) BatchResult {
+	r := BatchResult{File: filepath.Base(path)}
+	pcm, duration, err := loadInputWAV(path)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Duration = duration.Seconds()
+	glog.V(vEvent).Infof("Batch: processing %v of audio from %s", duration.Round(time.Millisecond), path)
+	collector, err := replaySession(ctx, cfg, nil, pcm, duration)
+	if err != nil {
+		glog.Errorf("Batch %s: %v", path, err)
+		r.Error = err.Error()
+		return r
+	}
+	turns := collector.Turns()
+	r.User, r.Bot = turns.User, turns.Bot
+	var latencies []float64
+	for _, l := range collector.Latencies() {
+		latencies = append(latencies, l.Round(time.Millisecond).Seconds())
+	}
+	r.Latency = latencyStats(latencies)
+	return r
+}
+
+// writeBatchResult writes r to <name>.json in -batch-out.
+func writeBatchResult(r BatchResult) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(*batchOut, strings.TrimSuffix(r.File, filepath.Ext(r.File))+".json")
+	if err := writeOutput(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("write batch result: %w", err)
+	}
+	return nil
+}
+
+func writeBatchSummary(w io.Writer, results []BatchResult) {
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(w, "FAIL %s: %s\n", r.File, r.Error)
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s: %d user turns, %d bot replies\n", r.File, len(r.User), len(r.Bot))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 网关的熔断器：连续多次上游建连或会话失败后熔断，新的下游连接立即得到 503，
+// 不再等待注定失败的上游；熔断期间定期探测上游（建立并结束一次连接），成功后
+// 恢复转发。
+
+var (
+	breakerThreshold = flag.Int("breaker-threshold", 5, "in the `gateway` and `serve` commands, stop dialing the upstream after this many consecutive dial or session failures (0 disables the circuit breaker)")
+	breakerProbe     = flag.Duration("breaker-probe", 30*time.Second, "in the `gateway` and `serve` commands, how often to probe the upstream while the circuit breaker is open")
+)
+
+// circuitBreaker counts the consecutive upstream failures. Once they reach
+// threshold it opens: connections are refused and the upstream is probed
+// every interval until a probe succeeds.
+type circuitBreaker struct {
+	threshold int
+	interval  time.Duration
+	probe     func(context.Context) error
+	ctx       context.Context
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	nextProbe time.Time
+}
+
+func newCircuitBreaker(ctx context.Context, threshold int, interval time.Duration, probe func(context.Context) error) *circuitBreaker {
+	return &circuitBreaker{ctx: ctx, threshold: threshold, interval: interval, probe: probe}
+}
+
+// Allow reports whether a connection may be dialed upstream, and otherwise
+// how long until the next probe.
+func (b *circuitBreaker) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true, 0
+	}
+	return false, max(time.Until(b.nextProbe), 0)
+}
+
+// Success resets the count of consecutive failures.
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// Failure counts a failure, and opens the breaker at the threshold.
+func (b *circuitBreaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.threshold <= 0 || b.open || b.failures < b.threshold {
+		return
+	}
+	b.open = true
+	b.nextProbe = time.Now().Add(b.interval)
+	gatewayMetrics.Add("breaker_opened", 1)
+	glog.Warningf("Circuit breaker open after %d consecutive upstream failures, probing every %v: %v", b.failures, b.interval, err)
+	go b.probeUntilClosed()
+}
+
+// probeUntilClosed probes the upstream every interval until a probe succeeds,
+// then closes the breaker.
+func (b *circuitBreaker) probeUntilClosed() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		b.mu.Lock()
+		b.nextProbe = time.Now().Add(b.interval)
+		b.mu.Unlock()
+		err := b.probe(b.ctx)
+		if err != nil {
+			glog.V(vEvent).Infof("Upstream probe failed: %v", err)
+			continue
+		}
+		b.mu.Lock()
+		b.open, b.failures = false, 0
+		b.mu.Unlock()
+		glog.Warning("Upstream probe succeeded, circuit breaker closed")
+		return
+	}
+}
+
+// probeUpstream opens and finishes a connection to the dialogue service.
+func probeUpstream(ctx context.Context, cfg *Config) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, _, err := dialDialog(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("websocket dial: %w", err)
+	}
+	defer conn.Close()
+	// 超时后关闭连接，中止握手中的读取
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if err := startConnection(conn); err != nil {
+		return fmt.Errorf("start connection: %w", err)
+	}
+	return finishConnection(conn)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCircuitBreaker runs sequences of outcomes through a breaker with a
+// threshold of 3 and checks whether it lets connections through.
+func TestCircuitBreaker(t *testing.T) {
+	errUpstream := errors.New("upstream down")
+	for name, tc := range map[string]struct {
+		threshold int
+		steps     string // f: Failure, s: Success
+		allowed   bool
+	}{
+		"closed":                {3, "", true},
+		"below the threshold":   {3, "ff", true},
+		"at the threshold":      {3, "fff", false},
+		"past the threshold":    {3, "ffff", false},
+		"reset by a success":    {3, "ffsff", true},
+		"success while open":    {3, "fffs", false},
+		"disabled":              {0, "ffffff", true},
+		"threshold of one":      {1, "f", false},
+		"interleaved successes": {3, "sfsfsf", true},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		b := newCircuitBreaker(ctx, tc.threshold, time.Hour, func(context.Context) error { return errUpstream })
+		for _, s := range tc.steps {
+			if s == 'f' {
+				b.Failure(errUpstream)
+			} else {
+				b.Success()
+			}
+		}
+		allowed, retry := b.Allow()
+		if allowed != tc.allowed {
+			t.Errorf("%s: allowed %v, want %v", name, allowed, tc.allowed)
+		}
+		if !allowed && (retry <= 0 || retry > time.Hour) {
+			t.Errorf("%s: retry after %v", name, retry)
+		}
+		cancel()
+	}
+}
+
+// TestCircuitBreakerProbe checks that an open breaker stays open while the
+// probes fail and closes after the first one that succeeds.
+func TestCircuitBreakerProbe(t *testing.T) {
+	var probes atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := newCircuitBreaker(ctx, 1, 10*time.Millisecond, func(context.Context) error {
+		if probes.Add(1) < 3 {
+			return errors.New("still down")
+		}
+		return nil
+	})
+	b.Failure(errors.New("down"))
+	if ok, _ := b.Allow(); ok {
+		t.Fatal("allowed a connection once open")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ok, _ := b.Allow(); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still open after %d probes", probes.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := probes.Load(); n != 3 {
+		t.Errorf("closed after %d probes, want 3", n)
+	}
+	// 关闭后重新从零计数
+	b.Failure(errors.New("down again"))
+	if ok, _ := b.Allow(); ok {
+		t.Error("allowed a connection after reopening")
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 录制对比：diff 子命令比较两个 -record-dir 录制目录（例如修改配置或换用后端
+// 前后各录一次）的 events.jsonl：按用户的话对齐两边的轮次（一边多出或缺少的
+// 轮次单独列出），逐字标出识别结果与机器人回复的差异，并给出每轮首音频时延的
+// 变化。加密的录制目录在设置 -encrypt-at-rest 后可直接比较。
+
+// diffGapCost is the cost of leaving a turn unaligned, against 1 minus the
+// similarity of the user text of two aligned turns: turns are aligned when
+// their user text is more than 30% similar.
+const diffGapCost = 0.35
+
+// diffMaxCells bounds the size of the character diff of two texts, beyond
+// which they are shown as replaced.
+const diffMaxCells = 4 << 20
+
+func init() {
+	commands["diff"] = runDiff
+}
+
+// bundleTurn is a user utterance and the bot reply to it.
+type bundleTurn struct {
+	User string
+	Bot  string
+	// Latency is the time from the end of the user speech to the first bot
+	// audio, zero if unknown.
+	Latency time.Duration
+}
+
+// BundleDiffTurn compares aligned turns of two bundles. The index of a turn
+// missing from a bundle is 0.
+type BundleDiffTurn struct {
+	IndexA         int     `json:"index_a"`
+	IndexB         int     `json:"index_b"`
+	UserA          string  `json:"user_a"`
+	UserB          string  `json:"user_b"`
+	BotA           string  `json:"bot_a"`
+	BotB           string  `json:"bot_b"`
+	UserSimilarity float64 `json:"user_similarity"`
+	BotSimilarity  float64 `json:"bot_similarity"`
+	// The first audio latencies, in seconds, 0 if unknown.
+	LatencyA     float64 `json:"latency_a,omitempty"`
+	LatencyB     float64 `json:"latency_b,omitempty"`
+	LatencyDelta float64 `json:"latency_delta,omitempty"`
+}
+
+// BundleDiffReport is the result of the `diff` command.
+type BundleDiffReport struct {
+	A        string           `json:"a"`
+	B        string           `json:"b"`
+	LatencyA LatencyStats     `json:"latency_a"`
+	LatencyB LatencyStats     `json:"latency_b"`
+	Turns    []BundleDiffTurn `json:"turns"`
+}
+
+// runDiff implements the `diff <bundle A> <bundle B>` subcommand.
+func runDiff(ctx context.Context, cfg *Config) error {
+	dirA, dirB := flag.Arg(1), flag.Arg(2)
+	if dirA == "" || dirB == "" {
+		return errors.New("usage: diff <recording bundle directory A> <recording bundle directory B>")
+	}
+	turnsA, err := loadBundleTurns(dirA)
+	if err != nil {
+		return err
+	}
+	turnsB, err := loadBundleTurns(dirB)
+	if err != nil {
+		return err
+	}
+	report := BundleDiffReport{A: dirA, B: dirB, Turns: diffBundleTurns(turnsA, turnsB)}
+	report.LatencyA, report.LatencyB = bundleLatencyStats(turnsA), bundleLatencyStats(turnsB)
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		return enc.Encode(report)
+	}
+	report.WriteSummary(os.Stdout, isTerminal(os.Stdout))
+	return nil
+}
+
+// readBundleFile returns the content of the file of a bundle, decrypted if
+// the bundle is encrypted, and its path.
+func readBundleFile(dir, name string) ([]byte, string, error) {
+	path := filepath.Join(dir, name)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if encrypted, encErr := os.ReadFile(path + encSuffix); encErr == nil {
+			path, data, err = path+encSuffix, encrypted, nil
+		}
+	}
+	if err != nil {
+		return nil, path, err
+	}
+	if data, err = openBytes(data); err != nil {
+		return nil, path, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, path, nil
+}
+
+// loadBundleTurns reads the turns of the events.jsonl of a bundle, encrypted
+// or not.
+func loadBundleTurns(dir string) ([]bundleTurn, error) {
+	data, path, err := readBundleFile(dir, "events.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("read events: %w", err)
+	}
+	var turns []bundleTurn
+	var speechEnd time.Time
+	var replyDone bool // the bot reply of the last turn has ended
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var ev jsonEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("parse event of %s: %w", path, err)
+		}
+		last := len(turns) - 1
+		switch ev.Type {
+		case "asr_final":
+			if last < 0 || turns[last].Bot != "" {
+				turns = append(turns, bundleTurn{User: ev.Text})
+				replyDone = false
+			} else {
+				// 机器人回复前的多段识别结果属于同一轮
+				turns[last].User = strings.TrimSpace(turns[last].User + " " + ev.Text)
+			}
+		case "asr_end":
+			speechEnd = ev.Time
+		case "audio_chunk_meta":
+			if !speechEnd.IsZero() && last >= 0 && turns[last].Latency == 0 {
+				turns[last].Latency = ev.Time.Sub(speechEnd)
+			}
+			speechEnd = time.Time{}
+		case "bot_text":
+			if last < 0 || replyDone {
+				// 开场白或没有识别结果的回复
+				turns = append(turns, bundleTurn{})
+				last++
+				replyDone = false
+			}
+			turns[last].Bot += ev.Text
+		case "bot_text_end":
+			replyDone = last >= 0 && turns[last].Bot != ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read events of %s: %w", path, err)
+	}
+	return turns, nil
+}
+
+// diffBundleTurns aligns the turns of a and b by the similarity of their
+// user text, with a minimum cost alignment, and compares the aligned turns.
+func diffBundleTurns(a, b []bundleTurn) []BundleDiffTurn {
+	// cost[i][j] 为 a[i:] 与 b[j:] 对齐的最小代价
+	cost := make([][]float64, len(a)+1)
+	for i := range cost {
+		cost[i] = make([]float64, len(b)+1)
+	}
+	for i := len(a); i >= 0; i-- {
+		for j := len(b); j >= 0; j-- {
+			switch {
+			case i == len(a):
+				cost[i][j] = float64(len(b)-j) * diffGapCost
+			case j == len(b):
+				cost[i][j] = float64(len(a)-i) * diffGapCost
+			default:
+				cost[i][j] = min(cost[i+1][j+1]+1-similarity(a[i].User, b[j].User),
+					cost[i+1][j]+diffGapCost, cost[i][j+1]+diffGapCost)
+			}
+		}
+	}
+	var turns []BundleDiffTurn
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		var t BundleDiffTurn
+		switch {
+		case i < len(a) && j < len(b) && cost[i][j] == cost[i+1][j+1]+1-similarity(a[i].User, b[j].User):
+			t = BundleDiffTurn{IndexA: i + 1, IndexB: j + 1, UserA: a[i].User, UserB: b[j].User, BotA: a[i].Bot, BotB: b[j].Bot}
+			t.LatencyA, t.LatencyB = a[i].Latency.Seconds(), b[j].Latency.Seconds()
+			if a[i].Latency > 0 && b[j].Latency > 0 {
+				t.LatencyDelta = (b[j].Latency - a[i].Latency).Seconds()
+			}
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || cost[i][j] == cost[i+1][j]+diffGapCost):
+			t = BundleDiffTurn{IndexA: i + 1, UserA: a[i].User, BotA: a[i].Bot, LatencyA: a[i].Latency.Seconds()}
+			i++
+		default:
+			t = BundleDiffTurn{IndexB: j + 1, UserB: b[j].User, BotB: b[j].Bot, LatencyB: b[j].Latency.Seconds()}
+			j++
+		}
+		t.UserSimilarity, t.BotSimilarity = similarity(t.UserA, t.UserB), similarity(t.BotA, t.BotB)
+		turns = append(turns, t)
+	}
+	return turns
+}
+
+func bundleLatencyStats(turns []bundleTurn) LatencyStats {
+	var latencies []float64
+	for _, t := range turns {
+		if t.Latency > 0 {
+			latencies = append(latencies, t.Latency.Round(time.Millisecond).Seconds())
+		}
+	}
+	return latencyStats(latencies)
+}
+
+// textEdit is a run of text kept (' '), deleted ('-') or inserted ('+').
+type textEdit struct {
+	op   byte
+	text string
+}
+
+// diffText returns the edits turning a into b, by character.
+func diffText(a, b string) []textEdit {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra)*len(rb) > diffMaxCells {
+		return []textEdit{{'-', a}, {'+', b}}
+	}
+	// lcs[i][j] 为 ra[i:] 与 rb[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(ra)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(rb)+1)
+	}
+	for i := len(ra) - 1; i >= 0; i-- {
+		for j := len(rb) - 1; j >= 0; j-- {
+			if ra[i] == rb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var edits []textEdit
+	add := func(op byte, r rune) {
+		if n := len(edits); n > 0 && edits[n-1].op == op {
+			edits[n-1].text += string(r)
+			return
+		}
+		edits = append(edits, textEdit{op, string(r)})
+	}
+	i, j := 0, 0
+	for i < len(ra) || j < len(rb) {
+		switch {
+		case i < len(ra) && j < len(rb) && ra[i] == rb[j]:
+			add(' ', ra[i])
+			i, j = i+1, j+1
+		case j == len(rb) || i < len(ra) && lcs[i+1][j] >= lcs[i][j+1]:
+			add('-', ra[i])
+			i++
+		default:
+			add('+', rb[j])
+			j++
+		}
+	}
+	return edits
+}
+
+// formatEdits renders edits in color, or as [-deleted-]{+inserted+}.
+func formatEdits(edits []textEdit, color bool) string {
+	var b strings.Builder
+	for _, e := range edits {
+		switch {
+		case e.op == ' ':
+			b.WriteString(e.text)
+		case color && e.op == '-':
+			b.WriteString(ansiRed + e.text + ansiReset)
+		case color:
+			b.WriteString(ansiGreen + e.text + ansiReset)
+		case e.op == '-':
+			b.WriteString("[-" + e.text + "-]")
+		default:
+			b.WriteString("{+" + e.text + "+}")
+		}
+	}
+	return b.String()
+}
+
+// WriteSummary writes the report to w in human-readable form, with the
+// differences in color if color is set.
+func (r *BundleDiffReport) WriteSummary(w io.Writer, color bool) {
+	for _, s := range []struct {
+		name, dir string
+		latency   LatencyStats
+	}{{"A", r.A, r.LatencyA}, {"B", r.B, r.LatencyB}} {
+		fmt.Fprintf(w, "%s: %s\n", s.name, s.dir)
+		if l := s.latency; l.Count > 0 {
+			fmt.Fprintf(w, "  latency: mean %.3fs, p50 %.3fs, p90 %.3fs, max %.3fs (n=%d)\n", l.Mean, l.P50, l.P90, l.Max, l.Count)
+		} else {
+			fmt.Fprintln(w, "  latency: n/a")
+		}
+	}
+	if r.LatencyA.Count > 0 && r.LatencyB.Count > 0 {
+		fmt.Fprintf(w, "latency delta: mean %+.3fs, p90 %+.3fs\n", r.LatencyB.Mean-r.LatencyA.Mean, r.LatencyB.P90-r.LatencyA.P90)
+	}
+	index := func(i int) string {
+		if i == 0 {
+			return "-"
+		}
+		return fmt.Sprint(i)
+	}
+	for _, t := range r.Turns {
+		fmt.Fprintf(w, "turn %s <> %s", index(t.IndexA), index(t.IndexB))
+		switch {
+		case t.IndexA == 0:
+			fmt.Fprintln(w, " (only in B)")
+		case t.IndexB == 0:
+			fmt.Fprintln(w, " (only in A)")
+		default:
+			fmt.Fprintf(w, " (user %.2f, bot %.2f", t.UserSimilarity, t.BotSimilarity)
+			if t.LatencyDelta != 0 {
+				fmt.Fprintf(w, ", latency %.3fs -> %.3fs, %+.3fs", t.LatencyA, t.LatencyB, t.LatencyDelta)
+			}
+			fmt.Fprintln(w, ")")
+		}
+		fmt.Fprintf(w, "  user: %s\n  bot:  %s\n", formatEdits(diffText(t.UserA, t.UserB), color), formatEdits(diffText(t.BotA, t.BotB), color))
+	}
+}
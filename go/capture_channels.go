@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 输入声道选择：多输入的声卡上，-capture-channels 指定采集设备的哪些声道（从 1
+// 开始，逗号分隔，例如 3 或 3,4），不再总是取默认设备的第一个声道。选择的声道数
+// 与 -input-channels 相同时按顺序对应；输入为单声道而选择了多个声道时按
+// -capture-downmix 混合：average 取平均，sum 相加（限幅），loudest 每块取电平
+// 最高的声道（适合每人一支麦克风）。
+
+var (
+	captureChannelList = flag.String("capture-channels", "", "comma-separated `channels` of the input device to capture, from 1, e.g. 3 or 3,4; empty for the first -input-channels")
+	captureDownmix     = flag.String("capture-downmix", "average", "how to mix the -capture-channels channels into mono input: average, sum or loudest (the loudest channel of each buffer)")
+)
+
+// channelSelector picks and mixes the channels of the captured audio into
+// the input channels.
+type channelSelector struct {
+	open     int   // channels captured from the device
+	channels []int // of the device to keep, from 0
+	mix      string
+	out      []int16
+}
+
+// parseCaptureChannels parses -capture-channels into device channels from 0.
+func parseCaptureChannels(spec string) ([]int, error) {
+	var channels []int
+	for _, field := range strings.Split(spec, ",") {
+		ch, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || ch < 1 {
+			return nil, fmt.Errorf("invalid capture channel %q, expect a number from 1", field)
+		}
+		channels = append(channels, ch-1)
+	}
+	return channels, nil
+}
+
+// validateCaptureChannels checks -capture-channels and -capture-downmix and
+// returns the device channels, from 0.
+func validateCaptureChannels() ([]int, error) {
+	channels, err := parseCaptureChannels(*captureChannelList)
+	if err != nil {
+		return nil, err
+	}
+	switch *captureDownmix {
+	case "average", "sum", "loudest":
+	default:
+		return nil, fmt.Errorf("invalid -capture-downmix %q, expect average, sum or loudest", *captureDownmix)
+	}
+	if len(channels) != audioSettings.InputChannels && audioSettings.InputChannels != 1 {
+		return nil, fmt.Errorf("%d capture channels selected for %d-channel input", len(channels), audioSettings.InputChannels)
+	}
+	return channels, nil
+}
+
+// newChannelSelector returns the selector of -capture-channels for a device
+// of maxChannels inputs and the channels to capture from it, or nil when
+// -capture-channels is not set.
+func newChannelSelector(maxChannels int) (*channelSelector, int, error) {
+	if *captureChannelList == "" {
+		return nil, audioSettings.InputChannels, nil
+	}
+	channels, err := validateCaptureChannels()
+	if err != nil {
+		return nil, 0, err
+	}
+	open := 0
+	for _, ch := range channels {
+		open = max(open, ch+1)
+	}
+	if open > maxChannels {
+		return nil, 0, fmt.Errorf("capture channel %d selected on a device of %d input channels", open, maxChannels)
+	}
+	return &channelSelector{open: open, channels: channels, mix: *captureDownmix}, open, nil
+}
+
+// Select returns the input audio of the interleaved samples in of s.open
+// channels. The result is only valid until the next call.
+func (s *channelSelector) Select(in []int16) []int16 {
+	frames := len(in) / s.open
+	s.out = s.out[:0]
+	if len(s.channels) == audioSettings.InputChannels {
+		// 按顺序对应，单声道输入只选一个声道时同样如此
+		for f := range frames {
+			for _, ch := range s.channels {
+				s.out = append(s.out, in[f*s.open+ch])
+			}
+		}
+		return s.out
+	}
+	switch s.mix {
+	case "loudest":
+		best, bestEnergy := s.channels[0], -1.0
+		for _, ch := range s.channels {
+			var energy float64
+			for f := range frames {
+				v := float64(in[f*s.open+ch])
+				energy += v * v
+			}
+			if energy > bestEnergy {
+				best, bestEnergy = ch, energy
+			}
+		}
+		for f := range frames {
+			s.out = append(s.out, in[f*s.open+best])
+		}
+	default:
+		for f := range frames {
+			var sum int
+			for _, ch := range s.channels {
+				sum += int(in[f*s.open+ch])
+			}
+			if s.mix == "average" {
+				sum /= len(s.channels)
+			}
+			s.out = append(s.out, int16(max(min(sum, math.MaxInt16), math.MinInt16)))
+		}
+	}
+	return s.out
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 
+	"RealtimeDialog/dialog"
 	"github.com/golang/glog"
-	"github.com/gordonklaus/portaudio"
-	"github.com/gorilla/websocket"
 )
 
 type StartSessionPayload struct {
+	ASR    ASRPayload    `json:"asr"`
 	TTS    TTSPayload    `json:"tts"`
 	Dialog DialogPayload `json:"dialog"`
 }
@@ -25,317 +26,172 @@ type ChatTTSTextPayload struct {
 	Content string `json:"content"`
 }
 
+type ChatTextQueryPayload struct {
+	Content string `json:"content"`
+}
+
+type ASRPayload struct {
+	AudioInfo *AudioConfig           `json:"audio_info,omitempty"`
+	Extra     map[string]interface{} `json:"extra,omitempty"`
+}
+
 type TTSPayload struct {
-	AudioConfig AudioConfig `json:"audio_config"`
+	Speaker     string                 `json:"speaker,omitempty"`
+	Cluster     string                 `json:"cluster,omitempty"`
+	AudioConfig AudioConfig            `json:"audio_config"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
 }
 
 type AudioConfig struct {
-	Channel    int    `json:"channel"`
-	Format     string `json:"format"`
-	SampleRate int    `json:"sample_rate"`
+	Channel      int    `json:"channel"`
+	Format       string `json:"format"`
+	SampleRate   int    `json:"sample_rate"`
+	SpeechRate   int    `json:"speech_rate,omitempty"`
+	LoudnessRate int    `json:"loudness_rate,omitempty"`
 }
 
 type DialogPayload struct {
-	BotName  string                 `json:"bot_name"`
-	DialogID string                 `json:"dialog_id"`
-	Extra    map[string]interface{} `json:"extra"`
+	BotName       string                 `json:"bot_name"`
+	SystemRole    string                 `json:"system_role,omitempty"`
+	SpeakingStyle string                 `json:"speaking_style,omitempty"`
+	DialogID      string                 `json:"dialog_id"`
+	DialogContext []DialogTurn           `json:"dialog_context,omitempty"`
+	Extra         map[string]interface{} `json:"extra"`
 }
 
-func startConnection(conn *websocket.Conn) error {
-	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
-	if err != nil {
-		return fmt.Errorf("create StartSession request message: %w", err)
-	}
-	msg.Event = 1
-	msg.Payload = []byte("{}")
-
-	frame, err := protocol.Marshal(msg)
-	glog.Infof("StartConnection frame: %v", frame)
-	if err != nil {
-		return fmt.Errorf("marshal StartConnection request message: %w", err)
-	}
-
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-		return fmt.Errorf("send StartConnection request: %w", err)
-	}
+type SessionStartedPayload struct {
+	DialogID string `json:"dialog_id"`
+}
 
-	// Read ConnectionStarted message.
-	mt, frame, err := conn.ReadMessage()
-	if err != nil {
-		return fmt.Errorf("read ConnectionStarted response: %w", err)
-	}
-	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
-		return fmt.Errorf("unexpected Websocket message type: %d", mt)
-	}
+// dialogClient speaks the protocol on conn, through the interceptors.
+func dialogClient(conn Transport) *dialog.Client {
+	c := dialog.NewClient(conn)
+	c.Outbound = interceptOutbound
+	c.Inbound = interceptInbound
+	return c
+}
 
-	msg, _, err = Unmarshal(frame, protocol.containsSequence)
+func startConnection(conn Transport) error {
+	msg, err := dialogClient(conn).StartConnection(context.Background())
 	if err != nil {
-		glog.Infof("StartConnection response: %s", frame)
-		return fmt.Errorf("unmarshal ConnectionStarted response message: %w", err)
+		return fmt.Errorf("StartConnection: %w", err)
 	}
-	if msg.Type != MsgTypeFullServer {
-		return fmt.Errorf("unexpected ConnectionStarted message type: %s", msg.Type)
-	}
-	if msg.Event != 50 {
-		return fmt.Errorf("unexpected response event (%d) for StartConnection request", msg.Event)
-	}
-	glog.Infof("Connection started (event=%d) connectID: %s, payload: %s", msg.Event, msg.ConnectID, msg.Payload)
-
+	glog.V(vEvent).Infof("Connection started (event=%d) connectID: %s, payload: %s", msg.Event, msg.ConnectID, msg.Payload)
 	return nil
 }
 
-func startSession(conn *websocket.Conn, sessionID string, req *StartSessionPayload) error {
+func startSession(conn Transport, sessionID string, req *StartSessionPayload) (*SessionStartedPayload, error) {
 	payload, err := json.Marshal(req)
 	if err != nil {
-		return fmt.Errorf("marshal StartSession request payload: %w", err)
+		return nil, fmt.Errorf("marshal StartSession request payload: %w", err)
 	}
-
-	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
-	if err != nil {
-		return fmt.Errorf("create StartSession request message: %w", err)
-	}
-	msg.Event = 100
-	msg.SessionID = sessionID
-	msg.Payload = payload
-
-	frame, err := protocol.Marshal(msg)
-	glog.Infof("StartSession request frame: %v", frame)
+	msg, err := dialogClient(conn).StartSession(context.Background(), sessionID, payload)
 	if err != nil {
-		return fmt.Errorf("marshal StartSession request message: %w", err)
+		return nil, fmt.Errorf("StartSession: %w", err)
 	}
+	glog.V(vEvent).Infof("SessionStarted response payload: %v", string(msg.Payload))
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-		return fmt.Errorf("send StartSession request: %w", err)
+	started := new(SessionStartedPayload)
+	if err := json.Unmarshal(msg.Payload, started); err != nil {
+		return nil, fmt.Errorf("unmarshal SessionStarted response payload: %w", err)
 	}
-
-	// Read SessionStarted message.
-	mt, frame, err := conn.ReadMessage()
-	if err != nil {
-		return fmt.Errorf("read SessionStarted response: %w", err)
-	}
-	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
-		return fmt.Errorf("unexpected Websocket message type: %d", mt)
-	}
-
-	// Validate SessionStarted message.
-	msg, _, err = Unmarshal(frame, protocol.containsSequence)
-	if err != nil {
-		glog.Infof("StartSession response: %s", frame)
-		return fmt.Errorf("unmarshal SessionStarted response message: %w", err)
-	}
-	if msg.Type != MsgTypeFullServer {
-		return fmt.Errorf("unexpected SessionStarted message type: %s", msg.Type)
-	}
-	if msg.Event != 150 {
-		return fmt.Errorf("unexpected response event (%d) for StartSession request", msg.Event)
-	}
-	glog.Infof("SessionStarted response payload: %v", string(msg.Payload))
-
-	return nil
+	return started, nil
 }
 
-func sayHello(conn *websocket.Conn, sessionID string, req *SayHelloPayload) error {
+// sendEvent sends req as the JSON payload of a client event of the session.
+func sendEvent(conn Transport, event int32, sessionID string, req any) error {
 	payload, err := json.Marshal(req)
-	glog.Infof("SayHello request payload: %s", string(payload))
-	if err != nil {
-		return fmt.Errorf("marshal SayHello request payload: %w", err)
-	}
-
-	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
 	if err != nil {
-		return fmt.Errorf("create SayHello request message: %w", err)
+		return fmt.Errorf("marshal event %d payload: %w", event, err)
 	}
-	msg.Event = 300
-	msg.SessionID = sessionID
-	msg.Payload = payload
-
-	frame, err := protocol.Marshal(msg)
-	glog.Infof("SayHello frame: %v", frame)
-	if err != nil {
-		return fmt.Errorf("marshal SayHello request message: %w", err)
-	}
-
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-		return fmt.Errorf("send SayHello request: %w", err)
-	}
-	return nil
+	glog.V(vEvent).Infof("Event %d request payload: %s", event, redactText(string(payload)))
+	return dialogClient(conn).Send(event, sessionID, payload)
 }
 
-func chatTTSText(conn *websocket.Conn, sessionID string, req *ChatTTSTextPayload) error {
-	payload, err := json.Marshal(req)
-	glog.Infof("ChatTTSText request payload: %s", string(payload))
-	if err != nil {
-		return fmt.Errorf("marshal ChatTTSText request payload: %w", err)
-	}
+func sayHello(conn Transport, sessionID string, req *SayHelloPayload) error {
+	return sendEvent(conn, dialog.EventSayHello, sessionID, req)
+}
 
-	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
-	if err != nil {
-		return fmt.Errorf("create ChatTTSText request message: %w", err)
+func chatTTSText(conn Transport, sessionID string, req *ChatTTSTextPayload) error {
+	if err := validateTTSMarkup(req.Content); err != nil {
+		return fmt.Errorf("ChatTTSText markup: %w", err)
 	}
-	msg.Event = 500
-	msg.SessionID = sessionID
-	msg.Payload = payload
+	return sendEvent(conn, dialog.EventChatTTSText, sessionID, req)
+}
 
-	frame, err := protocol.Marshal(msg)
-	glog.Infof("ChatTTSText frame: %v", frame)
-	if err != nil {
-		return fmt.Errorf("marshal ChatTTSText request message: %w", err)
-	}
+// chatTextQuery sends text as the user query of the session, answered like
+// speech would be.
+func chatTextQuery(conn Transport, sessionID string, req *ChatTextQueryPayload) error {
+	return sendEvent(conn, dialog.EventChatTextQuery, sessionID, req)
+}
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-		return fmt.Errorf("send ChatTTSText request: %w", err)
+// speakText has the bot speak text in the session with a single ChatTTSText
+// segment.
+func speakText(conn Transport, sessionID, text string) error {
+	if err := chatTTSText(conn, sessionID, &ChatTTSTextPayload{Start: true, Content: text}); err != nil {
+		return err
 	}
-	return nil
+	return chatTTSText(conn, sessionID, &ChatTTSTextPayload{End: true})
 }
 
-func sendAudio(ctx context.Context, c *websocket.Conn, sessionID string) {
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				glog.Errorf("panic: %v", err)
-			}
-		}()
-		defaultInputDevice, err := portaudio.DefaultInputDevice()
-		if err != nil {
-			glog.Errorf("Failed to get default input device: %v", err)
+// sendAudio streams the audio of src to the server until ctx is done, the
+// source is exhausted or the server ends the session. Unless the server has
+// ended it, the session is finished when sendAudio returns, whether the
+// source was stopped or failed.
+func sendAudio(ctx context.Context, c Transport, sessionID string, state *sessionState, src AudioSource) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		if !state.BeginFinish() {
+			glog.V(vEvent).Infof("Session %s already ended by the server, skip FinishSession", sessionID)
 			return
 		}
-		glog.Infof("Using default input device: %s", defaultInputDevice.Name)
-		streamParameters := portaudio.StreamParameters{
-			Input: portaudio.StreamDeviceParameters{
-				Device:   defaultInputDevice,
-				Channels: 1,
-				Latency:  defaultInputDevice.DefaultLowInputLatency,
-			},
-			SampleRate:      16000,
-			FramesPerBuffer: 160,
+		if finishErr := finishSession(c, sessionID); finishErr != nil {
+			glog.Errorf("Failed to finish session: %v", finishErr)
 		}
+	}()
 
-		stream, err := portaudio.OpenStream(streamParameters, func(in []int16) {
-			//glog.Infof("Sending audio: %v", in)
-			// 1. 将 int16 音频数据转换为 []byte (PCM S16LE)
-			audioBytes := make([]byte, len(in)*2)
-			for i, sample := range in {
-				audioBytes[i*2] = byte(sample & 0xff)
-				audioBytes[i*2+1] = byte((sample >> 8) & 0xff)
-			}
-
-			// 2. 设置序列化方式为原始数据
-			// 你提供的 sendAudioData 示例中在此处设置。确保这对你的协议是正确的。
-			protocol.SetSerialization(SerializationRaw)
-
-			// 3. 创建并发送消息
-			msg, err := NewMessage(MsgTypeAudioOnlyClient, MsgTypeFlagWithEvent)
-			if err != nil {
-				glog.Errorf("Error creating audio message: %v", err)
-				return // 从回调中退出
-			}
-
-			msg.Event = 200
-			msg.SessionID = sessionID
-			msg.Payload = audioBytes
-
-			frame, err := protocol.Marshal(msg)
-			if err != nil {
-				glog.Errorf("Error marshalling audio message: %v", err)
-				return // 从回调中退出
-			}
-
-			//glog.Infof("Sent %d bytes of audio data for frame %v", len(audioBytes), frame)
-			if err := c.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-				glog.Errorf("Error sending audio message: %v", err)
-				// 持续发送失败可能需要停止音频流，目前仅记录日志。
-				return
-			}
-		})
-		if err != nil {
-			glog.Errorf("Failed to open microphone input stream: %v", err)
-			return
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-state.Ended():
+			glog.V(vEvent).Info("Stopping audio source as the server ended the session...")
+			cancel()
+		case <-streamCtx.Done():
 		}
-		defer stream.Close()
+	}()
 
-		if err := stream.Start(); err != nil {
-			glog.Errorf("Failed to start microphone input stream: %v", err)
+	client := dialogClient(c)
+	var writeFailed atomic.Bool
+	return src.Stream(streamCtx, func(audioBytes []byte) {
+		if !state.Active() {
 			return
 		}
-		glog.Info("Microphone input stream started. please speak...")
-
-		// 保持 goroutine 运行以允许回调处理音频
-		select {
-		case <-ctx.Done():
-			glog.Info("Stopping microphone input stream due to context cancellation...")
-			if err := stream.Stop(); err != nil {
-				glog.Errorf("Failed to stop microphone input stream: %v", err)
-			}
-			err = finishSession(c, sessionID)
-			if err != nil {
-				glog.Errorf("Failed to finish session: %v", err)
+		if err := client.SendAudio(sessionID, audioBytes); err != nil {
+			// 只记录第一次发送失败，避免刷屏
+			if !writeFailed.Swap(true) {
+				glog.Errorf("Error sending audio message: %v", err)
 			}
+			return
 		}
-		glog.Info("Microphone input stream stopped.")
-	}()
+		glog.V(vFrame).Infof("Sent %d bytes of audio data", len(audioBytes))
+	})
 }
 
-func finishSession(conn *websocket.Conn, sessionID string) error {
-	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
-	if err != nil {
-		return fmt.Errorf("create FinishSession request message: %w", err)
+func finishSession(conn Transport, sessionID string) error {
+	if err := dialogClient(conn).FinishSession(sessionID); err != nil {
+		return err
 	}
-	msg.Event = 102
-	msg.SessionID = sessionID
-	msg.Payload = []byte("{}")
-
-	frame, err := protocol.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("marshal FinishSession request message: %w", err)
-	}
-
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-		return fmt.Errorf("send FinishSession request: %w", err)
-	}
-
-	glog.Info("FinishSession request is sent.")
+	glog.V(vEvent).Info("FinishSession request is sent.")
 	return nil
 }
 
-func finishConnection(conn *websocket.Conn) error {
-	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
-	if err != nil {
-		return fmt.Errorf("create FinishConnection request message: %w", err)
-	}
-	msg.Event = 2
-	msg.Payload = []byte("{}")
-
-	frame, err := protocol.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("marshal FinishConnection request message: %w", err)
+func finishConnection(conn Transport) error {
+	if err := dialogClient(conn).FinishConnection(context.Background()); err != nil {
+		return fmt.Errorf("FinishConnection: %w", err)
 	}
-
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-		return fmt.Errorf("send FinishConnection request: %w", err)
-	}
-
-	// Read ConnectionStarted message.
-	mt, frame, err := conn.ReadMessage()
-	if err != nil {
-		return fmt.Errorf("read ConnectionFinished response: %w", err)
-	}
-	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
-		return fmt.Errorf("unexpected Websocket message type: %d", mt)
-	}
-
-	msg, _, err = Unmarshal(frame, protocol.containsSequence)
-	if err != nil {
-		glog.Infof("FinishConnection response: %s", frame)
-		return fmt.Errorf("unmarshal ConnectionFinished response message: %w", err)
-	}
-	if msg.Type != MsgTypeFullServer {
-		return fmt.Errorf("unexpected ConnectionFinished message type: %s", msg.Type)
-	}
-	if msg.Event != 52 {
-		return fmt.Errorf("unexpected response event (%d) for FinishConnection request", msg.Event)
-	}
-
-	glog.Infof("Connection finished (event=%d).", msg.Event)
+	glog.V(vEvent).Info("Connection finished.")
 	return nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A/B 对比：把同一段录制的用户音频同时送入两组配置（不同的接入点、音色、审核
+// 设置等）的会话，并排比较两边的响应时延、识别结果与机器人回复。
+
+func init() {
+	commands["compare"] = runCompare
+}
+
+// CompareSide is the outcome of the session of one config.
+type CompareSide struct {
+	Config   string `json:"config"`
+	Endpoint string `json:"endpoint"`
+	Speaker  string `json:"speaker,omitempty"`
+	// Latency is the time from the end of each user turn to the first bot
+	// audio of the reply.
+	Latency LatencyStats `json:"latency"`
+	User    []string     `json:"user"`
+	Bot     []string     `json:"bot"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// CompareTurn puts a turn of both sessions side by side.
+type CompareTurn struct {
+	Role       string  `json:"role"` // user or bot
+	Index      int     `json:"index"`
+	A          string  `json:"a"`
+	B          string  `json:"b"`
+	Similarity float64 `json:"similarity"`
+}
+
+// CompareReport is the result of the `compare` command.
+type CompareReport struct {
+	Bundle string        `json:"bundle"`
+	A      CompareSide   `json:"a"`
+	B      CompareSide   `json:"b"`
+	Turns  []CompareTurn `json:"turns"`
+}
+
+// runCompare implements the `compare <bundle> <config A> <config B>`
+// subcommand.
+func runCompare(ctx context.Context, cfg *Config) error {
+	dir, pathA, pathB := flag.Arg(1), flag.Arg(2), flag.Arg(3)
+	if dir == "" || pathA == "" || pathB == "" {
+		return errors.New("usage: compare <recording bundle directory> <config A> <config B>")
+	}
+	pcm, duration, err := loadReplayAudio(dir)
+	if err != nil {
+		return err
+	}
+	report := CompareReport{Bundle: dir}
+	sides := []*CompareSide{&report.A, &report.B}
+	var turns [2]replayTurns
+	var wg sync.WaitGroup
+	for i, path := range []string{pathA, pathB} {
+		side := sides[i]
+		side.Config = path
+		sideCfg, settings, err := loadCompareConfig(path, cfg)
+		if err != nil {
+			return err
+		}
+		side.Endpoint, side.Speaker = wsURL.String(), settings.Speaker
+		if sideCfg.Endpoint != "" {
+			side.Endpoint = sideCfg.Endpoint
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			glog.V(vEvent).Infof("Replaying %v of user audio from %s with %s", duration.Round(time.Millisecond), dir, path)
+			collector, err := replaySession(ctx, sideCfg, settings, pcm, duration)
+			if err != nil {
+				glog.Errorf("Compare %s: %v", path, err)
+				side.Error = err.Error()
+				return
+			}
+			turns[i] = collector.Turns()
+			side.User, side.Bot = turns[i].User, turns[i].Bot
+			var latencies []float64
+			for _, l := range collector.Latencies() {
+				latencies = append(latencies, l.Round(time.Millisecond).Seconds())
+			}
+			side.Latency = latencyStats(latencies)
+		}()
+	}
+	wg.Wait()
+	if report.A.Error != "" && report.B.Error != "" {
+		return fmt.Errorf("both sessions failed: %s; %s", report.A.Error, report.B.Error)
+	}
+	for _, d := range diffReplay(turns[0], turns[1], 0) {
+		report.Turns = append(report.Turns, CompareTurn{Role: d.Role, Index: d.Index, A: d.Recorded, B: d.Replayed, Similarity: d.Similarity})
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		return enc.Encode(report)
+	}
+	report.WriteSummary(os.Stdout)
+	return nil
+}
+
+// loadCompareConfig reads a config file of the comparison. Missing
+// credentials are taken from base; the audio settings and the command-line
+// options are shared by both sides.
+func loadCompareConfig(path string, base *Config) (*Config, *SessionSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read config file: %w", err)
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	if cfg.AppID == "" && cfg.AccessToken == "" && cfg.AppKey == "" {
+		cfg.AppID, cfg.AccessToken, cfg.AppKey = base.AppID, base.AccessToken, base.AppKey
+	}
+	settings, err := resolveSessionSettings(cfg.Session)
+	if err != nil {
+		return nil, nil, fmt.Errorf("session settings of %s: %w", path, err)
+	}
+	return cfg, &settings, nil
+}
+
+// WriteSummary writes the report to w in human-readable form.
+func (r *CompareReport) WriteSummary(w io.Writer) {
+	for _, s := range []struct {
+		name string
+		side CompareSide
+	}{{"A", r.A}, {"B", r.B}} {
+		fmt.Fprintf(w, "%s: %s (%s", s.name, s.side.Config, s.side.Endpoint)
+		if s.side.Speaker != "" {
+			fmt.Fprintf(w, ", speaker %s", s.side.Speaker)
+		}
+		fmt.Fprintln(w, ")")
+		switch l := s.side.Latency; {
+		case s.side.Error != "":
+			fmt.Fprintf(w, "  error: %s\n", s.side.Error)
+		case l.Count == 0:
+			fmt.Fprintln(w, "  latency: n/a")
+		default:
+			fmt.Fprintf(w, "  latency: mean %.3fs, p50 %.3fs, p90 %.3fs, max %.3fs (n=%d)\n", l.Mean, l.P50, l.P90, l.Max, l.Count)
+		}
+	}
+	for _, t := range r.Turns {
+		fmt.Fprintf(w, "%s #%d (similarity %.2f)\n  A: %s\n  B: %s\n", t.Role, t.Index, t.Similarity, t.A, t.B)
+	}
+}
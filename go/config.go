@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var (
+	configPath      = flag.String("config", defaultConfigPath(), "path of the JSON config file")
+	appIDFlag       = flag.String("appid", "", "app ID, overrides VOLC_APP_ID and the config file")
+	accessTokenFlag = flag.String("access-token", "", "access token, overrides VOLC_ACCESS_KEY and the config file")
+	appKeyFlag      = flag.String("app-key", "", "app key, overrides VOLC_APP_KEY and the config file")
+)
+
+// Config holds the settings persisted in the config file.
+type Config struct {
+	AppID       string `json:"app_id"`
+	AccessToken string `json:"access_token"`
+	AppKey      string `json:"app_key"`
+	// Endpoint is the websocket URL of the dialogue service, e.g. of another
+	// region; empty for the default one.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	Audio   AudioSettings   `json:"audio"`
+	Session SessionSettings `json:"session"`
+	// LogLevel is quiet, info, verbose or trace. The -v, -quiet, -verbose
+	// and -trace flags take precedence.
+	LogLevel string `json:"log_level,omitempty"`
+	// RetryPolicy decides what to do when a session fails with a server
+	// error, by error code. See defaultRetryPolicy.
+	RetryPolicy []RetryRule `json:"retry_policy,omitempty"`
+	// Devices are the audio devices last selected with -input-device and
+	// -output-device.
+	Devices *DevicePreferences `json:"devices,omitempty"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "realtimedialog.json"
+	}
+	return filepath.Join(dir, "realtimedialog", "config.json")
+}
+
+// loadConfig reads the config file at path. A missing file yields an empty
+// Config rather than an error.
+func loadConfig(path string) (*Config, error) {
+	cfg := new(Config)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// saveConfig writes cfg to path. The file holds credentials, so it is only
+// readable by the current user.
+func saveConfig(path string, cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create config directory: %w", err)
+	}
+	if err := writeFileAtomic(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("write config file: %w", err)
+	}
+	return nil
+}
+
+// reloadCredentials rereads the credentials of cfg from the config file and
+// the environment, for the reauth retry action.
+func reloadCredentials(cfg *Config) error {
+	fresh, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	resolveCredentials(fresh)
+	cfg.AppID, cfg.AccessToken, cfg.AppKey = fresh.AppID, fresh.AccessToken, fresh.AppKey
+	return nil
+}
+
+// resolveCredentials fills the credentials in cfg, in decreasing order of
+// precedence, from the command-line flags, the environment, the config file
+// and the built-in defaults.
+func resolveCredentials(cfg *Config) {
+	pick := func(dst *string, flagValue, env, fallback string) {
+		switch {
+		case flagValue != "":
+			*dst = flagValue
+		case os.Getenv(env) != "":
+			*dst = os.Getenv(env)
+		case *dst == "":
+			*dst = fallback
+		}
+	}
+	pick(&cfg.AppID, *appIDFlag, "VOLC_APP_ID", appid)
+	pick(&cfg.AccessToken, *accessTokenFlag, "VOLC_ACCESS_KEY", accessToken)
+	pick(&cfg.AppKey, *appKeyFlag, "VOLC_APP_KEY", appKey)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+func init() {
+	configure := func(ctx context.Context, cfg *Config) error {
+		return runConfigure(ctx, *configPath, cfg)
+	}
+	commands["configure"] = configure
+	commands["login"] = configure
+}
+
+// runConfigure implements the `configure` (alias `login`) subcommand: it
+// prompts for the credentials, validates them with a StartConnection round
+// trip, and saves them to the config file. The current values offered are
+// those of the config file: credentials from the environment, the flags or
+// the built-in defaults are neither shown nor saved.
+func runConfigure(ctx context.Context, path string, cfg *Config) error {
+	saved, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	in := bufio.NewReader(os.Stdin)
+	for _, c := range []struct {
+		name   string
+		value  *string
+		secret bool
+	}{
+		{"App ID", &saved.AppID, false},
+		{"Access Token", &saved.AccessToken, true},
+		{"App Key", &saved.AppKey, false},
+	} {
+		if *c.value, err = prompt(in, c.name, *c.value, c.secret); err != nil {
+			return err
+		}
+		if *c.value == "" {
+			return fmt.Errorf("%s is required", c.name)
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Validating credentials...")
+	check := *cfg
+	check.AppID, check.AccessToken, check.AppKey = saved.AppID, saved.AccessToken, saved.AppKey
+	if err := validateCredentials(ctx, &check); err != nil {
+		return fmt.Errorf("validate credentials: %w", err)
+	}
+	if err := saveConfig(path, saved); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Credentials saved to %s\n", path)
+	return nil
+}
+
+// prompt asks for a value on stderr and reads it from stdin. An empty answer
+// keeps the current value. Secret values are read without echo when stdin is
+// a terminal.
+func prompt(in *bufio.Reader, name, current string, secret bool) (string, error) {
+	shown := current
+	switch {
+	case current == "":
+		shown = "(not set)"
+	case secret:
+		shown = "********"
+	}
+	fmt.Fprintf(os.Stderr, "%s [%s]: ", name, shown)
+
+	var line string
+	if fd := int(os.Stdin.Fd()); secret && term.IsTerminal(fd) {
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", name, err)
+		}
+		line = string(b)
+	} else {
+		s, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || s == "") {
+			return "", fmt.Errorf("read %s: %w", name, err)
+		}
+		line = s
+	}
+
+	if line = strings.TrimSpace(line); line == "" {
+		return current, nil
+	}
+	return line, nil
+}
+
+// validateCredentials opens a connection with cfg and performs the
+// StartConnection/FinishConnection handshake.
+func validateCredentials(ctx context.Context, cfg *Config) error {
+	conn, _, err := dialDialog(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	if err := startConnection(conn); err != nil {
+		return err
+	}
+	return finishConnection(conn)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+// 本地内容过滤：在服务端 strict_audit 之外，-blocklist 指定一个词表文件，识别
+// 结果在交给任何处理器（实时字幕、-json 事件、录制、对话历史与 -llm 外部大模型
+// 等）之前按词表过滤：-blocklist-action mask 把命中的词替换为等长的 *，drop 丢弃
+// 整条识别结果。词表每行一个词，忽略大小写；以 re: 开头的行是正则表达式，# 开头
+// 的行是注释。过滤只作用于本地，服务端内置的模型仍会收到原始语音。
+
+var (
+	blocklistPath   = flag.String("blocklist", "", "`file` of words, one per line (re:<regexp> for a regular expression), filtered out of the ASR results before they reach the transcripts, events, recordings and the -llm")
+	blocklistAction = flag.String("blocklist-action", "mask", "what to do with the ASR results matching -blocklist: mask the words or drop the result")
+)
+
+// asrFilter filters the ASR results before they are dispatched; nil, the
+// default, passes them through. It is set up by setupContentFilter before
+// the dialog starts.
+var asrFilter *contentFilter
+
+// contentFilter masks or drops the text matching a blocklist.
+type contentFilter struct {
+	re   *regexp.Regexp
+	drop bool
+}
+
+// setupContentFilter creates asrFilter from -blocklist.
+func setupContentFilter() error {
+	if *blocklistPath == "" {
+		return nil
+	}
+	if *blocklistAction != "mask" && *blocklistAction != "drop" {
+		return fmt.Errorf("invalid -blocklist-action %q, expect mask or drop", *blocklistAction)
+	}
+	f, err := os.Open(*blocklistPath)
+	if err != nil {
+		return fmt.Errorf("open blocklist: %w", err)
+	}
+	defer f.Close()
+	filter, err := parseBlocklist(bufio.NewScanner(f))
+	if err != nil {
+		return err
+	}
+	filter.drop = *blocklistAction == "drop"
+	asrFilter = filter
+	return nil
+}
+
+// parseBlocklist reads the words and expressions of a blocklist.
+func parseBlocklist(scanner *bufio.Scanner) (*contentFilter, error) {
+	var patterns []string
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if expr, ok := strings.CutPrefix(line, "re:"); ok {
+			if _, err := regexp.Compile(expr); err != nil {
+				return nil, fmt.Errorf("blocklist line %d: %w", n, err)
+			}
+			patterns = append(patterns, "(?:"+expr+")")
+		} else {
+			patterns = append(patterns, regexp.QuoteMeta(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read blocklist: %w", err)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("blocklist %s is empty", *blocklistPath)
+	}
+	return &contentFilter{re: regexp.MustCompile("(?i)" + strings.Join(patterns, "|"))}, nil
+}
+
+// Filter returns text with the blocked words masked, or false if the text
+// is to be dropped.
+func (f *contentFilter) Filter(text string) (string, bool) {
+	if !f.re.MatchString(text) {
+		return text, true
+	}
+	if f.drop {
+		return "", false
+	}
+	return f.re.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	}), true
+}
+
+// filterASRResult applies asrFilter to an ASR result.
+func filterASRResult(result ASRResult) (ASRResult, bool) {
+	if asrFilter == nil {
+		return result, true
+	}
+	text, ok := asrFilter.Filter(result.Text)
+	if !ok {
+		glog.V(vEvent).Info("Dropped an ASR result matching the blocklist")
+		return result, false
+	}
+	result.Words = maskWords(result.Text, text, result.Words)
+	result.Text = text
+	// 备选结果同样过滤，drop 时只丢弃命中的备选
+	var alternatives []ASRAlternative
+	for _, alt := range result.Alternatives {
+		if alt.Text, ok = asrFilter.Filter(alt.Text); ok {
+			alternatives = append(alternatives, alt)
+		}
+	}
+	result.Alternatives = alternatives
+	return result, true
+}
+
+// maskWords returns the words of the text original with the characters
+// masked in masked, which has the same characters, masked or not, as
+// original. Words not found in original are filtered on their own.
+func maskWords(original, masked string, words []ASRWord) []ASRWord {
+	if original == masked || len(words) == 0 {
+		return words
+	}
+	from, to := []rune(original), []rune(masked)
+	out := make([]ASRWord, len(words))
+	cursor := 0
+	for i, w := range words {
+		out[i] = w
+		word := []rune(w.Text)
+		if at := runeIndex(from[cursor:], word); at >= 0 && len(word) > 0 {
+			at += cursor
+			out[i].Text = string(to[at : at+len(word)])
+			cursor = at + len(word)
+		} else {
+			out[i].Text, _ = asrFilter.Filter(w.Text)
+		}
+	}
+	return out
+}
+
+// runeIndex returns the index of sub in s, or -1.
+func runeIndex(s, sub []rune) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if string(s[i:i+len(sub)]) == string(sub) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	conversationPath = flag.String("conversation", "", "load prior turns and the dialog ID from this JSON `file` at start, and save the conversation to it at exit")
+	historyTurns     = flag.Int("history-turns", 20, "maximum number of prior turns sent as dialog context at session start")
+
+	// history records the conversation to carry it across sessions and runs.
+	history *conversationRecorder
+)
+
+// Roles of a DialogTurn.
+const (
+	roleUser      = "user"
+	roleAssistant = "assistant"
+)
+
+// DialogTurn is a single turn of a conversation.
+type DialogTurn struct {
+	Role      string `json:"role"`
+	Text      string `json:"text"`
+	Timestamp int64  `json:"timestamp,omitempty"` // Unix milliseconds
+}
+
+// Conversation is the persisted state of a dialog: its server-side ID and
+// the turns spoken so far.
+type Conversation struct {
+	DialogID string       `json:"dialog_id,omitempty"`
+	Turns    []DialogTurn `json:"turns"`
+}
+
+// LoadConversation reads a conversation saved by Save. A missing file yields
+// an empty conversation.
+func LoadConversation(path string) (*Conversation, error) {
+	conv := new(Conversation)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return conv, nil
+	}
+	if err == nil {
+		data, err = openBytes(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read conversation: %w", err)
+	}
+	if err := json.Unmarshal(data, conv); err != nil {
+		return nil, fmt.Errorf("parse conversation %s: %w", path, err)
+	}
+	return conv, nil
+}
+
+// Save writes the conversation to path as JSON, with the personal
+// information of the turns masked.
+func (c *Conversation) Save(path string) error {
+	saved := *c
+	saved.Turns = make([]DialogTurn, len(c.Turns))
+	for i, t := range c.Turns {
+		t.Text = redactText(t.Text)
+		saved.Turns[i] = t
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal conversation: %w", err)
+	}
+	data = append(data, '\n')
+	if data, err = sealBytes(data); err != nil {
+		return fmt.Errorf("encrypt conversation: %w", err)
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("write conversation: %w", err)
+	}
+	return nil
+}
+
+// conversationRecorder appends the finished user and bot turns of every
+// session to a Conversation.
+type conversationRecorder struct {
+	NopHandler
+
+	mu    sync.Mutex
+	conv  *Conversation
+	reply strings.Builder
+}
+
+func newConversationRecorder(conv *Conversation) *conversationRecorder {
+	return &conversationRecorder{conv: conv}
+}
+
+// Context returns the dialog ID and the last max turns to send at session
+// start.
+func (r *conversationRecorder) Context(max int) (string, []DialogTurn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	turns := r.conv.Turns
+	if max >= 0 && len(turns) > max {
+		turns = turns[len(turns)-max:]
+	}
+	return r.conv.DialogID, append([]DialogTurn(nil), turns...)
+}
+
+// SetDialogID records the dialog ID assigned by the server.
+func (r *conversationRecorder) SetDialogID(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id != "" {
+		r.conv.DialogID = id
+	}
+}
+
+// Save flushes the pending bot reply and saves the conversation to path.
+func (r *conversationRecorder) Save(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushReply()
+	return r.conv.Save(path)
+}
+
+func (r *conversationRecorder) addTurn(role, text string) {
+	if text = strings.TrimSpace(text); text == "" {
+		return
+	}
+	r.conv.Turns = append(r.conv.Turns, DialogTurn{Role: role, Text: text, Timestamp: time.Now().UnixMilli()})
+}
+
+func (r *conversationRecorder) flushReply() {
+	r.addTurn(roleAssistant, r.reply.String())
+	r.reply.Reset()
+}
+
+func (r *conversationRecorder) OnASRFinal(result ASRResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushReply()
+	r.addTurn(roleUser, result.Text)
+}
+
+func (r *conversationRecorder) OnBotText(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reply.WriteString(text)
+}
+
+func (r *conversationRecorder) OnBotTextEnd() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushReply()
+}
+
+func (r *conversationRecorder) OnSessionEnd(int32, []byte) {
+	r.OnBotTextEnd()
+}
@@ -0,0 +1,268 @@
+//go:build cshared
+
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+// C 共享库接口：以 go build -buildmode=c-shared -tags cshared 构建，导出一组
+// 小巧的 C 函数（创建客户端、推送音频、取出音频、轮询事件），C++、Rust、Python
+// 等应用可在进程内嵌入对话客户端，无需另起进程。音频格式与会话设置是进程内的
+// 全局状态，因此同一时间只能有一个客户端：rd_client_close 释放之后才能以新的
+// 配置创建下一个。
+
+// cAudioSeconds bounds the bot audio queued for rd_pop_audio.
+const cAudioSeconds = 60
+
+// cClient is a dialogue client created with rd_client_create.
+type cClient struct {
+	NopHandler
+	cancel  context.CancelFunc
+	done    chan struct{}
+	audioIn chan []byte
+	// audioLimit is the size of cAudioSeconds of the output audio.
+	audioLimit int
+
+	mu       sync.Mutex
+	audioOut []byte   // bot audio, S16LE at the output rate and channels
+	events   [][]byte // JSON events, as written with -json
+}
+
+var (
+	// cCreateMu serializes rd_client_create, which sets the global state.
+	cCreateMu   sync.Mutex
+	cClientsMu  sync.Mutex
+	cClients    = map[int64]*cClient{}
+	cLastHandle int64
+	cLastError  string
+)
+
+func cSetError(err error) {
+	cClientsMu.Lock()
+	defer cClientsMu.Unlock()
+	cLastError = err.Error()
+}
+
+func cLookup(handle C.int64_t) *cClient {
+	cClientsMu.Lock()
+	defer cClientsMu.Unlock()
+	return cClients[int64(handle)]
+}
+
+// rd_client_create connects a client with the config, a JSON object in the
+// format of the config file, and starts a session. It returns the handle of
+// the client, or 0 on error, see rd_last_error. Only one client may exist at
+// a time.
+//
+//export rd_client_create
+func rd_client_create(configJSON *C.char) C.int64_t {
+	cCreateMu.Lock()
+	defer cCreateMu.Unlock()
+	cClientsMu.Lock()
+	busy := len(cClients) > 0
+	cClientsMu.Unlock()
+	if busy {
+		cSetError(errors.New("a client already exists: close it with rd_client_close first"))
+		return 0
+	}
+
+	cfg := new(Config)
+	if configJSON != nil {
+		if err := json.Unmarshal([]byte(C.GoString(configJSON)), cfg); err != nil {
+			cSetError(fmt.Errorf("parse config: %w", err))
+			return 0
+		}
+	}
+	resolveCredentials(cfg)
+	_ = flag.Set("logtostderr", "true")
+	settings, err := resolveAudioSettings(cfg.Audio)
+	if err != nil {
+		cSetError(fmt.Errorf("audio settings: %w", err))
+		return 0
+	}
+	audioSettings = settings
+	if err := applyConfig(cfg); err != nil {
+		cSetError(err)
+		return 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &cClient{
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		audioIn:    make(chan []byte, 100),
+		audioLimit: cAudioSeconds * settings.OutputSampleRate * settings.OutputChannels * 2,
+	}
+	cClientsMu.Lock()
+	cLastHandle++
+	handle := cLastHandle
+	cClients[handle] = c
+	cClientsMu.Unlock()
+
+	go func() {
+		defer close(c.done)
+		err := c.run(ctx, cfg)
+		if err != nil && ctx.Err() == nil {
+			glog.Errorf("Dialog of client %d: %v", handle, err)
+		}
+		ev := map[string]string{"type": "client_closed"}
+		if err != nil && ctx.Err() == nil {
+			ev["error"] = err.Error()
+		}
+		line, _ := json.Marshal(ev)
+		c.mu.Lock()
+		c.events = append(c.events, line)
+		c.mu.Unlock()
+	}()
+	return C.int64_t(handle)
+}
+
+func (c *cClient) run(ctx context.Context, cfg *Config) error {
+	conn, _, err := dialDialog(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("websocket dial: %w", err)
+	}
+	defer conn.Close()
+	ids, _ := newSessionIDs("")
+	handlers := multiHandler{c, newJSONEmitter(cEventWriter{c})}
+	return realTimeDialog(ctx, conn, ids, handlers, chanSource(c.audioIn))
+}
+
+// cEventWriter queues the lines written by a jsonEmitter as events.
+type cEventWriter struct{ c *cClient }
+
+func (w cEventWriter) Write(p []byte) (int, error) {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	w.c.events = append(w.c.events, append([]byte(nil), p[:len(p)-1]...))
+	return len(p), nil
+}
+
+func (c *cClient) OnAudioChunk(data []byte) {
+	samples := pcm.Int16ToBytes(pcm.Float32ToInt16(decodeOutputAudio(data)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.audioOut = append(c.audioOut, samples...)
+	if len(c.audioOut) > c.audioLimit {
+		c.audioOut = c.audioOut[len(c.audioOut)-c.audioLimit:]
+	}
+}
+
+// OnASRStart drops the queued bot audio: the user interrupted the bot.
+func (c *cClient) OnASRStart(ASRInfoPayload) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.audioOut = c.audioOut[:0]
+}
+
+// rd_push_audio sends user audio, S16LE at the input rate and channels. It
+// returns 0, or -1 if the handle is unknown or the audio is dropped because
+// the session is not keeping up.
+//
+//export rd_push_audio
+func rd_push_audio(handle C.int64_t, data *C.uint8_t, n C.int) C.int {
+	c := cLookup(handle)
+	if c == nil || n < 0 {
+		return -1
+	}
+	select {
+	case c.audioIn <- C.GoBytes(unsafe.Pointer(data), n):
+		return 0
+	default:
+		return -1
+	}
+}
+
+// rd_pop_audio copies up to capacity bytes of the bot audio, S16LE at the
+// output rate and channels, to buf. It returns the number of bytes copied,
+// or -1 if the handle is unknown.
+//
+//export rd_pop_audio
+func rd_pop_audio(handle C.int64_t, buf *C.uint8_t, capacity C.int) C.int {
+	c := cLookup(handle)
+	if c == nil || capacity < 0 {
+		return -1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := min(len(c.audioOut), int(capacity)&^1)
+	if n == 0 {
+		return 0
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(buf)), n), c.audioOut)
+	c.audioOut = c.audioOut[n:]
+	return C.int(n)
+}
+
+// rd_poll_event returns the next event as a JSON object, in the format of the
+// -json output, or NULL if there is none. The last event of a client is
+// {"type":"client_closed"}, with an "error" if it failed. The string is
+// freed with rd_free.
+//
+//export rd_poll_event
+func rd_poll_event(handle C.int64_t) *C.char {
+	c := cLookup(handle)
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.events) == 0 {
+		return nil
+	}
+	ev := c.events[0]
+	c.events = c.events[1:]
+	return C.CString(string(ev))
+}
+
+// rd_client_close finishes the session and the connection of the client
+// and releases it.
+//
+//export rd_client_close
+func rd_client_close(handle C.int64_t) {
+	cClientsMu.Lock()
+	c := cClients[int64(handle)]
+	delete(cClients, int64(handle))
+	cClientsMu.Unlock()
+	if c == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+}
+
+// rd_last_error returns the error of the last failed rd_client_create, or
+// NULL. The string is freed with rd_free.
+//
+//export rd_last_error
+func rd_last_error() *C.char {
+	cClientsMu.Lock()
+	defer cClientsMu.Unlock()
+	if cLastError == "" {
+		return nil
+	}
+	return C.CString(cLastError)
+}
+
+// rd_free frees a string returned by the library.
+//
+//export rd_free
+func rd_free(p *C.char) {
+	C.free(unsafe.Pointer(p))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// 记住音频设备选择：用 -input-device、-output-device 选择的设备以名称和宿主 API
+// 标识（设备序号在插拔后会变）保存到配置文件，下次启动未指定时沿用；
+// 设备不在时退回系统默认设备。
+
+// DeviceRef identifies an audio device across launches.
+type DeviceRef struct {
+	Name    string `json:"name"`
+	HostAPI string `json:"host_api,omitempty"`
+	// PulseSink is the PulseAudio sink selected with "pulse:<sink>".
+	PulseSink string `json:"pulse_sink,omitempty"`
+}
+
+// DevicePreferences are the audio devices last selected.
+type DevicePreferences struct {
+	Input  *DeviceRef `json:"input,omitempty"`
+	Output *DeviceRef `json:"output,omitempty"`
+}
+
+var (
+	devicePrefsMu sync.Mutex
+	// devicePrefs holds the preferences of the config file, set by run.
+	devicePrefs DevicePreferences
+)
+
+// savedDevice returns the saved output or input device among devices, or the
+// default device if none is saved or it is absent.
+func savedDevice(devices []*AudioDevice, output bool) (*AudioDevice, error) {
+	devicePrefsMu.Lock()
+	ref := devicePrefs.Input
+	if output {
+		ref = devicePrefs.Output
+	}
+	devicePrefsMu.Unlock()
+	if ref == nil {
+		return defaultDevice(devices, output)
+	}
+	for _, d := range devices {
+		if d.Name != ref.Name || ref.HostAPI != "" && d.HostAPI != ref.HostAPI || !d.hasDirection(output) {
+			continue
+		}
+		if ref.PulseSink != "" {
+			if err := os.Setenv("PULSE_SINK", ref.PulseSink); err != nil {
+				return nil, fmt.Errorf("select pulse sink: %w", err)
+			}
+		}
+		return d, nil
+	}
+	glog.Warningf("Saved audio device %q (%s) is absent, using the default device", ref.Name, ref.HostAPI)
+	return defaultDevice(devices, output)
+}
+
+// rememberDevice saves ref as the output or input device in the config file,
+// if it changed. Failures are logged: the device is in use anyway.
+func rememberDevice(output bool, ref DeviceRef) {
+	devicePrefsMu.Lock()
+	defer devicePrefsMu.Unlock()
+	saved := &devicePrefs.Input
+	if output {
+		saved = &devicePrefs.Output
+	}
+	if *saved != nil && **saved == ref {
+		return
+	}
+	*saved = &ref
+	// 重新读取配置文件再写回，只改设备选择，不把命令行与环境变量中的凭证写入文件
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		glog.Errorf("Remember audio device: %v", err)
+		return
+	}
+	cfg.Devices = &DevicePreferences{Input: devicePrefs.Input, Output: devicePrefs.Output}
+	if err := saveConfig(*configPath, cfg); err != nil {
+		glog.Errorf("Remember audio device: %v", err)
+		return
+	}
+	glog.V(vEvent).Infof("Remembered audio device %q in %s", ref.Name, *configPath)
+}
@@ -0,0 +1,353 @@
+package dialog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// 会话客户端：在 websocket 连接上完成 StartConnection、StartSession 等握手，
+// 发送用户音频与文本，读取服务端消息。命令行客户端与 mobile 包共用这一份实现：
+// 命令行客户端通过 NewClient 把自己的连接（-transport）与拦截器接入，在此之上
+// 另有重试与各种输出；其他应用用 Dial 与 Receive 即可运行一个会话。
+
+// DefaultEndpoint is the realtime dialog API.
+const DefaultEndpoint = "wss://openspeech.bytedance.com/api/v3/realtime/dialogue"
+
+// Config holds the credentials and the endpoint of a Client.
+type Config struct {
+	// Endpoint defaults to DefaultEndpoint.
+	Endpoint  string
+	AppID     string
+	AccessKey string
+	AppKey    string
+}
+
+// Conn is a websocket connection. ReadMessage is called from one goroutine
+// at a time; WriteMessage and Close may be called concurrently with each
+// other and with ReadMessage.
+type Conn interface {
+	// ReadMessage returns the type and data of the next message. The data
+	// is only valid until the next call. Once ctx is done it returns the
+	// context error.
+	ReadMessage(ctx context.Context) (messageType int, data []byte, err error)
+	// WriteMessage sends a message.
+	WriteMessage(messageType int, data []byte) error
+	// Close closes the connection without a closing handshake.
+	Close() error
+}
+
+// Handler receives the messages of a session from Client.Receive.
+type Handler interface {
+	// OnEvent is called with each FullServer message: the event and its JSON
+	// payload.
+	OnEvent(event int32, payload []byte)
+	// OnAudio is called with each chunk of bot audio, in the output format
+	// of the session. data is reused once the call returns.
+	OnAudio(data []byte)
+}
+
+// ErrSessionFailed is returned by Client.Receive when the server fails the
+// session.
+var ErrSessionFailed = errors.New("session failed")
+
+// ServerErrorMessage is the error of an Error message from the server.
+type ServerErrorMessage struct {
+	Code    uint32
+	Payload []byte
+}
+
+func (e *ServerErrorMessage) Error() string {
+	return fmt.Sprintf("server error %d: %s", e.Code, e.Payload)
+}
+
+// Client speaks the dialog protocol on a connection. Its methods sending
+// messages may be called concurrently with the reads.
+type Client struct {
+	conn Conn
+
+	// Outbound, if set, is applied to every message before it is
+	// marshaled, and Inbound to every message once unmarshaled: the
+	// message they return is used instead, and their error fails the send
+	// or the read.
+	Outbound func(*Message) (*Message, error)
+	Inbound  func(*Message) (*Message, error)
+}
+
+// Protocols of the messages: JSON payloads, and raw audio.
+var (
+	jsonProtocol  = NewBinaryProtocol()
+	audioProtocol *BinaryProtocol
+)
+
+func init() {
+	jsonProtocol.SetVersion(Version1)
+	jsonProtocol.SetHeaderSize(HeaderSize4)
+	jsonProtocol.SetSerialization(SerializationJSON)
+	jsonProtocol.SetCompression(CompressionNone, nil)
+	jsonProtocol.SetContainsSequence(ContainsSequence)
+
+	audioProtocol = jsonProtocol.Clone()
+	audioProtocol.SetSerialization(SerializationRaw)
+}
+
+// Marshal encodes msg as a Client does: the payload of audio messages as
+// raw data, that of the others as JSON.
+func Marshal(msg *Message) ([]byte, error) {
+	p := jsonProtocol
+	if msg.Type == MsgTypeAudioOnlyClient || msg.Type == MsgTypeAudioOnlyServer {
+		p = audioProtocol
+	}
+	return p.Marshal(msg)
+}
+
+// Message types of a Conn, as in the websocket protocol.
+const (
+	TextMessage   = websocket.TextMessage
+	BinaryMessage = websocket.BinaryMessage
+)
+
+// NewClient returns a client on conn, whose connection is not started yet.
+func NewClient(conn Conn) *Client {
+	return &Client{conn: conn}
+}
+
+// Dial connects to the dialog API and starts the connection. It returns the
+// client and the connect ID sent, which identifies the connection in support
+// tickets.
+func Dial(ctx context.Context, cfg Config) (*Client, string, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	connectID := uuid.New().String()
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, endpoint, Header(cfg, connectID))
+	if err != nil {
+		return nil, "", fmt.Errorf("websocket dial: %w", err)
+	}
+	c := NewClient(&gorillaConn{conn: conn})
+	if _, err := c.StartConnection(ctx); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return c, connectID, nil
+}
+
+// Header returns the handshake header of a connection with the connect ID.
+func Header(cfg Config, connectID string) http.Header {
+	return http.Header{
+		"X-Api-Resource-Id": []string{"volc.speech.dialog"},
+		"X-Api-Access-Key":  []string{cfg.AccessKey},
+		"X-Api-App-Key":     []string{cfg.AppKey},
+		"X-Api-App-ID":      []string{cfg.AppID},
+		"X-Api-Connect-Id":  []string{connectID},
+	}
+}
+
+// StartConnection starts the connection and returns the ConnectionStarted
+// message.
+func (c *Client) StartConnection(ctx context.Context) (*Message, error) {
+	if err := c.Send(EventStartConnection, "", []byte("{}")); err != nil {
+		return nil, err
+	}
+	return c.expect(ctx, EventConnectionStarted)
+}
+
+// StartSession starts a session with the StartSession payload, a JSON
+// object, and returns the SessionStarted message.
+func (c *Client) StartSession(ctx context.Context, sessionID string, payload []byte) (*Message, error) {
+	if !json.Valid(payload) {
+		return nil, errors.New("StartSession payload is not JSON")
+	}
+	if err := c.Send(EventStartSession, sessionID, payload); err != nil {
+		return nil, err
+	}
+	return c.expect(ctx, EventSessionStarted)
+}
+
+// FinishSession asks the server to finish the session.
+func (c *Client) FinishSession(sessionID string) error {
+	return c.Send(EventFinishSession, sessionID, []byte("{}"))
+}
+
+// FinishConnection finishes the connection, waiting for the server to
+// confirm. It is called once the reads of the session have returned.
+func (c *Client) FinishConnection(ctx context.Context) error {
+	if err := c.Send(EventFinishConnection, "", []byte("{}")); err != nil {
+		return err
+	}
+	_, err := c.expect(ctx, EventConnectionFinished)
+	return err
+}
+
+// SendAudio sends a chunk of user audio, in the input format of the session.
+func (c *Client) SendAudio(sessionID string, data []byte) error {
+	msg, err := NewMessage(MsgTypeAudioOnlyClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		return err
+	}
+	msg.Event = EventTaskRequest
+	msg.SessionID = sessionID
+	msg.Payload = data
+	return c.write(audioProtocol, msg)
+}
+
+// SendText sends a text query of the user.
+func (c *Client) SendText(sessionID, text string) error {
+	payload, err := json.Marshal(map[string]string{"content": text})
+	if err != nil {
+		return fmt.Errorf("marshal ChatTextQuery payload: %w", err)
+	}
+	return c.Send(EventChatTextQuery, sessionID, payload)
+}
+
+// Send sends a FullClient message with the event and JSON payload.
+func (c *Client) Send(event int32, sessionID string, payload []byte) error {
+	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		return err
+	}
+	msg.Event = event
+	msg.SessionID = sessionID
+	msg.Payload = payload
+	return c.write(jsonProtocol, msg)
+}
+
+func (c *Client) write(p *BinaryProtocol, msg *Message) error {
+	event := msg.Event
+	if c.Outbound != nil {
+		var err error
+		if msg, err = c.Outbound(msg); err != nil {
+			return err
+		}
+	}
+	frame, err := p.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal event %d: %w", event, err)
+	}
+	if err := c.conn.WriteMessage(BinaryMessage, frame); err != nil {
+		return fmt.Errorf("send event %d: %w", event, err)
+	}
+	return nil
+}
+
+// Read reads the next message. The payload of audio messages is only valid
+// until the next read.
+func (c *Client) Read(ctx context.Context) (*Message, error) {
+	mt, frame, err := c.conn.ReadMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mt != BinaryMessage && mt != TextMessage {
+		return nil, fmt.Errorf("unexpected Websocket message type: %d", mt)
+	}
+	msg, _, err := Unmarshal(frame, ContainsSequence)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal response message: %w", err)
+	}
+	// 帧所在的缓冲区会被下一条消息覆盖，音频以外的消息较少，复制后可以保留
+	if msg.Type != MsgTypeAudioOnlyServer {
+		msg.Payload = bytes.Clone(msg.Payload)
+	}
+	if c.Inbound != nil {
+		return c.Inbound(msg)
+	}
+	return msg, nil
+}
+
+// expect reads the response to a request, which must be the event.
+func (c *Client) expect(ctx context.Context, event int32) (*Message, error) {
+	msg, err := c.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read response event %d: %w", event, err)
+	}
+	if msg.Type == MsgTypeError {
+		return nil, &ServerErrorMessage{Code: msg.ErrorCode, Payload: msg.Payload}
+	}
+	if msg.Type != MsgTypeFullServer || msg.Event != event {
+		return nil, fmt.Errorf("unexpected %s message with event %d, want event %d: %s", msg.Type, msg.Event, event, msg.Payload)
+	}
+	return msg, nil
+}
+
+// Receive delivers the messages of the session to h until the server
+// finishes the session, returning nil, or fails it, returning an error
+// wrapping ErrSessionFailed. It returns a *ServerErrorMessage for an Error
+// message, and the error of the connection or of ctx otherwise.
+func (c *Client) Receive(ctx context.Context, h Handler) error {
+	for {
+		msg, err := c.Read(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case MsgTypeError:
+			return &ServerErrorMessage{Code: msg.ErrorCode, Payload: msg.Payload}
+		case MsgTypeAudioOnlyServer:
+			h.OnAudio(msg.Payload)
+		case MsgTypeFullServer:
+			h.OnEvent(msg.Event, msg.Payload)
+			switch msg.Event {
+			case EventSessionFinished:
+				return nil
+			case EventSessionFailed:
+				return fmt.Errorf("%w: %s", ErrSessionFailed, msg.Payload)
+			}
+		}
+	}
+}
+
+// closeTimeout bounds the wait for ConnectionFinished in Close.
+const closeTimeout = 5 * time.Second
+
+// Close finishes the connection, waiting a few seconds at most for the
+// server to confirm, and closes it. Call it once Receive has returned.
+func (c *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	err := c.FinishConnection(ctx)
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// gorillaConn is a Conn over a gorilla/websocket connection.
+type gorillaConn struct {
+	conn *websocket.Conn
+	// writeMu serializes the writes, as gorilla/websocket supports only one
+	// concurrent writer.
+	writeMu sync.Mutex
+}
+
+// ReadMessage aborts the read through the read deadline once ctx is done,
+// after which the connection cannot be read from.
+func (g *gorillaConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = g.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	mt, data, err := g.conn.ReadMessage()
+	if err != nil && ctx.Err() != nil {
+		return 0, nil, ctx.Err()
+	}
+	return mt, data, err
+}
+
+func (g *gorillaConn) WriteMessage(messageType int, data []byte) error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	return g.conn.WriteMessage(messageType, data)
+}
+
+func (g *gorillaConn) Close() error {
+	return g.conn.Close()
+}
@@ -0,0 +1,175 @@
+package dialog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// connectionFrame builds a connection level server event, whose connect ID
+// Marshal does not write.
+func connectionFrame(event int32, connectID string) []byte {
+	frame := []byte{0x11, 0x94, 0x10, 0x00}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(event))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(connectID)))
+	frame = append(frame, connectID...)
+	return append(binary.BigEndian.AppendUint32(frame, 2), "{}"...)
+}
+
+// fakeServer answers the handshakes and, once it has received audio and a
+// text query, streams a reply and finishes the session.
+func fakeServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-App-ID") != "app" || r.Header.Get("X-Api-Resource-Id") != "volc.speech.dialog" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		connectID := r.Header.Get("X-Api-Connect-Id")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		prot := NewBinaryProtocol()
+		prot.SetVersion(Version1)
+		prot.SetHeaderSize(HeaderSize4)
+		prot.SetSerialization(SerializationJSON)
+		send := func(typ MsgType, event int32, sessionID, payload string) {
+			msg, _ := NewMessage(typ, MsgTypeFlagWithEvent)
+			msg.Event, msg.SessionID, msg.Payload = event, sessionID, []byte(payload)
+			frame, err := prot.Marshal(msg)
+			if err != nil {
+				t.Error(err)
+			}
+			_ = conn.WriteMessage(websocket.BinaryMessage, frame)
+		}
+
+		var gotAudio bool
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, _, err := Unmarshal(frame, ContainsSequence)
+			if err != nil {
+				t.Errorf("server: %v", err)
+				return
+			}
+			switch msg.Event {
+			case EventStartConnection:
+				_ = conn.WriteMessage(websocket.BinaryMessage, connectionFrame(EventConnectionStarted, connectID))
+			case EventStartSession:
+				send(MsgTypeFullServer, EventSessionStarted, msg.SessionID, `{"dialog_id":"d1"}`)
+			case EventTaskRequest:
+				gotAudio = msg.Type == MsgTypeAudioOnlyClient && bytes.Equal(msg.Payload, []byte{1, 2, 3, 4})
+			case EventChatTextQuery:
+				if !gotAudio || string(msg.Payload) != `{"content":"你好"}` {
+					t.Errorf("server: audio %v, query %s", gotAudio, msg.Payload)
+				}
+				send(MsgTypeFullServer, EventChatResponse, msg.SessionID, `{"content":"您好"}`)
+				send(MsgTypeAudioOnlyServer, EventTTSResponse, msg.SessionID, "\x05\x06")
+				send(MsgTypeFullServer, EventSessionFinished, msg.SessionID, "{}")
+			case EventFinishConnection:
+				_ = conn.WriteMessage(websocket.BinaryMessage, connectionFrame(EventConnectionFinished, connectID))
+			}
+		}
+	}))
+}
+
+type recordingHandler struct {
+	events []int32
+	audio  []byte
+}
+
+func (h *recordingHandler) OnEvent(event int32, payload []byte) {
+	h.events = append(h.events, event)
+}
+
+func (h *recordingHandler) OnAudio(data []byte) {
+	h.audio = append(h.audio, data...)
+}
+
+func TestClientSession(t *testing.T) {
+	srv := fakeServer(t)
+	defer srv.Close()
+	endpoint := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx := context.Background()
+	if _, _, err := Dial(ctx, Config{Endpoint: endpoint, AppID: "other"}); err == nil {
+		t.Fatal("dialed with rejected credentials")
+	}
+
+	c, _, err := Dial(ctx, Config{Endpoint: endpoint, AppID: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, err := c.StartSession(ctx, "s1", []byte(`{"dialog":{"bot_name":"豆包"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(started.Payload) != `{"dialog_id":"d1"}` {
+		t.Errorf("SessionStarted payload %s", started.Payload)
+	}
+	if err := c.SendAudio("s1", []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendText("s1", "你好"); err != nil {
+		t.Fatal(err)
+	}
+
+	var h recordingHandler
+	if err := c.Receive(ctx, &h); err != nil {
+		t.Fatal(err)
+	}
+	// 服务端结束会话后 Receive 返回，之前的事件与音频都已送达
+	if want := []int32{EventChatResponse, EventSessionFinished}; !slices.Equal(h.events, want) {
+		t.Errorf("events %v, want %v", h.events, want)
+	}
+	if !bytes.Equal(h.audio, []byte{5, 6}) {
+		t.Errorf("audio %v", h.audio)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClientReceiveCancel stops waiting for a server that never finishes
+// the session once the context is done.
+func TestClientReceiveCancel(t *testing.T) {
+	srv := fakeServer(t)
+	defer srv.Close()
+	c, _, err := Dial(context.Background(), Config{Endpoint: "ws" + strings.TrimPrefix(srv.URL, "http"), AppID: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.StartSession(context.Background(), "s1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	// 假服务端不回应 FinishSession
+	if err := c.FinishSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Receive(ctx, &recordingHandler{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Receive returned %v, want the context error", err)
+	}
+	start := time.Now()
+	if err := c.Close(); err == nil {
+		t.Error("finished the connection after an aborted read")
+	}
+	if time.Since(start) > closeTimeout {
+		t.Error("Close waited past its timeout")
+	}
+}
@@ -0,0 +1,33 @@
+package dialog
+
+// Client events.
+const (
+	EventStartConnection  int32 = 1
+	EventFinishConnection int32 = 2
+	EventStartSession     int32 = 100
+	EventFinishSession    int32 = 102
+	EventTaskRequest      int32 = 200
+	EventSayHello         int32 = 300
+	EventChatTTSText      int32 = 500
+	EventChatTextQuery    int32 = 501
+)
+
+// Server events.
+const (
+	EventConnectionStarted  int32 = 50
+	EventConnectionFailed   int32 = 51
+	EventConnectionFinished int32 = 52
+	EventSessionStarted     int32 = 150
+	EventSessionFinished    int32 = 152
+	EventSessionFailed      int32 = 153
+	EventUsageResponse      int32 = 154
+	EventTTSSentenceStart   int32 = 350
+	EventTTSSentenceEnd     int32 = 351
+	EventTTSResponse        int32 = 352
+	EventTTSEnded           int32 = 359
+	EventASRInfo            int32 = 450
+	EventASRResponse        int32 = 451
+	EventASREnded           int32 = 459
+	EventChatResponse       int32 = 550
+	EventChatEnded          int32 = 559
+)
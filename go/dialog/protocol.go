@@ -1,4 +1,7 @@
-package main
+// Package dialog implements the binary protocol of the Volcengine realtime
+// dialog API: Marshal and Unmarshal frame Messages, and the Event constants
+// number the client and server events.
+package dialog
 
 import (
 	"bytes"
@@ -11,6 +14,10 @@ import (
 	"github.com/golang/glog"
 )
 
+// vTrace is the glog verbosity of the protocol internals, the -trace tier of
+// the command line client.
+const vTrace glog.Level = 3
+
 var (
 	errNoVersionAndSize              = errors.New("no protocol version and header size byte")
 	errNoTypeAndFlag                 = errors.New("no message type and specific flag byte")
@@ -22,7 +29,9 @@ var (
 	errNoEnoughHeaderBytes           = errors.New("no enough header bytes")
 	errReadEvent                     = errors.New("read event number")
 	errReadSessionIDSize             = errors.New("read session ID size")
+	errReadSessionID                 = errors.New("read session ID")
 	errReadConnectIDSize             = errors.New("read connection ID size")
+	errReadConnectID                 = errors.New("read connection ID")
 	errReadPayloadSize               = errors.New("read payload size")
 	errReadPayload                   = errors.New("read payload")
 	errReadSequence                  = errors.New("read sequence number")
@@ -187,16 +196,16 @@ func Unmarshal(data []byte, containsSequence ContainsSequenceFunc) (*Message, *B
 		versionAndHeaderSize: versionSize,
 		containsSequence:     containsSequence,
 	}
-	glog.V(2).Infof("Read version: %04b", versionSize>>4)
-	glog.V(2).Infof("Read size: %04b", versionSize&0b1111)
+	glog.V(vTrace).Infof("Read version: %04b", versionSize>>4)
+	glog.V(vTrace).Infof("Read size: %04b", versionSize&0b1111)
 
 	typeAndFlag, err := buf.ReadByte()
 	if err != nil {
 		return nil, nil, errNoTypeAndFlag
 	}
 	readSize++
-	glog.V(2).Infof("Read message type: %04b", typeAndFlag>>4)
-	glog.V(2).Infof("Read message type specific flag: %04b", typeAndFlag&0b1111)
+	glog.V(vTrace).Infof("Read message type: %04b", typeAndFlag>>4)
+	glog.V(vTrace).Infof("Read message type specific flag: %04b", typeAndFlag&0b1111)
 
 	msg, err := NewMessageFromByte(typeAndFlag)
 	if err != nil {
@@ -207,8 +216,8 @@ func Unmarshal(data []byte, containsSequence ContainsSequenceFunc) (*Message, *B
 	if err != nil {
 		return nil, nil, errNoSerializationAndCompression
 	}
-	glog.V(2).Infof("Read serialization method: %04b", serializationCompression>>4)
-	glog.V(2).Infof("Read compression method: %04b", serializationCompression&0b1111)
+	glog.V(vTrace).Infof("Read serialization method: %04b", serializationCompression>>4)
+	glog.V(vTrace).Infof("Read compression method: %04b", serializationCompression&0b1111)
 	readSize++
 	prot.serializationAndCompression = serializationCompression
 	if _, ok := serializations[prot.Serialization()]; !ok {
@@ -299,16 +308,16 @@ func (m *Message) writers(compress CompressFunc) (writers []writeFunc, _ error)
 
 	if containsSequence(m.TypeFlag()) {
 		writers = append(writers, m.writeSequence)
-		glog.Info("Add Sequence writer.")
+		glog.V(vTrace).Info("Add Sequence writer.")
 	}
 
-	if containsEvent(m.TypeFlag()) {
+	if ContainsEvent(m.TypeFlag()) {
 		writers = append(writers, m.writeEvent, m.writeSessionID)
-		glog.V(1).Info("Add Event and SessionID writer.")
+		glog.V(vTrace).Info("Add Event and SessionID writer.")
 	}
 
 	writers = append(writers, m.writePayload)
-	glog.V(1).Info("Add Payload writers.")
+	glog.V(vTrace).Info("Add Payload writers.")
 	return writers, nil
 }
 
@@ -322,7 +331,7 @@ func (m *Message) writeEvent(buf *bytes.Buffer) error {
 func (m *Message) writeSessionID(buf *bytes.Buffer) error {
 	switch m.Event {
 	case 1, 2, 50, 51, 52: // StartConnection, FinishConnection, ConnectionStarted, ConnectionFailed, ConnectionFinished
-		glog.V(1).Infof("Skip writing session ID for event: %d", m.Event)
+		glog.V(vTrace).Infof("Skip writing session ID for event: %d", m.Event)
 		return nil
 	}
 
@@ -371,30 +380,30 @@ func (m *Message) readers(containsSequence ContainsSequenceFunc) (readers []read
 	case MsgTypeAudioOnlyClient:
 		if containsSequence == nil || containsSequence(m.TypeFlag()) {
 			readers = append(readers, m.readSequence)
-			glog.V(1).Info("AudioOnlyClient message: add Sequence reader.")
+			glog.V(vTrace).Info("AudioOnlyClient message: add Sequence reader.")
 		}
 
 	case MsgTypeAudioOnlyServer:
 		if containsSequence != nil && containsSequence(m.TypeFlag()) {
 			readers = append(readers, m.readSequence)
-			glog.V(1).Info("AudioOnlyServer message: add Sequence reader.")
+			glog.V(vTrace).Info("AudioOnlyServer message: add Sequence reader.")
 		}
 
 	case MsgTypeError:
 		readers = append(readers, m.readErrorCode)
-		glog.V(1).Info("Error message: add Error-Code reader.")
+		glog.V(vTrace).Info("Error message: add Error-Code reader.")
 
 	default:
 		return nil, fmt.Errorf("cannot deserialize message with invalid type: %d", m.Type)
 	}
 
-	if containsEvent(m.TypeFlag()) {
+	if ContainsEvent(m.TypeFlag()) {
 		readers = append(readers, m.readEvent, m.readSessionID, m.readConnectID)
-		glog.V(1).Info("Add Event and SessionID readers.")
+		glog.V(vTrace).Info("Add Event and SessionID readers.")
 	}
 
 	readers = append(readers, m.readPayload)
-	glog.V(1).Info("Add Payload reader.")
+	glog.V(vTrace).Info("Add Payload reader.")
 	return readers, nil
 }
 
@@ -402,14 +411,14 @@ func (m *Message) readEvent(buf *bytes.Buffer) error {
 	if err := binary.Read(buf, binary.BigEndian, &m.Event); err != nil {
 		return fmt.Errorf("%w: %v", errReadEvent, err)
 	}
-	glog.V(1).Infof("Read Event: %d", m.Event)
+	glog.V(vTrace).Infof("Read Event: %d", m.Event)
 	return nil
 }
 
 func (m *Message) readSessionID(buf *bytes.Buffer) error {
 	switch m.Event {
 	case 1, 2, 50, 51, 52: //StartConnection, FinishConnection, ConnectionStarted, ConnectionFailed, ConnectionFinished
-		glog.V(1).Infof("Skip reading session ID for event: %d", m.Event)
+		glog.V(vTrace).Infof("Skip reading session ID for event: %d", m.Event)
 		return nil
 	}
 
@@ -417,12 +426,15 @@ func (m *Message) readSessionID(buf *bytes.Buffer) error {
 	if err := binary.Read(buf, binary.BigEndian, &size); err != nil {
 		return fmt.Errorf("%w: %v", errReadSessionIDSize, err)
 	}
-	glog.V(2).Infof("Read SessionID length: %d", size)
+	glog.V(vTrace).Infof("Read SessionID length: %d", size)
+	if err := checkSize(buf, size); err != nil {
+		return fmt.Errorf("%w: %v", errReadSessionID, err)
+	}
 
 	if size > 0 {
 		m.SessionID = string(buf.Next(int(size)))
 	}
-	glog.V(2).Infof("Read SessionID content: %s", m.SessionID)
+	glog.V(vTrace).Infof("Read SessionID content: %s", m.SessionID)
 	return nil
 }
 
@@ -430,7 +442,7 @@ func (m *Message) readConnectID(buf *bytes.Buffer) error {
 	switch m.Event {
 	case 50, 51, 52: // ConnectionStarted, event.Type_ConnectionFailed, ConnectionFinished
 	default:
-		glog.V(1).Infof("Skip reading session ID for event: %d", m.Event)
+		glog.V(vTrace).Infof("Skip reading session ID for event: %d", m.Event)
 		return nil
 	}
 
@@ -438,12 +450,15 @@ func (m *Message) readConnectID(buf *bytes.Buffer) error {
 	if err := binary.Read(buf, binary.BigEndian, &size); err != nil {
 		return fmt.Errorf("%w: %v", errReadConnectIDSize, err)
 	}
-	glog.V(2).Infof("Read connection ID length: %d", size)
+	glog.V(vTrace).Infof("Read connection ID length: %d", size)
+	if err := checkSize(buf, size); err != nil {
+		return fmt.Errorf("%w: %v", errReadConnectID, err)
+	}
 
 	if size > 0 {
 		m.ConnectID = string(buf.Next(int(size)))
 	}
-	glog.V(2).Infof("Read connection ID content: %s", m.ConnectID)
+	glog.V(vTrace).Infof("Read connection ID content: %s", m.ConnectID)
 	return nil
 }
 
@@ -451,7 +466,7 @@ func (m *Message) readSequence(buf *bytes.Buffer) error {
 	if err := binary.Read(buf, binary.BigEndian, &m.Sequence); err != nil {
 		return fmt.Errorf("%w: %v", errReadSequence, err)
 	}
-	glog.V(2).Infof("Read Sequence: %d", m.Sequence)
+	glog.V(vTrace).Infof("Read Sequence: %d", m.Sequence)
 	return nil
 }
 
@@ -459,7 +474,7 @@ func (m *Message) readErrorCode(buf *bytes.Buffer) error {
 	if err := binary.Read(buf, binary.BigEndian, &m.ErrorCode); err != nil {
 		return fmt.Errorf("%w: %v", errReadErrorCode, err)
 	}
-	glog.V(2).Infof("Read ErrorCode: %d", m.ErrorCode)
+	glog.V(vTrace).Infof("Read ErrorCode: %d", m.ErrorCode)
 	return nil
 }
 
@@ -468,13 +483,22 @@ func (m *Message) readPayload(buf *bytes.Buffer) error {
 	if err := binary.Read(buf, binary.BigEndian, &size); err != nil {
 		return fmt.Errorf("%w: %v", errReadPayloadSize, err)
 	}
-	glog.V(2).Infof("Read Payload length: %d", size)
+	glog.V(vTrace).Infof("Read Payload length: %d", size)
+	if err := checkSize(buf, size); err != nil {
+		return fmt.Errorf("%w: %v", errReadPayload, err)
+	}
 
 	if size > 0 {
 		m.Payload = buf.Next(int(size))
 	}
-	if m.Type == MsgTypeFullClient || m.Type == MsgTypeFullServer || m.Type == MsgTypeError {
-		glog.V(2).Infof("Read Payload content: %s", m.Payload)
+	return nil
+}
+
+// checkSize checks that a length read from untrusted data does not exceed the
+// remaining bytes, so that a field is never silently truncated.
+func checkSize(buf *bytes.Buffer, size uint32) error {
+	if uint64(size) > uint64(buf.Len()) {
+		return fmt.Errorf("size %d exceeds the remaining %d bytes", size, buf.Len())
 	}
 	return nil
 }
@@ -486,7 +510,9 @@ func ContainsSequence(bits MsgTypeFlagBits) bool {
 	return bits&MsgTypeFlagPositiveSeq == MsgTypeFlagPositiveSeq || bits&MsgTypeFlagNegativeSeq == MsgTypeFlagNegativeSeq
 }
 
-func containsEvent(bits MsgTypeFlagBits) bool {
+// ContainsEvent reports whether a message type specific flag indicates
+// messages with this kind of flag contain an event number and a session ID.
+func ContainsEvent(bits MsgTypeFlagBits) bool {
 	return bits&MsgTypeFlagWithEvent == MsgTypeFlagWithEvent
 }
 
@@ -520,6 +546,17 @@ func (p *BinaryProtocol) Clone() *BinaryProtocol {
 	return clonedBinaryProtocal
 }
 
+// SetContainsSequence sets the function that tells from the message type
+// specific flag whether a message contains a sequence number.
+func (p *BinaryProtocol) SetContainsSequence(f ContainsSequenceFunc) {
+	p.containsSequence = f
+}
+
+// ContainsSequence returns the function set with SetContainsSequence.
+func (p *BinaryProtocol) ContainsSequence() ContainsSequenceFunc {
+	return p.containsSequence
+}
+
 // SetVersion sets the protocol version.
 func (p *BinaryProtocol) SetVersion(v VersionBits) {
 	// Clear the higher 4 bits in `p.versionAndHeaderSize` and reset them to `v`.
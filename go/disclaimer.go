@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"math"
+	"math/rand/v2"
+)
+
+// 合规选项：-disclaimer 指定每个会话开始时机器人先说的一句声明（例如“我是 AI
+// 助手”），在开场白之前以同一个 SayHello 播报，同样支持人设模板变量；
+// -record-watermark 在录制目录的 mixed.wav 中混入指定电平的伪随机噪声水印，
+// 噪声序列由会话 ID 确定，可以用相关检测证明录音的来源。
+
+var (
+	disclaimer      = flag.String("disclaimer", "", "statement the bot speaks at the start of every session before the greeting, e.g. 我是 AI 助手")
+	recordWatermark = flag.Float64("record-watermark", 0, "mix a pseudo-random noise watermark derived from the session ID into the mixed.wav of the recordings, at this level in `dBFS`, e.g. -55 (0 disables)")
+)
+
+// greetingText is the text spoken at the start of a session with settings:
+// the disclaimer, then the greeting.
+func greetingText(settings *SessionSettings) (string, error) {
+	var text string
+	for _, field := range []struct{ name, text string }{
+		{"disclaimer", settings.Disclaimer},
+		{"greeting", settings.Greeting},
+	} {
+		rendered, err := renderTemplate(field.name, field.text, settings.Vars)
+		if err != nil {
+			return "", err
+		}
+		if text != "" && rendered != "" {
+			text += " "
+		}
+		text += rendered
+	}
+	return text, nil
+}
+
+// addWatermark adds to samples, 16-bit values at any rate, the watermark of
+// the session: noise of ±level dBFS from a generator seeded with the hash of
+// the session ID.
+func addWatermark(samples []float64, sessionID string, level float64) {
+	sum := sha256.Sum256([]byte(sessionID))
+	rng := rand.New(rand.NewPCG(binary.LittleEndian.Uint64(sum[:8]), binary.LittleEndian.Uint64(sum[8:16])))
+	amplitude := 32767 * math.Pow(10, level/20)
+	for i := range samples {
+		if rng.Uint64()&1 == 0 {
+			samples[i] += amplitude
+		} else {
+			samples[i] -= amplitude
+		}
+	}
+}
@@ -0,0 +1,370 @@
+//go:build discord
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"RealtimeDialog/pcm"
+	"github.com/bwmarrin/discordgo"
+	"github.com/golang/glog"
+	"golang.org/x/sync/errgroup"
+	"layeh.com/gopus"
+)
+
+// Discord 语音固定为 48kHz 双声道 Opus，每帧 20ms。
+const (
+	discordSampleRate   = 48000
+	discordChannels     = 2
+	discordFrameSize    = 960  // 20ms at 48 kHz
+	discordMaxFrameSize = 5760 // 120ms, the longest Opus frame
+)
+
+var (
+	discordToken   = flag.String("discord-token", "", "Discord bot token, overrides DISCORD_TOKEN")
+	discordGuild   = flag.String("discord-guild", "", "ID of the Discord guild to join")
+	discordChannel = flag.String("discord-channel", "", "ID of the Discord voice channel to join")
+	discordIdle    = flag.Duration("discord-idle", 30*time.Second, "finish the session of a Discord speaker after this long without speech")
+)
+
+func init() {
+	commands["discord"] = runDiscord
+}
+
+// runDiscord implements the `discord` subcommand: it joins a voice channel,
+// runs one dialog per speaker on its own connection, and plays the replies of
+// all dialogs back into the channel.
+func runDiscord(ctx context.Context, cfg *Config) error {
+	token := *discordToken
+	if token == "" {
+		token = os.Getenv("DISCORD_TOKEN")
+	}
+	if token == "" || *discordGuild == "" || *discordChannel == "" {
+		return errors.New("-discord-token (or DISCORD_TOKEN), -discord-guild and -discord-channel are required")
+	}
+
+	s, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return fmt.Errorf("create discord session: %w", err)
+	}
+	s.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildVoiceStates
+	if err := s.Open(); err != nil {
+		return fmt.Errorf("open discord session: %w", err)
+	}
+	defer s.Close()
+
+	vc, err := s.ChannelVoiceJoin(*discordGuild, *discordChannel, false, false)
+	if err != nil {
+		return fmt.Errorf("join voice channel %s: %w", *discordChannel, err)
+	}
+	defer func() {
+		if err := vc.Disconnect(); err != nil {
+			glog.Errorf("Failed to leave voice channel: %v", err)
+		}
+	}()
+	glog.V(vEvent).Infof("Joined Discord voice channel %s", *discordChannel)
+
+	enc, err := gopus.NewEncoder(discordSampleRate, discordChannels, gopus.Voip)
+	if err != nil {
+		return fmt.Errorf("create opus encoder: %w", err)
+	}
+	b := &discordBridge{
+		ctx:      ctx,
+		cfg:      cfg,
+		vc:       vc,
+		users:    make(map[uint32]string),
+		speakers: make(map[uint32]*discordSpeaker),
+		voices:   make(map[*discordSpeaker]struct{}),
+	}
+	vc.AddHandler(b.onSpeakingUpdate)
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return b.listen(gctx)
+	})
+	g.Go(func() error {
+		return b.play(gctx, enc)
+	})
+	err = g.Wait()
+	b.wg.Wait()
+	return err
+}
+
+// discordBridge maps the speakers of a voice channel to dialogs. Speakers are
+// identified by the SSRC of their audio stream; the user behind an SSRC is
+// learned from the speaking updates.
+type discordBridge struct {
+	ctx context.Context
+	cfg *Config
+	vc  *discordgo.VoiceConnection
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	users    map[uint32]string            // SSRC -> user ID
+	speakers map[uint32]*discordSpeaker   // speakers with a running dialog
+	voices   map[*discordSpeaker]struct{} // speakers whose replies are being played
+}
+
+func (b *discordBridge) onSpeakingUpdate(_ *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users[uint32(vs.SSRC)] = vs.UserID
+}
+
+// userOf returns the user ID behind ssrc, or the SSRC if it is not known yet.
+func (b *discordBridge) userOf(ssrc uint32) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if user, ok := b.users[ssrc]; ok {
+		return user
+	}
+	return fmt.Sprintf("ssrc:%d", ssrc)
+}
+
+// listen forwards the received Opus packets to their speakers, starting a
+// dialog for new speakers.
+func (b *discordBridge) listen(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pkt, ok := <-b.vc.OpusRecv:
+			if !ok {
+				return errors.New("discord voice connection closed")
+			}
+			if err := b.dispatch(pkt); err != nil {
+				glog.Errorf("Discord speaker %d: %v", pkt.SSRC, err)
+			}
+		}
+	}
+}
+
+func (b *discordBridge) dispatch(pkt *discordgo.Packet) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sp := b.speakers[pkt.SSRC]
+	if sp == nil {
+		var err error
+		if sp, err = newDiscordSpeaker(b, pkt.SSRC); err != nil {
+			return err
+		}
+		b.speakers[pkt.SSRC] = sp
+		b.voices[sp] = struct{}{}
+		b.wg.Add(1)
+		go sp.run()
+	}
+	select {
+	case sp.opus <- pkt.Opus:
+	default:
+		glog.V(vFrame).Infof("Drop Opus packet of speaker %d: queue full", pkt.SSRC)
+	}
+	return nil
+}
+
+// play mixes the replies of all speakers into 20ms Opus frames and sends them
+// to the voice channel.
+func (b *discordBridge) play(ctx context.Context, enc *gopus.Encoder) error {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	speaking := false
+	for {
+		frame, ok := b.mix()
+		if ok != speaking {
+			if err := b.vc.Speaking(ok); err != nil {
+				glog.Errorf("Failed to set speaking state: %v", err)
+			}
+			speaking = ok
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			continue
+		}
+		packet, err := enc.Encode(frame, discordFrameSize, len(frame)*2)
+		if err != nil {
+			return fmt.Errorf("encode opus: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case b.vc.OpusSend <- packet:
+		}
+	}
+}
+
+// mix takes the next frame of pending reply audio from every speaker and sums
+// them. It reports false when no speaker has audio to play.
+func (b *discordBridge) mix() ([]int16, bool) {
+	sum := make([]int32, discordFrameSize*discordChannels)
+	playing := false
+	b.mu.Lock()
+	for sp := range b.voices {
+		sp.mu.Lock()
+		n := min(len(sp.pending), len(sum))
+		for i := 0; i < n; i++ {
+			sum[i] += int32(sp.pending[i])
+		}
+		sp.pending = sp.pending[n:]
+		if n > 0 {
+			playing = true
+		} else if sp.done.Load() {
+			delete(b.voices, sp)
+		}
+		sp.mu.Unlock()
+	}
+	b.mu.Unlock()
+	if !playing {
+		return nil, false
+	}
+	frame := make([]int16, len(sum))
+	for i, v := range sum {
+		frame[i] = int16(max(min(v, 32767), -32768))
+	}
+	return frame, true
+}
+
+// discordSpeaker runs the dialog of one speaker. It is the handler of the
+// dialog, queueing the bot audio for the mixer.
+type discordSpeaker struct {
+	NopHandler
+	bridge *discordBridge
+	ssrc   uint32
+	opus   chan []byte
+	dec    *gopus.Decoder
+	in     *resampler // 48 kHz -> input rate
+	out    *resampler // output rate -> 48 kHz
+	done   atomic.Bool
+
+	mu      sync.Mutex
+	pending []int16 // 48 kHz stereo reply audio not played yet
+}
+
+func newDiscordSpeaker(b *discordBridge, ssrc uint32) (*discordSpeaker, error) {
+	dec, err := gopus.NewDecoder(discordSampleRate, discordChannels)
+	if err != nil {
+		return nil, fmt.Errorf("create opus decoder: %w", err)
+	}
+	return &discordSpeaker{
+		bridge: b,
+		ssrc:   ssrc,
+		opus:   make(chan []byte, 50),
+		dec:    dec,
+		in:     newResampler(discordSampleRate, audioSettings.InputSampleRate, audioSettings.InputChannels),
+		out:    newResampler(audioSettings.OutputSampleRate, discordSampleRate, audioSettings.OutputChannels),
+	}, nil
+}
+
+func (sp *discordSpeaker) run() {
+	defer sp.bridge.wg.Done()
+	defer sp.done.Store(true)
+	audio := make(chan []byte, 50)
+	go sp.decode(audio)
+	glog.V(vEvent).Infof("Discord user %s started speaking, starting a dialog", sp.bridge.userOf(sp.ssrc))
+	if err := sp.converse(chanSource(audio)); err != nil {
+		glog.Errorf("Dialog of Discord user %s: %v", sp.bridge.userOf(sp.ssrc), err)
+		return
+	}
+	glog.V(vEvent).Infof("Dialog of Discord user %s finished", sp.bridge.userOf(sp.ssrc))
+}
+
+// converse runs a single session on a connection of its own.
+func (sp *discordSpeaker) converse(src AudioSource) error {
+	ctx := sp.bridge.ctx
+	conn, _, err := dialDialog(ctx, sp.bridge.cfg)
+	if err != nil {
+		return fmt.Errorf("websocket dial: %w", err)
+	}
+	defer conn.Close()
+	if err := startConnection(conn); err != nil {
+		return fmt.Errorf("start connection: %w", err)
+	}
+	if err := runSession(ctx, conn, SessionInfo{ID: NewSessionID(), Seq: 1}, sp, src); err != nil {
+		return err
+	}
+	return finishConnection(conn)
+}
+
+// decode decodes the Opus packets of the speaker into uplink audio. After
+// -discord-idle without packets it closes audio, which finishes the session;
+// the next packet of the speaker starts a new one.
+func (sp *discordSpeaker) decode(audio chan<- []byte) {
+	defer close(audio)
+	idle := time.NewTimer(*discordIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case <-sp.bridge.ctx.Done():
+			return
+		case <-idle.C:
+			b := sp.bridge
+			b.mu.Lock()
+			// 计时器触发时可能恰好有新的数据包到达
+			if len(sp.opus) > 0 {
+				b.mu.Unlock()
+				idle.Reset(*discordIdle)
+				continue
+			}
+			delete(b.speakers, sp.ssrc)
+			b.mu.Unlock()
+			return
+		case data := <-sp.opus:
+			idle.Reset(*discordIdle)
+			samples, err := sp.dec.Decode(data, discordMaxFrameSize, false)
+			if err != nil {
+				glog.V(vFrame).Infof("Decode Opus packet of speaker %d: %v", sp.ssrc, err)
+				continue
+			}
+			if audioSettings.InputChannels == 1 {
+				samples = pcm.Downmix(samples, 2)
+			}
+			select {
+			case audio <- pcm.Int16ToBytes(sp.in.Process(samples)):
+			default:
+				glog.V(vFrame).Infof("Drop audio of speaker %d: session is not keeping up", sp.ssrc)
+			}
+		}
+	}
+}
+
+// OnASRStart drops the reply being played: the user interrupted the bot.
+func (sp *discordSpeaker) OnASRStart(ASRInfoPayload) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.pending = sp.pending[:0]
+}
+
+func (sp *discordSpeaker) OnASRFinal(result ASRResult) {
+	glog.V(vEvent).Infof("Discord user %s: %s", sp.bridge.userOf(sp.ssrc), redactText(result.Text))
+}
+
+func (sp *discordSpeaker) OnBotSentenceStart(sentence TTSSentencePayload) {
+	glog.V(vEvent).Infof("Bot to %s: %s", sp.bridge.userOf(sp.ssrc), redactText(sentence.Text))
+}
+
+func (sp *discordSpeaker) OnAudioChunk(data []byte) {
+	samples := sp.out.Process(pcm.Float32ToInt16(decodeOutputAudio(data)))
+	if audioSettings.OutputChannels == 1 {
+		stereo := make([]int16, len(samples)*2)
+		for i, s := range samples {
+			stereo[i*2], stereo[i*2+1] = s, s
+		}
+		samples = stereo
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.pending = append(sp.pending, samples...)
+}
+
+func (sp *discordSpeaker) OnError(err error) {
+	glog.Errorf("Dialog of Discord user %s: %v", sp.bridge.userOf(sp.ssrc), err)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"RealtimeDialog/dialog"
+)
+
+// Handler receives the semantic events decoded from server messages while a
+// session is running.
+type Handler interface {
+	// OnSessionStart is called once the server has started a session.
+	OnSessionStart(session SessionInfo)
+	// OnASRStart is called when the server detects the user starts speaking.
+	OnASRStart(info ASRInfoPayload)
+	// OnASRPartial is called with the interim recognition result of the
+	// utterance the user is currently speaking.
+	OnASRPartial(result ASRResult)
+	// OnASRFinal is called once an utterance is completely recognized.
+	OnASRFinal(result ASRResult)
+	// OnASREnd is called when the server detects the user stops speaking.
+	OnASREnd()
+	// OnBotText is called with each streamed chunk of the bot reply text.
+	OnBotText(text string)
+	// OnBotTextEnd is called when the bot reply text is complete.
+	OnBotTextEnd()
+	// OnBotSentenceStart is called when the bot starts speaking a sentence.
+	OnBotSentenceStart(sentence TTSSentencePayload)
+	// OnBotSentenceEnd is called when the bot finishes speaking a sentence.
+	OnBotSentenceEnd(sentence TTSSentencePayload)
+	// OnBotSpeechEnd is called when the bot has finished speaking its reply
+	// (TTSEnded); all audio of the reply has been received.
+	OnBotSpeechEnd()
+	// OnToolCall is called when the bot requests a tool to be invoked.
+	OnToolCall(call ToolCall)
+	// OnUsage is called with the usage reported by the server for the current
+	// session.
+	OnUsage(usage Usage)
+	// OnAudioChunk is called with every chunk of bot audio received. data
+	// is reused once the call returns: handlers keeping it copy it.
+	OnAudioChunk(data []byte)
+	// OnError is called when the server sends an Error message or a message
+	// the client cannot handle. The session ends after the call.
+	OnError(err error)
+	// OnSessionEnd is called when the server finishes (SessionFinished) or
+	// fails (SessionFailed) the session, with the raw event payload.
+	OnSessionEnd(event int32, payload []byte)
+}
+
+// NopHandler implements Handler with methods that do nothing. Embed it to
+// implement only the callbacks of interest.
+type NopHandler struct{}
+
+func (NopHandler) OnSessionStart(SessionInfo)            {}
+func (NopHandler) OnASRStart(ASRInfoPayload)             {}
+func (NopHandler) OnASRPartial(ASRResult)                {}
+func (NopHandler) OnASRFinal(ASRResult)                  {}
+func (NopHandler) OnASREnd()                             {}
+func (NopHandler) OnBotText(string)                      {}
+func (NopHandler) OnBotTextEnd()                         {}
+func (NopHandler) OnBotSentenceStart(TTSSentencePayload) {}
+func (NopHandler) OnBotSentenceEnd(TTSSentencePayload)   {}
+func (NopHandler) OnBotSpeechEnd()                       {}
+func (NopHandler) OnToolCall(ToolCall)                   {}
+func (NopHandler) OnUsage(Usage)                         {}
+func (NopHandler) OnAudioChunk([]byte)                   {}
+func (NopHandler) OnError(error)                         {}
+func (NopHandler) OnSessionEnd(int32, []byte)            {}
+
+// multiHandler fans every event out to all of its handlers in order.
+type multiHandler []Handler
+
+func (hs multiHandler) OnSessionStart(session SessionInfo) {
+	for _, h := range hs {
+		h.OnSessionStart(session)
+	}
+}
+
+func (hs multiHandler) OnASRStart(info ASRInfoPayload) {
+	for _, h := range hs {
+		h.OnASRStart(info)
+	}
+}
+
+func (hs multiHandler) OnASRPartial(result ASRResult) {
+	for _, h := range hs {
+		h.OnASRPartial(result)
+	}
+}
+
+func (hs multiHandler) OnASRFinal(result ASRResult) {
+	for _, h := range hs {
+		h.OnASRFinal(result)
+	}
+}
+
+func (hs multiHandler) OnASREnd() {
+	for _, h := range hs {
+		h.OnASREnd()
+	}
+}
+
+func (hs multiHandler) OnBotText(text string) {
+	for _, h := range hs {
+		h.OnBotText(text)
+	}
+}
+
+func (hs multiHandler) OnBotTextEnd() {
+	for _, h := range hs {
+		h.OnBotTextEnd()
+	}
+}
+
+func (hs multiHandler) OnBotSentenceStart(sentence TTSSentencePayload) {
+	for _, h := range hs {
+		h.OnBotSentenceStart(sentence)
+	}
+}
+
+func (hs multiHandler) OnBotSentenceEnd(sentence TTSSentencePayload) {
+	for _, h := range hs {
+		h.OnBotSentenceEnd(sentence)
+	}
+}
+
+func (hs multiHandler) OnBotSpeechEnd() {
+	for _, h := range hs {
+		h.OnBotSpeechEnd()
+	}
+}
+
+func (hs multiHandler) OnToolCall(call ToolCall) {
+	for _, h := range hs {
+		h.OnToolCall(call)
+	}
+}
+
+func (hs multiHandler) OnUsage(usage Usage) {
+	for _, h := range hs {
+		h.OnUsage(usage)
+	}
+}
+
+func (hs multiHandler) OnAudioChunk(data []byte) {
+	for _, h := range hs {
+		h.OnAudioChunk(data)
+	}
+}
+
+func (hs multiHandler) OnError(err error) {
+	for _, h := range hs {
+		h.OnError(err)
+	}
+}
+
+func (hs multiHandler) OnSessionEnd(event int32, payload []byte) {
+	for _, h := range hs {
+		h.OnSessionEnd(event, payload)
+	}
+}
+
+// dispatchServerEvent decodes the payload of a FullServer message and delivers
+// it to the matching Handler callback. Events without a callback are ignored.
+// The tool calls of any event go to OnToolCall first.
+func dispatchServerEvent(h Handler, msg *dialog.Message) error {
+	if err := dispatchToolCalls(h, msg); err != nil {
+		return err
+	}
+	switch msg.Event {
+	case dialog.EventASRInfo:
+		var payload ASRInfoPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			return fmt.Errorf("unmarshal ASRInfo payload: %w", err)
+		}
+		h.OnASRStart(payload)
+	case dialog.EventASRResponse:
+		var payload ASRResponsePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			return fmt.Errorf("unmarshal ASRResponse payload: %w", err)
+		}
+		for _, result := range payload.Results {
+			result, ok := filterASRResult(result)
+			if !ok {
+				continue
+			}
+			if result.Definite() {
+				h.OnASRFinal(result)
+			} else {
+				h.OnASRPartial(result)
+			}
+		}
+	case dialog.EventASREnded:
+		h.OnASREnd()
+	case dialog.EventChatResponse:
+		var payload ChatResponsePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			return fmt.Errorf("unmarshal ChatResponse payload: %w", err)
+		}
+		h.OnBotText(payload.Content)
+	case dialog.EventChatEnded:
+		h.OnBotTextEnd()
+	case dialog.EventTTSSentenceStart, dialog.EventTTSSentenceEnd:
+		var payload TTSSentencePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			return fmt.Errorf("unmarshal TTSSentence payload: %w", err)
+		}
+		if msg.Event == dialog.EventTTSSentenceStart {
+			h.OnBotSentenceStart(payload)
+		} else {
+			h.OnBotSentenceEnd(payload)
+		}
+	case dialog.EventTTSEnded:
+		h.OnBotSpeechEnd()
+	case dialog.EventUsageResponse:
+		var payload UsagePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			return fmt.Errorf("unmarshal UsageResponse payload: %w", err)
+		}
+		h.OnUsage(payload.Usage)
+	case dialog.EventSessionFinished, dialog.EventSessionFailed:
+		h.OnSessionEnd(msg.Event, msg.Payload)
+	}
+	return nil
+}
+
+// dispatchToolCalls delivers the tool calls carried by the payload of any
+// event, such as ChatResponse, to the handler.
+func dispatchToolCalls(h Handler, msg *dialog.Message) error {
+	if !bytes.Contains(msg.Payload, []byte(`"tool_calls"`)) {
+		return nil
+	}
+	var payload ToolCallPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return fmt.Errorf("unmarshal tool calls of event %d: %w", msg.Event, err)
+	}
+	for _, call := range payload.ToolCalls {
+		h.OnToolCall(call)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"RealtimeDialog/dialog"
+)
+
+// FuzzDispatchServerEvent feeds arbitrary payloads of every server event to
+// the payload decoders.
+func FuzzDispatchServerEvent(f *testing.F) {
+	f.Add(dialog.EventASRInfo, []byte(`{"question_id":"q"}`))
+	f.Add(dialog.EventASRResponse, []byte(`{"results":[{"text":"你好","is_interim":true}]}`))
+	f.Add(dialog.EventChatResponse, []byte(`{"content":"hi"}`))
+	f.Add(dialog.EventTTSSentenceStart, []byte(`{"text":"hi"}`))
+	f.Add(dialog.EventUsageResponse, []byte(`{"usage":{"input_text_tokens":1}}`))
+	f.Add(dialog.EventSessionFailed, []byte(`{"error":"x"}`))
+	f.Add(int32(550), []byte(`{"tool_calls":[{"id":"1","function":{"name":"f","arguments":"{}"}}]}`))
+	f.Add(dialog.EventASRResponse, []byte(nil))
+
+	f.Fuzz(func(t *testing.T, event int32, payload []byte) {
+		msg := &dialog.Message{Type: dialog.MsgTypeFullServer, Event: event, Payload: payload}
+		_ = dispatchServerEvent(NopHandler{}, msg)
+		_ = dispatchServerEvent(newJSONEmitter(io.Discard), msg)
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"RealtimeDialog/dialog"
+	"github.com/golang/glog"
+)
+
+// 协议测试语料：生成覆盖所有消息类型、标志位、序列化与压缩方式组合的合法帧，
+// 以及刻意构造的畸形帧，保存为 golden 文件；verify 重新编码并解码这些帧，与
+// golden 文件比较，用于在重构 Marshal/Unmarshal 时锁定其行为。
+
+const fixtureManifest = "manifest.json"
+
+func init() {
+	commands["fixtures"] = runFixtures
+}
+
+// fixtureCase is an entry of the manifest of a fixture corpus.
+type fixtureCase struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Input is the message marshaled to File, absent for malformed frames.
+	Input *fixtureMessage `json:"input,omitempty"`
+	// Decoded is the result of unmarshaling File, or Error the error.
+	Decoded *fixtureMessage `json:"decoded,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// fixtureMessage describes a Message and the protocol it is marshaled with.
+type fixtureMessage struct {
+	Type          dialog.MsgType           `json:"type"`
+	Flag          dialog.MsgTypeFlagBits   `json:"flag"`
+	Serialization dialog.SerializationBits `json:"serialization"`
+	Compression   dialog.CompressionBits   `json:"compression"`
+	Event         int32                    `json:"event,omitempty"`
+	SessionID     string                   `json:"session_id,omitempty"`
+	ConnectID     string                   `json:"connect_id,omitempty"`
+	Sequence      int32                    `json:"sequence,omitempty"`
+	ErrorCode     uint32                   `json:"error_code,omitempty"`
+	Payload       []byte                   `json:"payload,omitempty"`
+}
+
+// runFixtures implements the `fixtures gen|verify [dir]` subcommand.
+func runFixtures(ctx context.Context, cfg *Config) error {
+	dir := flag.Arg(2)
+	if dir == "" {
+		dir = filepath.Join("testdata", "protocol")
+	}
+	switch flag.Arg(1) {
+	case "gen":
+		return generateFixtures(dir)
+	case "verify":
+		return verifyFixtures(dir)
+	}
+	return errors.New("usage: fixtures gen|verify [directory]")
+}
+
+var (
+	fixtureTypes = []struct {
+		name string
+		typ  dialog.MsgType
+	}{
+		{"full-client", dialog.MsgTypeFullClient},
+		{"audio-client", dialog.MsgTypeAudioOnlyClient},
+		{"full-server", dialog.MsgTypeFullServer},
+		{"audio-server", dialog.MsgTypeAudioOnlyServer},
+		{"frontend-server", dialog.MsgTypeFrontEndResultServer},
+		{"error", dialog.MsgTypeError},
+	}
+	fixtureSerializations = []struct {
+		name string
+		bits dialog.SerializationBits
+	}{
+		{"raw", dialog.SerializationRaw},
+		{"json", dialog.SerializationJSON},
+		{"thrift", dialog.SerializationThrift},
+		{"custom", dialog.SerializationCustom},
+	}
+	fixtureCompressions = []struct {
+		name string
+		bits dialog.CompressionBits
+	}{
+		{"none", dialog.CompressionNone},
+		{"gzip", dialog.CompressionGzip},
+		{"custom", dialog.CompressionCustom},
+	}
+)
+
+// validFixtures returns a message for every combination of message type,
+// flag, serialization and compression, and for the events whose frames
+// differ from the others.
+func validFixtures() map[string]*fixtureMessage {
+	payloads := map[dialog.SerializationBits][]byte{
+		dialog.SerializationRaw:    {0x00, 0x01, 0x7F, 0x80, 0xFE, 0xFF},
+		dialog.SerializationJSON:   []byte(`{"content":"你好"}`),
+		dialog.SerializationThrift: {0x0B, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 'h', 'i', 0x00},
+		dialog.SerializationCustom: []byte("custom payload"),
+	}
+	fixtures := map[string]*fixtureMessage{}
+	for _, t := range fixtureTypes {
+		for flag := dialog.MsgTypeFlagBits(0); flag <= 0b111; flag++ {
+			for _, s := range fixtureSerializations {
+				for _, c := range fixtureCompressions {
+					m := &fixtureMessage{
+						Type:          t.typ,
+						Flag:          flag,
+						Serialization: s.bits,
+						Compression:   c.bits,
+						Payload:       payloads[s.bits],
+					}
+					if dialog.ContainsSequence(flag) {
+						m.Sequence = 7
+						if flag&dialog.MsgTypeFlagNegativeSeq == dialog.MsgTypeFlagNegativeSeq {
+							m.Sequence = -7
+						}
+					}
+					if dialog.ContainsEvent(flag) {
+						m.Event = 100
+						m.SessionID = "fixture-session"
+					}
+					fixtures[fmt.Sprintf("%s-flag%03b-%s-%s", t.name, flag, s.name, c.name)] = m
+				}
+			}
+		}
+		// 连接级事件不带会话 ID，事件 50~52 在解码时还会读取连接 ID
+		for _, event := range []int32{1, 2, 50, 51, 52, 152} {
+			fixtures[fmt.Sprintf("%s-event%d", t.name, event)] = &fixtureMessage{
+				Type:          t.typ,
+				Flag:          dialog.MsgTypeFlagWithEvent,
+				Serialization: dialog.SerializationJSON,
+				Compression:   dialog.CompressionNone,
+				Event:         event,
+				SessionID:     "fixture-session",
+				Payload:       []byte("{}"),
+			}
+		}
+	}
+	return fixtures
+}
+
+// malformedFixtures returns frames that Unmarshal must reject, or that
+// lock down how it handles inconsistent lengths.
+func malformedFixtures() map[string][]byte {
+	return map[string][]byte{
+		"malformed-empty":                   {},
+		"malformed-no-type":                 {0x11},
+		"malformed-no-serialization":        {0x11, 0x10},
+		"malformed-invalid-type":            {0x11, 0x30, 0x10, 0x00, 0, 0, 0, 0},
+		"malformed-invalid-serialization":   {0x11, 0x10, 0x20, 0x00, 0, 0, 0, 0},
+		"malformed-invalid-compression":     {0x11, 0x10, 0x12, 0x00, 0, 0, 0, 0},
+		"malformed-short-header-padding":    {0x12, 0x10, 0x10, 0x00, 0, 0},
+		"malformed-no-payload-size":         {0x11, 0x10, 0x10, 0x00},
+		"malformed-short-payload-size":      {0x11, 0x10, 0x10, 0x00, 0, 0},
+		"malformed-short-payload":           {0x11, 0x10, 0x10, 0x00, 0, 0, 0, 8, '{', '}'},
+		"malformed-redundant-bytes":         {0x11, 0x10, 0x10, 0x00, 0, 0, 0, 2, '{', '}', 0xFF},
+		"malformed-short-sequence":          {0x11, 0x21, 0x00, 0x00, 0, 0},
+		"malformed-no-error-code":           {0x11, 0xF0, 0x10, 0x00},
+		"malformed-short-event":             {0x11, 0x94, 0x10, 0x00, 0, 0},
+		"malformed-no-session-id-size":      {0x11, 0x94, 0x10, 0x00, 0, 0, 0, 100},
+		"malformed-short-session-id":        {0x11, 0x94, 0x10, 0x00, 0, 0, 0, 100, 0, 0, 0, 9, 'a', 'b'},
+		"malformed-no-connect-id-size":      {0x11, 0x94, 0x10, 0x00, 0, 0, 0, 50},
+		"malformed-huge-payload-size":       {0x11, 0x10, 0x10, 0x00, 0xFF, 0xFF, 0xFF, 0xFF},
+		"malformed-huge-session-id-size":    {0x11, 0x94, 0x10, 0x00, 0, 0, 0, 100, 0xFF, 0xFF, 0xFF, 0xFF},
+		"malformed-server-ack-no-sequence":  {0x11, 0xB1, 0x00, 0x00, 0, 0, 0, 0},
+		"malformed-client-audio-no-payload": {0x11, 0x20, 0x00, 0x00},
+	}
+}
+
+// fixtureGzip compresses without deflate, so that the golden frames do not
+// depend on the deflate implementation.
+func fixtureGzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// marshalFixture marshals the message as described.
+func marshalFixture(m *fixtureMessage) ([]byte, error) {
+	msg, err := dialog.NewMessage(m.Type, m.Flag)
+	if err != nil {
+		return nil, err
+	}
+	msg.Event = m.Event
+	msg.SessionID = m.SessionID
+	msg.ConnectID = m.ConnectID
+	msg.Sequence = m.Sequence
+	msg.ErrorCode = m.ErrorCode
+	msg.Payload = bytes.Clone(m.Payload)
+
+	p := dialog.NewBinaryProtocol()
+	p.SetVersion(dialog.Version1)
+	p.SetHeaderSize(dialog.HeaderSize4)
+	p.SetSerialization(m.Serialization)
+	switch m.Compression {
+	case dialog.CompressionGzip:
+		p.SetCompression(m.Compression, fixtureGzip)
+	default:
+		p.SetCompression(m.Compression, nil)
+	}
+	return p.Marshal(msg)
+}
+
+// decodeFixture unmarshals a frame into the fields and error of a case.
+func decodeFixture(data []byte) (*fixtureMessage, string) {
+	msg, prot, err := dialog.Unmarshal(data, dialog.ContainsSequence)
+	if err != nil {
+		return nil, err.Error()
+	}
+	return &fixtureMessage{
+		Type:          msg.Type,
+		Flag:          msg.TypeFlag(),
+		Serialization: prot.Serialization(),
+		Compression:   prot.Compression(),
+		Event:         msg.Event,
+		SessionID:     msg.SessionID,
+		ConnectID:     msg.ConnectID,
+		Sequence:      msg.Sequence,
+		ErrorCode:     msg.ErrorCode,
+		Payload:       msg.Payload,
+	}, ""
+}
+
+// generateFixtures writes the corpus and its manifest to dir.
+func generateFixtures(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var cases []fixtureCase
+	frames := map[string][]byte{}
+	for name, m := range validFixtures() {
+		data, err := marshalFixture(m)
+		if err != nil {
+			return fmt.Errorf("marshal %s: %w", name, err)
+		}
+		frames[name] = data
+		cases = append(cases, fixtureCase{Name: name, Input: m})
+	}
+	for name, data := range malformedFixtures() {
+		frames[name] = data
+		cases = append(cases, fixtureCase{Name: name})
+	}
+	slices.SortFunc(cases, func(a, b fixtureCase) int { return strings.Compare(a.Name, b.Name) })
+	for i := range cases {
+		c := &cases[i]
+		c.File = c.Name + ".bin"
+		c.Decoded, c.Error = decodeFixture(frames[c.Name])
+		if err := writeFileAtomic(filepath.Join(dir, c.File), frames[c.Name], 0o644); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(cases, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, fixtureManifest), append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	glog.V(vEvent).Infof("Wrote %d protocol fixtures to %s", len(cases), dir)
+	return nil
+}
+
+// verifyFixtures checks the current Marshal and Unmarshal against the
+// corpus in dir.
+func verifyFixtures(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, fixtureManifest))
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	var cases []fixtureCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return fmt.Errorf("parse manifest: %w", err)
+	}
+	failed := 0
+	for _, c := range cases {
+		if err := verifyFixture(dir, c); err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d fixtures failed", failed, len(cases))
+	}
+	fmt.Printf("ok %d fixtures\n", len(cases))
+	return nil
+}
+
+func verifyFixture(dir string, c fixtureCase) error {
+	frame, err := os.ReadFile(filepath.Join(dir, c.File))
+	if err != nil {
+		return err
+	}
+	if c.Input != nil {
+		data, err := marshalFixture(c.Input)
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		if !bytes.Equal(data, frame) {
+			return fmt.Errorf("marshaled % x, want % x", data, frame)
+		}
+	}
+	decoded, errText := decodeFixture(frame)
+	if errText != c.Error {
+		return fmt.Errorf("unmarshal error %q, want %q", errText, c.Error)
+	}
+	got, _ := json.Marshal(decoded)
+	want, _ := json.Marshal(c.Decoded)
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("unmarshaled %s, want %s", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"RealtimeDialog/pcm"
+)
+
+// 精简的 FLAC 编码器：16 位样本，固定块大小，各声道独立编码，每个子帧在固定
+// 预测器（0~4 阶）与原样存储中择优，残差采用单分区 Rice 编码。压缩率不及
+// libFLAC，但无需 cgo，语音通常可压缩到 PCM 的一半左右。
+
+const (
+	flacBlockSize     = 4096
+	flacMaxRiceParam  = 14
+	flacStreamInfoLen = 34
+)
+
+// flacWriter encodes interleaved 16-bit samples to a FLAC stream. The
+// STREAMINFO block is completed by Close if w is seekable; otherwise, as for
+// an encrypted file, it leaves the total samples, frame sizes and MD5
+// unknown.
+type flacWriter struct {
+	w        io.Writer
+	rate     int
+	channels int
+
+	pending   []int16 // interleaved samples of the next frame
+	frames    uint64
+	total     uint64
+	minFrame  int
+	maxFrame  int
+	lastBlock int
+	md5       hash.Hash
+}
+
+func newFLACWriter(w io.Writer, rate, channels int) (*flacWriter, error) {
+	if channels < 1 || channels > 8 {
+		return nil, fmt.Errorf("FLAC does not support %d channels", channels)
+	}
+	f := &flacWriter{w: w, rate: rate, channels: channels, md5: md5.New()}
+	// 先写入占位的 STREAMINFO，关闭时回填
+	if _, err := w.Write(append([]byte("fLaC"), f.streamInfo()...)); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write encodes interleaved samples, a frame at a time.
+func (f *flacWriter) Write(samples []int16) error {
+	_, _ = f.md5.Write(pcm.Int16ToBytes(samples))
+	f.pending = append(f.pending, samples...)
+	frame := flacBlockSize * f.channels
+	for len(f.pending) >= frame {
+		if err := f.writeFrame(f.pending[:frame]); err != nil {
+			return err
+		}
+		f.pending = f.pending[frame:]
+	}
+	return nil
+}
+
+// Close encodes the pending samples and completes the STREAMINFO block. It
+// does not close the underlying writer.
+func (f *flacWriter) Close() error {
+	if n := len(f.pending) / f.channels; n > 0 {
+		if err := f.writeFrame(f.pending[:n*f.channels]); err != nil {
+			return err
+		}
+		f.pending = nil
+	}
+	ws, ok := f.w.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := ws.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ws.Write(f.streamInfo()); err != nil {
+		return err
+	}
+	_, err = ws.Seek(end, io.SeekStart)
+	return err
+}
+
+// streamInfo returns the STREAMINFO metadata block, marked as the last one.
+func (f *flacWriter) streamInfo() []byte {
+	minBlock, maxBlock := flacBlockSize, flacBlockSize
+	if f.frames == 1 {
+		// 只有一帧时最小与最大块大小即该帧大小
+		minBlock, maxBlock = f.lastBlock, f.lastBlock
+	}
+	var b bitWriter
+	b.write(1, 1) // last metadata block
+	b.write(0, 7) // STREAMINFO
+	b.write(flacStreamInfoLen, 24)
+	b.write(uint64(minBlock), 16)
+	b.write(uint64(maxBlock), 16)
+	b.write(uint64(f.minFrame), 24)
+	b.write(uint64(f.maxFrame), 24)
+	b.write(uint64(f.rate), 20)
+	b.write(uint64(f.channels-1), 3)
+	b.write(16-1, 5)
+	b.write(f.total, 36)
+	sum := make([]byte, md5.Size)
+	if f.frames > 0 {
+		sum = f.md5.Sum(nil)
+	}
+	return append(b.bytes(), sum...)
+}
+
+func (f *flacWriter) writeFrame(samples []int16) error {
+	n := len(samples) / f.channels
+	var b bitWriter
+	b.write(0xFFF8, 16)              // sync code, fixed block size
+	b.write(0x7, 4)                  // block size in 16 bits at the end of the header
+	b.write(0x0, 4)                  // sample rate from STREAMINFO
+	b.write(uint64(f.channels-1), 4) // independent channels
+	b.write(0x4, 3)                  // 16 bits per sample
+	b.write(0, 1)
+	b.writeUTF8(f.frames)
+	b.write(uint64(n-1), 16)
+	b.write(uint64(crc8(b.bytes())), 8)
+
+	channel := make([]int32, n)
+	for c := 0; c < f.channels; c++ {
+		for i := range channel {
+			channel[i] = int32(samples[i*f.channels+c])
+		}
+		encodeSubframe(&b, channel)
+	}
+	b.align()
+	frame := b.bytes()
+	frame = binary.BigEndian.AppendUint16(frame, crc16(frame))
+	if _, err := f.w.Write(frame); err != nil {
+		return err
+	}
+
+	if f.frames == 0 || len(frame) < f.minFrame {
+		f.minFrame = len(frame)
+	}
+	f.maxFrame = max(f.maxFrame, len(frame))
+	f.frames++
+	f.total += uint64(n)
+	f.lastBlock = n
+	return nil
+}
+
+// encodeSubframe encodes the samples of one channel with the smallest of the
+// constant, fixed and verbatim subframes.
+func encodeSubframe(b *bitWriter, samples []int32) {
+	constant := true
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		b.write(0, 8) // CONSTANT
+		b.write(uint64(uint16(samples[0])), 16)
+		return
+	}
+
+	bestOrder, bestParam, bestBits := -1, 0, len(samples)*16 // verbatim
+	var bestResidual []int64
+	for order := 0; order <= 4 && order < len(samples); order++ {
+		residual := fixedResidual(samples, order)
+		param, bits := riceParam(residual)
+		bits += order*16 + 2 + 4 + 4
+		if param <= flacMaxRiceParam && bits < bestBits {
+			bestOrder, bestParam, bestBits, bestResidual = order, param, bits, residual
+		}
+	}
+	if bestOrder < 0 {
+		b.write(1<<1, 8) // VERBATIM
+		for _, s := range samples {
+			b.write(uint64(uint16(s)), 16)
+		}
+		return
+	}
+	b.write(uint64(0x08|bestOrder)<<1, 8) // FIXED
+	for _, s := range samples[:bestOrder] {
+		b.write(uint64(uint16(s)), 16)
+	}
+	b.write(0, 2) // Rice coding with 4-bit parameters
+	b.write(0, 4) // a single partition
+	b.write(uint64(bestParam), 4)
+	for _, r := range bestResidual {
+		u := uint64(r<<1 ^ r>>63) // zigzag
+		b.writeUnary(u >> bestParam)
+		b.write(u&(1<<bestParam-1), uint(bestParam))
+	}
+}
+
+// fixedResidual returns the residual of the fixed predictor of the given
+// order, for the samples after the warm-up ones.
+func fixedResidual(x []int32, order int) []int64 {
+	r := make([]int64, 0, len(x)-order)
+	for i := order; i < len(x); i++ {
+		v := int64(x[i])
+		switch order {
+		case 1:
+			v -= int64(x[i-1])
+		case 2:
+			v -= 2*int64(x[i-1]) - int64(x[i-2])
+		case 3:
+			v -= 3*int64(x[i-1]) - 3*int64(x[i-2]) + int64(x[i-3])
+		case 4:
+			v -= 4*int64(x[i-1]) - 6*int64(x[i-2]) + 4*int64(x[i-3]) - int64(x[i-4])
+		}
+		r = append(r, v)
+	}
+	return r
+}
+
+// riceParam returns the Rice parameter coding residual in the fewest bits,
+// and that number of bits.
+func riceParam(residual []int64) (param, bits int) {
+	var sum uint64
+	for _, r := range residual {
+		sum += uint64(r<<1 ^ r>>63)
+	}
+	bits = math.MaxInt
+	for k := 0; k <= flacMaxRiceParam+1; k++ {
+		// 每个样本需要 k 位余数、1 位终止位，商按其和估算
+		n := len(residual)*(k+1) + int(sum>>k)
+		if n < bits {
+			param, bits = k, n
+		}
+	}
+	return param, bits
+}
+
+// bitWriter packs big-endian bit fields.
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) write(v uint64, n uint) {
+	for n > 0 {
+		take := min(n, 56-b.nbits)
+		n -= take
+		b.acc = b.acc<<take | (v>>n)&(1<<take-1)
+		b.nbits += take
+		for b.nbits >= 8 {
+			b.nbits -= 8
+			b.buf = append(b.buf, byte(b.acc>>b.nbits))
+		}
+	}
+}
+
+func (b *bitWriter) writeUnary(q uint64) {
+	for ; q >= 32; q -= 32 {
+		b.write(0, 32)
+	}
+	b.write(1, uint(q)+1)
+}
+
+// writeUTF8 writes v in the UTF-8-like coding of FLAC frame numbers.
+func (b *bitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		b.write(v, 8)
+		return
+	}
+	n := 2
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	b.write(uint64(0xFF00>>n)&0xFF|v>>(6*(n-1)), 8)
+	for i := n - 2; i >= 0; i-- {
+		b.write(0x80|(v>>(6*i))&0x3F, 8)
+	}
+}
+
+// align pads with zero bits to a byte boundary.
+func (b *bitWriter) align() {
+	if b.nbits > 0 {
+		b.write(0, 8-b.nbits)
+	}
+}
+
+// bytes returns the complete bytes written so far.
+func (b *bitWriter) bytes() []byte {
+	return b.buf
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, d := range data {
+		crc ^= d
+		for range 8 {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, d := range data {
+		crc ^= uint16(d) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
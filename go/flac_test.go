@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"unicode/utf8"
+
+	"RealtimeDialog/pcm"
+)
+
+// TestCRC checks the CRCs of the frames against the check values of
+// CRC-8 (poly 0x07) and CRC-16/BUYPASS (poly 0x8005).
+func TestCRC(t *testing.T) {
+	if got := crc8([]byte("123456789")); got != 0xF4 {
+		t.Errorf("crc8 = %#x, want 0xf4", got)
+	}
+	if got := crc16([]byte("123456789")); got != 0xFEE8 {
+		t.Errorf("crc16 = %#x, want 0xfee8", got)
+	}
+}
+
+// TestWriteUTF8 compares the coding of the frame numbers with UTF-8, which
+// it extends.
+func TestWriteUTF8(t *testing.T) {
+	for _, v := range []rune{0, 0x7F, 0x80, 0x7FF, 0x800, 0xFFFF, 0x10000, 0x10FFFF} {
+		var b bitWriter
+		b.writeUTF8(uint64(v))
+		if want := utf8.AppendRune(nil, v); !bytes.Equal(b.bytes(), want) {
+			t.Errorf("writeUTF8(%#x) = %x, want %x", v, b.bytes(), want)
+		}
+	}
+}
+
+// TestFLACRoundTrip encodes signals that select every subframe type and
+// decodes them back, checking STREAMINFO, the frame CRCs and the samples.
+func TestFLACRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, tc := range []struct {
+		name     string
+		channels int
+		frames   int
+		sample   func(i, ch int) int16
+	}{
+		{"silence", 1, flacBlockSize + 10, func(int, int) int16 { return 0 }},
+		{"constant", 2, 3000, func(_, ch int) int16 { return int16(ch*1000 - 500) }},
+		{"tone", 2, 3*flacBlockSize + 100, func(i, ch int) int16 {
+			return int16(8000*math.Sin(float64(i)*0.05+float64(ch)) + float64(rng.IntN(64)-32))
+		}},
+		{"noise", 1, flacBlockSize, func(int, int) int16 { return int16(rng.Uint32()) }},
+		{"extremes", 1, 1000, func(i, _ int) int16 { return []int16{math.MaxInt16, math.MinInt16}[i%2] }},
+		// 帧号超过 127 时使用多字节编码
+		{"many frames", 1, 130 * flacBlockSize, func(int, int) int16 { return int16(rng.IntN(16)) }},
+		{"single frame", 3, 5, func(i, ch int) int16 { return int16(i * ch) }},
+	} {
+		samples := make([]int16, tc.frames*tc.channels)
+		for i := range samples {
+			samples[i] = tc.sample(i/tc.channels, i%tc.channels)
+		}
+		path := filepath.Join(t.TempDir(), "test.flac")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := newFLACWriter(f, 16000, tc.channels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 分多次写入，不与帧边界对齐
+		for chunk := range slices.Chunk(samples, 1234*tc.channels) {
+			if err := w.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, decoded, err := decodeTestFLAC(data)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if info.rate != 16000 || info.channels != tc.channels || info.bits != 16 || info.total != uint64(tc.frames) {
+			t.Errorf("%s: STREAMINFO %+v", tc.name, info)
+		}
+		if info.md5 != md5.Sum(pcm.Int16ToBytes(samples)) {
+			t.Errorf("%s: STREAMINFO MD5 differs from the samples", tc.name)
+		}
+		if info.minFrame != info.decodedMinFrame || info.maxFrame != info.decodedMaxFrame {
+			t.Errorf("%s: frame sizes %d-%d, decoded %d-%d", tc.name, info.minFrame, info.maxFrame, info.decodedMinFrame, info.decodedMaxFrame)
+		}
+		if !slices.Equal(decoded, samples) {
+			t.Errorf("%s: decoded samples differ", tc.name)
+		}
+	}
+}
+
+type testFLACInfo struct {
+	minBlock, maxBlock               int
+	minFrame, maxFrame               int
+	decodedMinFrame, decodedMaxFrame int
+	rate, channels, bits             int
+	total                            uint64
+	md5                              [md5.Size]byte
+}
+
+// decodeTestFLAC decodes the subset of FLAC written by flacWriter, checking
+// the CRCs of the frames.
+func decodeTestFLAC(data []byte) (info testFLACInfo, samples []int16, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		return info, nil, errTestFLAC("no fLaC marker")
+	}
+	r := &testBitReader{data: data, pos: 32}
+	if last, typ, size := r.read(1), r.read(7), r.read(24); last != 1 || typ != 0 || size != flacStreamInfoLen {
+		return info, nil, errTestFLAC("not a single STREAMINFO block")
+	}
+	info.minBlock, info.maxBlock = int(r.read(16)), int(r.read(16))
+	info.minFrame, info.maxFrame = int(r.read(24)), int(r.read(24))
+	info.rate, info.channels, info.bits = int(r.read(20)), int(r.read(3))+1, int(r.read(5))+1
+	info.total = r.read(36)
+	copy(info.md5[:], data[r.pos/8:])
+	r.pos += md5.Size * 8
+
+	for frame := uint64(0); r.pos/8 < uint(len(data)); frame++ {
+		start := r.pos / 8
+		if r.read(15) != 0x7FFC || r.read(1) != 0 {
+			return info, nil, errTestFLAC("no frame sync code")
+		}
+		if r.read(4) != 7 || r.read(4) != 0 || int(r.read(4)) != info.channels-1 || r.read(3) != 4 || r.read(1) != 0 {
+			return info, nil, errTestFLAC("unexpected frame header")
+		}
+		if n := r.readUTF8(); n != frame {
+			return info, nil, errTestFLAC("frame number out of sequence")
+		}
+		n := int(r.read(16)) + 1
+		if crc := crc8(data[start : r.pos/8]); uint64(crc) != r.read(8) {
+			return info, nil, errTestFLAC("frame header CRC mismatch")
+		}
+		if n > info.maxBlock {
+			return info, nil, errTestFLAC("block size out of STREAMINFO range")
+		}
+		channels := make([][]int32, info.channels)
+		for c := range channels {
+			channels[c] = r.subframe(n)
+		}
+		r.align()
+		if crc := crc16(data[start : r.pos/8]); uint64(crc) != r.read(16) {
+			return info, nil, errTestFLAC("frame CRC mismatch")
+		}
+		size := int(r.pos/8 - start)
+		if frame == 0 || size < info.decodedMinFrame {
+			info.decodedMinFrame = size
+		}
+		info.decodedMaxFrame = max(info.decodedMaxFrame, size)
+		for i := range n {
+			for c := range channels {
+				samples = append(samples, int16(channels[c][i]))
+			}
+		}
+	}
+	return info, samples, nil
+}
+
+type errTestFLAC string
+
+func (e errTestFLAC) Error() string { return string(e) }
+
+// testBitReader reads big-endian bit fields, panicking past the end.
+type testBitReader struct {
+	data []byte
+	pos  uint // in bits
+}
+
+func (r *testBitReader) read(n uint) uint64 {
+	var v uint64
+	for range n {
+		if r.pos/8 >= uint(len(r.data)) {
+			panic(errTestFLAC("truncated"))
+		}
+		v = v<<1 | uint64(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *testBitReader) readSigned(n uint) int64 {
+	return int64(r.read(n)<<(64-n)) >> (64 - n)
+}
+
+func (r *testBitReader) readUnary() uint64 {
+	var q uint64
+	for r.read(1) == 0 {
+		q++
+	}
+	return q
+}
+
+func (r *testBitReader) readUTF8() uint64 {
+	first := r.read(8)
+	if first < 0x80 {
+		return first
+	}
+	n := 0
+	for first&(0x80>>n) != 0 {
+		n++
+	}
+	v := first & (0xFF >> (n + 1))
+	for range n - 1 {
+		v = v<<6 | r.read(8)&0x3F
+	}
+	return v
+}
+
+func (r *testBitReader) align() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+// subframe decodes the CONSTANT, VERBATIM and FIXED subframes of n samples.
+func (r *testBitReader) subframe(n int) []int32 {
+	if r.read(1) != 0 {
+		panic(errTestFLAC("subframe padding bit set"))
+	}
+	typ := r.read(6)
+	if r.read(1) != 0 {
+		panic(errTestFLAC("wasted bits"))
+	}
+	x := make([]int32, n)
+	switch {
+	case typ == 0:
+		v := int32(r.readSigned(16))
+		for i := range x {
+			x[i] = v
+		}
+	case typ == 1:
+		for i := range x {
+			x[i] = int32(r.readSigned(16))
+		}
+	case typ >= 8 && typ <= 12:
+		order := int(typ & 7)
+		for i := range order {
+			x[i] = int32(r.readSigned(16))
+		}
+		if r.read(2) != 0 {
+			panic(errTestFLAC("not a 4-bit Rice residual"))
+		}
+		partitions := 1 << r.read(4)
+		i := order
+		for p := range partitions {
+			param := uint(r.read(4))
+			if param == 15 {
+				panic(errTestFLAC("escaped partition"))
+			}
+			count := n / partitions
+			if p == 0 {
+				count -= order
+			}
+			for range count {
+				u := r.readUnary()<<param | r.read(param)
+				res := int64(u>>1) ^ -int64(u&1)
+				var pred int64
+				switch order {
+				case 1:
+					pred = int64(x[i-1])
+				case 2:
+					pred = 2*int64(x[i-1]) - int64(x[i-2])
+				case 3:
+					pred = 3*int64(x[i-1]) - 3*int64(x[i-2]) + int64(x[i-3])
+				case 4:
+					pred = 4*int64(x[i-1]) - 6*int64(x[i-2]) + 4*int64(x[i-3]) - int64(x[i-4])
+				}
+				x[i] = int32(pred + res)
+				i++
+			}
+		}
+	default:
+		panic(errTestFLAC("unexpected subframe type"))
+	}
+	return x
+}
@@ -0,0 +1,132 @@
+package main
+
+// G.711 编解码，几乎所有电话系统（SIP/RTP、呼叫中心）都以 8 kHz 单声道 G.711
+// 传输音频。算法参照 ITU-T G.711 与 Sun 的参考实现。
+
+// G.711 codecs, named as in SDP.
+const (
+	codecPCMU = "pcmu" // µ-law
+	codecPCMA = "pcma" // A-law
+)
+
+// g711Rate is the sample rate of G.711 audio.
+const g711Rate = 8000
+
+const (
+	ulawBias = 0x84
+	ulawClip = 8159
+)
+
+// segment ends of the µ-law and A-law encodings.
+var (
+	ulawSegEnd = [8]int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+	alawSegEnd = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+)
+
+// 解码查表，码字只有 256 个
+var ulawTable, alawTable [256]int16
+
+func init() {
+	for i := range 256 {
+		ulawTable[i] = ulawToLinear(byte(i))
+		alawTable[i] = alawToLinear(byte(i))
+	}
+}
+
+func g711Segment(v int, ends *[8]int) int {
+	for i, end := range ends {
+		if v <= end {
+			return i
+		}
+	}
+	return len(ends)
+}
+
+// linearToULaw encodes a 16-bit sample as µ-law.
+func linearToULaw(sample int16) byte {
+	v := int(sample) >> 2
+	mask := byte(0xFF)
+	if v < 0 {
+		v = -v
+		mask = 0x7F
+	}
+	v = min(v, ulawClip) + ulawBias>>2
+	seg := g711Segment(v, &ulawSegEnd)
+	if seg >= 8 {
+		return 0x7F ^ mask
+	}
+	return byte(seg<<4|(v>>(seg+1))&0x0F) ^ mask
+}
+
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0F)<<3 + ulawBias) << ((u & 0x70) >> 4)
+	if u&0x80 != 0 {
+		return int16(ulawBias - t)
+	}
+	return int16(t - ulawBias)
+}
+
+// linearToALaw encodes a 16-bit sample as A-law.
+func linearToALaw(sample int16) byte {
+	v := int(sample) >> 3
+	mask := byte(0xD5)
+	if v < 0 {
+		v = -v - 1
+		mask = 0x55
+	}
+	seg := g711Segment(v, &alawSegEnd)
+	if seg >= 8 {
+		return 0x7F ^ mask
+	}
+	a := seg << 4
+	if seg < 2 {
+		a |= (v >> 1) & 0x0F
+	} else {
+		a |= (v >> seg) & 0x0F
+	}
+	return byte(a) ^ mask
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	switch seg := (a & 0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << (seg - 1)
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// encodeG711 encodes samples with codec, one byte per sample.
+func encodeG711(codec string, samples []int16) []byte {
+	encode := linearToULaw
+	if codec == codecPCMA {
+		encode = linearToALaw
+	}
+	out := make([]byte, len(samples))
+	for i, s := range samples {
+		out[i] = encode(s)
+	}
+	return out
+}
+
+// decodeG711 decodes audio encoded with codec.
+func decodeG711(codec string, data []byte) []int16 {
+	table := &ulawTable
+	if codec == codecPCMA {
+		table = &alawTable
+	}
+	out := make([]int16, len(data))
+	for i, b := range data {
+		out[i] = table[b]
+	}
+	return out
+}
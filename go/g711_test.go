@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+// TestG711Reference checks code words against the values of the Sun
+// reference implementation of G.711.
+func TestG711Reference(t *testing.T) {
+	for _, tc := range []struct {
+		sample     int16
+		ulaw, alaw byte
+	}{
+		{0, 0xFF, 0xD5},
+		{-1, 0x7E, 0x55}, // 负数向下取整
+		{8, 0xFE, 0xD5},
+		{-8, 0x7E, 0x55},
+		{100, 0xF2, 0xD3},
+		{-100, 0x72, 0x53},
+		{1000, 0xCE, 0xFA},
+		{-1000, 0x4E, 0x7A},
+		{10000, 0x9C, 0xB6},
+		{-10000, 0x1C, 0x36},
+		{32767, 0x80, 0xAA}, // 削波
+		{-32768, 0x00, 0x2A},
+	} {
+		if got := linearToULaw(tc.sample); got != tc.ulaw {
+			t.Errorf("linearToULaw(%d) = %#02x, want %#02x", tc.sample, got, tc.ulaw)
+		}
+		if got := linearToALaw(tc.sample); got != tc.alaw {
+			t.Errorf("linearToALaw(%d) = %#02x, want %#02x", tc.sample, got, tc.alaw)
+		}
+	}
+
+	for _, tc := range []struct {
+		code       byte
+		ulaw, alaw int16
+	}{
+		{0x00, -32124, -5504},
+		{0x80, 32124, 5504},
+		{0xFF, 0, 848},
+		{0x7F, 0, -848}, // µ-law 的负零
+		{0xFE, 8, 880},
+		{0xCE, 988, 440},
+		{0xFA, 40, 1008},
+		{0xD5, 716, 8},
+		{0x55, -716, -8},
+		{0xAA, 5372, 32256},
+		{0x2A, -5372, -32256},
+	} {
+		if got := ulawToLinear(tc.code); got != tc.ulaw {
+			t.Errorf("ulawToLinear(%#02x) = %d, want %d", tc.code, got, tc.ulaw)
+		}
+		if got := alawToLinear(tc.code); got != tc.alaw {
+			t.Errorf("alawToLinear(%#02x) = %d, want %d", tc.code, got, tc.alaw)
+		}
+	}
+}
+
+// TestG711RoundTrip encodes every 16-bit sample: the decoded sample must be
+// within half a quantization step, which stays below 1/16 of the sample, and
+// decoding then encoding must give back every code word.
+func TestG711RoundTrip(t *testing.T) {
+	for _, codec := range []string{codecPCMU, codecPCMA} {
+		samples := make([]int16, 0, 1<<16)
+		for s := -32768; s <= 32767; s++ {
+			samples = append(samples, int16(s))
+		}
+		decoded := decodeG711(codec, encodeG711(codec, samples))
+		for i, s := range samples {
+			err := int(decoded[i]) - int(s)
+			if abs := max(int(s), -int(s)); max(err, -err) > max(16, abs/16) {
+				t.Errorf("%s: %d decoded as %d", codec, s, decoded[i])
+			}
+		}
+
+		codes := make([]byte, 256)
+		for i := range codes {
+			codes[i] = byte(i)
+		}
+		for i, c := range encodeG711(codec, decodeG711(codec, codes)) {
+			// µ-law 的负零 0x7F 解码为 0，重新编码为正零
+			if c != byte(i) && !(codec == codecPCMU && i == 0x7F && c == 0xFF) {
+				t.Errorf("%s: code %#02x encoded back as %#02x", codec, i, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// 游戏引擎桥接：在本地提供一个 websocket 服务，供 Unity/Unreal 插件接入。
+// 二进制帧传输 PCM 音频，文本帧传输 JSON 控制消息与事件。
+
+var gameAddr = flag.String("game-addr", "127.0.0.1:8765", "listen address of the `game` command")
+
+// gameVisemeFrame is the duration covered by each mouth value of a viseme
+// event, in milliseconds.
+const gameVisemeFrame = 20
+
+func init() {
+	commands["game"] = runGame
+}
+
+// gameControl is a control message sent by a game client.
+//
+//	{"type": "say", "text": "..."}  have the bot speak text
+//	{"type": "stop"}                 end the user audio and finish the session
+type gameControl struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// gameEvent is an event sent to a game client.
+type gameEvent struct {
+	Type      string         `json:"type"`
+	SessionID string         `json:"session_id,omitempty"`
+	Text      string         `json:"text,omitempty"`
+	Audio     *AudioSettings `json:"audio,omitempty"`
+	FrameMs   int            `json:"frame_ms,omitempty"`
+	Mouth     []float64      `json:"mouth,omitempty"`
+}
+
+// runGame implements the `game` subcommand. Every game client connected to
+// -game-addr gets a dialog connection of its own:
+//
+//   - binary frames from the client are the user audio, in the input format;
+//   - binary frames to the client are the bot audio, in the output format,
+//     each preceded by a "viseme" event with its mouth openness envelope;
+//   - text frames carry gameControl messages and gameEvent events.
+//
+// The service reports no phonemes, so visemes are derived from the loudness
+// of the bot audio: one mouth value in [0, 1] per 20ms.
+func runGame(ctx context.Context, cfg *Config) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	upgrader := websocket.Upgrader{}
+	srv := &http.Server{
+		Addr: *gameAddr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				glog.Errorf("Upgrade game client %s: %v", r.RemoteAddr, err)
+				return
+			}
+			wg.Add(1)
+			defer wg.Done()
+			glog.V(vEvent).Infof("Game client %s connected", r.RemoteAddr)
+			serveGameClient(ctx, cfg, ws)
+			glog.V(vEvent).Infof("Game client %s disconnected", r.RemoteAddr)
+		}),
+	}
+	stop := context.AfterFunc(ctx, func() { _ = srv.Close() })
+	defer stop()
+	glog.V(vEvent).Infof("Game bridge listening on ws://%s", *gameAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("game bridge: %w", err)
+	}
+	return nil
+}
+
+// serveGameClient runs the dialog of a game client until it disconnects or
+// the session ends.
+func serveGameClient(ctx context.Context, cfg *Config, ws *websocket.Conn) {
+	defer ws.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = ws.Close() })
+	defer stop()
+
+	client := &gameClient{ws: ws}
+	conn, _, err := dialDialog(ctx, cfg)
+	if err != nil {
+		client.emit(gameEvent{Type: "error", Text: fmt.Sprintf("websocket dial: %v", err)})
+		return
+	}
+	defer conn.Close()
+	settings := audioSettings
+	client.emit(gameEvent{Type: "ready", Audio: &settings})
+
+	audioIn := make(chan []byte, 100)
+	go client.readLoop(conn, audioIn, cancel)
+	ids, _ := newSessionIDs("")
+	if err := realTimeDialog(ctx, conn, ids, client, chanSource(audioIn)); err != nil && ctx.Err() == nil {
+		client.emit(gameEvent{Type: "error", Text: err.Error()})
+	}
+}
+
+// gameClient is a connected game client. It is the handler of its dialog,
+// forwarding the events to the client.
+type gameClient struct {
+	NopHandler
+	ws *websocket.Conn
+
+	mu        sync.Mutex // serializes writes to ws
+	sessionID string
+}
+
+func (g *gameClient) write(messageType int, data []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.ws.WriteMessage(messageType, data); err != nil {
+		glog.V(vFrame).Infof("Write to game client: %v", err)
+	}
+}
+
+func (g *gameClient) emit(ev gameEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		glog.Errorf("Marshal game event %s: %v", ev.Type, err)
+		return
+	}
+	g.write(websocket.TextMessage, data)
+}
+
+func (g *gameClient) session() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.sessionID
+}
+
+// readLoop feeds the user audio to audioIn and handles the control messages.
+// It closes audioIn on "stop" and cancels the dialog when the client
+// disconnects.
+func (g *gameClient) readLoop(conn Transport, audioIn chan<- []byte, cancel context.CancelFunc) {
+	stopped := false
+	defer func() {
+		if !stopped {
+			close(audioIn)
+		}
+		cancel()
+	}()
+	for {
+		mt, data, err := g.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if mt == websocket.BinaryMessage {
+			if stopped {
+				continue
+			}
+			select {
+			case audioIn <- data:
+			default:
+				glog.V(vFrame).Infof("Drop %d bytes of game client audio: session is not keeping up", len(data))
+			}
+			continue
+		}
+		var ctl gameControl
+		if err := json.Unmarshal(data, &ctl); err != nil {
+			g.emit(gameEvent{Type: "error", Text: fmt.Sprintf("invalid control message: %v", err)})
+			continue
+		}
+		switch ctl.Type {
+		case "stop":
+			if !stopped {
+				stopped = true
+				close(audioIn)
+			}
+		case "say":
+			sessionID := g.session()
+			if sessionID == "" {
+				g.emit(gameEvent{Type: "error", Text: "say: no session"})
+				continue
+			}
+			if err := speakText(conn, sessionID, ctl.Text); err != nil {
+				g.emit(gameEvent{Type: "error", Text: fmt.Sprintf("say: %v", err)})
+			}
+		default:
+			g.emit(gameEvent{Type: "error", Text: fmt.Sprintf("unknown control message type: %q", ctl.Type)})
+		}
+	}
+}
+
+func (g *gameClient) OnSessionStart(session SessionInfo) {
+	g.mu.Lock()
+	g.sessionID = session.ID
+	g.mu.Unlock()
+	g.emit(gameEvent{Type: "session_start", SessionID: session.ID})
+}
+
+// OnASRStart tells the client to stop playing the bot audio: the user
+// interrupted the bot.
+func (g *gameClient) OnASRStart(ASRInfoPayload) {
+	g.emit(gameEvent{Type: "interrupt"})
+}
+
+func (g *gameClient) OnASRPartial(result ASRResult) {
+	g.emit(gameEvent{Type: "asr_partial", Text: result.Text})
+}
+
+func (g *gameClient) OnASRFinal(result ASRResult) {
+	g.emit(gameEvent{Type: "asr_final", Text: result.Text})
+}
+
+func (g *gameClient) OnBotText(text string) {
+	g.emit(gameEvent{Type: "bot_text", Text: text})
+}
+
+func (g *gameClient) OnBotSentenceStart(sentence TTSSentencePayload) {
+	g.emit(gameEvent{Type: "sentence_start", Text: sentence.Text})
+}
+
+func (g *gameClient) OnBotSentenceEnd(sentence TTSSentencePayload) {
+	g.emit(gameEvent{Type: "sentence_end", Text: sentence.Text})
+}
+
+func (g *gameClient) OnBotSpeechEnd() {
+	g.emit(gameEvent{Type: "speech_end"})
+}
+
+func (g *gameClient) OnAudioChunk(data []byte) {
+	g.emit(gameEvent{Type: "viseme", FrameMs: gameVisemeFrame, Mouth: mouthEnvelope(decodeOutputAudio(data))})
+	g.write(websocket.BinaryMessage, data)
+}
+
+func (g *gameClient) OnError(err error) {
+	g.emit(gameEvent{Type: "error", Text: err.Error()})
+}
+
+func (g *gameClient) OnSessionEnd(int32, []byte) {
+	g.emit(gameEvent{Type: "session_end", SessionID: g.session()})
+}
+
+// mouthEnvelope returns the mouth openness, in [0, 1], of each 20ms window of
+// bot audio, from the RMS loudness of the window.
+func mouthEnvelope(samples []float32) []float64 {
+	window := audioSettings.OutputSampleRate * audioSettings.OutputChannels * gameVisemeFrame / 1000
+	if window <= 0 {
+		return nil
+	}
+	var mouth []float64
+	for off := 0; off < len(samples); off += window {
+		end := min(off+window, len(samples))
+		var sum float64
+		for _, s := range samples[off:end] {
+			sum += float64(s) * float64(s)
+		}
+		rms := math.Sqrt(sum / float64(end-off))
+		// 语音的 RMS 通常不超过 0.25，放大到 [0, 1]
+		mouth = append(mouth, math.Round(min(rms*4, 1)*100)/100)
+	}
+	return mouth
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RealtimeDialog/dialog"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// 网关模式：下游客户端使用与服务端相同的二进制协议连接网关，网关以自己的凭证
+// 为每个客户端建立独立的上游连接并透明转发。客户端使用各自的 API key 鉴权，
+// 并受所属租户的频率与时长配额限制。浏览器客户端的 Origin 须与网关同源或列在
+// -gateway-origins 中，其他网站的页面不能借用户的浏览器连接网关。
+
+var (
+	gatewayAddr    = flag.String("gateway-addr", "127.0.0.1:8081", "listen address of the `gateway` command")
+	gatewayTenants = flag.String("tenants", "", "JSON file with the tenants allowed to use the gateway")
+	gatewayOrigins = flag.String("gateway-origins", "", "comma-separated `origins` (like https://app.example.com) of the cross-origin browser pages allowed to connect to the gateway; same-origin pages and clients sending no Origin are always allowed")
+
+	gatewayMetrics = expvar.NewMap("gateway")
+)
+
+func init() {
+	commands["gateway"] = runGateway
+}
+
+// Tenant is a downstream client of the gateway and its quotas. Zero quotas
+// are unlimited.
+type Tenant struct {
+	Name   string `json:"name"`
+	APIKey string `json:"api_key"`
+	// RatePerMinute limits the connections opened per minute.
+	RatePerMinute int `json:"rate_per_minute,omitempty"`
+	// MaxConcurrent limits the simultaneous connections.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// MaxConnectionDuration limits the duration of each connection.
+	MaxConnectionDuration Duration `json:"max_connection_duration,omitempty"`
+	// DailyDuration limits the total connection time per UTC day.
+	DailyDuration Duration `json:"daily_duration,omitempty"`
+}
+
+// Duration is a time.Duration written as a string like "10m" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// loadTenants reads the tenants file.
+func loadTenants(path string) ([]*Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read tenants file: %w", err)
+	}
+	tenants, err := parseTenants(data)
+	if err != nil {
+		return nil, fmt.Errorf("tenants file %s: %w", path, err)
+	}
+	return tenants, nil
+}
+
+// parseTenants parses a JSON array of tenants.
+func parseTenants(data []byte) ([]*Tenant, error) {
+	var tenants []*Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("parse tenants: %w", err)
+	}
+	for i, t := range tenants {
+		if t.Name == "" || t.APIKey == "" {
+			return nil, fmt.Errorf("tenant %d: name and api_key are required", i)
+		}
+	}
+	return tenants, nil
+}
+
+var (
+	errUnknownAPIKey  = errors.New("unknown API key")
+	errQuotaExhausted = errors.New("quota exhausted")
+)
+
+// tenantQuota tracks the usage of a tenant against its quotas.
+type tenantQuota struct {
+	tenant *Tenant
+
+	mu      sync.Mutex
+	recent  []time.Time // connections opened in the last minute
+	active  int
+	day     string
+	usedDay time.Duration
+}
+
+// acquire admits a new connection, returning the longest it may last, or 0
+// for no limit. With a daily quota that duration is reserved, so that
+// concurrent connections cannot together exceed the quota; release refunds
+// the part not used.
+func (q *tenantQuota) acquire(now time.Time) (time.Duration, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tenant
+	q.resetDay(now)
+	cutoff := now.Add(-time.Minute)
+	for len(q.recent) > 0 && q.recent[0].Before(cutoff) {
+		q.recent = q.recent[1:]
+	}
+	if t.RatePerMinute > 0 && len(q.recent) >= t.RatePerMinute {
+		return 0, fmt.Errorf("%w: %d connections per minute", errQuotaExhausted, t.RatePerMinute)
+	}
+	if t.MaxConcurrent > 0 && q.active >= t.MaxConcurrent {
+		return 0, fmt.Errorf("%w: %d concurrent connections", errQuotaExhausted, t.MaxConcurrent)
+	}
+	limit := time.Duration(t.MaxConnectionDuration)
+	if t.DailyDuration > 0 {
+		left := time.Duration(t.DailyDuration) - q.usedDay
+		if left <= 0 {
+			return 0, fmt.Errorf("%w: %v per day", errQuotaExhausted, time.Duration(t.DailyDuration))
+		}
+		if limit == 0 || left < limit {
+			limit = left
+		}
+	}
+	q.recent = append(q.recent, now)
+	q.active++
+	if t.DailyDuration > 0 {
+		q.usedDay += limit
+	}
+	return limit, nil
+}
+
+// release accounts a connection acquired at start with limit, ending now.
+func (q *tenantQuota) release(start, now time.Time, limit time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.resetDay(now)
+	q.active--
+	q.usedDay += now.Sub(start)
+	// 预留的时长只计在获取连接的那一天，跨天后已随之清零
+	if q.tenant.DailyDuration > 0 && start.UTC().Format("2006-01-02") == q.day {
+		q.usedDay -= limit
+	}
+}
+
+func (q *tenantQuota) resetDay(now time.Time) {
+	if day := now.UTC().Format("2006-01-02"); day != q.day {
+		q.day, q.usedDay = day, 0
+	}
+}
+
+// gateway relays downstream clients to the dialogue service. Relayed
+// connections are closed when ctx is done.
+type gateway struct {
+	ctx     context.Context
+	cfg     *Config
+	quotas  map[string]*tenantQuota // by API key
+	breaker *circuitBreaker
+	origins map[string]bool // allowed cross-origin pages
+	wg      sync.WaitGroup
+}
+
+func newGateway(ctx context.Context, cfg *Config, tenants []*Tenant, origins map[string]bool) *gateway {
+	g := &gateway{ctx: ctx, cfg: cfg, quotas: make(map[string]*tenantQuota), origins: origins}
+	g.breaker = newCircuitBreaker(ctx, *breakerThreshold, *breakerProbe, func(ctx context.Context) error {
+		return probeUpstream(ctx, cfg)
+	})
+	for _, t := range tenants {
+		g.quotas[t.APIKey] = &tenantQuota{tenant: t}
+	}
+	return g
+}
+
+// authenticate returns the quota of the tenant whose API key is presented in
+// the X-Api-Key header, an "Authorization: Bearer" header or the api_key
+// query parameter.
+func (g *gateway) authenticate(r *http.Request) (*tenantQuota, error) {
+	key := requestAPIKey(r)
+	// 逐个比较以保证耗时与 key 内容无关
+	var found *tenantQuota
+	for k, q := range g.quotas {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			found = q
+		}
+	}
+	if found == nil {
+		return nil, errUnknownAPIKey
+	}
+	return found, nil
+}
+
+// parseOrigins parses a comma-separated list of origins.
+func parseOrigins(list string) (map[string]bool, error) {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("invalid origin %q, want scheme://host[:port]", origin)
+		}
+		origins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+	return origins, nil
+}
+
+// checkOrigin accepts the requests without an Origin header, which do not
+// come from browsers, those of the same origin as the gateway and those of
+// the allowed origins.
+func (g *gateway) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host) || g.origins[strings.ToLower(u.Scheme+"://"+u.Host)]
+}
+
+// Wait waits for the relayed connections to end.
+func (g *gateway) Wait() {
+	g.wg.Wait()
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.wg.Add(1)
+	defer g.wg.Done()
+	// 在建立上游连接之前拒绝
+	if !g.checkOrigin(r) {
+		gatewayMetrics.Add("rejected_origin", 1)
+		glog.V(vEvent).Infof("Reject the client from origin %s", r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	quota, err := g.authenticate(r)
+	if err != nil {
+		gatewayMetrics.Add("rejected_auth", 1)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	tenant := quota.tenant.Name
+	if ok, retry := g.breaker.Allow(); !ok {
+		gatewayMetrics.Add("rejected_breaker", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	start := time.Now()
+	limit, err := quota.acquire(start)
+	if err != nil {
+		gatewayMetrics.Add("rejected_quota", 1)
+		glog.V(vEvent).Infof("Reject tenant %s: %v", tenant, err)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer func() {
+		now := time.Now()
+		quota.release(start, now, limit)
+		d := now.Sub(start)
+		gatewayMetrics.AddFloat("seconds_"+tenant, d.Seconds())
+	}()
+
+	upstream, resp, err := dialDialog(r.Context(), g.cfg)
+	if err != nil {
+		glog.Errorf("Dial upstream for tenant %s: %v", tenant, err)
+		// 客户端放弃的连接不说明上游有故障
+		if !errors.Is(err, context.Canceled) && r.Context().Err() == nil {
+			g.breaker.Failure(err)
+		}
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	var header http.Header
+	if resp != nil && resp.Header.Get("X-Tt-Logid") != "" {
+		header = http.Header{"X-Tt-Logid": {resp.Header.Get("X-Tt-Logid")}}
+	}
+	downstream, err := (&websocket.Upgrader{CheckOrigin: g.checkOrigin}).Upgrade(w, r, header)
+	if err != nil {
+		glog.Errorf("Upgrade client of tenant %s: %v", tenant, err)
+		return
+	}
+	defer downstream.Close()
+	gatewayMetrics.Add("connections_"+tenant, 1)
+	glog.V(vEvent).Infof("Tenant %s connected from %s", tenant, r.RemoteAddr)
+
+	ctx := g.ctx
+	var cancel context.CancelFunc
+	if limit > 0 {
+		ctx, cancel = context.WithTimeout(ctx, limit)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			glog.V(vEvent).Infof("Tenant %s reached its duration quota", tenant)
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "duration quota exhausted")
+			_ = downstream.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		}
+		_ = downstream.Close()
+		_ = upstream.Close()
+	})
+	defer stop()
+
+	done := make(chan struct{}, 2)
+	client := newGorillaTransport(downstream)
+	go func() { relayFrames(client, upstream, nil, g.watchUpstream); done <- struct{}{} }()
+	go func() { relayFrames(upstream, client, nil, nil); done <- struct{}{} }()
+	<-done
+	cancel()
+	<-done
+	glog.V(vEvent).Infof("Tenant %s disconnected after %v", tenant, time.Since(start).Round(time.Second))
+}
+
+// watchUpstream feeds the outcome of the sessions to the circuit breaker,
+// which is shared by the tenants. Only the failures of the service count:
+// errors caused by a client, such as invalid requests (4xxxxxxx codes) or a
+// failed session, do not open the circuit for the other tenants.
+func (g *gateway) watchUpstream(msg *dialog.Message) {
+	switch {
+	case msg.Type == dialog.MsgTypeError:
+		if serverSideCode(msg.ErrorCode) {
+			g.breaker.Failure(&ServerError{Code: msg.ErrorCode, Payload: bytes.Clone(msg.Payload)})
+		}
+	case msg.Event == dialog.EventConnectionFailed:
+		g.breaker.Failure(fmt.Errorf("event %d: %s", msg.Event, msg.Payload))
+	case msg.Event == dialog.EventSessionStarted:
+		g.breaker.Success()
+	}
+}
+
+// serverSideCode reports whether an error code is of the server-side class
+// (5xxxxxxx), as opposed to the client errors (4xxxxxxx).
+func serverSideCode(code uint32) bool {
+	return strconv.FormatUint(uint64(code), 10)[0] == '5'
+}
+
+// requestAPIKey returns the API key presented by a downstream client.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	if key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// relayFrames copies websocket messages from src to dst until either fails.
+// Binary protocol messages are passed to watch, if not nil, and only valid
+// during the call; those whose event is in drop are not copied.
+func relayFrames(dst, src Transport, drop eventSet, watch func(*dialog.Message)) {
+	for {
+		mt, data, err := src.ReadMessage(context.Background())
+		if err != nil {
+			return
+		}
+		if (len(drop) > 0 || watch != nil) && mt == BinaryMessage {
+			if msg, _, err := dialog.Unmarshal(data, dialog.ContainsSequence); err == nil {
+				if watch != nil {
+					watch(msg)
+				}
+				if drop[msg.Event] {
+					glog.V(vFrame).Infof("Drop event %d", msg.Event)
+					continue
+				}
+			}
+		}
+		if err := dst.WriteMessage(mt, data); err != nil {
+			return
+		}
+	}
+}
+
+// runGateway implements the `gateway` subcommand.
+func runGateway(ctx context.Context, cfg *Config) error {
+	if *gatewayTenants == "" {
+		return errors.New("-tenants is required")
+	}
+	tenants, err := loadTenants(*gatewayTenants)
+	if err != nil {
+		return err
+	}
+	origins, err := parseOrigins(*gatewayOrigins)
+	if err != nil {
+		return fmt.Errorf("-gateway-origins: %w", err)
+	}
+	serveMetrics()
+	srv := &http.Server{Addr: *gatewayAddr, Handler: newGateway(ctx, cfg, tenants, origins)}
+	stop := context.AfterFunc(ctx, func() { _ = srv.Close() })
+	defer stop()
+	glog.V(vEvent).Infof("Gateway listening on ws://%s for %d tenants", *gatewayAddr, len(tenants))
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTenantQuotaConcurrentAcquire checks that the connections admitted at
+// once cannot be granted more than the daily quota together, and that the
+// unused part of a grant is refunded.
+func TestTenantQuotaConcurrentAcquire(t *testing.T) {
+	q := &tenantQuota{tenant: &Tenant{
+		Name:                  "t",
+		MaxConnectionDuration: Duration(4 * time.Minute),
+		DailyDuration:         Duration(10 * time.Minute),
+	}}
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	var mu sync.Mutex
+	var granted []time.Duration
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limit, err := q.acquire(now)
+			if err != nil {
+				if !errors.Is(err, errQuotaExhausted) {
+					t.Error(err)
+				}
+				return
+			}
+			mu.Lock()
+			granted = append(granted, limit)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	var total time.Duration
+	for _, d := range granted {
+		total += d
+	}
+	// 4 + 4 + 2 分钟
+	if total != 10*time.Minute || len(granted) != 3 {
+		t.Fatalf("granted %v, want 10m in total", granted)
+	}
+
+	// 提前结束的连接退回未用的时长
+	q.release(now, now.Add(time.Minute), granted[0])
+	if limit, err := q.acquire(now.Add(time.Minute)); err != nil || limit != granted[0]-time.Minute {
+		t.Fatalf("acquired %v, %v after a refund of %v", limit, err, granted[0]-time.Minute)
+	}
+
+	// 跨天的连接计入次日，前一天的预留不再退回
+	late := time.Date(2026, 1, 2, 23, 59, 0, 0, time.UTC)
+	q.release(late, late.Add(2*time.Minute), granted[1])
+	if q.usedDay != 2*time.Minute {
+		t.Errorf("used %v on the next day, want 2m", q.usedDay)
+	}
+}
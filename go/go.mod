@@ -3,8 +3,21 @@ module RealtimeDialog
 go 1.24
 
 require (
+	fyne.io/systray v1.11.0
+	github.com/bwmarrin/discordgo v0.29.0
+	github.com/gen2brain/malgo v0.11.26
 	github.com/golang/glog v1.2.5
 	github.com/google/uuid v1.6.0
 	github.com/gordonklaus/portaudio v0.0.0-20250206071425-98a94950218b
 	github.com/gorilla/websocket v1.5.3
+	golang.org/x/sync v0.16.0
+	golang.org/x/term v0.32.0
+	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32
+	nhooyr.io/websocket v1.8.17
+)
+
+require (
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect
+	golang.org/x/sys v0.33.0 // indirect
 )
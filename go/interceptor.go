@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"RealtimeDialog/dialog"
+	"github.com/golang/glog"
+)
+
+// 消息拦截器：客户端发送的每条消息在序列化前依次经过 outboundInterceptors，
+// 收到的每条消息在反序列化后依次经过 inboundInterceptors，用于日志、脱敏、
+// 统计、修改负载以及测试中的故障注入等横切逻辑。内置按事件计数的 messages 指标，
+// 以及 -log-messages 脱敏日志。
+
+var (
+	logMessages  = flag.Bool("log-messages", false, "log every message sent and received, with the JSON fields in -redact-fields masked and audio summarized")
+	redactFields = flag.String("redact-fields", "content,text", "comma-separated JSON `fields` masked in the messages logged with -log-messages")
+)
+
+// messageMetrics counts the messages sent and received, by event.
+var messageMetrics = expvar.NewMap("messages")
+
+// Interceptor inspects or changes a message. The message it returns replaces
+// msg; an error fails the send or receive of the message.
+type Interceptor func(msg *dialog.Message) (*dialog.Message, error)
+
+// outboundInterceptors run, in order, on the messages sent by the client,
+// and inboundInterceptors on those it receives. They are appended to in init
+// or before the first connection, and not changed while dialogs run.
+var outboundInterceptors, inboundInterceptors []Interceptor
+
+func init() {
+	outboundInterceptors = append(outboundInterceptors, countMessage("sent"), logMessage("Send"))
+	inboundInterceptors = append(inboundInterceptors, countMessage("received"), logMessage("Receive"))
+}
+
+// intercept runs msg through the interceptors.
+func intercept(interceptors []Interceptor, msg *dialog.Message) (*dialog.Message, error) {
+	for _, ic := range interceptors {
+		var err error
+		if msg, err = ic(msg); err != nil {
+			return nil, fmt.Errorf("interceptor: %w", err)
+		}
+		if msg == nil {
+			return nil, errors.New("interceptor returned no message")
+		}
+	}
+	return msg, nil
+}
+
+// interceptOutbound runs a message to send through the outbound
+// interceptors.
+func interceptOutbound(msg *dialog.Message) (*dialog.Message, error) {
+	return intercept(outboundInterceptors, msg)
+}
+
+// interceptInbound runs a received message through the inbound interceptors.
+func interceptInbound(msg *dialog.Message) (*dialog.Message, error) {
+	if msg.Type == dialog.MsgTypeFullClient || msg.Type == dialog.MsgTypeFullServer || msg.Type == dialog.MsgTypeError {
+		glog.V(vTrace).Infof("Read Payload content: %s", redactText(string(msg.Payload)))
+	}
+	return intercept(inboundInterceptors, msg)
+}
+
+// countMessage counts the messages in messageMetrics as direction_event.
+func countMessage(direction string) Interceptor {
+	return func(msg *dialog.Message) (*dialog.Message, error) {
+		messageMetrics.Add(direction+"_"+strconv.Itoa(int(msg.Event)), 1)
+		return msg, nil
+	}
+}
+
+// logMessage logs the messages when -log-messages is set.
+func logMessage(verb string) Interceptor {
+	return func(msg *dialog.Message) (*dialog.Message, error) {
+		if *logMessages {
+			glog.V(vEvent).Infof("%s %s event=%d session=%s: %s", verb, msg.Type, msg.Event, msg.SessionID, redactPayload(msg))
+		}
+		return msg, nil
+	}
+}
+
+// redactPayload describes the payload of msg for logs: the size of audio,
+// and JSON with the -redact-fields masked.
+func redactPayload(msg *dialog.Message) string {
+	if msg.Type == dialog.MsgTypeAudioOnlyClient || msg.Type == dialog.MsgTypeAudioOnlyServer {
+		return fmt.Sprintf("<%d bytes of audio>", len(msg.Payload))
+	}
+	var v any
+	if err := json.Unmarshal(msg.Payload, &v); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(msg.Payload))
+	}
+	fields := make(map[string]bool)
+	for _, f := range strings.Split(*redactFields, ",") {
+		fields[strings.TrimSpace(f)] = true
+	}
+	out, err := json.Marshal(redactJSON(v, fields))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes>", len(msg.Payload))
+	}
+	return redactText(string(out))
+}
+
+// redactJSON masks the values of the fields of v, recursively.
+func redactJSON(v any, fields map[string]bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if fields[key] {
+				v[key] = "***"
+			} else {
+				v[key] = redactJSON(value, fields)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redactJSON(value, fields)
+		}
+	}
+	return v
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 自适应抖动缓冲：每段回复先缓冲到目标深度再开始播放。回复尚未收完时缓冲被
+// 耗尽（欠载）就增大目标深度并重新缓冲，持续稳定播放一段时间后再逐步减小，
+// 在网络波动时以少量延迟换取无卡顿的播放。
+
+var (
+	jitterMin = flag.Duration("jitter-min", 40*time.Millisecond, "smallest depth of bot audio buffered before playback starts")
+	jitterMax = flag.Duration("jitter-max", 400*time.Millisecond, "largest depth the playback buffer grows to after underruns")
+)
+
+const (
+	// jitterStep is how much the target depth grows after an underrun and
+	// shrinks after jitterStable.
+	jitterStep = 40 * time.Millisecond
+	// jitterStable is how long playback must run without underrun before
+	// the target depth shrinks.
+	jitterStable = 30 * time.Second
+)
+
+// jitterBuffer decides when the buffered bot audio is played. Its methods
+// are called with bufferLock held. Receive, EndReply and Reset do nothing on a nil
+// jitterBuffer: without startPlayer nothing is played.
+type jitterBuffer struct {
+	rate           int // frames per second
+	min, max, step int // frames
+	target         int
+	playing        bool
+	starved        bool      // rebuffering after an underrun
+	complete       bool      // the reply has been received completely
+	changed        time.Time // last underrun or change of target
+}
+
+func newJitterBuffer(rate int, low, high time.Duration) *jitterBuffer {
+	frames := func(d time.Duration) int { return int(d.Seconds() * float64(rate)) }
+	j := &jitterBuffer{rate: rate, min: frames(low), max: max(frames(high), frames(low)), step: frames(jitterStep), changed: time.Now()}
+	j.target = j.min
+	j.export()
+	return j
+}
+
+// Receive notes that bot audio arrived.
+func (j *jitterBuffer) Receive() {
+	if j == nil {
+		return
+	}
+	j.complete = false
+}
+
+// EndReply notes that the whole reply has been received.
+func (j *jitterBuffer) EndReply() {
+	if j == nil {
+		return
+	}
+	j.complete = true
+}
+
+// Reset restarts buffering: the buffer was cleared.
+func (j *jitterBuffer) Reset() {
+	if j == nil {
+		return
+	}
+	j.playing, j.starved = false, false
+}
+
+// Playing reports whether the buffer is being played.
+func (j *jitterBuffer) Playing() bool {
+	return j != nil && j.playing
+}
+
+// Starved reports whether the buffer ran dry in the middle of the reply
+// and is filling up again.
+func (j *jitterBuffer) Starved() bool {
+	return j.starved
+}
+
+// Ready reports whether to play from the buffer, holding buffered frames,
+// to fill n frames of output.
+func (j *jitterBuffer) Ready(buffered, n int) bool {
+	now := time.Now()
+	if !j.playing {
+		if buffered == 0 || buffered < j.target && !j.complete {
+			return false
+		}
+		j.playing, j.starved = true, false
+	}
+	switch {
+	case buffered < n && !j.complete:
+		// 欠载：播放剩余的音频，然后按更大的目标深度重新缓冲
+		j.playing, j.starved = false, true
+		j.changed = now
+		playbackMetrics.Add("underruns", 1)
+		if j.target < j.max {
+			j.target = min(j.target+j.step, j.max)
+			glog.V(vEvent).Infof("Playback underrun, buffering %v before playing", j.depth())
+			j.export()
+		}
+	case buffered <= n:
+		j.playing = false // 回复播放完毕
+	case now.Sub(j.changed) >= jitterStable && j.target > j.min:
+		j.target = max(j.target-j.step, j.min)
+		j.changed = now
+		glog.V(vEvent).Infof("Playback stable, buffering %v before playing", j.depth())
+		j.export()
+	}
+	return true
+}
+
+func (j *jitterBuffer) depth() time.Duration {
+	return time.Duration(j.target) * time.Second / time.Duration(j.rate)
+}
+
+func (j *jitterBuffer) export() {
+	v := new(expvar.Int)
+	v.Set(j.depth().Milliseconds())
+	playbackMetrics.Set("jitter_target_ms", v)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// jsonEvent is a single line written by jsonEmitter.
+type jsonEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id,omitempty"`
+
+	Text       string    `json:"text,omitempty"`
+	StartTime  float64   `json:"start_time,omitempty"`
+	EndTime    float64   `json:"end_time,omitempty"`
+	Words      []ASRWord `json:"words,omitempty"`
+	Confidence float64   `json:"confidence,omitempty"`
+	// Alternatives of an ASR result, see -asr-alternatives.
+	Alternatives []ASRAlternative `json:"alternatives,omitempty"`
+	Bytes        int              `json:"bytes,omitempty"`
+	Event        int32            `json:"event,omitempty"`
+	Usage        Usage            `json:"usage,omitempty"`
+	Payload      json.RawMessage  `json:"payload,omitempty"`
+}
+
+// jsonEmitter writes one JSON object per line for every semantic event, so
+// that other programs can consume the dialog without parsing logs.
+type jsonEmitter struct {
+	mu        sync.Mutex
+	enc       *json.Encoder
+	sessionID string
+}
+
+func newJSONEmitter(w io.Writer) *jsonEmitter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonEmitter{enc: enc}
+}
+
+func (e *jsonEmitter) emit(ev jsonEvent) {
+	ev.Time = time.Now()
+	if redacted := redactText(ev.Text); redacted != ev.Text {
+		// 脱敏可能跨越多个词，逐词脱敏会漏掉，不输出词的时间
+		ev.Text, ev.Words = redacted, nil
+	}
+	if len(ev.Alternatives) > 0 && piiRedactor != nil {
+		ev.Alternatives = slices.Clone(ev.Alternatives)
+		for i := range ev.Alternatives {
+			ev.Alternatives[i].Text = redactText(ev.Alternatives[i].Text)
+		}
+	}
+	if len(ev.Payload) > 0 && piiRedactor != nil {
+		redacted := redactText(string(ev.Payload))
+		if ev.Payload = json.RawMessage(redacted); !json.Valid(ev.Payload) {
+			// 脱敏替换了 JSON 中的数字
+			ev.Payload, _ = json.Marshal(redacted)
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ev.SessionID = e.sessionID
+	if err := e.enc.Encode(ev); err != nil {
+		glog.Errorf("Write JSON event %s: %v", ev.Type, err)
+	}
+}
+
+func (e *jsonEmitter) OnSessionStart(session SessionInfo) {
+	e.mu.Lock()
+	e.sessionID = session.ID
+	e.mu.Unlock()
+	e.emit(jsonEvent{Type: "session_start"})
+}
+
+func (e *jsonEmitter) OnASRStart(ASRInfoPayload) {
+	e.emit(jsonEvent{Type: "asr_start"})
+}
+
+func (e *jsonEmitter) OnASRPartial(result ASRResult) {
+	e.emit(jsonEvent{Type: "asr_partial", Text: result.Text, StartTime: result.StartTime, EndTime: result.EndTime, Words: result.Words, Confidence: result.Confidence, Alternatives: result.Alternatives})
+}
+
+func (e *jsonEmitter) OnASRFinal(result ASRResult) {
+	e.emit(jsonEvent{Type: "asr_final", Text: result.Text, StartTime: result.StartTime, EndTime: result.EndTime, Words: result.Words, Confidence: result.Confidence, Alternatives: result.Alternatives})
+}
+
+func (e *jsonEmitter) OnASREnd() {
+	e.emit(jsonEvent{Type: "asr_end"})
+}
+
+func (e *jsonEmitter) OnBotText(text string) {
+	e.emit(jsonEvent{Type: "bot_text", Text: text})
+}
+
+func (e *jsonEmitter) OnBotTextEnd() {
+	e.emit(jsonEvent{Type: "bot_text_end"})
+}
+
+func (e *jsonEmitter) OnBotSentenceStart(sentence TTSSentencePayload) {
+	e.emit(jsonEvent{Type: "bot_sentence_start", Text: sentence.Text})
+}
+
+func (e *jsonEmitter) OnBotSentenceEnd(sentence TTSSentencePayload) {
+	e.emit(jsonEvent{Type: "bot_sentence_end", Text: sentence.Text})
+}
+
+func (e *jsonEmitter) OnBotSpeechEnd() {
+	e.emit(jsonEvent{Type: "bot_speech_end"})
+}
+
+func (e *jsonEmitter) OnToolCall(call ToolCall) {
+	ev := jsonEvent{Type: "tool_call", Text: call.Name}
+	if json.Valid(call.Arguments) {
+		ev.Payload = call.Arguments
+	}
+	e.emit(ev)
+}
+
+func (e *jsonEmitter) OnUsage(usage Usage) {
+	e.emit(jsonEvent{Type: "usage", Usage: usage})
+}
+
+func (e *jsonEmitter) OnAudioChunk(data []byte) {
+	e.emit(jsonEvent{Type: "audio_chunk_meta", Bytes: len(data)})
+}
+
+func (e *jsonEmitter) OnError(err error) {
+	e.emit(jsonEvent{Type: "error", Text: err.Error()})
+}
+
+func (e *jsonEmitter) OnSessionEnd(event int32, payload []byte) {
+	ev := jsonEvent{Type: "session_end", Event: event}
+	if json.Valid(payload) {
+		ev.Payload = payload
+	}
+	e.emit(ev)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+// JSON-RPC 边车模式：rpc 子命令在标准输入输出上使用 JSON-RPC 2.0（每行一个
+// 对象），Python、Node 等脚本无需网络服务即可驱动对话。方法有 startSession、
+// sendAudioBase64、sendText 与 stopSession；对话事件以 event 通知发送，格式与
+// -json 输出相同，机器人音频以 audio 通知发送。
+
+func init() {
+	commands["rpc"] = runRPC
+}
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// rpcServer serves JSON-RPC requests read from stdin, one session at a time.
+type rpcServer struct {
+	ctx context.Context
+	cfg *Config
+
+	wmu sync.Mutex
+	enc *json.Encoder
+
+	session *rpcSession
+}
+
+// rpcSession is the dialog started by startSession, and its handler.
+type rpcSession struct {
+	NopHandler
+	srv     *rpcServer
+	cancel  context.CancelFunc
+	audioIn chan []byte
+	started chan struct{}
+	done    chan struct{}
+	err     error // set before done is closed
+
+	mu        sync.Mutex
+	conn      Transport
+	sessionID string
+}
+
+// runRPC implements the `rpc` subcommand.
+func runRPC(ctx context.Context, cfg *Config) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	s := &rpcServer{ctx: ctx, cfg: cfg, enc: enc}
+	defer s.stopSession()
+
+	dec := json.NewDecoder(os.Stdin)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			s.write(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, err.Error()}})
+			return fmt.Errorf("read request: %w", err)
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+			s.write(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcInvalidRequest, "invalid request"}})
+			continue
+		}
+		result, rerr := s.call(req.Method, req.Params)
+		if req.ID == nil {
+			if rerr != nil {
+				glog.Errorf("JSON-RPC notification %s: %s", req.Method, rerr.Message)
+			}
+			continue
+		}
+		resp := rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result, Error: rerr}
+		if rerr == nil && result == nil {
+			resp.Result = struct{}{}
+		}
+		s.write(resp)
+	}
+}
+
+// write writes v as a line to stdout.
+func (s *rpcServer) write(v any) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.enc.Encode(v); err != nil {
+		glog.Errorf("Write JSON-RPC message: %v", err)
+	}
+}
+
+func (s *rpcServer) notify(method string, params any) {
+	s.write(rpcNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// Write sends each line written by a jsonEmitter as an event notification.
+func (s *rpcServer) Write(p []byte) (int, error) {
+	s.notify("event", json.RawMessage(p[:len(p)-1]))
+	return len(p), nil
+}
+
+func (s *rpcServer) call(method string, params json.RawMessage) (any, *rpcError) {
+	var err error
+	switch method {
+	case "startSession":
+		var id string
+		if id, err = s.startSession(); err == nil {
+			return map[string]string{"session_id": id}, nil
+		}
+	case "sendAudioBase64":
+		var p struct {
+			Audio string `json:"audio"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		audio, derr := base64.StdEncoding.DecodeString(p.Audio)
+		if derr != nil {
+			return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("decode audio: %v", derr)}
+		}
+		err = s.sendAudio(audio)
+	case "sendText":
+		var p struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil || p.Text == "" {
+			return nil, &rpcError{rpcInvalidParams, "text is required"}
+		}
+		err = s.sendText(p.Text)
+	case "stopSession":
+		err = s.stopSession()
+	default:
+		return nil, &rpcError{rpcMethodNotFound, "method not found: " + method}
+	}
+	if err != nil {
+		return nil, &rpcError{rpcServerError, err.Error()}
+	}
+	return nil, nil
+}
+
+// startSession connects and starts a session, and returns its ID once the
+// server has started it.
+func (s *rpcServer) startSession() (string, error) {
+	if s.session != nil {
+		select {
+		case <-s.session.done:
+			s.session = nil
+		default:
+			return "", errors.New("a session is already running")
+		}
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	conn, _, err := dialDialog(ctx, s.cfg)
+	if err != nil {
+		cancel()
+		return "", fmt.Errorf("websocket dial: %w", err)
+	}
+	ss := &rpcSession{
+		srv:     s,
+		cancel:  cancel,
+		audioIn: make(chan []byte, 100),
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+		conn:    conn,
+	}
+	s.session = ss
+	go func() {
+		defer close(ss.done)
+		defer conn.Close()
+		ids, _ := newSessionIDs("")
+		events := newJSONEmitter(s)
+		ss.err = realTimeDialog(ctx, conn, ids, multiHandler{ss, events}, chanSource(ss.audioIn))
+		if ss.err == nil || ctx.Err() != nil {
+			return
+		}
+		glog.Errorf("JSON-RPC dialog: %v", ss.err)
+		// startSession reports the errors before the session started
+		select {
+		case <-ss.started:
+			events.OnError(ss.err)
+		default:
+		}
+	}()
+	select {
+	case <-ss.started:
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		return ss.sessionID, nil
+	case <-ss.done:
+		s.session = nil
+		if ss.err == nil {
+			ss.err = errors.New("dialog ended before the session started")
+		}
+		return "", ss.err
+	}
+}
+
+// sendAudio queues user audio, S16LE at the input rate and channels.
+func (s *rpcServer) sendAudio(audio []byte) error {
+	if s.session == nil {
+		return errNoSession
+	}
+	select {
+	case s.session.audioIn <- audio:
+		return nil
+	case <-s.session.done:
+		return errNoSession
+	default:
+		return errors.New("audio dropped: session is not keeping up")
+	}
+}
+
+// sendText sends text as the user query.
+func (s *rpcServer) sendText(text string) error {
+	if s.session == nil {
+		return errNoSession
+	}
+	ss := s.session
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.sessionID == "" {
+		return errNoSession
+	}
+	return chatTextQuery(ss.conn, ss.sessionID, &ChatTextQueryPayload{Content: text})
+}
+
+// stopSession finishes the session, if any, and waits for the connection to
+// close.
+func (s *rpcServer) stopSession() error {
+	ss := s.session
+	if ss == nil {
+		return nil
+	}
+	s.session = nil
+	select {
+	case <-ss.done:
+	default:
+		close(ss.audioIn)
+		<-ss.done
+	}
+	ss.cancel()
+	return nil
+}
+
+func (ss *rpcSession) OnSessionStart(session SessionInfo) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.sessionID = session.ID
+	select {
+	case <-ss.started:
+	default:
+		close(ss.started)
+	}
+}
+
+func (ss *rpcSession) OnSessionEnd(int32, []byte) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.sessionID = ""
+}
+
+// OnAudioChunk sends the bot audio as S16LE at the output rate and channels.
+func (ss *rpcSession) OnAudioChunk(data []byte) {
+	pcm := pcm.Int16ToBytes(pcm.Float32ToInt16(decodeOutputAudio(data)))
+	ss.srv.notify("audio", map[string]string{"audio": base64.StdEncoding.EncodeToString(pcm)})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	llmMode   = flag.Bool("llm", false, "use the service only for ASR and TTS: send ASR finals to an external OpenAI-compatible LLM and speak its replies")
+	llmURL    = flag.String("llm-url", "https://api.openai.com/v1/chat/completions", "chat completions endpoint of the external LLM")
+	llmModel  = flag.String("llm-model", "gpt-4o-mini", "model name sent to the external LLM")
+	llmAPIKey = flag.String("llm-api-key", "", "API key of the external LLM, defaults to $OPENAI_API_KEY")
+	llmSystem = flag.String("llm-system", "你是一个友好的语音助手，请用简短的口语回答。", "system prompt sent to the external LLM")
+
+	// playbackGate, when set, decides whether received bot audio is played.
+	playbackGate func() bool
+)
+
+// ttsTypeChatTTSText is the tts_type of sentences synthesized from
+// ChatTTSText requests, as opposed to the replies of the built-in model.
+const ttsTypeChatTTSText = "chat_tts_text"
+
+// LLM produces the reply to a conversation.
+type LLM interface {
+	Complete(ctx context.Context, system string, turns []DialogTurn) (string, error)
+}
+
+// openAILLM is an LLM speaking the OpenAI chat completions HTTP API.
+type openAILLM struct {
+	url, model, apiKey string
+	client             *http.Client
+}
+
+func newOpenAILLM(url, model, apiKey string) *openAILLM {
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+	}
+	return &openAILLM{url: url, model: model, apiKey: apiKey, client: &http.Client{Timeout: 60 * time.Second}}
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func (l *openAILLM) Complete(ctx context.Context, system string, turns []DialogTurn) (string, error) {
+	req := struct {
+		Model    string        `json:"model"`
+		Messages []chatMessage `json:"messages"`
+	}{Model: l.model}
+	if system != "" {
+		req.Messages = append(req.Messages, chatMessage{Role: "system", Content: system})
+	}
+	for _, t := range turns {
+		req.Messages = append(req.Messages, chatMessage{Role: t.Role, Content: t.Text})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("marshal completion request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("create completion request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if l.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+l.apiKey)
+	}
+	resp, err := l.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("send completion request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read completion response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("completion request failed (status=%d): %s", resp.StatusCode, data)
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message chatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(data, &completion); err != nil {
+		return "", fmt.Errorf("unmarshal completion response: %w", err)
+	}
+	if len(completion.Choices) == 0 {
+		return "", errors.New("completion response has no choices")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
+
+// llmPipeline replaces the replies of the built-in model with those of an
+// external LLM. It forwards every event to the wrapped Handler except the
+// built-in bot text, which is replaced by the LLM completion, and it mutes
+// the audio of built-in replies through playbackGate.
+type llmPipeline struct {
+	Handler
+
+	ctx  context.Context
+	conn Transport
+	llm  LLM
+
+	mu        sync.Mutex
+	sessionID string
+	turns     []DialogTurn
+	cancel    context.CancelFunc // cancels the pending completion
+
+	speaking atomic.Bool // the current sentence was requested by the pipeline
+}
+
+func newLLMPipeline(ctx context.Context, conn Transport, llm LLM, next Handler) *llmPipeline {
+	return &llmPipeline{Handler: next, ctx: ctx, conn: conn, llm: llm}
+}
+
+// AllowAudio reports whether the audio being received should be played.
+func (p *llmPipeline) AllowAudio() bool {
+	return p.speaking.Load()
+}
+
+func (p *llmPipeline) OnSessionStart(session SessionInfo) {
+	p.mu.Lock()
+	p.sessionID = session.ID
+	p.mu.Unlock()
+	p.Handler.OnSessionStart(session)
+}
+
+func (p *llmPipeline) OnASRStart(info ASRInfoPayload) {
+	// The user interrupts: drop the reply being prepared.
+	p.mu.Lock()
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+	p.mu.Unlock()
+	p.Handler.OnASRStart(info)
+}
+
+func (p *llmPipeline) OnASRFinal(result ASRResult) {
+	p.Handler.OnASRFinal(result)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	text := result.Text
+	if lowConfidence(result) {
+		if *minConfidenceAction == "drop" {
+			glog.V(vEvent).Infof("Dropped an ASR result of confidence %.2f", result.Confidence)
+			return
+		}
+		text += lowConfidenceNote
+	}
+	p.turns = append(p.turns, DialogTurn{Role: roleUser, Text: text, Timestamp: time.Now().UnixMilli()})
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.cancel = cancel
+	go p.reply(ctx, p.sessionID, append([]DialogTurn(nil), p.turns...))
+}
+
+func (p *llmPipeline) reply(ctx context.Context, sessionID string, turns []DialogTurn) {
+	text, err := p.llm.Complete(ctx, *llmSystem, turns)
+	if err != nil {
+		if ctx.Err() == nil {
+			glog.Errorf("LLM completion error: %v", err)
+		}
+		return
+	}
+	p.mu.Lock()
+	if ctx.Err() != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.turns = append(p.turns, DialogTurn{Role: roleAssistant, Text: text, Timestamp: time.Now().UnixMilli()})
+	p.mu.Unlock()
+
+	p.Handler.OnBotText(text)
+	p.Handler.OnBotTextEnd()
+	if err := speakText(p.conn, sessionID, text); err != nil {
+		glog.Errorf("Speak LLM reply error: %v", err)
+	}
+}
+
+func (p *llmPipeline) OnBotText(string) {}
+
+func (p *llmPipeline) OnBotTextEnd() {}
+
+func (p *llmPipeline) OnBotSentenceStart(sentence TTSSentencePayload) {
+	p.speaking.Store(sentence.TTSType == ttsTypeChatTTSText)
+	p.Handler.OnBotSentenceStart(sentence)
+}
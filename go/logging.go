@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Verbosity levels passed to glog.V. Warnings and errors are always logged.
+const (
+	vEvent glog.Level = 1 // connection, session and dialog events
+	vFrame glog.Level = 2 // every frame sent or received
+	vTrace glog.Level = 3 // frame byte dumps and protocol internals
+)
+
+var (
+	quietLog   = flag.Bool("quiet", false, "only log warnings and errors")
+	verboseLog = flag.Bool("verbose", false, "also log every frame sent or received")
+	traceLog   = flag.Bool("trace", false, "also log frame byte dumps and protocol internals")
+)
+
+// applyVerbosity sets the glog verbosity from the -quiet, -verbose and -trace
+// tiers. An explicit -v flag takes precedence over the tiers.
+func applyVerbosity() {
+	if flagIsSet("v") {
+		return
+	}
+
+	level := vEvent
+	switch {
+	case *traceLog:
+		level = vTrace
+	case *verboseLog:
+		level = vFrame
+	case *quietLog:
+		level = 0
+	}
+	_ = flag.Set("v", strconv.Itoa(int(level)))
+}
+
+// verbosityFlagIsSet reports whether the verbosity was given on the command
+// line, with -v or one of the tiers.
+func verbosityFlagIsSet() bool {
+	return flagIsSet("v") || flagIsSet("quiet") || flagIsSet("verbose") || flagIsSet("trace")
+}
+
+// setLogLevel sets the glog verbosity from a level name: quiet, info,
+// verbose or trace.
+func setLogLevel(name string) error {
+	levels := map[string]glog.Level{"quiet": 0, "info": vEvent, "verbose": vFrame, "trace": vTrace}
+	level, ok := levels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", name)
+	}
+	return flag.Set("v", strconv.Itoa(int(level)))
+}
+
+// connIdentity identifies a dialog connection in support tickets to
+// Volcengine: the logid of the dial response and the connect ID sent with it.
+type connIdentity struct {
+	LogID     string
+	ConnectID string
+}
+
+func newConnIdentity(resp *http.Response, connectID string) connIdentity {
+	id := connIdentity{ConnectID: connectID}
+	if resp != nil {
+		id.LogID = resp.Header.Get("X-Tt-Logid")
+	}
+	return id
+}
+
+func (id connIdentity) String() string {
+	return fmt.Sprintf("logid=%s connect_id=%s", id.LogID, id.ConnectID)
+}
+
+// Wrap adds the identifiers to err.
+func (id connIdentity) Wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w (%s)", err, id)
+}
+
+// tagLogs adds the identifiers to every subsequent log line, so that logs can
+// be attached to support tickets as they are. The lines are tagged by the
+// logRewriter installed at startup; the returned function restores the
+// previous tag. Without a logRewriter, as in the C library, logs are not
+// tagged.
+func tagLogs(id connIdentity) func() {
+	if logs == nil {
+		return func() {}
+	}
+	tag := "[" + id.String() + "] "
+	previous := logs.tag.Swap(&tag)
+	return func() { logs.tag.Store(previous) }
+}
+
+// 日志改写：glog 只能把文本写到 stderr。程序启动时（还没有其他 goroutine 写
+// 日志）redirectLogs 把 stderr 换成管道，此后不再替换；一个 goroutine 按块读取
+// 管道并改写其中的行：serve 模式下转换为 JSON，连接期间加上连接标识。读取不受
+// 行长度的限制，写日志的 goroutine 不会因为管道无人读取而阻塞。
+
+// maxLogLine bounds the incomplete line buffered in JSON mode: longer lines
+// are split into several entries.
+const maxLogLine = 1 << 20
+
+// glogLine matches the header of a glog line: severity, date, time, thread
+// and source location.
+var glogLine = regexp.MustCompile(`^([IWEF])\d{4} \d{2}:\d{2}:\d{2}\.\d{6}\s+\d+ ([^\]]+)\] (.*)$`)
+
+// logRewriter rewrites the lines written to stderr once redirectLogs has
+// replaced it with a pipe.
+type logRewriter struct {
+	stderr io.Writer // the original stderr
+	stdout io.Writer // of the JSON entries
+	// json converts the lines to JSON entries written to stdout.
+	json atomic.Bool
+	// tag is inserted after the glog header of the lines, if not nil.
+	tag atomic.Pointer[string]
+
+	// Used by run only.
+	line    []byte // incomplete line, in JSON mode
+	midLine bool   // the start of the current line was written, in text mode
+	level   string // of the last JSON entry
+}
+
+// logs rewrites the logs, nil if they are not redirected.
+var logs *logRewriter
+
+// redirectLogs replaces stderr with a pipe read by a logRewriter. It must
+// be called before other goroutines log. The returned function writes the
+// pending lines; the logs written after it are lost.
+func redirectLogs() (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("create log pipe: %w", err)
+	}
+	logs = &logRewriter{stderr: os.Stderr, stdout: os.Stdout, level: "info"}
+	os.Stderr = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logs.run(r)
+	}()
+	return func() {
+		glog.Flush()
+		_ = w.Close()
+		<-done
+	}, nil
+}
+
+// run rewrites what is read from r until it is closed. Partial lines are
+// written as they come in text mode, so that prompts are shown.
+func (l *logRewriter) run(r io.Reader) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := r.Read(buf)
+		l.write(buf[:n])
+		if err != nil {
+			if len(l.line) > 0 {
+				l.writeJSON(string(l.line))
+			}
+			return
+		}
+	}
+}
+
+func (l *logRewriter) write(data []byte) {
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		line := data[:end]
+		data = data[end:]
+		if !l.json.Load() {
+			if !l.midLine {
+				line = l.tagLine(line)
+			}
+			_, _ = l.stderr.Write(line)
+			l.midLine = line[len(line)-1] != '\n'
+			continue
+		}
+		line, complete := bytes.CutSuffix(line, []byte{'\n'})
+		l.line = append(l.line, line...)
+		if complete || len(l.line) >= maxLogLine {
+			l.writeJSON(string(l.tagLine(l.line)))
+			l.line = l.line[:0]
+		}
+	}
+}
+
+// tagLine returns line with the tag inserted after its glog header. Lines
+// without a header, such as stack traces, are not tagged.
+func (l *logRewriter) tagLine(line []byte) []byte {
+	tag := l.tag.Load()
+	if tag == nil {
+		return line
+	}
+	body, _ := bytes.CutSuffix(line, []byte{'\n'})
+	m := glogLine.FindSubmatchIndex(body)
+	if m == nil {
+		return line
+	}
+	return slices.Concat(line[:m[6]], []byte(*tag), line[m[6]:])
+}
+
+// writeJSON writes line as a JSON entry. Lines without a glog header, such
+// as stack traces, keep the level of the previous one.
+func (l *logRewriter) writeJSON(line string) {
+	entry := struct {
+		Time   time.Time `json:"time"`
+		Level  string    `json:"level"`
+		Source string    `json:"source,omitempty"`
+		Msg    string    `json:"msg"`
+	}{Time: time.Now(), Level: l.level, Msg: line}
+	if m := glogLine.FindStringSubmatch(line); m != nil {
+		l.level = map[string]string{"I": "info", "W": "warning", "E": "error", "F": "fatal"}[m[1]]
+		entry.Level, entry.Source, entry.Msg = l.level, m[2], m[3]
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, _ = l.stdout.Write(append(data, '\n'))
+}
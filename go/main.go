@@ -2,110 +2,454 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
+	"time"
 
+	"RealtimeDialog/dialog"
 	"github.com/golang/glog"
 	"github.com/google/uuid"
-	"github.com/gordonklaus/portaudio"
-	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
 	appid       = "9168491271"
 	accessToken = "YOUR_API_KEY_HERE"
+	appKey      = "PlgvMymc7f3tQnJ6"
 
 	wsURL    = url.URL{Scheme: "wss", Host: "openspeech.bytedance.com", Path: "/api/v3/realtime/dialogue"}
-	protocol = NewBinaryProtocol()
+	protocol = dialog.NewBinaryProtocol()
+	// audioProtocol serializes audio frames, whose payload is raw data.
+	audioProtocol *dialog.BinaryProtocol
+
+	showTranscript = flag.Bool("transcript", true, "print a live color-coded transcript of the dialog to stdout")
+	jsonOutput     = flag.Bool("json", false, "write one JSON object per semantic event to stdout instead of the transcript")
+	loopMode       = flag.Bool("loop", false, "start a new session on the same connection whenever a session ends, until terminated")
+	sessionTimeout = flag.Duration("session-timeout", 0, "finish each session after this duration (0 means no limit)")
+	shutdownGrace  = flag.Duration("shutdown-grace", 3*time.Second, "on shutdown, how long to wait for the server to finish the session before aborting")
+
+	// commands holds the subcommands, by name. Without a subcommand the
+	// program runs the dialog on the microphone and speaker.
+	commands = map[string]func(ctx context.Context, cfg *Config) error{}
 )
 
+func main() {
+	_ = flag.Set("logtostderr", "true")
+	flag.Parse()
+	applyVerbosity()
+	stopLogs, err := redirectLogs()
+	if err != nil {
+		glog.Exit(err)
+	}
+
+	err = run()
+	if err != nil {
+		glog.Error(err)
+	}
+	stopLogs()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// notifyReload relays SIGHUP, the request to reload the config file, to c.
+func notifyReload(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
+
 func init() {
-	protocol.SetVersion(Version1)
-	protocol.SetHeaderSize(HeaderSize4)
-	protocol.SetSerialization(SerializationJSON)
-	protocol.SetCompression(CompressionNone, nil)
-	protocol.containsSequence = ContainsSequence
+	protocol.SetVersion(dialog.Version1)
+	protocol.SetHeaderSize(dialog.HeaderSize4)
+	protocol.SetSerialization(dialog.SerializationJSON)
+	protocol.SetCompression(dialog.CompressionNone, nil)
+	protocol.SetContainsSequence(dialog.ContainsSequence)
+
+	audioProtocol = protocol.Clone()
+	audioProtocol.SetSerialization(dialog.SerializationRaw)
 }
 
 // 流式合成
-func realTimeDialog(ctx context.Context, c *websocket.Conn, sessionID string) {
+//
+// A session that fails with a ServerError is retried as the retry policy
+// decides; a *reauthError asks the caller to reconnect. Any other error ends
+// the dialog and is returned.
+func realTimeDialog(ctx context.Context, c Transport, ids *sessionIDs, handler Handler, src AudioSource) error {
 	err := startConnection(c)
 	if err != nil {
-		glog.Errorf("realTimeDialog startConnection error: %v", err)
-		return
-	}
-	extra := map[string]interface{}{
-		"strict_audit": false,
-	}
-	err = startSession(c, sessionID, &StartSessionPayload{
-		TTS: TTSPayload{
-			AudioConfig: AudioConfig{
-				Channel:    1,
-				Format:     "pcm",
-				SampleRate: 24000,
-			},
-		},
-		Dialog: DialogPayload{
-			BotName: "豆包",
-			Extra:   extra,
-		},
-	})
-	if err != nil {
-		glog.Errorf("realTimeDialog startSession error: %v", err)
-		return
+		return fmt.Errorf("start connection: %w", err)
 	}
-	// 模拟发送音频流到服务端
-	sendAudio(ctx, c, sessionID)
 
-	// 接收服务端返回数据
-	realtimeAPIOutputAudio(ctx, c)
+	if err := runSessions(ctx, c, ids, handler, src); err != nil {
+		return err
+	}
 
 	// 结束对话，断开websocket连接
 	err = finishConnection(c)
 	if err != nil {
-		glog.Errorf("Failed to finish connection: %v", err)
+		return fmt.Errorf("finish connection: %w", err)
 	}
-	glog.Info("realTimeDialog finished.")
+	glog.V(vEvent).Info("realTimeDialog finished.")
+	return nil
 }
 
-func main() {
-	_ = flag.Set("logtostderr", "true")
-	flag.Parse()
+// runSessions runs one session, or consecutive sessions in -loop mode, and
+// retries the failed ones as sessionRetry decides.
+func runSessions(ctx context.Context, c Transport, ids *sessionIDs, handler Handler, src AudioSource) error {
+	for {
+		err := runSession(ctx, c, ids.Next(), handler, src)
+		if err != nil {
+			action, delay := sessionRetry.Decide(err)
+			switch action {
+			case retryActionAbort:
+				return err
+			case retryActionReauth:
+				return &reauthError{err: err, delay: delay}
+			}
+			glog.Errorf("Session error, starting a new session in %v: %v", delay, err)
+			sleepCtx(ctx, delay)
+		} else {
+			sessionRetry.Reset()
+			if !*loopMode {
+				break
+			}
+			glog.V(vEvent).Info("Session ended, starting a new session...")
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// runSession runs a single dialog session on the connection until the server
+// finishes it. The session is finished from the client side when ctx is done,
+// the -session-timeout elapses or src is exhausted.
+func runSession(ctx context.Context, c Transport, session SessionInfo, handler Handler, src AudioSource) error {
+	sessionID := session.ID
+	session.Settings = localizeSession(session.Settings)
+	started, err := startSession(c, sessionID, newStartSessionPayload(session.Settings))
+	if err != nil {
+		return fmt.Errorf("start session %s: %w", sessionID, err)
+	}
+	artifacts.setDialogID(started.DialogID)
+	handler = multiHandler{artifacts, handler}
+	if history != nil {
+		history.SetDialogID(started.DialogID)
+	}
+	glog.V(vEvent).Infof("Session %d started: session_id=%s", session.Seq, sessionID)
+	sessionMetrics.Add("started", 1)
+	currentSessionID.Set(sessionID)
+	handler.OnSessionStart(session)
+	sendGreeting(c, session)
+
+	var sessionCtx context.Context
+	var cancel context.CancelFunc
+	if *sessionTimeout > 0 {
+		sessionCtx, cancel = context.WithTimeout(ctx, *sessionTimeout)
+	} else {
+		sessionCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	state := newSessionState()
+	g, gctx := errgroup.WithContext(sessionCtx)
+	// 发送音频流到服务端
+	g.Go(func() error {
+		return sendAudio(gctx, c, sessionID, state, src)
+	})
+	// 接收服务端返回数据。ctx 结束后先等待服务端正常结束会话，超过宽限期再中止读取。
+	recvCtx, abortRecv := context.WithCancel(context.Background())
+	defer abortRecv()
+	stopGrace := context.AfterFunc(ctx, func() {
+		time.AfterFunc(*shutdownGrace, abortRecv)
+	})
+	defer stopGrace()
+	g.Go(func() error {
+		defer state.End()
+		return realtimeAPIOutputAudio(recvCtx, c, handler)
+	})
+	return g.Wait()
+}
+
+// dialDialog opens the websocket connection to the realtime dialogue service.
+func dialDialog(ctx context.Context, cfg *Config) (Transport, *http.Response, error) {
+	return dialDialogWithID(ctx, cfg, uuid.New().String())
+}
 
-	if err := portaudio.Initialize(); err != nil {
-		glog.Fatalf("portaudio initialize error: %v", err)
-		return
+// dialDialogWithID is dialDialog with the given connect ID.
+func dialDialogWithID(ctx context.Context, cfg *Config, connectID string) (Transport, *http.Response, error) {
+	endpoint := wsURL.String()
+	if cfg.Endpoint != "" {
+		endpoint = cfg.Endpoint
 	}
+	return dialTransport(ctx, endpoint, dialog.Header(dialog.Config{AppID: cfg.AppID, AccessKey: cfg.AccessToken, AppKey: cfg.AppKey}, connectID))
+}
+
+func run() error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer func() {
-		err := portaudio.Terminate()
+	defer stop()
+
+	ids, err := newSessionIDs(*sessionIDFlag)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	resolveCredentials(cfg)
+	if cfg.Devices != nil {
+		devicePrefs = *cfg.Devices
+	}
+	if audioSettings, err = resolveAudioSettings(cfg.Audio); err != nil {
+		return fmt.Errorf("audio settings: %w", err)
+	}
+	if err := applyConfig(cfg); err != nil {
+		return err
+	}
+	if err := setupRedaction(); err != nil {
+		return err
+	}
+	if err := setupContentFilter(); err != nil {
+		return err
+	}
+	if err := validateConfidence(); err != nil {
+		return err
+	}
+	if err := checkEncryptionKey(); err != nil {
+		return fmt.Errorf("encryption key: %w", err)
+	}
+	if err := validatePathTemplates(); err != nil {
+		return err
+	}
+	watchReload(ctx, cfg)
+
+	if name := flag.Arg(0); name != "" {
+		cmd, ok := commands[name]
+		if !ok {
+			return fmt.Errorf("unknown command: %s", name)
+		}
+		if err := cmd(ctx, cfg); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+
+	serveMetrics()
+	return runDialog(ctx, cfg, ids)
+}
+
+// runDialog runs the dialog on the configured input and outputs until ctx is
+// done or the dialog ends. The events are also passed to extra.
+func runDialog(ctx context.Context, cfg *Config, ids *sessionIDs, extra ...Handler) error {
+	usage := newUsageTracker()
+	defer usage.Report(os.Stderr)
+	sinks, speaker, err := openSinks()
+	if err != nil {
+		return err
+	}
+	defer closeSinks(sinks)
+	speech := newTextQueue()
+	handlers := multiHandler{usage, newLatencyTracker(), speech, sinkFanout{sinks: sinks}}
+	handlers = append(handlers, extra...)
+	if *enableTools {
+		tools := newToolDispatcher(ctx, speech, defaultTools())
+		defer tools.Wait()
+		handlers = append(handlers, tools)
+	}
+	src, err := openInput()
+	if err != nil {
+		return err
+	}
+	// 只有本地麦克风与扬声器需要音频后端，无 cgo 的构建仍可使用文件、网络与标准输入输出
+	if _, mic := src.(micSource); mic || speaker {
+		if audioBackend, err = openAudioBackend(); err != nil {
+			return err
+		}
+		defer func() {
+			err := audioBackend.Close()
+			if err != nil {
+				glog.Errorf("Failed to close the audio backend: %v", err)
+			}
+		}()
+	}
+	// 先缓冲再处理：bufferBetweenSessions 按来源的类型判断是否为实时音频
+	src, stopCapture := bufferBetweenSessions(ctx, src)
+	defer stopCapture()
+	if src, err = processCapture(src); err != nil {
+		return err
+	}
+	src = muteSource{src: src}
+	watchControlSignals(ctx)
+	if err := startPushToTalk(ctx); err != nil {
+		return err
+	}
+	if speaker {
+		src = duckOnSpeech(src)
+	}
+	var rec *sessionRecorder
+	if *recordDir != "" {
+		recoverRecordings(*recordDir)
+		rec = newSessionRecorder(*recordDir)
+		defer rec.Close()
+		handlers = append(handlers, rec)
+		src = rec.Tap(src)
+	}
+	if *conversationPath != "" {
+		conv, err := LoadConversation(*conversationPath)
 		if err != nil {
-			glog.Errorf("Failed to terminate portaudio: %v", err)
+			return err
 		}
-		stop()
-	}()
-
-	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL.String(), http.Header{
-		"X-Api-Resource-Id": []string{"volc.speech.dialog"},
-		"X-Api-Access-Key":  []string{accessToken},
-		"X-Api-App-Key":     []string{"PlgvMymc7f3tQnJ6"},
-		"X-Api-App-ID":      []string{appid},
-		"X-Api-Connect-Id":  []string{uuid.New().String()},
-	})
+		history = newConversationRecorder(conv)
+		defer func() {
+			if err := history.Save(*conversationPath); err != nil {
+				glog.Errorf("Save conversation error: %v", err)
+			}
+		}()
+		handlers = append(handlers, history)
+	}
+	notifications, err := newNotificationHandler()
 	if err != nil {
-		glog.Errorf("Websocket dial error: %v", err)
-		return
+		return err
+	}
+	if notifications != nil {
+		handlers = append(handlers, notifications)
+	}
+	if *analyticsPath != "" {
+		w, closeAnalytics, err := openAnalytics(*analyticsPath)
+		if err != nil {
+			return err
+		}
+		defer closeAnalytics()
+		handlers = append(handlers, newConversationAnalytics(w, os.Stderr))
+	}
+	switch {
+	case *jsonOutput:
+		handlers = append(handlers, newJSONEmitter(os.Stdout))
+	case *showTranscript:
+		out := os.Stdout
+		if slices.Contains(sinkSpecs, "stdout") {
+			out = os.Stderr // 标准输出用于音频
+		}
+		transcript := newTranscriptPrinter(out, isTerminal(out))
+		defer transcript.Close()
+		handlers = append(handlers, transcript)
+		if *statusLine && isTerminal(out) {
+			meter := &levelMeter{}
+			src = tapSource{src: src, tap: meter.Process}
+			if !speaker {
+				handlers = append(handlers, botLevelHandler{})
+			}
+			stopStatus := transcript.ShowStatus(func() string { return statusText(meter.Read(), botMeter.Read()) })
+			defer stopStatus()
+			// 状态行代替逐条的事件日志
+			if !verbosityFlagIsSet() && cfg.LogLevel == "" {
+				_ = flag.Set("v", "0")
+			}
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	playerCtx, stopPlayer := context.WithCancel(gctx)
+	if speaker {
+		g.Go(func() error {
+			return startPlayer(playerCtx)
+		})
+	}
+	g.Go(func() error {
+		defer stopPlayer()
+		return runConnections(gctx, cfg, ids, handlers, src, rec, speech)
+	})
+	return g.Wait()
+}
+
+// Backoff of the reconnections after a lost connection, doubled for each
+// consecutive failure to dial.
+const (
+	reconnectBackoff    = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// runConnections runs the dialog on a connection, and on a new one whenever
+// the connection is lost or the retry policy asks to reauthenticate, until
+// ctx is done or the dialog ends.
+func runConnections(ctx context.Context, cfg *Config, ids *sessionIDs, handlers multiHandler, src AudioSource, rec *sessionRecorder, speech *textQueue) error {
+	dialFailures := 0
+	for {
+		err := runConnection(ctx, cfg, ids, handlers, src, rec, speech)
+		var reauth *reauthError
+		var lost *disconnectError
+		switch {
+		case errors.As(err, &reauth):
+			dialFailures = 0
+			glog.Warningf("Reconnecting with reloaded credentials in %v: %v", reauth.delay, reauth.err)
+			sleepCtx(ctx, reauth.delay)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := reloadCredentials(cfg); err != nil {
+				return err
+			}
+		case errors.As(err, &lost):
+			// 已建立的连接断开后很快重连，连续拨号失败时逐次延长等待
+			if lost.dial {
+				dialFailures++
+			} else {
+				dialFailures = 0
+			}
+			delay := backoff(reconnectBackoff, reconnectMaxBackoff, dialFailures+1)
+			glog.Warningf("Connection lost, reconnecting in %v: %v", delay, err)
+			sleepCtx(ctx, delay)
+			if ctx.Err() != nil {
+				return nil
+			}
+		default:
+			return err
+		}
 	}
-	defer func() {
-		if resp != nil {
-			glog.Infof("Websocket dial response logid: %s", resp.Header.Get("X-Tt-Logid"))
+}
+
+// runConnection dials a connection and runs the dialog on it. The logs,
+// errors and metrics are tagged with the identifiers of the connection.
+func runConnection(ctx context.Context, cfg *Config, ids *sessionIDs, handlers multiHandler, src AudioSource, rec *sessionRecorder, speech *textQueue) error {
+	connectID := uuid.New().String()
+	setConnectionState("connecting")
+	defer setConnectionState("closed")
+	conn, resp, err := dialDialogWithID(ctx, cfg, connectID)
+	id := newConnIdentity(resp, connectID)
+	if err != nil {
+		err = fmt.Errorf("websocket dial: %w", err)
+		// 握手被拒绝（如凭证错误）时重连无济于事，只在网络错误与服务端故障时重连
+		if !errors.Is(err, errUnknownTransport) && (resp == nil || resp.StatusCode >= http.StatusInternalServerError) {
+			err = &disconnectError{err: err, dial: true}
 		}
-		_ = conn.Close()
-	}()
+		return id.Wrap(err)
+	}
+	defer conn.Close()
+	conn = disconnectTransport{conn}
+	setConnectionState("connected")
+	glog.V(vEvent).Infof("Connected: %s", id)
+	defer tagLogs(id)()
+	setConnectionMetrics(id)
+	if rec != nil {
+		rec.SetConnection(id)
+	}
+	speech.SetConnection(conn)
+	defer speech.SetConnection(nil)
 
-	realTimeDialog(ctx, conn, uuid.New().String())
+	// 自带大模型通过连接回复，每个连接单独创建
+	var handler Handler = handlers
+	if *llmMode {
+		pipeline := newLLMPipeline(ctx, conn, newOpenAILLM(*llmURL, *llmModel, *llmAPIKey), handlers)
+		playbackGate = pipeline.AllowAudio
+		handler = pipeline
+	}
+	return id.Wrap(realTimeDialog(ctx, conn, ids, handler, src))
 }
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Markdown 导出：export 子命令把一个 -record-dir 录制目录中已结束的对话导出为
+// Markdown，便于贴到 wiki 或 issue 中：输出目录下的 conversation.md 按时间列出
+// 标明说话人的每轮对话，并链接到 audio/ 下该轮用户与机器人的 WAV 音频（按
+// audio_index.jsonl 从 user.wav、bot.wav 中截取）。目录中没有 WAV 音频（-format
+// flac 或 -record-keep-audio=false）时只导出文本；加密的目录需设置
+// -encrypt-at-rest。识别结果带有词的时间时，另外导出逐词计时的 WebVTT 字幕
+// captions.vtt，与 mixed.wav 的时间线对齐。
+
+func init() {
+	commands["export"] = runExport
+}
+
+// exportMessage is a message of a conversation exported to Markdown.
+type exportMessage struct {
+	Role     string        // roleUser or roleAssistant
+	At       time.Duration // from the start of the bundle
+	Text     string
+	From, To float64 // seconds of the bundle whose audio belongs to the message
+	Audio    string  // path of the audio file, relative to the Markdown
+	// Words are the timed words of the user text, in seconds of the audio
+	// of the session, see ASRResult.
+	Words []ASRWord
+}
+
+// runExport implements the `export <bundle> <output dir>` subcommand.
+func runExport(ctx context.Context, cfg *Config) error {
+	bundle, out := flag.Arg(1), flag.Arg(2)
+	if bundle == "" || out == "" {
+		return errors.New("usage: export <recording bundle directory> <output directory>")
+	}
+	data, _, err := readBundleFile(bundle, "events.jsonl")
+	if err != nil {
+		return fmt.Errorf("read events: %w", err)
+	}
+	events, err := parseEvents(data)
+	if err != nil {
+		return err
+	}
+	var meta RecordingMetadata
+	if data, err := os.ReadFile(filepath.Join(bundle, "metadata.json")); err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return fmt.Errorf("parse metadata: %w", err)
+		}
+	}
+	if meta.StartedAt.IsZero() && len(events) > 0 {
+		meta.StartedAt = events[0].Time
+	}
+	messages := exportMessages(events, meta.StartedAt)
+
+	if err := os.MkdirAll(filepath.Join(out, "audio"), 0755); err != nil {
+		return err
+	}
+	index, err := readAudioIndex(bundle)
+	if err != nil {
+		return err
+	}
+	if err := exportAudio(bundle, out, index, messages); err != nil {
+		return err
+	}
+	captions := ""
+	if vtt := formatCaptions(meta, index, messages); vtt != "" {
+		captions = "captions.vtt"
+		if err := writeOutput(filepath.Join(out, captions), []byte(vtt)); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(out, "conversation.md")
+	if err := writeOutput(path, []byte(formatMarkdown(meta, messages, captions))); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d messages of %s to %s\n", len(messages), bundle, path)
+	return nil
+}
+
+// exportMessages returns the messages of the events of a bundle started at
+// start.
+func exportMessages(events []jsonEvent, start time.Time) []exportMessage {
+	var messages []exportMessage
+	seconds := func(t time.Time) float64 { return t.Sub(start).Seconds() }
+	var speechStart time.Time
+	replyDone := true // no reply is open
+	for _, ev := range events {
+		last := len(messages) - 1
+		switch ev.Type {
+		case "asr_start":
+			speechStart = ev.Time
+			replyDone = true
+		case "asr_final":
+			if last >= 0 && messages[last].Role == roleUser {
+				// 机器人回复前的多段识别结果属于同一条
+				messages[last].Text = strings.TrimSpace(messages[last].Text + " " + ev.Text)
+				messages[last].To = seconds(ev.Time)
+				messages[last].Words = append(messages[last].Words, ev.Words...)
+				continue
+			}
+			from := speechStart
+			if from.IsZero() {
+				from = ev.Time
+			}
+			messages = append(messages, exportMessage{Role: roleUser, At: from.Sub(start), Text: ev.Text, From: seconds(from), To: seconds(ev.Time), Words: ev.Words})
+			speechStart = time.Time{}
+			replyDone = true
+		case "asr_end":
+			if last >= 0 && messages[last].Role == roleUser {
+				messages[last].To = max(messages[last].To, seconds(ev.Time))
+			}
+		case "bot_text", "audio_chunk_meta":
+			if replyDone {
+				messages = append(messages, exportMessage{Role: roleAssistant, At: ev.Time.Sub(start), From: seconds(ev.Time)})
+				last++
+				replyDone = false
+			}
+			if ev.Type == "bot_text" {
+				messages[last].Text += ev.Text
+			}
+		case "bot_text_end", "session_end":
+			replyDone = true
+		}
+	}
+	// 回复的音频到下一条消息开始为止
+	for i := range messages {
+		if messages[i].Role != roleAssistant {
+			continue
+		}
+		messages[i].To = math.Inf(1)
+		if i+1 < len(messages) {
+			messages[i].To = messages[i+1].From
+		}
+	}
+	return messages
+}
+
+// readAudioIndex returns the entries of the audio_index.jsonl of a bundle,
+// none if it has no index.
+func readAudioIndex(bundle string) ([]AudioIndexEntry, error) {
+	data, _, err := readBundleFile(bundle, "audio_index.jsonl")
+	if err != nil {
+		glog.Warningf("No audio index in %s, exporting the text only: %v", bundle, err)
+		return nil, nil
+	}
+	var index []AudioIndexEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e AudioIndexEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("parse audio index: %w", err)
+		}
+		index = append(index, e)
+	}
+	return index, nil
+}
+
+// exportAudio writes the audio of every message of a bundle to the audio
+// directory of out and sets their Audio.
+func exportAudio(bundle, out string, index []AudioIndexEntry, messages []exportMessage) error {
+	if len(index) == 0 {
+		return nil
+	}
+	streams := map[string][]byte{}
+	for _, stream := range []string{"user", "bot"} {
+		data, _, err := readBundleFile(bundle, stream+".wav")
+		if err != nil || len(data) < 44 || string(data[:4]) != "RIFF" {
+			glog.Warningf("No WAV audio of the %s in %s, exporting its text only", stream, bundle)
+			continue
+		}
+		streams[stream] = data
+	}
+
+	for i := range messages {
+		m := &messages[i]
+		stream := "user"
+		if m.Role == roleAssistant {
+			stream = "bot"
+		}
+		wav, ok := streams[stream]
+		if !ok {
+			continue
+		}
+		// 音频块按顺序写入，属于消息的块在文件中连续
+		begin, end := -1, 0
+		for _, e := range index {
+			if e.Stream == stream && e.Arrival >= m.From && e.Arrival < m.To {
+				if begin < 0 {
+					begin = e.Offset
+				}
+				end = e.Offset + e.Bytes
+			}
+		}
+		if begin < 0 || 44+end > len(wav) {
+			continue
+		}
+		name := fmt.Sprintf("%02d-%s.wav", i+1, stream)
+		if err := writeOutput(filepath.Join(out, "audio", name), sliceWAV(wav, begin, end)); err != nil {
+			return err
+		}
+		m.Audio = "audio/" + name
+	}
+	return nil
+}
+
+// sliceWAV returns the WAV file of the audio data from begin to end of wav,
+// which has the 44-byte header of the recorder.
+func sliceWAV(wav []byte, begin, end int) []byte {
+	out := make([]byte, 0, 44+end-begin)
+	out = append(out, wav[:44]...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(36+end-begin))
+	binary.LittleEndian.PutUint32(out[40:], uint32(end-begin))
+	return append(out, wav[44+begin:44+end]...)
+}
+
+// formatCaptions returns the WebVTT captions of the timed words of the user
+// messages, on the timeline of the bundle, or "" if there are none. The
+// words are timed from the start of the audio of the session, so only the
+// first part of a session can be captioned.
+func formatCaptions(meta RecordingMetadata, index []AudioIndexEntry, messages []exportMessage) string {
+	if meta.Part > 1 {
+		return ""
+	}
+	start := -1.0 // of the user audio in the bundle
+	for _, e := range index {
+		if e.Stream == "user" {
+			start = e.Arrival
+			break
+		}
+	}
+	if start < 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, m := range messages {
+		if len(m.Words) == 0 {
+			continue
+		}
+		// 中文的词之间没有空格
+		sep := ""
+		if strings.Contains(m.Text, " ") {
+			sep = " "
+		}
+		at := func(t float64) string { return vttTimestamp(start + t) }
+		fmt.Fprintf(&b, "\n%s --> %s\n<v User>", at(m.Words[0].StartTime), at(m.Words[len(m.Words)-1].EndTime))
+		for i, w := range m.Words {
+			if i > 0 {
+				fmt.Fprintf(&b, "%s<%s>", sep, at(w.StartTime))
+			}
+			b.WriteString(vttEscaper.Replace(w.Text))
+		}
+		b.WriteString("\n")
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "WEBVTT\n" + b.String()
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp, e.g. 00:01:02.345.
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(max(seconds, 0) * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// formatMarkdown returns the Markdown of the conversation of a bundle, with
+// a link to its captions file if any.
+func formatMarkdown(meta RecordingMetadata, messages []exportMessage, captions string) string {
+	var b strings.Builder
+	title := "Conversation"
+	if meta.SessionID != "" {
+		title += " " + meta.SessionID
+	}
+	fmt.Fprintf(&b, "# %s\n\n", markdownEscape(title))
+	fmt.Fprintf(&b, "- Started: %s\n", meta.StartedAt.Format("2006-01-02 15:04:05"))
+	if meta.DurationSeconds > 0 {
+		fmt.Fprintf(&b, "- Duration: %v\n", time.Duration(meta.DurationSeconds*float64(time.Second)).Round(time.Second))
+	}
+	if meta.LogID != "" {
+		fmt.Fprintf(&b, "- Log ID: `%s`\n", meta.LogID)
+	}
+	if meta.Truncated {
+		b.WriteString("- Recovered from an interrupted recording\n")
+	}
+	if captions != "" {
+		fmt.Fprintf(&b, "- Captions: [%s](%s)\n", captions, captions)
+	}
+	for _, m := range messages {
+		speaker := "User"
+		if m.Role == roleAssistant {
+			speaker = "Bot"
+		}
+		text := markdownEscape(m.Text)
+		if text == "" {
+			text = "*(no text)*"
+		}
+		fmt.Fprintf(&b, "\n**%s** `%s`: %s", speaker, formatOffset(m.At), text)
+		if m.Audio != "" {
+			fmt.Fprintf(&b, " ([audio](%s))", m.Audio)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// formatOffset formats d as minutes and seconds, e.g. 01:02.3.
+func formatOffset(d time.Duration) string {
+	d = max(d, 0).Round(100 * time.Millisecond)
+	return fmt.Sprintf("%02d:%04.1f", int(d/time.Minute), (d % time.Minute).Seconds())
+}
+
+// markdownReplacer escapes the characters of text that Markdown would
+// format.
+var markdownReplacer = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "#", `\#`, "|", `\|`, "\n", " ",
+)
+
+func markdownEscape(text string) string {
+	return markdownReplacer.Replace(text)
+}
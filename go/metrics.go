@@ -0,0 +1,52 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+var (
+	metricsAddr = flag.String("metrics-addr", "", "serve metrics at http://`addr`/debug/vars when set, e.g. :9090")
+
+	usageMetrics     = expvar.NewMap("usage")
+	sessionMetrics   = expvar.NewMap("sessions")
+	currentSessionID = expvar.NewString("session_id")
+	// connectionMetrics identifies the dialog connection: logid and connect_id.
+	connectionMetrics = expvar.NewMap("connection")
+	// bufferMetrics are the depths of the audio and text queues, read when
+	// the metrics are.
+	bufferMetrics = expvar.NewMap("buffers")
+)
+
+// serveMetrics serves the expvar metrics on the -metrics-addr, if set.
+func serveMetrics() {
+	if *metricsAddr == "" {
+		return
+	}
+	go func() {
+		glog.V(vEvent).Infof("Serving metrics at %s", *metricsAddr)
+		if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
+			glog.Errorf("Serve metrics error: %v", err)
+		}
+	}()
+}
+
+// setConnectionState exports the state of the dialog connection:
+// connecting, connected or closed.
+func setConnectionState(state string) {
+	v := new(expvar.String)
+	v.Set(state)
+	connectionMetrics.Set("state", v)
+}
+
+// setConnectionMetrics exports the identifiers of the dialog connection.
+func setConnectionMetrics(id connIdentity) {
+	for key, value := range map[string]string{"logid": id.LogID, "connect_id": id.ConnectID} {
+		v := new(expvar.String)
+		v.Set(value)
+		connectionMetrics.Set(key, v)
+	}
+}
@@ -0,0 +1,160 @@
+// Package mobile wraps the dialog client for gomobile bind, so that Android
+// and iOS apps can embed it, with the audio captured and played by the
+// platform layer.
+//
+// Its API uses only the types gomobile can bind: strings, byte slices,
+// integers, errors and interfaces of such methods, implemented in Java or
+// Objective-C.
+package mobile
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"RealtimeDialog/dialog"
+	"github.com/google/uuid"
+)
+
+// 移动端绑定：gomobile bind -target=android ./mobile（或 -target=ios）生成
+// Android 的 .aar 与 iOS 的 .xcframework。音频由平台层采集与播放：SendAudio
+// 推送 S16LE 用户音频，Listener.OnAudio 收到会话输出格式的机器人音频。
+
+// Listener receives the events of a session, on a goroutine of the client.
+type Listener interface {
+	// OnEvent is called with each server event and its JSON payload, for
+	// example 451 (ASRResponse) with the recognized text.
+	OnEvent(event int32, payload string)
+	// OnAudio is called with each chunk of bot audio.
+	OnAudio(data []byte)
+	// OnClose is called once the session has ended, with an empty message or
+	// the error that ended it.
+	OnClose(message string)
+}
+
+// stopTimeout bounds the wait of Stop for the server to finish the session,
+// after which the connection is closed.
+const stopTimeout = 5 * time.Second
+
+// Client runs a dialog session.
+type Client struct {
+	cfg dialog.Config
+
+	mu        sync.Mutex
+	client    *dialog.Client
+	sessionID string
+	cancel    context.CancelFunc // aborts the reads of the session
+	done      chan struct{}
+}
+
+// NewClient returns a client with the credentials of the app. An empty
+// endpoint uses the public API.
+func NewClient(endpoint, appID, accessKey, appKey string) *Client {
+	return &Client{cfg: dialog.Config{Endpoint: endpoint, AppID: appID, AccessKey: accessKey, AppKey: appKey}}
+}
+
+// Start connects and starts a session with sessionConfig, the StartSession
+// payload as JSON, and returns the session ID. It blocks until the session
+// has started: call it off the UI thread. The events of the session go to
+// listener until its OnClose, after which another session can start.
+func (c *Client) Start(sessionConfig string, listener Listener) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		return "", errors.New("session already started")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client, _, err := dialog.Dial(ctx, c.cfg)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	sessionID := uuid.New().String()
+	if _, err := client.StartSession(ctx, sessionID, []byte(sessionConfig)); err != nil {
+		client.Close()
+		cancel()
+		return "", err
+	}
+	done := make(chan struct{})
+	c.client, c.sessionID, c.cancel, c.done = client, sessionID, cancel, done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		message := ""
+		if err := client.Receive(ctx, listenerHandler{listener}); err != nil {
+			message = err.Error()
+		}
+		if err := client.Close(); err != nil && message == "" {
+			message = err.Error()
+		}
+		c.mu.Lock()
+		if c.client == client {
+			c.client = nil
+		}
+		c.mu.Unlock()
+		listener.OnClose(message)
+	}()
+	return sessionID, nil
+}
+
+// SendAudio sends a chunk of user audio, S16LE at the input rate of the
+// session.
+func (c *Client) SendAudio(data []byte) error {
+	client, sessionID, err := c.session()
+	if err != nil {
+		return err
+	}
+	return client.SendAudio(sessionID, data)
+}
+
+// SendText sends a text query of the user.
+func (c *Client) SendText(text string) error {
+	client, sessionID, err := c.session()
+	if err != nil {
+		return err
+	}
+	return client.SendText(sessionID, text)
+}
+
+// Stop finishes the session and waits for the OnClose of the listener. If
+// the server does not finish the session within a few seconds, the
+// connection is closed. It does nothing once the session has ended.
+func (c *Client) Stop() error {
+	c.mu.Lock()
+	client, sessionID, cancel, done := c.client, c.sessionID, c.cancel, c.done
+	c.client = nil
+	c.mu.Unlock()
+	if client == nil {
+		return nil
+	}
+	err := client.FinishSession(sessionID)
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		cancel()
+		<-done
+	}
+	return err
+}
+
+func (c *Client) session() (*dialog.Client, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil, "", errors.New("no session started")
+	}
+	return c.client, c.sessionID, nil
+}
+
+// listenerHandler delivers the events of a dialog.Client to a Listener.
+type listenerHandler struct{ l Listener }
+
+func (h listenerHandler) OnEvent(event int32, payload []byte) {
+	h.l.OnEvent(event, string(payload))
+}
+
+func (h listenerHandler) OnAudio(data []byte) {
+	h.l.OnAudio(data)
+}
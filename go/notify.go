@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"RealtimeDialog/dialog"
+	"github.com/golang/glog"
+)
+
+// 桌面通知：作为后台助手运行时，-notify 选择的通知方式在会话开始与结束、出错
+// 以及终端窗口不在前台时机器人提问（回复以问号结尾）时弹出桌面通知，-notify-on
+// 选择其中的事件。内置 notify-send（Linux）、osascript（macOS）与 powershell
+// （Windows）三种通知方式，auto 按系统选择；exec:<程序> 以标题与正文为参数运行
+// 任意程序（同时放在 NOTIFY_TITLE、NOTIFY_BODY 环境变量中）；其他方式在单独
+// 文件的 init 中注册到 notifiers。终端窗口是否在前台由 xdotool 与 $WINDOWID
+// （X11）或 System Events（macOS 的 Terminal 与 iTerm2）判断，无法判断时视为
+// 不在前台。通知正文按 -redact-pii 脱敏。
+
+var (
+	notifyWith = flag.String("notify", "", "show desktop notifications with `notifier`: auto, notify-send, osascript, powershell, exec:<program> (run with the title and body as arguments) or those registered in notifiers")
+	notifyOn   = flag.String("notify-on", "session,error,question", "comma-separated `events` shown by -notify: session (start and end), error and question (the bot asks a question while the terminal is in the background)")
+)
+
+// notifyTimeout bounds the time taken to show a notification.
+const notifyTimeout = 5 * time.Second
+
+// Notifier shows desktop notifications.
+type Notifier interface {
+	Notify(ctx context.Context, title, body string) error
+}
+
+// notifiers are the notifiers selectable with -notify, by name.
+var notifiers = map[string]Notifier{}
+
+func init() {
+	notifiers["notify-send"] = commandNotifier(func(ctx context.Context, title, body string) *exec.Cmd {
+		return exec.CommandContext(ctx, "notify-send", "--app-name=realtimedialog", title, body)
+	})
+	notifiers["osascript"] = commandNotifier(func(ctx context.Context, title, body string) *exec.Cmd {
+		// 标题与正文经环境变量传入，无需转义
+		return exec.CommandContext(ctx, "osascript", "-e", `display notification (system attribute "NOTIFY_BODY") with title (system attribute "NOTIFY_TITLE")`)
+	})
+	notifiers["powershell"] = commandNotifier(func(ctx context.Context, title, body string) *exec.Cmd {
+		return exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", powershellToast)
+	})
+}
+
+// powershellToast shows $env:NOTIFY_TITLE and $env:NOTIFY_BODY as a toast.
+const powershellToast = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode($env:NOTIFY_TITLE)) > $null
+$x.Item(1).AppendChild($t.CreateTextNode($env:NOTIFY_BODY)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('RealtimeDialog').Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+
+// commandNotifier shows notifications by running the command it returns,
+// with the title and body in $NOTIFY_TITLE and $NOTIFY_BODY.
+type commandNotifier func(ctx context.Context, title, body string) *exec.Cmd
+
+func (n commandNotifier) Notify(ctx context.Context, title, body string) error {
+	cmd := n(ctx, title, body)
+	cmd.Env = append(os.Environ(), "NOTIFY_TITLE="+title, "NOTIFY_BODY="+body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd.Path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// openNotifier returns the notifier of -notify, nil if it is not set.
+func openNotifier() (Notifier, error) {
+	name := *notifyWith
+	switch {
+	case name == "":
+		return nil, nil
+	case name == "auto":
+		switch runtime.GOOS {
+		case "darwin":
+			name = "osascript"
+		case "windows":
+			name = "powershell"
+		default:
+			name = "notify-send"
+		}
+	case strings.HasPrefix(name, "exec:"):
+		program := strings.TrimPrefix(name, "exec:")
+		return commandNotifier(func(ctx context.Context, title, body string) *exec.Cmd {
+			return exec.CommandContext(ctx, program, title, body)
+		}), nil
+	}
+	n, ok := notifiers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown notifier %q", name)
+	}
+	return n, nil
+}
+
+// notificationHandler is a Handler showing the events of -notify-on as
+// desktop notifications.
+type notificationHandler struct {
+	NopHandler
+	notifier Notifier
+	events   map[string]bool
+
+	mu    sync.Mutex
+	reply strings.Builder
+}
+
+// newNotificationHandler returns the handler of -notify, nil if it is not
+// set.
+func newNotificationHandler() (*notificationHandler, error) {
+	notifier, err := openNotifier()
+	if err != nil || notifier == nil {
+		return nil, err
+	}
+	h := &notificationHandler{notifier: notifier, events: map[string]bool{}}
+	for _, event := range strings.Split(*notifyOn, ",") {
+		switch event = strings.TrimSpace(event); event {
+		case "session", "error", "question":
+			h.events[event] = true
+		default:
+			return nil, fmt.Errorf("unknown -notify-on event %q", event)
+		}
+	}
+	return h, nil
+}
+
+// notify shows a notification in the background.
+func (h *notificationHandler) notify(event, title, body string) {
+	if !h.events[event] {
+		return
+	}
+	body = redactText(body)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := h.notifier.Notify(ctx, title, body); err != nil {
+			glog.Warningf("Show notification: %v", err)
+		}
+	}()
+}
+
+func (h *notificationHandler) OnSessionStart(session SessionInfo) {
+	h.mu.Lock()
+	h.reply.Reset()
+	h.mu.Unlock()
+	h.notify("session", "Dialog session started", fmt.Sprintf("Session %d: %s", session.Seq, session.ID))
+}
+
+func (h *notificationHandler) OnBotText(text string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reply.WriteString(text)
+}
+
+func (h *notificationHandler) OnBotTextEnd() {
+	h.mu.Lock()
+	reply := strings.TrimSpace(h.reply.String())
+	h.reply.Reset()
+	h.mu.Unlock()
+	if !h.events["question"] || !isQuestion(reply) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if !terminalFocused(ctx) {
+			h.notify("question", "The bot asks", reply)
+		}
+	}()
+}
+
+func (h *notificationHandler) OnError(err error) {
+	h.notify("error", "Dialog error", err.Error())
+}
+
+func (h *notificationHandler) OnSessionEnd(event int32, payload []byte) {
+	body := "The session finished"
+	if event == dialog.EventSessionFailed {
+		body = "The session failed: " + string(payload)
+	}
+	h.notify("session", "Dialog session ended", body)
+}
+
+// isQuestion reports whether the bot reply ends with a question mark.
+func isQuestion(reply string) bool {
+	reply = strings.TrimRight(reply, " \n\"'”’」』)）~～")
+	return strings.HasSuffix(reply, "?") || strings.HasSuffix(reply, "？")
+}
+
+// terminalFocused reports whether the terminal window running the program is
+// in the foreground, false when it cannot tell.
+func terminalFocused(ctx context.Context) bool {
+	switch runtime.GOOS {
+	case "darwin":
+		app := map[string]string{"Apple_Terminal": "Terminal", "iTerm.app": "iTerm2"}[os.Getenv("TERM_PROGRAM")]
+		if app == "" {
+			return false
+		}
+		out, err := exec.CommandContext(ctx, "osascript", "-e", `tell application "System Events" to get name of first application process whose frontmost is true`).Output()
+		return err == nil && strings.TrimSpace(string(out)) == app
+	case "linux", "freebsd", "netbsd", "openbsd":
+		window := os.Getenv("WINDOWID")
+		if window == "" {
+			return false
+		}
+		out, err := exec.CommandContext(ctx, "xdotool", "getactivewindow").Output()
+		return err == nil && strings.TrimSpace(string(out)) == window
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+//go:build telegram || opus
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Ogg 容器的最小实现，只覆盖 Ogg/Opus 所需的部分：读取单个逻辑流的数据包，
+// 以及把 Opus 帧封装为每页一个数据包的 Ogg/Opus 流。
+
+// opusPreSkip is the number of 48 kHz samples the decoder drops at the start
+// of a stream, the usual encoder lookahead.
+const opusPreSkip = 312
+
+var errInvalidOggPage = errors.New("invalid ogg page")
+
+var oggCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func oggCRC(b []byte) uint32 {
+	var crc uint32
+	for _, v := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// readOggPackets returns the packets of the first logical stream of an Ogg
+// file. Pages of other streams are skipped.
+func readOggPackets(data []byte) ([][]byte, error) {
+	var (
+		packets [][]byte
+		partial []byte
+		serial  uint32
+		first   = true
+	)
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" {
+			return nil, errInvalidOggPage
+		}
+		pageSerial := binary.LittleEndian.Uint32(data[14:18])
+		segments := int(data[26])
+		if len(data) < 27+segments {
+			return nil, fmt.Errorf("%w: truncated segment table", errInvalidOggPage)
+		}
+		table := data[27 : 27+segments]
+		body := data[27+segments:]
+		size := 0
+		for _, l := range table {
+			size += int(l)
+		}
+		if len(body) < size {
+			return nil, fmt.Errorf("%w: truncated page", errInvalidOggPage)
+		}
+		data = body[size:]
+
+		if first {
+			serial, first = pageSerial, false
+		} else if pageSerial != serial {
+			continue
+		}
+		off := 0
+		for _, l := range table {
+			partial = append(partial, body[off:off+int(l)]...)
+			off += int(l)
+			if l < 255 {
+				packets = append(packets, partial)
+				partial = nil
+			}
+		}
+	}
+	return packets, nil
+}
+
+// opusHeadChannels returns the channel count of an OpusHead packet.
+func opusHeadChannels(head []byte) (int, error) {
+	if len(head) < 19 || string(head[:8]) != "OpusHead" {
+		return 0, errors.New("missing OpusHead")
+	}
+	return int(head[9]), nil
+}
+
+// Ogg page header types.
+const (
+	oggBOS = 0x02 // first page of a logical stream
+	oggEOS = 0x04 // last page of a logical stream
+)
+
+// oggWriter writes a logical Ogg stream, one packet per page.
+type oggWriter struct {
+	w      io.Writer
+	serial uint32
+	seq    uint32
+}
+
+func (o *oggWriter) writePage(packet []byte, granule uint64, headerType byte) error {
+	page := make([]byte, 27, 27+len(packet)/255+1+len(packet))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.seq)
+	o.seq++
+	n := len(packet)
+	for ; n >= 255; n -= 255 {
+		page = append(page, 255)
+	}
+	page = append(page, byte(n))
+	page[26] = byte(len(page) - 27)
+	page = append(page, packet...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	_, err := o.w.Write(page)
+	return err
+}
+
+// writeOpusHeaders writes the OpusHead and OpusTags pages. inputRate is
+// recorded in OpusHead as the rate of the original audio.
+func (o *oggWriter) writeOpusHeaders(channels, inputRate int) error {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], uint32(inputRate))
+	if err := o.writePage(head, 0, oggBOS); err != nil {
+		return err
+	}
+
+	const vendor = "RealtimeDialog"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	return o.writePage(tags, 0, 0)
+}
+
+// writeOggOpus wraps 20ms Opus frames, encoded at 48 kHz, in an Ogg/Opus
+// file.
+func writeOggOpus(frames [][]byte, channels, inputRate int) []byte {
+	var buf bytes.Buffer
+	o := &oggWriter{w: &buf, serial: 1}
+	_ = o.writeOpusHeaders(channels, inputRate)
+	for i, frame := range frames {
+		var headerType byte
+		if i == len(frames)-1 {
+			headerType = oggEOS
+		}
+		_ = o.writePage(frame, uint64(i+1)*960, headerType)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,92 @@
+//go:build telegram || opus
+
+package main
+
+import (
+	"fmt"
+
+	"RealtimeDialog/pcm"
+	"layeh.com/gopus"
+)
+
+// opusFrameSize is the number of 48 kHz samples per channel of each 20ms
+// Opus frame.
+const opusFrameSize = 960
+
+func init() {
+	sinkFactories["ogg"] = newOggSink
+}
+
+// newOggSink records the bot audio to an Ogg/Opus file as it arrives, one
+// page per 20ms frame, so that the file is playable even if the process dies
+// mid-session. Interrupted audio is kept, as received.
+func newOggSink(path string) (AudioSink, error) {
+	channels := audioSettings.OutputChannels
+	if channels != 1 && channels != 2 {
+		return nil, fmt.Errorf("opus does not support %d channels", channels)
+	}
+	enc, err := gopus.NewEncoder(48000, channels, gopus.Audio)
+	if err != nil {
+		return nil, fmt.Errorf("create opus encoder: %w", err)
+	}
+	f, err := createAtomicOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	o := &oggWriter{w: f, serial: 1}
+	if err := o.writeOpusHeaders(channels, audioSettings.OutputSampleRate); err != nil {
+		f.Abort()
+		return nil, err
+	}
+	var (
+		rs      = newResampler(audioSettings.OutputSampleRate, 48000, channels)
+		pending []int16 // 48 kHz samples of the next frame
+		held    []byte  // 最后一帧留到关闭时写入，以便标记流结束
+		frames  uint64
+		samples uint64 // 48 kHz samples per channel encoded, without padding
+	)
+	encode := func(frame []int16) error {
+		packet, err := enc.Encode(frame, opusFrameSize, 4000)
+		if err != nil {
+			return fmt.Errorf("encode opus frame: %w", err)
+		}
+		if held != nil {
+			frames++
+			if err := o.writePage(held, frames*opusFrameSize, 0); err != nil {
+				return err
+			}
+		}
+		held = packet
+		return nil
+	}
+	frame := opusFrameSize * channels
+	s := newQueuedSink("ogg:"+path, func(chunk []byte) error {
+		in := rs.Process(pcm.Float32ToInt16(decodeOutputAudio(chunk)))
+		samples += uint64(len(in) / channels)
+		pending = append(pending, in...)
+		for len(pending) >= frame {
+			if err := encode(pending[:frame]); err != nil {
+				return err
+			}
+			pending = pending[frame:]
+		}
+		return nil
+	}, func() error {
+		var err error
+		if len(pending) > 0 {
+			err = encode(append(pending, make([]int16, frame-len(pending))...))
+		}
+		if err == nil && held != nil {
+			// 结束位置去掉末帧补齐的静音
+			frames++
+			granule := min(frames*opusFrameSize, opusPreSkip+samples)
+			err = o.writePage(held, granule, oggEOS)
+		}
+		if err != nil {
+			f.Abort()
+			return err
+		}
+		return f.Close()
+	})
+	return fileSink{s}, nil
+}
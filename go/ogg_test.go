@@ -0,0 +1,27 @@
+//go:build telegram || opus
+
+package main
+
+import "testing"
+
+// FuzzReadOggPackets feeds arbitrary files to the Ogg demuxer of the
+// Telegram voice messages.
+func FuzzReadOggPackets(f *testing.F) {
+	f.Add(writeOggOpus([][]byte{{0xF8, 0xFF, 0xFE}, {0xF8}}, 1, 48000))
+	f.Add(writeOggOpus([][]byte{make([]byte, 600)}, 2, 16000))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packets, err := readOggPackets(data)
+		if err != nil || len(packets) == 0 {
+			return
+		}
+		size := 0
+		for _, p := range packets {
+			size += len(p)
+		}
+		if size > len(data) {
+			t.Fatalf("read %d bytes of packets from %d bytes", size, len(data))
+		}
+		_, _ = opusHeadChannels(packets[0])
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 输出路径模板：-save-audio、-sink 的文件路径与 -record-dir 都可以写成
+// recordings/{date}/{dialog_id}/{session_id}-{turn}.wav 这样的模板，占位符有
+// {date}（会话开始的日期，2006-01-02）、{time}（会话开始的时间，150405）、
+// {session_id}、{dialog_id}、{seq}（连接上的会话序号）与 {turn}（会话中机器人
+// 回复的序号，从 1 开始）。展开结果变化时（新的会话或回复）关闭当前文件并打开新
+// 文件，所需目录自动创建；不含占位符的路径与以前一样只写一个文件。
+
+var saveAudio = flag.String("save-audio", "output.wav", "path `template` of the WAV file saving the bot audio played on the speaker, with {date}, {time}, {session_id}, {dialog_id}, {seq} and {turn}; empty disables")
+
+// pathPlaceholder matches the placeholders of the path templates.
+var pathPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// pathVars are the values of the placeholders of the path templates.
+type pathVars struct {
+	Started   time.Time // of the session
+	SessionID string
+	DialogID  string
+	Seq       int
+	Turn      int
+}
+
+// expand returns the path of template with the placeholders replaced.
+func (v pathVars) expand(template string) string {
+	started := v.Started
+	if started.IsZero() {
+		started = time.Now()
+	}
+	return pathPlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		switch p[1 : len(p)-1] {
+		case "date":
+			return started.Format("2006-01-02")
+		case "time":
+			return started.Format("150405")
+		case "session_id":
+			return v.SessionID
+		case "dialog_id":
+			return v.DialogID
+		case "seq":
+			return strconv.Itoa(v.Seq)
+		case "turn":
+			return strconv.Itoa(v.Turn)
+		}
+		return p
+	})
+}
+
+// validatePathTemplate checks the placeholders of template.
+func validatePathTemplate(template string) error {
+	for _, m := range pathPlaceholder.FindAllStringSubmatch(template, -1) {
+		switch m[1] {
+		case "date", "time", "session_id", "dialog_id", "seq", "turn":
+		default:
+			return fmt.Errorf("unknown placeholder %s in path %q", m[0], template)
+		}
+	}
+	return nil
+}
+
+// validatePathTemplates checks the path template flags.
+func validatePathTemplates() error {
+	for _, template := range []string{*saveAudio, *recordDir} {
+		if err := validatePathTemplate(template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// artifactState tracks the session and turn of the dialog for the path
+// templates. It is a Handler of every session, see runSession.
+type artifactState struct {
+	NopHandler
+
+	mu   sync.Mutex
+	vars pathVars
+}
+
+// artifacts is the state of the current session.
+var artifacts = &artifactState{}
+
+// Vars returns the values of the placeholders for the current session.
+func (a *artifactState) Vars() pathVars {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.vars
+}
+
+func (a *artifactState) setDialogID(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.vars.DialogID = id
+}
+
+func (a *artifactState) OnSessionStart(session SessionInfo) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.vars = pathVars{Started: time.Now(), SessionID: session.ID, DialogID: a.vars.DialogID, Seq: session.Seq, Turn: 1}
+}
+
+func (a *artifactState) OnBotSpeechEnd() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.vars.Turn++
+}
+
+// templatedSink writes to the sink opened on the path expanded from a
+// template, reopening it whenever the expansion changes. The first sink is
+// opened with the first audio.
+type templatedSink struct {
+	template string
+	open     func(path string) (AudioSink, error)
+
+	mu   sync.Mutex
+	path string
+	sink AudioSink // nil if the path failed to open
+}
+
+func newTemplatedSink(template string, open func(path string) (AudioSink, error)) (*templatedSink, error) {
+	if err := validatePathTemplate(template); err != nil {
+		return nil, err
+	}
+	return &templatedSink{template: template, open: open}, nil
+}
+
+func (s *templatedSink) Write(chunk []byte) {
+	path := artifacts.Vars().expand(s.template)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if path != s.path {
+		s.closeLocked()
+		s.path = path
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			glog.Errorf("Create the directory of %s: %v", path, err)
+			return
+		}
+		var err error
+		if s.sink, err = s.open(path); err != nil {
+			glog.Errorf("Open %s: %v", path, err)
+			return
+		}
+		glog.V(vEvent).Infof("Writing the bot audio to %s", path)
+	}
+	if s.sink != nil {
+		s.sink.Write(chunk)
+	}
+}
+
+func (s *templatedSink) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sink != nil {
+		s.sink.Flush()
+	}
+}
+
+func (s *templatedSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeLocked()
+}
+
+func (s *templatedSink) closeLocked() error {
+	if s.sink == nil {
+		return nil
+	}
+	err := s.sink.Close()
+	if err != nil {
+		glog.Errorf("Close %s: %v", s.path, err)
+	}
+	s.sink = nil
+	return err
+}
+
+// hasPathPlaceholders reports whether path is a template.
+func hasPathPlaceholders(path string) bool {
+	return strings.Contains(path, "{") && pathPlaceholder.MatchString(path)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 多声道输出路由：在多声道声卡上把机器人音频送到指定的输出声道（例如接扩声系统
+// 的 3、4 声道），而不是总从第 1 声道开始输出。
+
+var outputRoute = flag.String("output-route", "", "play the bot audio on these output channels of the device, counted from 1, e.g. \"3,4\" or \"3-4\"; with as many channels as the audio each gets its own, otherwise each gets the mix")
+
+// parseOutputRoute parses -output-route into channel indexes from 0.
+func parseOutputRoute(spec string) ([]int, error) {
+	var route []int
+	for _, part := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			last = first
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, fmt.Errorf("parse output channel %q: %w", part, err)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(last))
+		if err != nil {
+			return nil, fmt.Errorf("parse output channel %q: %w", part, err)
+		}
+		if from < 1 || to < from {
+			return nil, fmt.Errorf("invalid output channels %q", part)
+		}
+		for ch := from; ch <= to; ch++ {
+			route = append(route, ch-1)
+		}
+	}
+	return route, nil
+}
+
+// outputRouter places the audio, with channels channels, on the routed
+// channels of a device with devChannels channels. The other channels are
+// silent.
+type outputRouter struct {
+	channels    int
+	devChannels int
+	route       []int
+	scratch     []float32
+}
+
+func newOutputRouter(channels int, route []int) *outputRouter {
+	r := &outputRouter{channels: channels, route: route}
+	for _, ch := range route {
+		r.devChannels = max(r.devChannels, ch+1)
+	}
+	return r
+}
+
+// Play fills out, a device buffer, with the audio fill produces.
+func (r *outputRouter) Play(out []float32, fill func([]float32)) {
+	frames := len(out) / r.devChannels
+	if cap(r.scratch) < frames*r.channels {
+		r.scratch = make([]float32, frames*r.channels)
+	}
+	in := r.scratch[:frames*r.channels]
+	fill(in)
+	clear(out)
+	for i := range frames {
+		frame := in[i*r.channels : (i+1)*r.channels]
+		var mix float32
+		if len(r.route) != r.channels {
+			for _, v := range frame {
+				mix += v
+			}
+			mix /= float32(r.channels)
+		}
+		for j, ch := range r.route {
+			v := mix
+			if len(r.route) == r.channels {
+				v = frame[j]
+			}
+			out[i*r.devChannels+ch] += v
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build 386 || amd64 || arm || arm64 || loong64 || mips64le || mipsle || ppc64le || riscv64 || wasm
+
+package pcm
+
+// littleEndian reports whether the samples in memory have the byte order of
+// S16LE and F32LE, which are then copied as is.
+const littleEndian = true
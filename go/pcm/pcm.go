@@ -0,0 +1,238 @@
+// Package pcm converts PCM audio between 16-bit integer and 32-bit float
+// samples, in memory and as little-endian bytes, and between channel
+// layouts.
+//
+// The functions named after a conversion allocate their result; the Append
+// functions append it to a slice, so that a buffer can be reused across
+// calls. Float samples are in [-1, 1]; converting them to integers clips
+// them.
+package pcm
+
+import (
+	"encoding/binary"
+	"slices"
+	"unsafe"
+)
+
+// 采样格式转换：用户音频（S16LE）、机器人音频（S16LE 或 F32LE）、各种音频后端
+// 与适配器（Discord、Telegram、RTP、C 共享库等）之间的转换集中在这里。
+
+// Sample is the type of a sample in memory.
+type Sample interface {
+	~int16 | ~float32
+}
+
+// Int16ToBytes returns samples as S16LE bytes.
+func Int16ToBytes(samples []int16) []byte {
+	return AppendInt16Bytes(make([]byte, 0, len(samples)*2), samples)
+}
+
+// AppendInt16Bytes appends samples to dst as S16LE bytes.
+func AppendInt16Bytes(dst []byte, samples []int16) []byte {
+	return appendBytes(dst, samples)
+}
+
+// BytesToInt16 returns the samples of S16LE bytes. A trailing odd byte is
+// ignored.
+func BytesToInt16(b []byte) []int16 {
+	return AppendBytesInt16(make([]int16, 0, len(b)/2), b)
+}
+
+// AppendBytesInt16 appends the samples of S16LE bytes to dst.
+func AppendBytesInt16(dst []int16, b []byte) []int16 {
+	return appendSamples(dst, b)
+}
+
+// Float32ToBytes returns samples as F32LE bytes.
+func Float32ToBytes(samples []float32) []byte {
+	return AppendFloat32Bytes(make([]byte, 0, len(samples)*4), samples)
+}
+
+// AppendFloat32Bytes appends samples to dst as F32LE bytes.
+func AppendFloat32Bytes(dst []byte, samples []float32) []byte {
+	return appendBytes(dst, samples)
+}
+
+// BytesToFloat32 returns the samples of F32LE bytes. Trailing bytes short
+// of a sample are ignored.
+func BytesToFloat32(b []byte) []float32 {
+	return AppendBytesFloat32(make([]float32, 0, len(b)/4), b)
+}
+
+// AppendBytesFloat32 appends the samples of F32LE bytes to dst.
+func AppendBytesFloat32(dst []float32, b []byte) []float32 {
+	return appendSamples(dst, b)
+}
+
+// Int16ToFloat32 returns samples as floats.
+func Int16ToFloat32(samples []int16) []float32 {
+	return AppendInt16Float32(make([]float32, 0, len(samples)), samples)
+}
+
+// AppendInt16Float32 appends samples to dst as floats.
+func AppendInt16Float32(dst []float32, samples []int16) []float32 {
+	dst, out := grow(dst, len(samples))
+	for i, s := range samples {
+		out[i] = float32(s) * int16Scale
+	}
+	return dst
+}
+
+// Float32ToInt16 returns samples as 16-bit integers.
+func Float32ToInt16(samples []float32) []int16 {
+	return AppendFloat32Int16(make([]int16, 0, len(samples)), samples)
+}
+
+// AppendFloat32Int16 appends samples to dst as 16-bit integers.
+func AppendFloat32Int16(dst []int16, samples []float32) []int16 {
+	dst, out := grow(dst, len(samples))
+	for i, s := range samples {
+		out[i] = int16(max(min(s, 1), -1) * 32767)
+	}
+	return dst
+}
+
+// BytesInt16ToFloat32 returns the samples of S16LE bytes as floats.
+func BytesInt16ToFloat32(b []byte) []float32 {
+	return AppendBytesInt16Float32(make([]float32, 0, len(b)/2), b)
+}
+
+// AppendBytesInt16Float32 appends the samples of S16LE bytes to dst as
+// floats.
+func AppendBytesInt16Float32(dst []float32, b []byte) []float32 {
+	n := len(b) / 2
+	dst, out := grow(dst, n)
+	// 字节序相同且对齐时直接按 int16 读取，省去逐个样本的字节拼接
+	if littleEndian && uintptr(unsafe.Pointer(unsafe.SliceData(b)))%2 == 0 {
+		for i, s := range unsafe.Slice((*int16)(unsafe.Pointer(unsafe.SliceData(b))), n) {
+			out[i] = float32(s) * int16Scale
+		}
+		return dst
+	}
+	for i := range out {
+		out[i] = float32(int16(binary.LittleEndian.Uint16(b[i*2:]))) * int16Scale
+	}
+	return dst
+}
+
+// int16Scale scales 16-bit samples to [-1, 1]. Being a power of two, the
+// product is exactly the quotient by 32768.
+const int16Scale = 1.0 / 32768
+
+// grow extends dst by n samples, returned as out to be filled.
+func grow[T any](dst []T, n int) (grown, out []T) {
+	dst = slices.Grow(dst, n)
+	return dst[:len(dst)+n], dst[len(dst) : len(dst)+n]
+}
+
+// asBytes returns the memory of samples.
+func asBytes[T Sample](samples []T) []byte {
+	var zero T
+	return unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(samples))), len(samples)*int(unsafe.Sizeof(zero)))
+}
+
+// appendBytes appends samples to dst as little-endian bytes: their memory on
+// little-endian machines, otherwise through the bulk encoding of
+// encoding/binary.
+func appendBytes[T Sample](dst []byte, samples []T) []byte {
+	if littleEndian {
+		return append(dst, asBytes(samples)...)
+	}
+	dst, _ = binary.Append(dst, binary.LittleEndian, samples)
+	return dst
+}
+
+// appendSamples appends the samples of little-endian bytes to dst, like
+// appendBytes.
+func appendSamples[T Sample](dst []T, b []byte) []T {
+	var zero T
+	n := len(b) / int(unsafe.Sizeof(zero))
+	dst, out := grow(dst, n)
+	if littleEndian {
+		copy(asBytes(out), b)
+	} else {
+		_, _ = binary.Decode(b, binary.LittleEndian, out)
+	}
+	return dst
+}
+
+// Interleave returns the samples of the channels interleaved, as many frames
+// as the shortest channel has.
+func Interleave[T Sample](channels ...[]T) []T {
+	if len(channels) == 0 {
+		return nil
+	}
+	frames := len(channels[0])
+	for _, ch := range channels[1:] {
+		frames = min(frames, len(ch))
+	}
+	out := make([]T, 0, frames*len(channels))
+	for f := range frames {
+		for _, ch := range channels {
+			out = append(out, ch[f])
+		}
+	}
+	return out
+}
+
+// Deinterleave returns the samples of each of the channels of interleaved
+// samples. A trailing partial frame is ignored, and a count of channels
+// below 1 gives nil.
+func Deinterleave[T Sample](samples []T, channels int) [][]T {
+	if channels < 1 {
+		return nil
+	}
+	frames := len(samples) / channels
+	out := make([][]T, channels)
+	for c := range out {
+		out[c] = make([]T, frames)
+		for f := range frames {
+			out[c][f] = samples[f*channels+c]
+		}
+	}
+	return out
+}
+
+// Downmix returns the average of the channels of interleaved samples, nil
+// for a count of channels below 1.
+func Downmix[T Sample](samples []T, channels int) []T {
+	if channels < 1 {
+		return nil
+	}
+	mono := make([]T, len(samples)/channels)
+	for i := range mono {
+		var sum float64
+		for _, s := range samples[i*channels : (i+1)*channels] {
+			sum += float64(s)
+		}
+		mono[i] = T(sum / float64(channels))
+	}
+	return mono
+}
+
+// ConvertChannels converts interleaved samples from one channel count to
+// another through mono: the channels are averaged, then duplicated. The
+// samples are returned as is when the counts are the same, and nil when a
+// count is below 1.
+func ConvertChannels[T Sample](samples []T, from, to int) []T {
+	if from < 1 || to < 1 {
+		return nil
+	}
+	if from == to {
+		return samples
+	}
+	mono := samples
+	if from > 1 {
+		mono = Downmix(samples, from)
+	}
+	if to == 1 {
+		return mono
+	}
+	out := make([]T, 0, len(mono)*to)
+	for _, s := range mono {
+		for range to {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,211 @@
+package pcm
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+)
+
+// TestInt16Bytes checks the S16LE encoding against known bytes.
+func TestInt16Bytes(t *testing.T) {
+	samples := []int16{0, 1, -1, math.MaxInt16, math.MinInt16, 0x1234}
+	want := []byte{0, 0, 1, 0, 0xFF, 0xFF, 0xFF, 0x7F, 0, 0x80, 0x34, 0x12}
+	if got := Int16ToBytes(samples); !slices.Equal(got, want) {
+		t.Fatalf("Int16ToBytes = %v, want %v", got, want)
+	}
+	if got := BytesToInt16(append(want, 0xAB)); !slices.Equal(got, samples) {
+		t.Fatalf("BytesToInt16 = %v, want %v", got, samples)
+	}
+	buf := AppendInt16Bytes([]byte{9}, samples[:1])
+	if !slices.Equal(buf, []byte{9, 0, 0}) {
+		t.Fatalf("AppendInt16Bytes = %v", buf)
+	}
+}
+
+// TestFloat32Bytes checks the F32LE encoding against known bytes.
+func TestFloat32Bytes(t *testing.T) {
+	samples := []float32{0, 1, -0.5}
+	want := []byte{0, 0, 0, 0, 0, 0, 0x80, 0x3F, 0, 0, 0, 0xBF}
+	if got := Float32ToBytes(samples); !slices.Equal(got, want) {
+		t.Fatalf("Float32ToBytes = %v, want %v", got, want)
+	}
+	if got := BytesToFloat32(append(want, 1, 2, 3)); !slices.Equal(got, samples) {
+		t.Fatalf("BytesToFloat32 = %v, want %v", got, samples)
+	}
+}
+
+// TestFloat32Int16 checks the scaling and clipping between float and
+// integer samples.
+func TestFloat32Int16(t *testing.T) {
+	got := Float32ToInt16([]float32{0, 0.5, 1, -1, 2, -2})
+	want := []int16{0, 16383, 32767, -32767, 32767, -32767}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Float32ToInt16 = %v, want %v", got, want)
+	}
+	floats := Int16ToFloat32([]int16{0, 16384, math.MinInt16})
+	if !slices.Equal(floats, []float32{0, 0.5, -1}) {
+		t.Fatalf("Int16ToFloat32 = %v", floats)
+	}
+	if got := BytesInt16ToFloat32(Int16ToBytes([]int16{16384, math.MinInt16})); !slices.Equal(got, []float32{0.5, -1}) {
+		t.Fatalf("BytesInt16ToFloat32 = %v", got)
+	}
+	// 未对齐的字节走逐个样本的路径
+	unaligned := append([]byte{0}, Int16ToBytes([]int16{16384, math.MinInt16})...)[1:]
+	if got := BytesInt16ToFloat32(unaligned); !slices.Equal(got, []float32{0.5, -1}) {
+		t.Fatalf("BytesInt16ToFloat32 of unaligned bytes = %v", got)
+	}
+}
+
+// TestChannels checks interleaving, downmixing and channel conversion.
+func TestChannels(t *testing.T) {
+	stereo := Interleave([]int16{1, 2, 3}, []int16{11, 12})
+	if !slices.Equal(stereo, []int16{1, 11, 2, 12}) {
+		t.Fatalf("Interleave = %v", stereo)
+	}
+	channels := Deinterleave([]int16{1, 11, 2, 12, 3}, 2)
+	if len(channels) != 2 || !slices.Equal(channels[0], []int16{1, 2}) || !slices.Equal(channels[1], []int16{11, 12}) {
+		t.Fatalf("Deinterleave = %v", channels)
+	}
+	if got := Downmix([]int16{1, 2, -3, -4, math.MaxInt16, math.MaxInt16}, 2); !slices.Equal(got, []int16{1, -3, math.MaxInt16}) {
+		t.Fatalf("Downmix = %v", got)
+	}
+	if got := Downmix([]float32{0.5, -0.5, 1, 0}, 2); !slices.Equal(got, []float32{0, 0.5}) {
+		t.Fatalf("Downmix float32 = %v", got)
+	}
+	if got := ConvertChannels([]int16{2, 4, 6, 8}, 2, 3); !slices.Equal(got, []int16{3, 3, 3, 7, 7, 7}) {
+		t.Fatalf("ConvertChannels = %v", got)
+	}
+	same := []int16{1, 2}
+	if got := ConvertChannels(same, 2, 2); &got[0] != &same[0] {
+		t.Fatal("ConvertChannels copied samples of the same channel count")
+	}
+
+	// 无效的声道数不会 panic
+	for _, n := range []int{0, -1} {
+		if got := Deinterleave(same, n); got != nil {
+			t.Errorf("Deinterleave with %d channels = %v", n, got)
+		}
+		if got := Downmix(same, n); got != nil {
+			t.Errorf("Downmix with %d channels = %v", n, got)
+		}
+		if got := ConvertChannels(same, n, 1); got != nil {
+			t.Errorf("ConvertChannels from %d channels = %v", n, got)
+		}
+		if got := ConvertChannels(same, 2, n); got != nil {
+			t.Errorf("ConvertChannels to %d channels = %v", n, got)
+		}
+	}
+}
+
+// FuzzRoundTrip checks that the byte encodings round-trip arbitrary data.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{0, 0x80, 0xFF, 0x7F})
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if got := Int16ToBytes(BytesToInt16(data)); !slices.Equal(got, data[:len(data)&^1]) {
+			t.Fatalf("S16LE round trip of %v = %v", data, got)
+		}
+		floats := BytesToFloat32(data)
+		if got := Float32ToBytes(floats); len(got) != len(data)&^3 {
+			t.Fatalf("F32LE round trip of %d bytes gave %d", len(data), len(got))
+		}
+		samples := BytesToInt16(data)
+		if got := Float32ToInt16(Int16ToFloat32(samples)); len(got) != len(samples) {
+			t.Fatalf("converted %d samples to %d", len(samples), len(got))
+		}
+		for i, s := range Float32ToInt16(BytesInt16ToFloat32(data)) {
+			// 32767 的满量程使幅度按 32767/32768 缩小，误差不超过 1
+			if d := int(s) - int(samples[i]); d < -1 || d > 1 {
+				t.Fatalf("sample %d converted to %d and back", samples[i], s)
+			}
+		}
+	})
+}
+
+// benchmarkSamples is the number of samples of the benchmarks: 100 ms of
+// 24 kHz bot audio, or 200 ms of 16 kHz stereo user audio.
+const benchmarkSamples = 2400
+
+// The loop* functions are the conversions sample by sample the package
+// replaced, kept as the baseline of the benchmarks.
+
+func loopInt16ToBytes(samples []int16) []byte {
+	b := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		b[i*2] = byte(sample & 0xff)
+		b[i*2+1] = byte((sample >> 8) & 0xff)
+	}
+	return b
+}
+
+func loopBytesToInt16(b []byte) []int16 {
+	samples := make([]int16, len(b)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(b[i*2:]))
+	}
+	return samples
+}
+
+func loopBytesInt16ToFloat32(b []byte) []float32 {
+	samples := make([]float32, len(b)/2)
+	for i := 0; i < len(samples); i++ {
+		samples[i] = float32(int16(binary.LittleEndian.Uint16(b[i*2:]))) / 32768
+	}
+	return samples
+}
+
+func loopBytesToFloat32(b []byte) []float32 {
+	samples := make([]float32, len(b)/4)
+	for i := 0; i < len(samples); i++ {
+		samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4 : (i+1)*4]))
+	}
+	return samples
+}
+
+func benchmarkConversion[In, Out any](b *testing.B, in In, size int, convert map[string]func(In) Out) {
+	for _, name := range []string{"loop", "bulk"} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for b.Loop() {
+				convert[name](in)
+			}
+		})
+	}
+}
+
+// BenchmarkInt16ToBytes measures the conversion of the captured audio.
+func BenchmarkInt16ToBytes(b *testing.B) {
+	samples := make([]int16, benchmarkSamples)
+	benchmarkConversion(b, samples, len(samples)*2, map[string]func([]int16) []byte{
+		"loop": loopInt16ToBytes, "bulk": Int16ToBytes,
+	})
+}
+
+// BenchmarkBytesToInt16 measures the decoding of S16LE audio.
+func BenchmarkBytesToInt16(b *testing.B) {
+	data := make([]byte, benchmarkSamples*2)
+	benchmarkConversion(b, data, len(data), map[string]func([]byte) []int16{
+		"loop": loopBytesToInt16, "bulk": BytesToInt16,
+	})
+}
+
+// BenchmarkBytesInt16ToFloat32 measures the decoding of S16LE bot audio
+// for playback.
+func BenchmarkBytesInt16ToFloat32(b *testing.B) {
+	data := make([]byte, benchmarkSamples*2)
+	benchmarkConversion(b, data, len(data), map[string]func([]byte) []float32{
+		"loop": loopBytesInt16ToFloat32, "bulk": BytesInt16ToFloat32,
+	})
+}
+
+// BenchmarkBytesToFloat32 measures the decoding of F32LE bot audio for
+// playback.
+func BenchmarkBytesToFloat32(b *testing.B) {
+	data := make([]byte, benchmarkSamples*4)
+	benchmarkConversion(b, data, len(data), map[string]func([]byte) []float32{
+		"loop": loopBytesToFloat32, "bulk": BytesToFloat32,
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+// 原始 PCM TCP 模式，供无法使用 websocket 的老旧或受限设备接入。每个帧为
+// 1 字节类型 + 4 字节大端长度 + 数据。
+
+var tcpAddr = flag.String("tcp-addr", "127.0.0.1:8766", "listen address of the `tcp` command")
+
+// Frame types of the PCM TCP protocol.
+const (
+	tcpFrameAudio     byte = 'A' // s16le PCM: input format from the client, output rate and channels to it
+	tcpFrameEnd       byte = 'E' // client: no more audio; server: the session ended
+	tcpFrameInterrupt byte = 'I' // server: the user interrupted the bot, drop the queued audio
+	tcpFrameText      byte = 'T' // server: UTF-8 text of a complete bot reply
+)
+
+// maxTCPFrame bounds the payload of a frame, 1 MiB.
+const maxTCPFrame = 1 << 20
+
+func init() {
+	commands["tcp"] = runTCP
+}
+
+// runTCP implements the `tcp` subcommand: every client connected to -tcp-addr
+// gets a dialog connection of its own, fed with the PCM it streams.
+func runTCP(ctx context.Context, cfg *Config) error {
+	ln, err := net.Listen("tcp", *tcpAddr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = ln.Close() })
+	defer stop()
+	glog.V(vEvent).Infof("PCM TCP server listening on %s", *tcpAddr)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			glog.V(vEvent).Infof("TCP client %s connected", c.RemoteAddr())
+			serveTCPClient(ctx, cfg, c)
+			glog.V(vEvent).Infof("TCP client %s disconnected", c.RemoteAddr())
+		}()
+	}
+}
+
+func serveTCPClient(ctx context.Context, cfg *Config, c net.Conn) {
+	defer c.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = c.Close() })
+	defer stop()
+
+	conn, _, err := dialDialog(ctx, cfg)
+	if err != nil {
+		glog.Errorf("Dial dialog for TCP client %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+
+	client := &tcpClient{w: bufio.NewWriter(c)}
+	audioIn := make(chan []byte, 100)
+	go func() {
+		defer cancel()
+		if err := readTCPFrames(bufio.NewReader(c), audioIn); err != nil && ctx.Err() == nil {
+			glog.Errorf("Read from TCP client %s: %v", c.RemoteAddr(), err)
+		}
+	}()
+	ids, _ := newSessionIDs("")
+	if err := realTimeDialog(ctx, conn, ids, client, chanSource(audioIn)); err != nil && ctx.Err() == nil {
+		glog.Errorf("Dialog of TCP client %s: %v", c.RemoteAddr(), err)
+	}
+}
+
+// readTCPFrames feeds the audio frames read from r to audioIn, until an end
+// frame or EOF, then closes audioIn.
+func readTCPFrames(r io.Reader, audioIn chan<- []byte) error {
+	defer close(audioIn)
+	var header [5]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint32(header[1:])
+		if n > maxTCPFrame {
+			return fmt.Errorf("frame of %d bytes exceeds %d", n, maxTCPFrame)
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		switch header[0] {
+		case tcpFrameAudio:
+			select {
+			case audioIn <- payload:
+			default:
+				glog.V(vFrame).Infof("Drop %d bytes of TCP client audio: session is not keeping up", n)
+			}
+		case tcpFrameEnd:
+			return nil
+		default:
+			return fmt.Errorf("unknown frame type %q", header[0])
+		}
+	}
+}
+
+// tcpClient is the handler of the dialog of a TCP client.
+type tcpClient struct {
+	NopHandler
+
+	mu    sync.Mutex
+	w     *bufio.Writer
+	reply strings.Builder
+}
+
+func (t *tcpClient) send(typ byte, payload []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, _ = t.w.Write(header[:])
+	_, _ = t.w.Write(payload)
+	if err := t.w.Flush(); err != nil {
+		glog.V(vFrame).Infof("Write to TCP client: %v", err)
+	}
+}
+
+func (t *tcpClient) OnASRStart(ASRInfoPayload) {
+	t.send(tcpFrameInterrupt, nil)
+}
+
+func (t *tcpClient) OnBotText(text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reply.WriteString(text)
+}
+
+func (t *tcpClient) OnBotTextEnd() {
+	t.mu.Lock()
+	text := t.reply.String()
+	t.reply.Reset()
+	t.mu.Unlock()
+	if text != "" {
+		t.send(tcpFrameText, []byte(text))
+	}
+}
+
+func (t *tcpClient) OnAudioChunk(data []byte) {
+	t.send(tcpFrameAudio, pcm.Int16ToBytes(pcm.Float32ToInt16(decodeOutputAudio(data))))
+}
+
+func (t *tcpClient) OnSessionEnd(int32, []byte) {
+	t.send(tcpFrameEnd, nil)
+}
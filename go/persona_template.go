@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 人设模板：机器人名称、人设、说话风格与开场白可以写成 Go 模板，例如
+// "你是{{.product}}的客服，用户叫{{.user_name}}"，变量依次取自配置文件的
+// session.vars、DIALOG_VAR_<NAME> 环境变量与 -var 参数，后者优先；每个会话开始时
+// 渲染，模板中还可以用 now 取当前时间。开场声明（-disclaimer）同样是模板。
+
+// templateEnvPrefix is the prefix of the environment variables setting
+// template variables: DIALOG_VAR_USER_NAME sets user_name.
+const templateEnvPrefix = "DIALOG_VAR_"
+
+var templateVars = make(templateVarFlag)
+
+func init() {
+	flag.Var(templateVars, "var", "set the `name=value` variable of the persona and greeting templates (repeatable), e.g. user_name=小明; also set by DIALOG_VAR_<NAME> environment variables")
+}
+
+// templateVarFlag collects the -var flags.
+type templateVarFlag map[string]string
+
+func (f templateVarFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (f templateVarFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expect name=value, got %q", s)
+	}
+	f[name] = value
+	return nil
+}
+
+// resolveTemplateVars merges the template variables of the config file, the
+// environment and the flags, in increasing precedence.
+func resolveTemplateVars(file map[string]string) map[string]string {
+	vars := maps.Clone(file)
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, templateEnvPrefix) && len(name) > len(templateEnvPrefix) {
+			vars[strings.ToLower(strings.TrimPrefix(name, templateEnvPrefix))] = value
+		}
+	}
+	maps.Copy(vars, templateVars)
+	return vars
+}
+
+// renderTemplate renders text as a Go template with vars. A variable missing
+// from vars is an error.
+func renderTemplate(name, text string, vars map[string]string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{"now": time.Now}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parse %s template: %w", name, err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("render %s template: %w", name, err)
+	}
+	return b.String(), nil
+}
+
+// sendGreeting has the bot speak the disclaimer and the greeting of the
+// session settings, if any.
+func sendGreeting(conn Transport, session SessionInfo) {
+	settings := session.Settings
+	if settings == nil {
+		settings = sessionSettings.Load()
+	}
+	if settings == nil || settings.Disclaimer == "" && settings.Greeting == "" {
+		return
+	}
+	text, err := greetingText(settings)
+	if err == nil {
+		err = sayHello(conn, session.ID, &SayHelloPayload{Content: text})
+	}
+	if err != nil {
+		glog.Errorf("Greet: %v", err)
+	}
+}
+
+// renderPersona returns s with the persona and greeting templates rendered.
+func renderPersona(s SessionSettings) (SessionSettings, error) {
+	for _, field := range []struct {
+		name string
+		text *string
+	}{
+		{"bot_name", &s.BotName},
+		{"system_role", &s.SystemRole},
+		{"speaking_style", &s.SpeakingStyle},
+		{"greeting", &s.Greeting},
+		{"disclaimer", &s.Disclaimer},
+	} {
+		text, err := renderTemplate(field.name, *field.text, s.Vars)
+		if err != nil {
+			return s, err
+		}
+		*field.text = text
+	}
+	return s, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 个人信息脱敏：-redact-pii 选择的检测器与 -redact-pattern 给出的正则在文本落盘
+// 或输出之前把其中的个人信息替换为 [PHONE] 之类的标签，作用于 -json 事件流、
+// 录制目录的 transcript.txt 与 events.jsonl、-analytics 报告、-conversation
+// 对话历史以及日志中的对话文本。内置手机号、身份证号（校验位）、银行卡号（Luhn
+// 校验）与邮箱检测器，自定义检测器在单独文件的 init 中注册到 piiDetectors。
+// 录制目录中的原始音频是否保留由 -record-keep-audio 单独控制。
+
+var (
+	redactPII      = flag.String("redact-pii", "", "comma-separated PII `detectors` masking personal information in the transcripts, event logs, reports and logs: phone, id, card, email, all or those registered in piiDetectors")
+	redactPatterns patternsFlag
+)
+
+func init() {
+	flag.Var(&redactPatterns, "redact-pattern", "regular `expression` whose matches are masked as [REDACTED] like -redact-pii (repeatable)")
+	piiDetectors["phone"] = regexDetector("PHONE", `(?:\+86[- ]?)?\b1[3-9]\d{9}\b`, nil)
+	piiDetectors["id"] = regexDetector("ID", `\b\d{17}[\dXx]\b`, validIDNumber)
+	piiDetectors["card"] = regexDetector("CARD", `\b\d{16,19}\b`, validLuhn)
+	piiDetectors["email"] = regexDetector("EMAIL", `[\w.+-]+@[\w-]+(?:\.[\w-]+)+`, nil)
+}
+
+// patternsFlag collects the -redact-pattern flags.
+type patternsFlag []string
+
+func (f *patternsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *patternsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// PIIDetector finds personal information in text.
+type PIIDetector interface {
+	// Find returns the byte ranges [start, end) of the personal information
+	// in text and the label replacing them.
+	Find(text string) (ranges [][]int, label string)
+}
+
+// piiDetectors are the detectors selectable with -redact-pii, by name.
+var piiDetectors = map[string]PIIDetector{}
+
+// piiRedactor masks the personal information of the text persisted or
+// logged; nil, the default, leaves the text unchanged. It is set up by
+// setupRedaction before the dialog starts.
+var piiRedactor redactor
+
+// redactor masks the ranges found by its detectors.
+type redactor []PIIDetector
+
+// Redact returns text with the personal information masked.
+func (r redactor) Redact(text string) string {
+	for _, d := range r {
+		ranges, label := d.Find(text)
+		if len(ranges) == 0 {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, rg := range ranges {
+			b.WriteString(text[last:rg[0]])
+			b.WriteString("[" + label + "]")
+			last = rg[1]
+		}
+		b.WriteString(text[last:])
+		text = b.String()
+	}
+	return text
+}
+
+// redactText masks the personal information of text with piiRedactor.
+func redactText(text string) string {
+	if piiRedactor == nil {
+		return text
+	}
+	return piiRedactor.Redact(text)
+}
+
+// setupRedaction creates piiRedactor from -redact-pii and -redact-pattern.
+func setupRedaction() error {
+	var r redactor
+	if *redactPII != "" {
+		names := strings.Split(*redactPII, ",")
+		if *redactPII == "all" {
+			// 身份证号先于银行卡号检测，以免按银行卡号标记
+			names = []string{"id"}
+			for name := range piiDetectors {
+				if name != "id" {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names[1:])
+		}
+		for _, name := range names {
+			d, ok := piiDetectors[strings.TrimSpace(name)]
+			if !ok {
+				return fmt.Errorf("unknown PII detector %q", name)
+			}
+			r = append(r, d)
+		}
+	}
+	for _, pattern := range redactPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("redact pattern: %w", err)
+		}
+		r = append(r, regexPIIDetector{re: re, label: "REDACTED"})
+	}
+	if len(r) > 0 {
+		piiRedactor = r
+	}
+	return nil
+}
+
+// regexPIIDetector finds the matches of a regular expression accepted by
+// valid, if not nil.
+type regexPIIDetector struct {
+	re    *regexp.Regexp
+	label string
+	valid func(match string) bool
+}
+
+func regexDetector(label, pattern string, valid func(string) bool) PIIDetector {
+	return regexPIIDetector{re: regexp.MustCompile(pattern), label: label, valid: valid}
+}
+
+func (d regexPIIDetector) Find(text string) ([][]int, string) {
+	ranges := d.re.FindAllStringIndex(text, -1)
+	if d.valid != nil {
+		kept := ranges[:0]
+		for _, rg := range ranges {
+			if d.valid(text[rg[0]:rg[1]]) {
+				kept = append(kept, rg)
+			}
+		}
+		ranges = kept
+	}
+	return ranges, d.label
+}
+
+// validIDNumber checks the check digit of an 18-digit resident ID number.
+func validIDNumber(id string) bool {
+	weights := []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	sum := 0
+	for i, w := range weights {
+		sum += int(id[i]-'0') * w
+	}
+	return strings.ToUpper(id[17:]) == string("10X98765432"[sum%11])
+}
+
+// validLuhn checks the Luhn checksum of a card number.
+func validLuhn(number string) bool {
+	sum := 0
+	for i := range len(number) {
+		d := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestValidIDNumber(t *testing.T) {
+	for id, want := range map[string]bool{
+		"11010519491231002X": true,
+		"11010519491231002x": true,
+		"440304199001011233": true,
+		"320102198003150012": true,
+		"110105194912310021": false, // 校验位应为 X
+		"440304199001011234": false,
+		"320102198003150013": false,
+	} {
+		if got := validIDNumber(id); got != want {
+			t.Errorf("validIDNumber(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestValidLuhn(t *testing.T) {
+	for number, want := range map[string]bool{
+		"4111111111111111":    true,
+		"6217000010001234569": true,
+		"79927398713":         true,
+		"4111111111111112":    false,
+		"6217000010001234568": false,
+		"79927398710":         false,
+	} {
+		if got := validLuhn(number); got != want {
+			t.Errorf("validLuhn(%q) = %v, want %v", number, got, want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	r := redactor{piiDetectors["id"], piiDetectors["card"], piiDetectors["email"], piiDetectors["phone"]}
+	for text, want := range map[string]string{
+		"我的手机号是13812345678，也可以打+86 13912345678":         "我的手机号是[PHONE]，也可以打[PHONE]",
+		"身份证 11010519491231002X，卡号 6217000010001234569": "身份证 [ID]，卡号 [CARD]",
+		"邮箱 a.b+tag@example.com.cn":                     "邮箱 [EMAIL]",
+		// 校验不通过的号码不是个人信息
+		"订单 6217000010001234568，编号 110105194912310021": "订单 6217000010001234568，编号 110105194912310021",
+		"没有个人信息": "没有个人信息",
+	} {
+		if got := r.Redact(text); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
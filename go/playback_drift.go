@@ -0,0 +1,100 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"math"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 播放时钟漂移补偿：声卡的实际采样率与标称的 24 kHz 存在几十 ppm 的偏差，长
+// 会话中实时到达的音频会让播放缓冲慢慢堆积或耗尽。按声卡消耗的帧数与经过的
+// 时间估计实际采样率，在播放期间偶尔重复或丢弃一帧，使消耗速率与标称速率一致。
+
+var driftCompensation = flag.Bool("drift-compensation", true, "estimate the clock drift of the output device and insert or drop a frame now and then to keep the playback buffer stable")
+
+const (
+	// driftSettle is skipped at the start of the stream, when the device
+	// fills its buffers faster than real time.
+	driftSettle = 10 * time.Second
+	// driftWarmup is how long the output device is measured before the
+	// drift is compensated: the jitter of the callbacks, a few ms, must be
+	// small against it.
+	driftWarmup = 10 * time.Minute
+	// driftMinPPM is the smallest drift compensated, in parts per million.
+	driftMinPPM = 20
+	// driftLogInterval is how often the drift estimate is logged.
+	driftLogInterval = 5 * time.Minute
+)
+
+// playbackMetrics exports the statistics of the local playback: the drift
+// estimate, in ppm, and the frames inserted and dropped to compensate it,
+// among others.
+var playbackMetrics = expvar.NewMap("playback")
+
+// driftCompensator estimates the rate of the output device against the wall
+// clock and decides when to insert or drop a frame.
+type driftCompensator struct {
+	nominal float64 // frames per second
+	start   time.Time
+	frames  int64     // consumed by the device since start
+	settled time.Time // end of driftSettle
+	ppm     float64
+	pending float64 // frames to compensate, positive to insert
+	logged  time.Time
+}
+
+func newDriftCompensator(rate int) *driftCompensator {
+	return &driftCompensator{nominal: float64(rate)}
+}
+
+// Frames returns how many frames to take from the buffer, which holds
+// buffered frames, to fill n frames of output: n-1 to insert a frame, n+1 to
+// drop one, or n.
+func (d *driftCompensator) Frames(n, buffered int) int {
+	now := time.Now()
+	switch {
+	case d.settled.IsZero():
+		d.settled = now.Add(driftSettle)
+		return n
+	case now.Before(d.settled):
+		return n
+	case d.start.IsZero():
+		// 从这一次回调开始计时，本次的帧在下一次回调前才被消耗
+		d.start, d.logged = now, now
+		d.frames = int64(n)
+		return n
+	}
+	elapsed, consumed := now.Sub(d.start), d.frames
+	d.frames += int64(n)
+	if elapsed < driftWarmup {
+		return n
+	}
+	// 设备比标称速率快时消耗的帧更多，需要插帧
+	d.ppm = (float64(consumed)/(elapsed.Seconds()*d.nominal) - 1) * 1e6
+	if now.Sub(d.logged) >= driftLogInterval {
+		d.logged = now
+		glog.V(vEvent).Infof("Output device clock drift: %+.1f ppm", d.ppm)
+		v := new(expvar.Float)
+		v.Set(math.Round(d.ppm*10) / 10)
+		playbackMetrics.Set("drift_ppm", v)
+	}
+	// 只在播放期间（缓冲足够时）补偿
+	if !*driftCompensation || math.Abs(d.ppm) < driftMinPPM || buffered <= n {
+		return n
+	}
+	d.pending += float64(n) * d.ppm / 1e6
+	switch {
+	case d.pending >= 1:
+		d.pending--
+		playbackMetrics.Add("frames_inserted", 1)
+		return n - 1
+	case d.pending <= -1:
+		d.pending++
+		playbackMetrics.Add("frames_dropped", 1)
+		return n + 1
+	}
+	return n
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+// 用户说话时自动压低播放音量：本地按能量检测麦克风中的人声，检测到后把机器人
+// 播放音量降低若干 dB（不停止），用户停止说话一段时间后再恢复。在回声消除配置
+// 不完善的环境中，双方同时说话时不至于太刺耳。
+
+var (
+	duckDB        = flag.Float64("duck-db", 12, "lower the bot playback by this many dB while the user is heard speaking (0 disables)")
+	duckThreshold = flag.Float64("duck-threshold", -40, "level of the input audio, in dBFS, above which the user is considered speaking, for -duck-db")
+)
+
+const (
+	// duckAttack is how long the input must stay above the threshold before
+	// the playback is lowered.
+	duckAttack = 30 * time.Millisecond
+	// duckRelease is how long the input must stay below the threshold before
+	// the playback is restored.
+	duckRelease = 400 * time.Millisecond
+	// duckRamp is how long the gain takes to change, to avoid clicks.
+	duckRamp = 20 * time.Millisecond
+)
+
+// userSpeaking is set while the local voice detector hears the user.
+var userSpeaking atomic.Bool
+
+// duckOnSpeech wraps src so that its audio is fed to the voice detector
+// setting userSpeaking, when ducking is enabled.
+func duckOnSpeech(src AudioSource) AudioSource {
+	if *duckDB <= 0 {
+		return src
+	}
+	d := &voiceDetector{threshold: math.Pow(10, *duckThreshold/20)}
+	return tapSource{src: src, tap: d.Process}
+}
+
+// voiceDetector tells speech from silence by the level of the audio, with
+// an attack and a release time.
+type voiceDetector struct {
+	threshold float64 // RMS, full scale 1
+	above     time.Duration
+	below     time.Duration
+	buf       []float32 // samples of the last chunk, reused by Process
+}
+
+// Process takes a chunk of audio in the input format.
+func (d *voiceDetector) Process(chunk []byte) {
+	d.buf = pcm.AppendBytesInt16Float32(d.buf[:0], chunk)
+	n := len(d.buf)
+	if n == 0 {
+		return
+	}
+	var sum float64
+	for _, s := range d.buf {
+		sum += float64(s) * float64(s)
+	}
+	duration := time.Duration(n/audioSettings.InputChannels) * time.Second / time.Duration(audioSettings.InputSampleRate)
+	if math.Sqrt(sum/float64(n)) >= d.threshold {
+		d.above, d.below = d.above+duration, 0
+	} else {
+		d.above, d.below = 0, d.below+duration
+	}
+	switch speaking := userSpeaking.Load(); {
+	case !speaking && d.above >= duckAttack:
+		userSpeaking.Store(true)
+		glog.V(vFrame).Info("User speaking, lowering the playback")
+	case speaking && d.below >= duckRelease:
+		userSpeaking.Store(false)
+		glog.V(vFrame).Info("User silent, restoring the playback")
+	}
+}
+
+// ducker applies the ducking gain to the playback, ramping it to follow
+// userSpeaking.
+type ducker struct {
+	channels int
+	low      float32 // gain while the user speaks
+	step     float32 // change of gain per frame
+	gain     float32
+}
+
+func newDucker(rate, channels int) *ducker {
+	return &ducker{
+		channels: channels,
+		low:      float32(math.Pow(10, -*duckDB/20)),
+		step:     1 / float32(duckRamp.Seconds()*float64(rate)),
+		gain:     1,
+	}
+}
+
+// Apply scales out by the ducking gain.
+func (d *ducker) Apply(out []float32) {
+	target := float32(1)
+	if *duckDB > 0 && userSpeaking.Load() {
+		target = d.low
+	}
+	if d.gain == 1 && target == 1 {
+		return
+	}
+	for i := 0; i+d.channels <= len(out); i += d.channels {
+		switch {
+		case d.gain < target:
+			d.gain = min(d.gain+d.step, target)
+		case d.gain > target:
+			d.gain = max(d.gain-d.step, target)
+		}
+		for ch := range d.channels {
+			out[i+ch] *= d.gain
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+// 打断时平滑清空播放缓冲：用户打断（事件 450）时不再让正在播放的音频戛然而止，
+// 而是把缓冲开头的一小段淡出后播完再清空；下一段回复开始时再淡入，避免爆音。
+
+// flushFade is how long the audio fades out when the buffer is flushed, and
+// fades in when playback resumes.
+const flushFade = 10 * time.Millisecond
+
+// flushFader fades the playback out on a flush and back in on the next
+// audio. Its methods are called with bufferLock held, and do nothing on a nil
+// flushFader.
+type flushFader struct {
+	channels int
+	frames   int       // length of the fades
+	tail     []float32 // faded-out audio left to play
+	fadeIn   int       // frames left to fade in
+}
+
+func newFlushFader(rate, channels int) *flushFader {
+	return &flushFader{channels: channels, frames: int(flushFade.Seconds() * float64(rate))}
+}
+
+// Flush takes the fade-out from the start of buffer, about to be cleared.
+// playing tells whether buffer is being played; if not, it is not faded.
+func (f *flushFader) Flush(buffer []float32, playing bool) {
+	if f == nil || !playing || len(buffer) < f.channels {
+		return
+	}
+	f.tail = append(f.tail[:0], buffer[:min(len(buffer), f.frames*f.channels)]...)
+	n := len(f.tail) / f.channels
+	for i := range n {
+		gain := float32(n-i) / float32(n+1)
+		for ch := range f.channels {
+			f.tail[i*f.channels+ch] *= gain
+		}
+	}
+	f.fadeIn = f.frames
+}
+
+// Drain copies the fade-out left to play to out, and returns the number of
+// samples copied.
+func (f *flushFader) Drain(out []float32) int {
+	if f == nil {
+		return 0
+	}
+	n := copy(out, f.tail)
+	f.tail = f.tail[n:]
+	return n
+}
+
+// FadeIn fades in out, the first audio played after a flush.
+func (f *flushFader) FadeIn(out []float32) {
+	if f == nil {
+		return
+	}
+	for i := 0; i+f.channels <= len(out) && f.fadeIn > 0; i += f.channels {
+		gain := float32(f.frames-f.fadeIn) / float32(f.frames)
+		for ch := range f.channels {
+			out[i+ch] *= gain
+		}
+		f.fadeIn--
+	}
+}
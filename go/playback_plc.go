@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"time"
+)
+
+// 丢包隐藏：下行音频分片丢失或迟到、播放缓冲在回复中途被播空时，不直接输出
+// 静音，而是按基音周期重复最近播放的波形并逐渐淡出；音频恢复时再短暂淡入，
+// 消除弱网下能听到的爆音。
+
+var plcEnabled = flag.Bool("plc", true, "fill gaps in the bot audio by repeating the last waveform with a fade, instead of silence")
+
+const (
+	// plcHistory is how much of the played audio is kept to find the pitch
+	// period in.
+	plcHistory = 40 * time.Millisecond
+	// plcMinPeriod and plcMaxPeriod bound the pitch period searched for.
+	plcMinPeriod = 2500 * time.Microsecond
+	plcMaxPeriod = 15 * time.Millisecond
+	// plcFadeOut is how long a gap is concealed, fading to silence.
+	plcFadeOut = 60 * time.Millisecond
+	// plcFadeIn is how long the audio fades in after a gap.
+	plcFadeIn = 5 * time.Millisecond
+)
+
+// concealer fills gaps in the played audio. Its methods are called from the
+// output callback.
+type concealer struct {
+	channels int
+	rate     int
+	history  []float32 // last samples played, interleaved
+	period   int       // frames repeated in the current gap; 0 outside gaps
+	pos      int       // frames concealed in the current gap
+	fadeIn   int       // frames left to fade in
+}
+
+func newConcealer(rate, channels int) *concealer {
+	return &concealer{rate: rate, channels: channels}
+}
+
+func (c *concealer) frames(d time.Duration) int {
+	return int(d.Seconds() * float64(c.rate))
+}
+
+// Played takes out, filled with buffered audio, fading it in after a gap,
+// and keeps its end for concealment.
+func (c *concealer) Played(out []float32) {
+	if c.period > 0 {
+		c.period, c.pos = 0, 0
+		c.fadeIn = c.frames(plcFadeIn)
+	}
+	if total := c.frames(plcFadeIn); c.fadeIn > 0 {
+		for i := 0; i+c.channels <= len(out) && c.fadeIn > 0; i += c.channels {
+			gain := float32(total-c.fadeIn) / float32(total)
+			for ch := range c.channels {
+				out[i+ch] *= gain
+			}
+			c.fadeIn--
+		}
+	}
+	size := c.frames(plcHistory) * c.channels
+	c.history = append(c.history, out...)
+	if len(c.history) > size {
+		c.history = append(c.history[:0], c.history[len(c.history)-size:]...)
+	}
+}
+
+// Reset forgets the played audio: the next gap is not a continuation of it.
+func (c *concealer) Reset() {
+	c.history = c.history[:0]
+	c.period, c.pos, c.fadeIn = 0, 0, 0
+}
+
+// Conceal fills out, a gap following the played audio, with the last pitch
+// period repeated and faded out.
+func (c *concealer) Conceal(out []float32) {
+	historyFrames := len(c.history) / c.channels
+	if !*plcEnabled || historyFrames < c.frames(plcMaxPeriod) {
+		clear(out)
+		return
+	}
+	if c.period == 0 {
+		c.period = c.pitchPeriod()
+	}
+	fade := c.frames(plcFadeOut)
+	concealed := 0
+	for i := 0; i+c.channels <= len(out); i += c.channels {
+		if c.pos >= fade {
+			clear(out[i:])
+			break
+		}
+		gain := float32(fade-c.pos) / float32(fade)
+		src := (historyFrames - c.period + c.pos%c.period) * c.channels
+		for ch := range c.channels {
+			out[i+ch] = c.history[src+ch] * gain
+		}
+		c.pos++
+		concealed++
+	}
+	if concealed > 0 {
+		playbackMetrics.Add("frames_concealed", int64(concealed))
+	}
+}
+
+// pitchPeriod returns the lag, in frames, with the highest normalized
+// autocorrelation of the end of the history.
+func (c *concealer) pitchPeriod() int {
+	mono := make([]float32, len(c.history)/c.channels)
+	for i := range mono {
+		for ch := range c.channels {
+			mono[i] += c.history[i*c.channels+ch]
+		}
+	}
+	minLag, maxLag := c.frames(plcMinPeriod), c.frames(plcMaxPeriod)
+	window := len(mono) - maxLag
+	best, bestScore := maxLag, -1.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		var corr, energy float64
+		for i := len(mono) - window; i < len(mono); i++ {
+			corr += float64(mono[i] * mono[i-lag])
+			energy += float64(mono[i-lag] * mono[i-lag])
+		}
+		if energy == 0 {
+			continue
+		}
+		if score := corr / math.Sqrt(energy); score > bestScore {
+			best, bestScore = lag, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+)
+
+// 端到端回环时延探测：在一个会话中反复发送一段已知音频（默认为合成的啁啾声，
+// 也可指定一段语音 WAV），测量服务端检测到它、判定说完、给出识别结果以及返回
+// 首个机器人音频所需的时间，输出时延分布，用于评估某条网络路径的端到端时延。
+
+var (
+	probeCount   = flag.Int("probe-count", 10, "in the `probe` command, number of rounds")
+	probeTimeout = flag.Duration("probe-timeout", 10*time.Second, "in the `probe` command, how long to wait for the reply to each round after the probe audio")
+	probeGap     = flag.Duration("probe-gap", time.Second, "in the `probe` command, silence before each round once the bot is idle")
+)
+
+func init() {
+	commands["probe"] = runProbe
+}
+
+// ProbeRound is the latency measured in a round of the probe. Detect is
+// from the start of the probe audio, the others from its end.
+type ProbeRound struct {
+	Round              int     `json:"round"`
+	DetectSeconds      float64 `json:"detect_seconds,omitempty"`
+	EndOfSpeechSeconds float64 `json:"end_of_speech_seconds,omitempty"`
+	ASRFinalSeconds    float64 `json:"asr_final_seconds,omitempty"`
+	FirstAudioSeconds  float64 `json:"first_audio_seconds,omitempty"`
+	// Lost is set when no bot audio arrived within -probe-timeout.
+	Lost bool `json:"lost,omitempty"`
+}
+
+// LatencyStats is the distribution of a latency over the rounds, in seconds.
+type LatencyStats struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// ProbeReport is the result of the `probe` command.
+type ProbeReport struct {
+	Rounds      []ProbeRound `json:"rounds"`
+	Lost        int          `json:"lost"`
+	Detect      LatencyStats `json:"detect"`
+	EndOfSpeech LatencyStats `json:"end_of_speech"`
+	ASRFinal    LatencyStats `json:"asr_final"`
+	FirstAudio  LatencyStats `json:"first_audio"`
+}
+
+// runProbe implements the `probe [audio.wav]` subcommand.
+func runProbe(ctx context.Context, cfg *Config) error {
+	clip := probeChirp()
+	if path := flag.Arg(1); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read probe audio: %w", err)
+		}
+		samples, rate, channels, err := decodeWAV(data)
+		if err != nil {
+			return fmt.Errorf("decode probe audio: %w", err)
+		}
+		clip = newInputConverter(rate, channels).convert(samples)
+	}
+	if *probeCount <= 0 {
+		return fmt.Errorf("invalid -probe-count %d", *probeCount)
+	}
+
+	connectID := uuid.New().String()
+	conn, resp, err := dialDialogWithID(ctx, cfg, connectID)
+	id := newConnIdentity(resp, connectID)
+	if err != nil {
+		return id.Wrap(fmt.Errorf("websocket dial: %w", err))
+	}
+	defer conn.Close()
+	glog.V(vEvent).Infof("Connected: %s", id)
+	if err := startConnection(conn); err != nil {
+		return id.Wrap(fmt.Errorf("start connection: %w", err))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	src := newProbeSource(clip)
+	collector := newProbeCollector()
+	var report ProbeReport
+	go func() {
+		defer close(src.done)
+		report = runProbeRounds(ctx, src, collector, *probeCount)
+	}()
+	if err := runSession(ctx, conn, SessionInfo{ID: NewSessionID(), Seq: 1}, collector, src); err != nil {
+		return id.Wrap(err)
+	}
+	if err := finishConnection(conn); err != nil {
+		return id.Wrap(fmt.Errorf("finish connection: %w", err))
+	}
+	cancel()
+	<-src.done
+	if len(report.Rounds) == 0 {
+		return errors.New("no probe round completed")
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		return enc.Encode(report)
+	}
+	report.WriteSummary(os.Stdout)
+	return nil
+}
+
+// probeChirp returns a second of a 300 Hz to 3.4 kHz sweep, amplitude
+// modulated at a syllabic rate so that it passes as speech for the VAD, in
+// the input format.
+func probeChirp() []byte {
+	rate := audioSettings.InputSampleRate
+	n := rate
+	samples := make([]int16, n)
+	const f0, f1 = 300.0, 3400.0
+	for i := range samples {
+		t := float64(i) / float64(rate)
+		phase := 2 * math.Pi * (f0*t + (f1-f0)/2*t*t)
+		envelope := 0.5 * (1 - math.Cos(2*math.Pi*4*t))
+		samples[i] = int16(0.5 * envelope * math.Sin(phase) * math.MaxInt16)
+	}
+	return pcm.Int16ToBytes(pcm.ConvertChannels(samples, 1, audioSettings.InputChannels))
+}
+
+// probeClip is when the probe audio was sent.
+type probeClip struct{ start, end time.Time }
+
+// probeSource streams silence, and the probe audio on every Play.
+type probeSource struct {
+	clip   []byte
+	play   chan struct{}
+	played chan probeClip
+	done   chan struct{}
+}
+
+func newProbeSource(clip []byte) *probeSource {
+	return &probeSource{clip: clip, play: make(chan struct{}, 1), played: make(chan probeClip, 1), done: make(chan struct{})}
+}
+
+// Play sends the probe audio after the current chunk; its times are then
+// received from played.
+func (s *probeSource) Play() {
+	select {
+	case s.play <- struct{}{}:
+	default:
+	}
+}
+
+func (s *probeSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	chunk := audioSettings.InputSampleRate * audioSettings.InputChannels * 2 * audioSettings.InputBufferMs / 1000
+	silence := make([]byte, chunk)
+	ticker := time.NewTicker(time.Duration(audioSettings.InputBufferMs) * time.Millisecond)
+	defer ticker.Stop()
+	off := -1 // not playing
+	var clip probeClip
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		case <-ticker.C:
+		}
+		if off < 0 {
+			select {
+			case <-s.play:
+				off, clip.start = 0, time.Now()
+			default:
+			}
+		}
+		if off < 0 {
+			send(silence)
+			continue
+		}
+		send(s.clip[off:min(off+chunk, len(s.clip))])
+		if off += chunk; off >= len(s.clip) {
+			off, clip.end = -1, time.Now()
+			s.played <- clip
+		}
+	}
+}
+
+// Events observed by the probeCollector.
+const (
+	probeASRStart = iota
+	probeASREnd
+	probeASRFinal
+	probeBotAudio // first chunk of a reply
+	probeBotSpeechEnd
+)
+
+type probeEvent struct {
+	kind int
+	at   time.Time
+}
+
+// probeCollector is a Handler passing the events of interest to the rounds.
+type probeCollector struct {
+	NopHandler
+	events chan probeEvent
+
+	mu       sync.Mutex
+	replying bool
+}
+
+func newProbeCollector() *probeCollector {
+	return &probeCollector{events: make(chan probeEvent, 64)}
+}
+
+func (c *probeCollector) emit(kind int) {
+	select {
+	case c.events <- probeEvent{kind: kind, at: time.Now()}:
+	default:
+		glog.Warningf("Probe event %d dropped", kind)
+	}
+}
+
+func (c *probeCollector) OnASRStart(ASRInfoPayload) { c.emit(probeASRStart) }
+func (c *probeCollector) OnASREnd()                 { c.emit(probeASREnd) }
+func (c *probeCollector) OnASRFinal(ASRResult)      { c.emit(probeASRFinal) }
+
+func (c *probeCollector) OnAudioChunk([]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.replying {
+		c.replying = true
+		c.emit(probeBotAudio)
+	}
+}
+
+func (c *probeCollector) OnBotSpeechEnd() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replying = false
+	c.emit(probeBotSpeechEnd)
+}
+
+// runProbeRounds plays the probe count times, each once the bot is idle, and
+// returns the report.
+func runProbeRounds(ctx context.Context, src *probeSource, c *probeCollector, count int) ProbeReport {
+	var report ProbeReport
+	for i := 1; i <= count; i++ {
+		if !probeSettle(ctx, c) {
+			break
+		}
+		r, ok := probeRound(ctx, src, c, i)
+		if !ok {
+			break
+		}
+		if r.Lost {
+			report.Lost++
+			glog.Warningf("Probe round %d: no bot audio within %v", i, *probeTimeout)
+		} else {
+			glog.V(vEvent).Infof("Probe round %d: detect %.3fs, end of speech %.3fs, ASR final %.3fs, first audio %.3fs",
+				i, r.DetectSeconds, r.EndOfSpeechSeconds, r.ASRFinalSeconds, r.FirstAudioSeconds)
+		}
+		report.Rounds = append(report.Rounds, r)
+	}
+	field := func(get func(ProbeRound) float64) LatencyStats {
+		var values []float64
+		for _, r := range report.Rounds {
+			if v := get(r); v > 0 {
+				values = append(values, v)
+			}
+		}
+		return latencyStats(values)
+	}
+	report.Detect = field(func(r ProbeRound) float64 { return r.DetectSeconds })
+	report.EndOfSpeech = field(func(r ProbeRound) float64 { return r.EndOfSpeechSeconds })
+	report.ASRFinal = field(func(r ProbeRound) float64 { return r.ASRFinalSeconds })
+	report.FirstAudio = field(func(r ProbeRound) float64 { return r.FirstAudioSeconds })
+	return report
+}
+
+// probeSettle waits until no event arrived for -probe-gap, after the bot
+// finished any reply or -probe-timeout elapsed. It returns false if ctx is
+// done.
+func probeSettle(ctx context.Context, c *probeCollector) bool {
+	idle := time.NewTimer(*probeGap)
+	defer idle.Stop()
+	deadline := time.Now().Add(*probeTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-c.events:
+			idle.Reset(*probeGap)
+		case <-idle.C:
+			c.mu.Lock()
+			replying := c.replying
+			c.mu.Unlock()
+			if !replying || time.Now().After(deadline) {
+				return true
+			}
+			idle.Reset(*probeGap)
+		}
+	}
+}
+
+// probeRound plays the probe and measures the events until the bot reply
+// ends or -probe-timeout elapses. It returns false if ctx is done.
+func probeRound(ctx context.Context, src *probeSource, c *probeCollector, n int) (ProbeRound, bool) {
+	r := ProbeRound{Round: n}
+	src.Play()
+	var clip probeClip
+	select {
+	case <-ctx.Done():
+		return r, false
+	case clip = <-src.played:
+	}
+	timeout := time.NewTimer(*probeTimeout)
+	defer timeout.Stop()
+	seconds := func(from, to time.Time) float64 {
+		return math.Round(max(to.Sub(from).Seconds(), 0)*1000) / 1000
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return r, false
+		case <-timeout.C:
+			r.Lost = r.FirstAudioSeconds == 0
+			return r, true
+		case ev := <-c.events:
+			if ev.at.Before(clip.start) {
+				continue // 上一轮的残余事件
+			}
+			switch ev.kind {
+			case probeASRStart:
+				if r.DetectSeconds == 0 {
+					r.DetectSeconds = seconds(clip.start, ev.at)
+				}
+			case probeASREnd:
+				if r.EndOfSpeechSeconds == 0 {
+					r.EndOfSpeechSeconds = seconds(clip.end, ev.at)
+				}
+			case probeASRFinal:
+				if r.ASRFinalSeconds == 0 {
+					r.ASRFinalSeconds = seconds(clip.end, ev.at)
+				}
+			case probeBotAudio:
+				if r.FirstAudioSeconds == 0 {
+					r.FirstAudioSeconds = seconds(clip.end, ev.at)
+				}
+			case probeBotSpeechEnd:
+				if r.FirstAudioSeconds > 0 {
+					return r, true
+				}
+			}
+		}
+	}
+}
+
+// latencyStats returns the distribution of values, in seconds.
+func latencyStats(values []float64) LatencyStats {
+	if len(values) == 0 {
+		return LatencyStats{}
+	}
+	sort.Float64s(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	// 最近秩法求分位数
+	percentile := func(p float64) float64 {
+		return values[max(int(math.Ceil(p*float64(len(values))))-1, 0)]
+	}
+	return LatencyStats{
+		Count: len(values),
+		Min:   values[0],
+		Mean:  math.Round(sum/float64(len(values))*1000) / 1000,
+		P50:   percentile(0.5),
+		P90:   percentile(0.9),
+		P99:   percentile(0.99),
+		Max:   values[len(values)-1],
+	}
+}
+
+// WriteSummary writes the report to w in human-readable form.
+func (r *ProbeReport) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "Probe: %d rounds, %d lost\n", len(r.Rounds), r.Lost)
+	for _, s := range []struct {
+		name  string
+		stats LatencyStats
+	}{
+		{"detect", r.Detect},
+		{"end of speech", r.EndOfSpeech},
+		{"ASR final", r.ASRFinal},
+		{"first audio", r.FirstAudio},
+	} {
+		if s.stats.Count == 0 {
+			fmt.Fprintf(w, "  %-14s n/a\n", s.name+":")
+			continue
+		}
+		fmt.Fprintf(w, "  %-14s min %.3fs, mean %.3fs, p50 %.3fs, p90 %.3fs, p99 %.3fs, max %.3fs (n=%d)\n",
+			s.name+":", s.stats.Min, s.stats.Mean, s.stats.P50, s.stats.P90, s.stats.P99, s.stats.Max, s.stats.Count)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"RealtimeDialog/dialog"
+)
+
+// FuzzUnmarshal feeds arbitrary frames to Unmarshal, seeded with the
+// protocol fixture corpus.
+func FuzzUnmarshal(f *testing.F) {
+	dir := filepath.Join("testdata", "protocol")
+	data, err := os.ReadFile(filepath.Join(dir, fixtureManifest))
+	if err != nil {
+		f.Fatal(err)
+	}
+	var cases []fixtureCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		f.Fatal(err)
+	}
+	for _, c := range cases {
+		frame, err := os.ReadFile(filepath.Join(dir, c.File))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+	}
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		for _, cs := range []dialog.ContainsSequenceFunc{dialog.ContainsSequence, nil} {
+			msg, prot, err := dialog.Unmarshal(frame, cs)
+			if err != nil {
+				continue
+			}
+			if _, err := dialog.NewMessage(msg.Type, 0); err != nil {
+				t.Fatalf("decoded invalid message type %d", msg.Type)
+			}
+			if prot.HeaderSize() > len(frame) {
+				t.Fatalf("header size %d exceeds frame of %d bytes", prot.HeaderSize(), len(frame))
+			}
+			// 负载总在帧尾，其长度字段必须与实际长度一致
+			size := len(frame) - len(msg.Payload) - 4
+			if size < 0 || int(binary.BigEndian.Uint32(frame[size:])) != len(msg.Payload) {
+				t.Fatalf("decoded a payload of %d bytes from a frame of %d bytes", len(msg.Payload), len(frame))
+			}
+		}
+	})
+}
+
+// TestProtocolFixtures checks Marshal and Unmarshal against the fixture
+// corpus generated by `fixtures gen`.
+func TestProtocolFixtures(t *testing.T) {
+	if err := verifyFixtures(filepath.Join("testdata", "protocol")); err != nil {
+		t.Fatal(err)
+	}
+}
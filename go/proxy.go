@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// 代理模式：下游客户端使用与服务端相同的二进制协议连接，代理在上游连接中注入
+// 真实凭证，凭证只保存在运行代理的主机上。可按事件 ID 过滤双向的消息。
+
+var (
+	proxyAddr       = flag.String("proxy-addr", "127.0.0.1:8082", "listen address of the `proxy` command")
+	proxyToken      = flag.String("proxy-token", "", "shared secret downstream clients of the proxy must present, if set")
+	proxyDropServer = make(eventSet)
+	proxyDropClient = make(eventSet)
+)
+
+var errProxyForbidden = errors.New("invalid proxy token")
+
+func init() {
+	flag.Var(proxyDropServer, "proxy-drop-server-events", "comma-separated server `events` the proxy does not forward downstream, e.g. 154")
+	flag.Var(proxyDropClient, "proxy-drop-client-events", "comma-separated client `events` the proxy does not forward upstream, e.g. 300,500")
+	commands["proxy"] = runProxy
+}
+
+// eventSet is a set of event IDs, set from a comma-separated list.
+type eventSet map[int32]bool
+
+func (s eventSet) String() string {
+	ids := make([]string, 0, len(s))
+	for id := range s {
+		ids = append(ids, strconv.Itoa(int(id)))
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func (s eventSet) Set(v string) error {
+	for _, f := range strings.Split(v, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(f), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid event %q: %w", f, err)
+		}
+		s[int32(id)] = true
+	}
+	return nil
+}
+
+// dialogProxy relays downstream clients to the dialogue service with the
+// credentials of the config.
+type dialogProxy struct {
+	ctx context.Context
+	cfg *Config
+}
+
+func (p *dialogProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if *proxyToken != "" && subtle.ConstantTimeCompare([]byte(requestAPIKey(r)), []byte(*proxyToken)) != 1 {
+		http.Error(w, errProxyForbidden.Error(), http.StatusUnauthorized)
+		return
+	}
+	// 下游自带的凭证头不会转发，上游连接总是使用代理的凭证
+	upstream, resp, err := dialDialog(r.Context(), p.cfg)
+	if err != nil {
+		glog.Errorf("Dial upstream for %s: %v", r.RemoteAddr, err)
+		status := http.StatusBadGateway
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "upstream unavailable", status)
+		return
+	}
+	defer upstream.Close()
+	var header http.Header
+	if resp != nil && resp.Header.Get("X-Tt-Logid") != "" {
+		header = http.Header{"X-Tt-Logid": {resp.Header.Get("X-Tt-Logid")}}
+	}
+	downstream, err := (&websocket.Upgrader{}).Upgrade(w, r, header)
+	if err != nil {
+		glog.Errorf("Upgrade proxy client %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer downstream.Close()
+	start := time.Now()
+	glog.V(vEvent).Infof("Proxy client %s connected", r.RemoteAddr)
+
+	stop := context.AfterFunc(p.ctx, func() {
+		_ = downstream.Close()
+		_ = upstream.Close()
+	})
+	defer stop()
+	done := make(chan struct{}, 2)
+	client := newGorillaTransport(downstream)
+	go func() { relayFrames(upstream, client, proxyDropClient, nil); done <- struct{}{} }()
+	go func() { relayFrames(client, upstream, proxyDropServer, nil); done <- struct{}{} }()
+	<-done
+	_ = downstream.Close()
+	_ = upstream.Close()
+	<-done
+	glog.V(vEvent).Infof("Proxy client %s disconnected after %v", r.RemoteAddr, time.Since(start).Round(time.Second))
+}
+
+// runProxy implements the `proxy` subcommand.
+func runProxy(ctx context.Context, cfg *Config) error {
+	srv := &http.Server{Addr: *proxyAddr, Handler: &dialogProxy{ctx: ctx, cfg: cfg}}
+	stop := context.AfterFunc(ctx, func() { _ = srv.Close() })
+	defer stop()
+	glog.V(vEvent).Infof("Proxy listening on ws://%s", *proxyAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("proxy: %w", err)
+	}
+	return nil
+}
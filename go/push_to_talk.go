@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 全局快捷键按键说话：-push-to-talk 指定一个全局快捷键，如 ctrl+shift+space
+// 或 f9，终端不在前台时也有效，只有按住时才发送麦克风音频，松开后发送静音。按键
+// 状态由系统的键盘状态轮询得到，不拦截按键，其他程序照常收到。Windows 上直接
+// 可用；Linux（X11）上需以 go build -tags hotkey 构建（需要 libX11）。
+//
+// 快捷键由 + 连接的若干键组成：修饰键 ctrl、shift、alt、super，以及字母、
+// 数字、f1 至 f24、space、tab、enter、escape、capslock、pause、scrolllock、
+// insert、home、end、pageup、pagedown。
+
+var pushToTalkKey = flag.String("push-to-talk", "", "global `hotkey` to hold while speaking, e.g. ctrl+shift+space or f9: the microphone audio is sent only while it is held, even when the terminal is in the background")
+
+// pushToTalkPoll is how often the hotkey state is read.
+const pushToTalkPoll = 20 * time.Millisecond
+
+// pushToTalkIdle is set while -push-to-talk is given and its hotkey is not
+// held: the input audio is replaced with silence, see muteSource.
+var pushToTalkIdle atomic.Bool
+
+// openKeyboard returns a function reporting whether all the keys of hotkey
+// are held, and a function releasing the keyboard. It is set by the files of
+// the platforms with global hotkeys.
+var openKeyboard func(hotkey []string) (held func() bool, release func(), err error)
+
+// parseHotkey returns the keys of a hotkey spec, lowercase.
+func parseHotkey(spec string) ([]string, error) {
+	var keys []string
+	for _, key := range strings.Split(strings.ToLower(spec), "+") {
+		key = strings.TrimSpace(key)
+		if !validHotkeyKey(key) {
+			return nil, fmt.Errorf("unknown key %q in hotkey %q", key, spec)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func validHotkeyKey(key string) bool {
+	switch key {
+	case "ctrl", "shift", "alt", "super", "space", "tab", "enter", "escape", "capslock", "pause", "scrolllock", "insert", "home", "end", "pageup", "pagedown":
+		return true
+	}
+	if len(key) == 1 {
+		return key[0] >= 'a' && key[0] <= 'z' || key[0] >= '0' && key[0] <= '9'
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(key, "f"))
+	return strings.HasPrefix(key, "f") && err == nil && n >= 1 && n <= 24
+}
+
+// startPushToTalk polls the -push-to-talk hotkey until ctx is done, letting
+// the input audio through while it is held.
+func startPushToTalk(ctx context.Context) error {
+	if *pushToTalkKey == "" {
+		return nil
+	}
+	keys, err := parseHotkey(*pushToTalkKey)
+	if err != nil {
+		return err
+	}
+	if openKeyboard == nil {
+		return errors.New("global hotkeys need Windows, or X11 and a build with -tags hotkey")
+	}
+	held, release, err := openKeyboard(keys)
+	if err != nil {
+		return fmt.Errorf("push to talk: %w", err)
+	}
+	pushToTalkIdle.Store(true)
+	glog.V(vEvent).Infof("Hold %s to talk", *pushToTalkKey)
+	go func() {
+		defer release()
+		defer pushToTalkIdle.Store(false)
+		ticker := time.NewTicker(pushToTalkPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			talking := held()
+			if talking == !pushToTalkIdle.Load() {
+				continue
+			}
+			pushToTalkIdle.Store(!talking)
+			if talking {
+				glog.V(vEvent).Info("Push to talk: microphone on")
+			} else {
+				glog.V(vEvent).Info("Push to talk: microphone off")
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Windows 按键状态：GetAsyncKeyState 读取物理按键的状态，与焦点所在的窗口
+// 无关。
+
+func init() {
+	openKeyboard = openWindowsKeyboard
+}
+
+// windowsVirtualKeys are the virtual-key codes of the hotkey keys, the left
+// and right ones for super.
+var windowsVirtualKeys = map[string][]uintptr{
+	"ctrl":       {0x11},
+	"shift":      {0x10},
+	"alt":        {0x12},
+	"super":      {0x5B, 0x5C},
+	"space":      {0x20},
+	"tab":        {0x09},
+	"enter":      {0x0D},
+	"escape":     {0x1B},
+	"capslock":   {0x14},
+	"pause":      {0x13},
+	"scrolllock": {0x91},
+	"insert":     {0x2D},
+	"home":       {0x24},
+	"end":        {0x23},
+	"pageup":     {0x21},
+	"pagedown":   {0x22},
+}
+
+func openWindowsKeyboard(hotkey []string) (func() bool, func(), error) {
+	getAsyncKeyState := syscall.NewLazyDLL("user32.dll").NewProc("GetAsyncKeyState")
+	if err := getAsyncKeyState.Find(); err != nil {
+		return nil, nil, err
+	}
+	var codes [][]uintptr
+	for _, key := range hotkey {
+		vks, ok := windowsVirtualKeys[key]
+		switch {
+		case ok:
+		case len(key) == 1:
+			// 字母与数字的虚拟键码即其大写 ASCII 码
+			vks = []uintptr{uintptr(strings.ToUpper(key)[0])}
+		default:
+			n, _ := strconv.Atoi(key[1:])
+			vks = []uintptr{0x70 + uintptr(n-1)} // VK_F1
+		}
+		codes = append(codes, vks)
+	}
+	held := func() bool {
+		for _, vks := range codes {
+			down := false
+			for _, vk := range vks {
+				if state, _, _ := getAsyncKeyState.Call(vk); state&0x8000 != 0 {
+					down = true
+				}
+			}
+			if !down {
+				return false
+			}
+		}
+		return true
+	}
+	return held, func() {}, nil
+}
@@ -0,0 +1,95 @@
+//go:build hotkey && linux && cgo
+
+package main
+
+// #cgo LDFLAGS: -lX11
+// #include <stdlib.h>
+// #include <X11/Xlib.h>
+//
+// static int keyDown(const char *keys, KeyCode code) {
+// 	return (keys[code / 8] >> (code % 8)) & 1;
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// X11 按键状态：XQueryKeymap 返回整个键盘的状态，与焦点所在的窗口无关。
+
+func init() {
+	openKeyboard = openX11Keyboard
+}
+
+// x11Keysyms are the keysyms of the hotkey keys, the left and right ones for
+// the modifiers.
+var x11Keysyms = map[string][]string{
+	"ctrl":       {"Control_L", "Control_R"},
+	"shift":      {"Shift_L", "Shift_R"},
+	"alt":        {"Alt_L", "Alt_R"},
+	"super":      {"Super_L", "Super_R"},
+	"space":      {"space"},
+	"tab":        {"Tab"},
+	"enter":      {"Return"},
+	"escape":     {"Escape"},
+	"capslock":   {"Caps_Lock"},
+	"pause":      {"Pause"},
+	"scrolllock": {"Scroll_Lock"},
+	"insert":     {"Insert"},
+	"home":       {"Home"},
+	"end":        {"End"},
+	"pageup":     {"Prior"},
+	"pagedown":   {"Next"},
+}
+
+func openX11Keyboard(hotkey []string) (func() bool, func(), error) {
+	display := C.XOpenDisplay(nil)
+	if display == nil {
+		return nil, nil, errors.New("cannot open the X display (check $DISPLAY)")
+	}
+	// 每个键对应若干键码，按下其中任意一个即可
+	var codes [][]C.KeyCode
+	for _, key := range hotkey {
+		names, ok := x11Keysyms[key]
+		if !ok {
+			names = []string{key}
+			if strings.HasPrefix(key, "f") && len(key) > 1 {
+				names = []string{strings.ToUpper(key)}
+			}
+		}
+		var keyCodes []C.KeyCode
+		for _, name := range names {
+			cname := C.CString(name)
+			sym := C.XStringToKeysym(cname)
+			C.free(unsafe.Pointer(cname))
+			if code := C.XKeysymToKeycode(display, sym); code != 0 {
+				keyCodes = append(keyCodes, code)
+			}
+		}
+		if len(keyCodes) == 0 {
+			C.XCloseDisplay(display)
+			return nil, nil, fmt.Errorf("no key %s on the keyboard", key)
+		}
+		codes = append(codes, keyCodes)
+	}
+	var keys [32]C.char
+	held := func() bool {
+		C.XQueryKeymap(display, &keys[0])
+		for _, keyCodes := range codes {
+			down := false
+			for _, code := range keyCodes {
+				if C.keyDown(&keys[0], code) != 0 {
+					down = true
+				}
+			}
+			if !down {
+				return false
+			}
+		}
+		return true
+	}
+	return held, func() { C.XCloseDisplay(display) }, nil
+}
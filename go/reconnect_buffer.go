@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 重连期间的音频缓冲：麦克风与 RTP 输入在会话之间（重连、会话重试、循环模式的
+// 会话间隙）保持采集，把最近一段音频缓存下来，在下一个会话开始后先行发送，
+// 避免用户在网络抖动期间说的话丢失。
+
+var reconnectBuffer = flag.Duration("reconnect-buffer", 10*time.Second, "keep capturing the microphone or RTP input between sessions and while reconnecting, and send up to the last `duration` of it to the next session (0 disables)")
+
+// bufferBetweenSessions wraps the live sources, the microphone and RTP, in a
+// bufferedSource per -reconnect-buffer. It returns the source and a function
+// stopping the capture.
+func bufferBetweenSessions(ctx context.Context, src AudioSource) (AudioSource, func()) {
+	if *reconnectBuffer <= 0 {
+		return src, func() {}
+	}
+	switch src.(type) {
+	case micSource, rtpSource:
+		bytesPerSecond := audioSettings.InputSampleRate * audioSettings.InputChannels * 2
+		b := newBufferedSource(ctx, src, int(reconnectBuffer.Seconds()*float64(bytesPerSecond)))
+		return b, b.Close
+	}
+	return src, func() {}
+}
+
+// bufferedSource streams a live source continuously from its first session
+// until ctx is done. Between sessions it keeps the last limit bytes, which
+// are sent at the start of the next session.
+type bufferedSource struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	src    AudioSource
+	limit  int
+	start  sync.Once
+	done   chan struct{} // closed when the source stops
+	err    error
+
+	mu      sync.Mutex
+	send    func(chunk []byte) // of the current session, nil between sessions
+	pending [][]byte
+	size    int
+}
+
+func newBufferedSource(ctx context.Context, src AudioSource, limit int) *bufferedSource {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &bufferedSource{ctx: ctx, cancel: cancel, src: src, limit: limit, done: make(chan struct{})}
+	bufferMetrics.Set("reconnect_bytes", expvar.Func(func() any {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.size
+	}))
+	return b
+}
+
+// Close stops the source and waits for it.
+func (b *bufferedSource) Close() {
+	b.cancel()
+	b.start.Do(func() { close(b.done) })
+	<-b.done
+}
+
+func (b *bufferedSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	b.start.Do(func() {
+		go func() {
+			defer close(b.done)
+			b.err = b.src.Stream(b.ctx, b.receive)
+		}()
+	})
+	b.mu.Lock()
+	if b.size > 0 {
+		bytesPerSecond := audioSettings.InputSampleRate * audioSettings.InputChannels * 2
+		glog.V(vEvent).Infof("Sending %v of audio captured between sessions", time.Duration(b.size)*time.Second/time.Duration(bytesPerSecond))
+	}
+	for _, chunk := range b.pending {
+		send(chunk)
+	}
+	b.pending, b.size = nil, 0
+	b.send = send
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.send = nil
+		b.mu.Unlock()
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-b.done:
+		return b.err
+	}
+}
+
+// receive sends chunk to the current session, or keeps it for the next one.
+func (b *bufferedSource) receive(chunk []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.send != nil {
+		b.send(chunk)
+		return
+	}
+	b.pending = append(b.pending, append([]byte(nil), chunk...))
+	b.size += len(chunk)
+	for b.size > b.limit && len(b.pending) > 0 {
+		b.size -= len(b.pending[0])
+		b.pending = b.pending[1:]
+	}
+}
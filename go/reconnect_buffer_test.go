@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"RealtimeDialog/dialog"
+)
+
+// fakeDialogConn is a Transport answering the handshakes of a session like
+// the dialogue service, and passing the user audio to onAudio.
+type fakeDialogConn struct {
+	in      chan []byte
+	broken  chan struct{}
+	once    sync.Once
+	onAudio func(c *fakeDialogConn, sessionID string, data []byte)
+}
+
+func newFakeDialogConn(onAudio func(c *fakeDialogConn, sessionID string, data []byte)) *fakeDialogConn {
+	return &fakeDialogConn{in: make(chan []byte, 16), broken: make(chan struct{}), onAudio: onAudio}
+}
+
+// Break drops the connection: reads and writes fail from then on.
+func (c *fakeDialogConn) Break() {
+	c.once.Do(func() { close(c.broken) })
+}
+
+// reply sends a session level server event.
+func (c *fakeDialogConn) reply(event int32, sessionID, payload string) {
+	msg, _ := dialog.NewMessage(dialog.MsgTypeFullServer, dialog.MsgTypeFlagWithEvent)
+	msg.Event, msg.SessionID, msg.Payload = event, sessionID, []byte(payload)
+	frame, err := protocol.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	c.in <- frame
+}
+
+// replyConnection sends a connection level server event, whose connect ID
+// Marshal does not write.
+func (c *fakeDialogConn) replyConnection(event int32) {
+	frame := []byte{0x11, 0x94, 0x10, 0x00}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(event))
+	frame = binary.BigEndian.AppendUint32(frame, 0)
+	c.in <- append(binary.BigEndian.AppendUint32(frame, 2), "{}"...)
+}
+
+func (c *fakeDialogConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	select {
+	case frame := <-c.in:
+		return BinaryMessage, frame, nil
+	case <-c.broken:
+		return 0, nil, errors.New("connection reset by peer")
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (c *fakeDialogConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.broken:
+		return errors.New("broken pipe")
+	default:
+	}
+	msg, _, err := dialog.Unmarshal(data, dialog.ContainsSequence)
+	if err != nil {
+		return err
+	}
+	switch msg.Event {
+	case dialog.EventStartConnection:
+		c.replyConnection(dialog.EventConnectionStarted)
+	case dialog.EventStartSession:
+		c.reply(dialog.EventSessionStarted, msg.SessionID, `{"dialog_id":"d1"}`)
+	case dialog.EventTaskRequest:
+		c.onAudio(c, msg.SessionID, msg.Payload)
+	case dialog.EventFinishSession:
+		c.reply(dialog.EventSessionFinished, msg.SessionID, "{}")
+	case dialog.EventFinishConnection:
+		c.replyConnection(dialog.EventConnectionFinished)
+	}
+	return nil
+}
+
+func (c *fakeDialogConn) Close() error {
+	c.Break()
+	return nil
+}
+
+// buffered reports whether b holds audio for the next session.
+func buffered(b *bufferedSource) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size > 0
+}
+
+// TestReconnectSendsBufferedAudio drops the connection during a session:
+// the dialog reconnects, and the audio captured while it was disconnected
+// starts the next session.
+func TestReconnectSendsBufferedAudio(t *testing.T) {
+	var err error
+	if audioSettings, err = resolveAudioSettings(AudioSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	live := make(chan []byte)
+	src := newBufferedSource(ctx, chanSource(live), 1<<20)
+	defer src.Close()
+
+	var mu sync.Mutex
+	var received [][]string // 每个连接收到的音频
+	record := func(conn int, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[conn] = append(received[conn], string(data))
+	}
+	dial := func(ctx context.Context, url string, header http.Header) (Transport, *http.Response, error) {
+		mu.Lock()
+		conn := len(received)
+		received = append(received, nil)
+		mu.Unlock()
+		switch conn {
+		case 0:
+			// 第一个连接收到音频后断开
+			return newFakeDialogConn(func(c *fakeDialogConn, _ string, data []byte) {
+				record(0, data)
+				c.Break()
+			}), nil, nil
+		case 1:
+			// 断开期间采集的音频缓存到下一个会话
+			live <- []byte("between")
+			for !buffered(src) {
+				time.Sleep(time.Millisecond)
+			}
+			return newFakeDialogConn(func(c *fakeDialogConn, sessionID string, data []byte) {
+				record(1, data)
+				c.reply(dialog.EventSessionFinished, sessionID, "{}")
+			}), nil, nil
+		}
+		return nil, nil, errors.New("too many connections")
+	}
+	defer func(name string) {
+		*transportName = name
+		delete(transports, "fake")
+	}(*transportName)
+	transports["fake"] = dial
+	*transportName = "fake"
+
+	ids, err := newSessionIDs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		select {
+		case live <- []byte("first"):
+		case <-ctx.Done():
+		}
+	}()
+	if err := runConnections(ctx, &Config{}, ids, multiHandler{}, src, nil, &textQueue{}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || len(received[0]) != 1 || received[0][0] != "first" || len(received[1]) == 0 || received[1][0] != "between" {
+		t.Errorf("audio received by the connections: %q", received)
+	}
+}
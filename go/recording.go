@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+var (
+	recordDir         = flag.String("record-dir", "", "record every session to a bundle directory under `dir`: audio, transcript, events and metadata; a path template as for -save-audio, e.g. recordings/{date}")
+	recordMaxMB       = flag.Int("record-max-mb", 0, "continue a session in a new bundle once the audio of the current one reaches this many MiB (0 means no limit)")
+	recordMaxDuration = flag.Duration("record-max-duration", 0, "continue a session in a new bundle once the current one is this long (0 means no limit)")
+	recordRetain      = flag.Int("record-retain", 0, "keep at most this many bundles in -record-dir, deleting the oldest (0 keeps all)")
+	recordRetainAge   = flag.Duration("record-retain-age", 0, "delete the bundles in -record-dir older than this (0 keeps all)")
+	recordKeepAudio   = flag.Bool("record-keep-audio", true, "keep the audio in the bundles of -record-dir; false deletes user, bot and mixed audio once a bundle is complete, keeping the text, events and metadata")
+)
+
+// 每个会话的录制目录包含：
+//
+//	user.wav        上行（麦克风）音频（-format flac 时为 .flac，下同）
+//	bot.wav         下行（机器人）音频，按接收顺序
+//	mixed.wav       按播放时间线混合的双方音频，单声道 16 位（-record-watermark 时带水印）
+//	transcript.txt  对话文本
+//	events.jsonl    与 -json 相同格式的事件流
+//	audio_index.jsonl 每个音频块的到达与播放时间及其在 user.wav/bot.wav 中的偏移
+//	metadata.json   logid、connect id、配置哈希与各项时长
+//
+// 文本按 -redact-pii 脱敏后写入；-record-keep-audio=false 时，目录完成后删除
+// 其中的音频文件；-encrypt-at-rest 时，metadata.json 以外的文件在写入时即加密，
+// 文件名带 .enc 后缀。
+//
+// 长时间运行时，会话超过 -record-max-mb 或 -record-max-duration 后在新目录中
+// 继续录制（part 递增），每个目录完成后按 -record-retain、-record-retain-age
+// 删除旧目录。
+
+// RecordingMetadata is the metadata.json of a recording bundle.
+type RecordingMetadata struct {
+	SessionID        string        `json:"session_id"`
+	Part             int           `json:"part"` // of the session, from 1
+	ConnectID        string        `json:"connect_id"`
+	LogID            string        `json:"logid,omitempty"`
+	ConfigHash       string        `json:"config_hash"`
+	Audio            AudioSettings `json:"audio"`
+	StartedAt        time.Time     `json:"started_at"`
+	EndedAt          time.Time     `json:"ended_at"`
+	DurationSeconds  float64       `json:"duration_seconds"`
+	UserAudioSeconds float64       `json:"user_audio_seconds"`
+	BotAudioSeconds  float64       `json:"bot_audio_seconds"`
+	EndEvent         int32         `json:"end_event,omitempty"`
+	TranscriptTurns  int           `json:"transcript_turns"`
+	InterruptedBotAt []float64     `json:"interrupted_bot_at,omitempty"`
+	// WatermarkDBFS is the level of the watermark mixed into mixed.wav, see
+	// addWatermark.
+	WatermarkDBFS float64 `json:"watermark_dbfs,omitempty"`
+	// Truncated marks a bundle recovered after the run recording it was
+	// interrupted, see recoverRecordings: it ends with the last data written
+	// and has no mixed audio.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// AudioIndexEntry is a line of audio_index.jsonl: a chunk of user.wav or
+// bot.wav. Bot audio scheduled after an interruption in InterruptedBotAt was
+// not played.
+type AudioIndexEntry struct {
+	Stream string    `json:"stream"` // user or bot
+	Offset int       `json:"offset"` // in the audio data, in bytes
+	Bytes  int       `json:"bytes"`
+	Time   time.Time `json:"time"` // of arrival, as in events.jsonl
+	// Seconds from the start of the bundle when the chunk arrived (was sent,
+	// for user audio) and when it starts playing.
+	Arrival  float64 `json:"arrival"`
+	Playback float64 `json:"playback"`
+	Duration float64 `json:"duration"`
+}
+
+// sessionRecorder writes a recording bundle for every session. Events are
+// forwarded to the JSON emitter of the current bundle.
+type sessionRecorder struct {
+	Handler // events.jsonl of the current bundle
+	dir     string
+	meta    RecordingMetadata
+
+	mu         sync.Mutex
+	session    SessionInfo
+	bundle     string
+	events     *outputFile
+	index      *outputFile
+	indexEnc   *json.Encoder
+	user       *outputFile
+	bot        *outputFile
+	userBytes  int
+	botBytes   int
+	userStart  float64   // offset of the first user audio, in seconds
+	botCursor  float64   // end of the scheduled bot audio, in seconds
+	segments   []segment // bot audio on the playback timeline
+	transcript strings.Builder
+	reply      strings.Builder
+}
+
+// segment places bot audio on the playback timeline of a session.
+type segment struct {
+	offset   float64 // seconds from the session start
+	start    int     // byte offset in bot.wav data
+	length   int     // bytes
+	duration float64 // seconds
+}
+
+func newSessionRecorder(dir string) *sessionRecorder {
+	return &sessionRecorder{Handler: NopHandler{}, dir: dir}
+}
+
+// SetConnection sets the identifiers of the connection recorded in the
+// metadata of the next bundles.
+func (r *sessionRecorder) SetConnection(id connIdentity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.meta.ConnectID, r.meta.LogID = id.ConnectID, id.LogID
+}
+
+// Tap returns a source that records the audio of src to the current bundle.
+func (r *sessionRecorder) Tap(src AudioSource) AudioSource {
+	return tapSource{src: src, tap: r.writeUser}
+}
+
+// tapSource passes the audio of src to tap as it is sent.
+type tapSource struct {
+	src AudioSource
+	tap func([]byte)
+}
+
+func (t tapSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	return t.src.Stream(ctx, func(chunk []byte) {
+		t.tap(chunk)
+		send(chunk)
+	})
+}
+
+func (r *sessionRecorder) elapsed() float64 {
+	return time.Since(r.meta.StartedAt).Seconds()
+}
+
+func (r *sessionRecorder) writeUser(chunk []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.user == nil {
+		return
+	}
+	if r.userBytes == 0 {
+		r.userStart = r.elapsed()
+	}
+	now := r.elapsed()
+	bytesPerSecond := float64(audioSettings.InputSampleRate * audioSettings.InputChannels * 2)
+	r.writeIndex(AudioIndexEntry{Stream: "user", Offset: r.userBytes, Bytes: len(chunk), Arrival: now, Playback: now, Duration: float64(len(chunk)) / bytesPerSecond})
+	n, err := r.user.Write(chunk)
+	r.userBytes += n
+	if err != nil {
+		glog.Errorf("Record user audio: %v", err)
+	}
+	r.rotateIfDue()
+}
+
+func (r *sessionRecorder) OnSessionStart(session SessionInfo) {
+	r.mu.Lock()
+	r.finishLocked()
+	if err := r.start(session, 1); err != nil {
+		glog.Errorf("Start recording session %s: %v", session.ID, err)
+	}
+	r.mu.Unlock()
+	r.Handler.OnSessionStart(session)
+}
+
+// rotateIfDue continues the session in a new bundle once the current one
+// reaches -record-max-mb or -record-max-duration. r.mu must be held.
+func (r *sessionRecorder) rotateIfDue() {
+	due := *recordMaxMB > 0 && r.userBytes+r.botBytes >= *recordMaxMB<<20 ||
+		*recordMaxDuration > 0 && time.Since(r.meta.StartedAt) >= *recordMaxDuration
+	if !due {
+		return
+	}
+	session, part := r.session, r.meta.Part+1
+	r.finishLocked()
+	if err := r.start(session, part); err != nil {
+		glog.Errorf("Continue recording session %s: %v", session.ID, err)
+	}
+}
+
+// start opens the bundle of a part of a session. r.mu must be held.
+func (r *sessionRecorder) start(session SessionInfo, part int) error {
+	now := time.Now()
+	name := now.Format("20060102-150405") + "-" + session.ID
+	if part > 1 {
+		name += fmt.Sprintf("-part%d", part)
+	}
+	// 录制完成后才去掉 .part 后缀
+	bundle := filepath.Join(artifacts.Vars().expand(r.dir), name) + partSuffix
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return err
+	}
+	create := func(name string, header func(dataSize int) []byte) (*outputFile, error) {
+		f, err := createOutput(filepath.Join(bundle, name))
+		if err != nil || header == nil {
+			return f, err
+		}
+		if _, err := f.Write(initialWAVHeader(f, header)); err != nil {
+			f.Abort()
+			return nil, err
+		}
+		return f, nil
+	}
+	var err error
+	if r.events, err = create("events.jsonl", nil); err != nil {
+		return err
+	}
+	if r.user, err = create("user.wav", r.userHeader); err != nil {
+		return err
+	}
+	if r.bot, err = create("bot.wav", wavHeader); err != nil {
+		return err
+	}
+	if r.index, err = create("audio_index.jsonl", nil); err != nil {
+		return err
+	}
+	r.indexEnc = json.NewEncoder(r.index)
+	payload, _ := json.Marshal(newStartSessionPayload(session.Settings))
+	hash := sha256.Sum256(payload)
+	r.meta = RecordingMetadata{
+		SessionID:  session.ID,
+		Part:       part,
+		ConnectID:  r.meta.ConnectID,
+		LogID:      r.meta.LogID,
+		ConfigHash: hex.EncodeToString(hash[:]),
+		Audio:      audioSettings,
+		StartedAt:  now,
+	}
+	r.session = session
+	r.bundle = bundle
+	r.userBytes, r.botBytes, r.userStart, r.botCursor = 0, 0, 0, 0
+	r.segments = nil
+	r.transcript.Reset()
+	r.reply.Reset()
+	r.Handler = newJSONEmitter(r.events)
+	if part > 1 {
+		// 续录的目录也以 session_start 开头，事件带有会话 ID
+		r.Handler.OnSessionStart(session)
+	}
+	glog.V(vEvent).Infof("Recording session %s to %s", session.ID, bundle)
+	return nil
+}
+
+func (r *sessionRecorder) userHeader(dataSize int) []byte {
+	return encodeWAVHeader(wavFormatPCM, audioSettings.InputChannels, audioSettings.InputSampleRate, 2, dataSize)
+}
+
+// writeIndex appends an entry to audio_index.jsonl. r.mu must be held.
+func (r *sessionRecorder) writeIndex(e AudioIndexEntry) {
+	e.Time = time.Now()
+	e.Arrival = math.Round(e.Arrival*1e6) / 1e6
+	e.Playback = math.Round(e.Playback*1e6) / 1e6
+	e.Duration = math.Round(e.Duration*1e6) / 1e6
+	if err := r.indexEnc.Encode(e); err != nil {
+		glog.Errorf("Write audio index: %v", err)
+	}
+}
+
+// OnASRStart cuts the bot audio scheduled after now: the user interrupted the
+// bot, so it was not played.
+func (r *sessionRecorder) OnASRStart(info ASRInfoPayload) {
+	r.mu.Lock()
+	now := r.elapsed()
+	if r.botCursor > now {
+		r.meta.InterruptedBotAt = append(r.meta.InterruptedBotAt, math.Round(now*1000)/1000)
+		for i := range r.segments {
+			s := &r.segments[i]
+			if end := s.offset + s.duration; end > now {
+				keep := max(now-s.offset, 0)
+				frame := audioSettings.OutputChannels * audioSettings.outputBytesPerSample()
+				s.length = int(float64(s.length)*keep/s.duration) / frame * frame
+				s.duration = keep
+			}
+		}
+		r.botCursor = now
+	}
+	r.mu.Unlock()
+	r.Handler.OnASRStart(info)
+}
+
+func (r *sessionRecorder) OnASRFinal(result ASRResult) {
+	r.mu.Lock()
+	fmt.Fprintf(&r.transcript, "[%s] user: %s%s\n", r.timestamp(), result.Text, confidenceLabel(result))
+	r.meta.TranscriptTurns++
+	r.mu.Unlock()
+	r.Handler.OnASRFinal(result)
+}
+
+func (r *sessionRecorder) OnBotText(text string) {
+	r.mu.Lock()
+	r.reply.WriteString(text)
+	r.mu.Unlock()
+	r.Handler.OnBotText(text)
+}
+
+func (r *sessionRecorder) OnBotTextEnd() {
+	r.mu.Lock()
+	if r.reply.Len() > 0 {
+		fmt.Fprintf(&r.transcript, "[%s] bot: %s\n", r.timestamp(), r.reply.String())
+		r.meta.TranscriptTurns++
+		r.reply.Reset()
+	}
+	r.mu.Unlock()
+	r.Handler.OnBotTextEnd()
+}
+
+func (r *sessionRecorder) timestamp() string {
+	return (time.Duration(r.elapsed()*1000) * time.Millisecond).String()
+}
+
+func (r *sessionRecorder) OnAudioChunk(data []byte) {
+	r.mu.Lock()
+	if r.bot != nil {
+		now := r.elapsed()
+		r.botCursor = max(r.botCursor, now)
+		bytesPerSecond := float64(audioSettings.OutputSampleRate * audioSettings.OutputChannels * audioSettings.outputBytesPerSample())
+		d := float64(len(data)) / bytesPerSecond
+		r.segments = append(r.segments, segment{offset: r.botCursor, start: r.botBytes, length: len(data), duration: d})
+		r.writeIndex(AudioIndexEntry{Stream: "bot", Offset: r.botBytes, Bytes: len(data), Arrival: now, Playback: r.botCursor, Duration: d})
+		r.botCursor += d
+		n, err := r.bot.Write(data)
+		r.botBytes += n
+		if err != nil {
+			glog.Errorf("Record bot audio: %v", err)
+		}
+		r.rotateIfDue()
+	}
+	r.mu.Unlock()
+	r.Handler.OnAudioChunk(data)
+}
+
+func (r *sessionRecorder) OnSessionEnd(event int32, payload []byte) {
+	r.Handler.OnSessionEnd(event, payload)
+	r.mu.Lock()
+	r.meta.EndEvent = event
+	r.mu.Unlock()
+	r.finish()
+}
+
+// Close finishes the bundle of the current session, if any.
+func (r *sessionRecorder) Close() {
+	r.finish()
+}
+
+// finish completes the bundle of the current session: it fixes the WAV
+// headers and writes the mixed audio, the transcript and the metadata.
+func (r *sessionRecorder) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finishLocked()
+}
+
+func (r *sessionRecorder) finishLocked() {
+	if r.bundle == "" {
+		return
+	}
+	r.meta.EndedAt = time.Now()
+	r.meta.DurationSeconds = r.meta.EndedAt.Sub(r.meta.StartedAt).Seconds()
+	r.meta.UserAudioSeconds = float64(r.userBytes) / float64(audioSettings.InputSampleRate*audioSettings.InputChannels*2)
+	r.meta.BotAudioSeconds = float64(r.botBytes) / float64(audioSettings.OutputSampleRate*audioSettings.OutputChannels*audioSettings.outputBytesPerSample())
+
+	closeWAV := func(f *outputFile, header []byte) {
+		// 加密的文件无法回填，文件头中的长度保持未知
+		if wa, ok := f.Writer.(io.WriterAt); ok {
+			if _, err := wa.WriteAt(header, 0); err != nil {
+				glog.Errorf("Finish %s: %v", f.Path(), err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			glog.Errorf("Close %s: %v", f.Path(), err)
+		}
+	}
+	closeWAV(r.user, r.userHeader(r.userBytes))
+	closeWAV(r.bot, wavHeader(r.botBytes))
+	if err := r.index.Close(); err != nil {
+		glog.Errorf("Close audio index of %s: %v", r.bundle, err)
+	}
+	if err := r.events.Close(); err != nil {
+		glog.Errorf("Close events of %s: %v", r.bundle, err)
+	}
+	if err := r.writeMixed(); err != nil {
+		glog.Errorf("Write mixed audio of %s: %v", r.bundle, err)
+	}
+	if *audioFileFormat == "flac" {
+		// 录制过程中写 WAV，结束后再统一转换为 FLAC
+		for _, name := range []string{"user.wav", "bot.wav", "mixed.wav"} {
+			if err := wavToFLAC(filepath.Join(r.bundle, name)); err != nil {
+				glog.Errorf("Convert %s of %s to FLAC: %v", name, r.bundle, err)
+			}
+		}
+	}
+	if err := writeOutput(filepath.Join(r.bundle, "transcript.txt"), []byte(redactText(r.transcript.String()))); err != nil {
+		glog.Errorf("Write transcript of %s: %v", r.bundle, err)
+	}
+	if !*recordKeepAudio {
+		r.deleteAudio()
+	}
+	meta, err := json.MarshalIndent(r.meta, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(r.bundle, "metadata.json"), append(meta, '\n'), 0644)
+	}
+	if err != nil {
+		glog.Errorf("Write metadata of %s: %v", r.bundle, err)
+	}
+	final := strings.TrimSuffix(r.bundle, partSuffix)
+	if err := os.Rename(r.bundle, final); err != nil {
+		glog.Errorf("Complete %s: %v", r.bundle, err)
+	} else {
+		glog.V(vEvent).Infof("Recording of session %s saved to %s", r.meta.SessionID, final)
+	}
+	dir := filepath.Dir(r.bundle)
+	r.bundle, r.user, r.bot, r.events, r.index = "", nil, nil, nil, nil
+	r.Handler = NopHandler{}
+	pruneRecordings(dir)
+}
+
+// deleteAudio deletes the audio files of the current bundle.
+func (r *sessionRecorder) deleteAudio() {
+	for _, name := range []string{"user", "bot", "mixed"} {
+		path := filepath.Join(r.bundle, name+".wav")
+		if *audioFileFormat == "flac" {
+			path = filepath.Join(r.bundle, name+".flac")
+		}
+		if err := removeOutput(path); err != nil {
+			glog.Errorf("Delete %s: %v", path, err)
+		}
+	}
+}
+
+// pruneRecordings deletes the completed bundles in dir beyond -record-retain,
+// oldest first, and those older than -record-retain-age.
+func pruneRecordings(dir string) {
+	if *recordRetain <= 0 && *recordRetainAge <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		glog.Errorf("List recordings: %v", err)
+		return
+	}
+	// 目录名以开始时间开头，ReadDir 按名称排序即按时间排序；没有 metadata.json
+	// 的目录尚未完成或不是录制目录，不予处理
+	var bundles []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasSuffix(e.Name(), partSuffix) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), "metadata.json")); err == nil {
+			bundles = append(bundles, e.Name())
+		}
+	}
+	for i, name := range bundles {
+		path := filepath.Join(dir, name)
+		expired := *recordRetain > 0 && i < len(bundles)-*recordRetain
+		if !expired && *recordRetainAge > 0 {
+			info, err := os.Stat(filepath.Join(path, "metadata.json"))
+			expired = err == nil && time.Since(info.ModTime()) > *recordRetainAge
+		}
+		if !expired {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			glog.Errorf("Delete recording %s: %v", path, err)
+			continue
+		}
+		glog.V(vEvent).Infof("Deleted recording %s", path)
+	}
+}
+
+// writeMixed mixes the user audio and the played bot audio into mixed.wav,
+// mono 16-bit at the output rate.
+func (r *sessionRecorder) writeMixed() error {
+	rate := audioSettings.OutputSampleRate
+	mixed := make([]float64, int(math.Ceil(r.meta.DurationSeconds*float64(rate))))
+	add := func(offset float64, samples []int16) {
+		i := int(offset * float64(rate))
+		for _, s := range samples {
+			if i >= 0 && i < len(mixed) {
+				mixed[i] += float64(s)
+			}
+			i++
+		}
+	}
+	toMono := func(samples []int16, channels int) []int16 {
+		if channels == 1 {
+			return samples
+		}
+		mono := make([]int16, len(samples)/channels)
+		for i := range mono {
+			var sum int
+			for c := 0; c < channels; c++ {
+				sum += int(samples[i*channels+c])
+			}
+			mono[i] = int16(sum / channels)
+		}
+		return mono
+	}
+
+	userData, _, err := readOutput(filepath.Join(r.bundle, "user.wav"))
+	if err != nil {
+		return err
+	}
+	user := make([]int16, (len(userData)-44)/2)
+	for i := range user {
+		user[i] = int16(uint16(userData[44+i*2]) | uint16(userData[45+i*2])<<8)
+	}
+	user = toMono(user, audioSettings.InputChannels)
+	add(r.userStart, newResampler(audioSettings.InputSampleRate, rate, 1).Process(user))
+
+	botData, _, err := readOutput(filepath.Join(r.bundle, "bot.wav"))
+	if err != nil {
+		return err
+	}
+	botData = botData[44:]
+	for _, s := range r.segments {
+		if s.length <= 0 {
+			continue
+		}
+		samples := pcm.Float32ToInt16(decodeOutputAudio(botData[s.start : s.start+s.length]))
+		add(s.offset, toMono(samples, audioSettings.OutputChannels))
+	}
+
+	if *recordWatermark < 0 {
+		addWatermark(mixed, r.meta.SessionID, *recordWatermark)
+		r.meta.WatermarkDBFS = *recordWatermark
+	}
+
+	out := make([]byte, 44, 44+len(mixed)*2)
+	copy(out, encodeWAVHeader(wavFormatPCM, 1, rate, 2, len(mixed)*2))
+	for _, v := range mixed {
+		s := int16(max(min(v, 32767), -32768))
+		out = append(out, byte(s), byte(s>>8))
+	}
+	return writeOutput(filepath.Join(r.bundle, "mixed.wav"), out)
+}
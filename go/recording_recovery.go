@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 恢复中断的录制：进程被强行结束（崩溃、kill -9、断电）时，录制目录停留在
+// .part 后缀，WAV 文件头中的长度仍为 0。启动时 recoverRecordings 在 -record-dir
+// 下查找这样的目录，按文件大小回填 user.wav、bot.wav 的文件头，截掉 JSONL 文件
+// 末尾不完整的一行，删除未写完的临时文件，由 events.jsonl 重建 transcript.txt，
+// 写入标记 truncated 的 metadata.json，然后像正常完成的目录一样转换格式、删除
+// 音频并去掉 .part 后缀。恢复的目录没有 mixed.wav。加密写入的文件只保留已经
+// 完整写出的分块（每个文件最后不足 1 MiB 的数据随进程丢失），重新加密为完整的
+// 文件；明文写入的旧目录在 -encrypt-at-rest 时加密。最近 recoverGrace 内
+// 仍在写入的目录可能属于另一个正在运行的进程，留待以后恢复。
+
+// recoverGrace is how long a bundle must have been left untouched to be
+// recovered.
+const recoverGrace = time.Minute
+
+// recoverRecordings finalizes the incomplete bundles left under the
+// -record-dir template by an interrupted run.
+func recoverRecordings(template string) {
+	pattern := pathPlaceholder.ReplaceAllString(template, "*")
+	bundles, err := filepath.Glob(filepath.Join(pattern, "*"+partSuffix))
+	if err != nil {
+		glog.Errorf("List incomplete recordings: %v", err)
+		return
+	}
+	for _, bundle := range bundles {
+		if info, err := os.Stat(bundle); err != nil || !info.IsDir() || recentlyModified(bundle) {
+			continue
+		}
+		if err := recoverBundle(bundle); err != nil {
+			glog.Errorf("Recover recording %s: %v", bundle, err)
+			continue
+		}
+		glog.V(vEvent).Infof("Recovered the interrupted recording %s", strings.TrimSuffix(bundle, partSuffix))
+	}
+}
+
+// recentlyModified reports whether a file of dir was written within
+// recoverGrace.
+func recentlyModified(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) < recoverGrace {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverBundle completes an incomplete bundle like finishLocked does with
+// what was written.
+func recoverBundle(bundle string) error {
+	entries, err := os.ReadDir(bundle)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// 未完成的 FLAC 转换与加密
+		if name := e.Name(); strings.HasSuffix(name, partSuffix) || strings.HasSuffix(name, encSuffix+".tmp") {
+			if err := os.Remove(filepath.Join(bundle, name)); err != nil {
+				return err
+			}
+		}
+	}
+	// metadata.json 已写入时目录只差加密与改名
+	if _, err := os.Stat(filepath.Join(bundle, "metadata.json")); os.IsNotExist(err) {
+		if err := recoverContent(bundle); err != nil {
+			return err
+		}
+	}
+	// 不加密时写入的文件
+	if err := sealDir(bundle, "metadata.json"); err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	return os.Rename(bundle, strings.TrimSuffix(bundle, partSuffix))
+}
+
+// recoverContent fixes the audio and the JSONL files of a bundle and writes
+// its transcript and metadata.
+func recoverContent(bundle string) error {
+	meta := RecordingMetadata{Part: 1}
+	name := strings.TrimSuffix(filepath.Base(bundle), partSuffix)
+	if started, err := time.ParseInLocation("20060102-150405", name[:min(len(name), 15)], time.Local); err == nil {
+		meta.StartedAt = started
+	}
+	meta.SessionID = strings.TrimPrefix(name[min(len(name), 15):], "-")
+	if i := strings.LastIndex(meta.SessionID, "-part"); i >= 0 {
+		if part, err := strconv.Atoi(meta.SessionID[i+len("-part"):]); err == nil {
+			meta.SessionID, meta.Part = meta.SessionID[:i], part
+		}
+	}
+
+	var err error
+	if meta.UserAudioSeconds, meta.Audio.InputSampleRate, meta.Audio.InputChannels, err = recoverWAV(filepath.Join(bundle, "user.wav")); err != nil {
+		return err
+	}
+	if meta.BotAudioSeconds, meta.Audio.OutputSampleRate, meta.Audio.OutputChannels, err = recoverWAV(filepath.Join(bundle, "bot.wav")); err != nil {
+		return err
+	}
+	for _, name := range []string{"events.jsonl", "audio_index.jsonl"} {
+		if err := trimPartialLine(filepath.Join(bundle, name)); err != nil {
+			return err
+		}
+	}
+
+	transcript, err := recoverTranscript(bundle, &meta)
+	if err != nil {
+		return err
+	}
+	if err := writeOutput(filepath.Join(bundle, "transcript.txt"), []byte(redactText(transcript))); err != nil {
+		return err
+	}
+	// 用户音频持续写入，结束时间取最后的事件、音频块与音频长度中最晚的
+	meta.EndedAt = maxTime(meta.EndedAt, lastIndexTime(filepath.Join(bundle, "audio_index.jsonl")),
+		meta.StartedAt.Add(time.Duration(max(meta.UserAudioSeconds, meta.BotAudioSeconds)*float64(time.Second))))
+	meta.DurationSeconds = meta.EndedAt.Sub(meta.StartedAt).Seconds()
+	meta.Truncated = true
+
+	if *audioFileFormat == "flac" {
+		for _, name := range []string{"user.wav", "bot.wav"} {
+			path := filepath.Join(bundle, name)
+			if !outputExists(path) {
+				continue
+			}
+			if err := wavToFLAC(path); err != nil {
+				glog.Errorf("Convert %s of %s to FLAC: %v", name, bundle, err)
+			}
+		}
+	}
+	if !*recordKeepAudio {
+		for _, name := range []string{"user.wav", "bot.wav", "user.flac", "bot.flac"} {
+			if err := removeOutput(filepath.Join(bundle, name)); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bundle, "metadata.json"), append(data, '\n'), 0644)
+}
+
+// recoverWAV completes the WAV file at path, or path.enc, as fixWAVHeader
+// does.
+func recoverWAV(path string) (seconds float64, rate, channels int, err error) {
+	sealed := path + encSuffix
+	if _, err := os.Stat(sealed); err != nil {
+		return fixWAVHeader(path)
+	}
+	data, err := readSealedPrefix(sealed)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if len(data) < 44 || string(data[:4]) != "RIFF" {
+		return 0, 0, 0, fmt.Errorf("%s has no WAV header", sealed)
+	}
+	dataSize, seconds, rate, channels := completeWAVHeader(data[:44], len(data)-44)
+	return seconds, rate, channels, writeOutput(path, data[:44+dataSize])
+}
+
+// completeWAVHeader sets the sizes in the WAV header to the whole frames of
+// size bytes of audio, and returns their size, duration and format.
+func completeWAVHeader(header []byte, size int) (dataSize int, seconds float64, rate, channels int) {
+	channels = int(binary.LittleEndian.Uint16(header[22:]))
+	rate = int(binary.LittleEndian.Uint32(header[24:]))
+	byteRate := int(binary.LittleEndian.Uint32(header[28:]))
+	frame := max(int(binary.LittleEndian.Uint16(header[32:])), 1)
+	dataSize = size / frame * frame
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+dataSize))
+	binary.LittleEndian.PutUint32(header[40:], uint32(dataSize))
+	if byteRate > 0 {
+		seconds = float64(dataSize) / float64(byteRate)
+	}
+	return dataSize, seconds, rate, channels
+}
+
+// fixWAVHeader sets the sizes in the header of the WAV file at path to the
+// whole frames written and returns their duration and format. A missing
+// file has no audio.
+func fixWAVHeader(path string) (seconds float64, rate, channels int, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	header := make([]byte, 44)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:4]) != "RIFF" {
+		return 0, 0, 0, fmt.Errorf("%s has no WAV header", path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	dataSize, seconds, rate, channels := completeWAVHeader(header, int(info.Size())-44)
+	if err := f.Truncate(int64(44 + dataSize)); err != nil {
+		return 0, 0, 0, err
+	}
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return 0, 0, 0, err
+	}
+	return seconds, rate, channels, f.Sync()
+}
+
+// trimPartialLine truncates the file at path, or path.enc, after its last
+// complete line.
+func trimPartialLine(path string) error {
+	sealed := path + encSuffix
+	if _, err := os.Stat(sealed); err == nil {
+		data, err := readSealedPrefix(sealed)
+		if err != nil {
+			return err
+		}
+		return writeOutput(path, data[:bytes.LastIndexByte(data, '\n')+1])
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	return os.Truncate(path, int64(strings.LastIndexByte(string(data), '\n')+1))
+}
+
+// lastIndexTime returns the time of the last entry of the audio index at
+// path, zero if there is none.
+func lastIndexTime(path string) time.Time {
+	data, _, err := readOutput(path)
+	if err != nil {
+		return time.Time{}
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var e AudioIndexEntry
+	if json.Unmarshal([]byte(lines[len(lines)-1]), &e) != nil {
+		return time.Time{}
+	}
+	return e.Time
+}
+
+func maxTime(times ...time.Time) time.Time {
+	var latest time.Time
+	for _, t := range times {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// recoverTranscript rebuilds the transcript of a bundle from events.jsonl,
+// filling in the session, times, turns and end event of meta.
+func recoverTranscript(bundle string, meta *RecordingMetadata) (string, error) {
+	data, _, err := readOutput(filepath.Join(bundle, "events.jsonl"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var transcript, reply strings.Builder
+	var events []jsonEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		var ev jsonEvent
+		if json.Unmarshal(scanner.Bytes(), &ev) == nil {
+			events = append(events, ev)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if len(events) > 0 {
+		// 目录名中的时间只精确到秒
+		meta.StartedAt, meta.EndedAt = events[0].Time, events[len(events)-1].Time
+	}
+	timestamp := func(t time.Time) string {
+		return t.Sub(meta.StartedAt).Round(time.Millisecond).String()
+	}
+	var replyAt time.Time
+	endReply := func() {
+		if reply.Len() > 0 {
+			fmt.Fprintf(&transcript, "[%s] bot: %s\n", timestamp(replyAt), reply.String())
+			meta.TranscriptTurns++
+			reply.Reset()
+		}
+	}
+	for _, ev := range events {
+		if ev.SessionID != "" {
+			meta.SessionID = ev.SessionID
+		}
+		switch ev.Type {
+		case "asr_final":
+			fmt.Fprintf(&transcript, "[%s] user: %s\n", timestamp(ev.Time), ev.Text)
+			meta.TranscriptTurns++
+		case "bot_text":
+			reply.WriteString(ev.Text)
+			replyAt = ev.Time
+		case "bot_text_end":
+			replyAt = ev.Time
+			endReply()
+		case "session_end":
+			meta.EndEvent = ev.Event
+			endReply()
+		}
+	}
+	// 中断时未结束的回复
+	endReply()
+	return transcript.String(), nil
+}
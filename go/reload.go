@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/golang/glog"
+)
+
+// 收到 SIGHUP 时重新读取配置文件，无需重启即可更新音色、韵律、人设、审核与日志
+// 级别与重试策略。日志级别立即生效；会话参数只在会话开始时发送，因此从下一个会话起生效，
+// 进行中的会话不受影响。凭证与音频格式的修改仍需重启。
+
+// applyConfig applies the reloadable settings of cfg: the session settings,
+// the log level and the retry policy.
+func applyConfig(cfg *Config) error {
+	settings, err := resolveSessionSettings(cfg.Session)
+	if err != nil {
+		return fmt.Errorf("session settings: %w", err)
+	}
+	if err := validateRetryRules(cfg.RetryPolicy); err != nil {
+		return err
+	}
+	if cfg.LogLevel != "" && !verbosityFlagIsSet() {
+		if err := setLogLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+	sessionSettings.Store(&settings)
+	sessionRetry.SetRules(cfg.RetryPolicy)
+	return nil
+}
+
+// watchReload reloads the config file on SIGHUP until ctx is done. cfg is
+// the config in effect, used to warn about changes that need a restart.
+func watchReload(ctx context.Context, cfg *Config) {
+	hup := make(chan os.Signal, 1)
+	notifyReload(hup)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reloadConfig(cfg)
+			}
+		}
+	}()
+}
+
+func reloadConfig(current *Config) {
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		glog.Errorf("Reload config: %v", err)
+		return
+	}
+	if err := applyConfig(cfg); err != nil {
+		// 保留原有设置
+		glog.Errorf("Reload config %s: %v", *configPath, err)
+		return
+	}
+	resolveCredentials(cfg)
+	audio, err := resolveAudioSettings(cfg.Audio)
+	if err == nil && audio != audioSettings {
+		glog.Warning("Reload config: audio settings changed, restart to apply them")
+	}
+	if cfg.AppID != current.AppID || cfg.AccessToken != current.AccessToken || cfg.AppKey != current.AppKey {
+		glog.Warning("Reload config: credentials changed, restart to apply them")
+	}
+	settings, _ := json.Marshal(sessionSettings.Load())
+	glog.V(vEvent).Infof("Config reloaded, session settings for the next session: %s", settings)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+)
+
+// 回归回放：把 -record-dir 录制的用户音频重新送入一个新会话，与录制时的识别
+// 结果和机器人回复逐轮比较，用于发现服务端或配置变更引起的行为变化。
+
+var (
+	replayIdle          = flag.Duration("replay-idle", 5*time.Second, "in the `replay`, `compare` and `batch` commands, finish the session after the recording and this long without bot activity")
+	replayMinSimilarity = flag.Float64("replay-min-similarity", 0.8, "in the `replay` command, similarity in [0, 1] below which a turn counts as changed")
+)
+
+func init() {
+	commands["replay"] = runReplay
+}
+
+// replayTurns are the utterances of the user and the replies of the bot, in
+// order.
+type replayTurns struct {
+	User []string `json:"user"`
+	Bot  []string `json:"bot"`
+	// UserHypotheses are the hypotheses of each User text, see
+	// ASRResult.Hypotheses; nil for recorded turns.
+	UserHypotheses [][]string `json:"-"`
+}
+
+// TurnDiff compares a turn of the recording with the replay.
+type TurnDiff struct {
+	Role       string  `json:"role"` // user or bot
+	Index      int     `json:"index"`
+	Recorded   string  `json:"recorded"`
+	Replayed   string  `json:"replayed"`
+	Similarity float64 `json:"similarity"`
+	Changed    bool    `json:"changed"`
+}
+
+// runReplay implements the `replay <bundle>` subcommand.
+func runReplay(ctx context.Context, cfg *Config) error {
+	dir := flag.Arg(1)
+	if dir == "" {
+		return errors.New("usage: replay <recording bundle directory>")
+	}
+	recorded, err := loadReplayTurns(filepath.Join(dir, "events.jsonl"))
+	if err != nil {
+		return err
+	}
+	pcm, duration, err := loadReplayAudio(dir)
+	if err != nil {
+		return err
+	}
+	glog.V(vEvent).Infof("Replaying %v of user audio from %s", duration.Round(time.Millisecond), dir)
+	collector, err := replaySession(ctx, cfg, nil, pcm, duration)
+	if err != nil {
+		return err
+	}
+
+	diffs := diffReplay(recorded, collector.Turns(), *replayMinSimilarity)
+	changed := 0
+	for _, d := range diffs {
+		if d.Changed {
+			changed++
+		}
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(diffs); err != nil {
+			return err
+		}
+	} else {
+		writeReplayDiff(os.Stdout, diffs)
+	}
+	if changed > 0 {
+		return fmt.Errorf("%d of %d turns changed", changed, len(diffs))
+	}
+	return nil
+}
+
+// loadReplayAudio reads the user audio of a recording bundle, in the input
+// format.
+func loadReplayAudio(dir string) ([]byte, time.Duration, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "user.wav"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("read user audio (bundles recorded with -format flac cannot be replayed): %w", err)
+	}
+	samples, rate, channels, err := decodeWAV(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decode user audio: %w", err)
+	}
+	duration := time.Duration(len(samples)/channels) * time.Second / time.Duration(rate)
+	return newInputConverter(rate, channels).convert(samples), duration, nil
+}
+
+// replaySession streams pcm, lasting duration, into a new session on a new
+// connection, with settings or the current session settings if nil. The
+// session ends once the bot has been idle for -replay-idle after the audio.
+func replaySession(ctx context.Context, cfg *Config, settings *SessionSettings, pcm []byte, duration time.Duration) (*replayCollector, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	collector := newReplayCollector()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 录音播放完毕后，等待机器人空闲一段时间再结束会话
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(duration):
+		}
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for collector.Idle() < *replayIdle {
+			select {
+			case <-ctx.Done():
+				return
+			case <-collector.ended:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	connectID := uuid.New().String()
+	conn, resp, err := dialDialogWithID(ctx, cfg, connectID)
+	id := newConnIdentity(resp, connectID)
+	if err != nil {
+		return nil, id.Wrap(fmt.Errorf("websocket dial: %w", err))
+	}
+	defer conn.Close()
+	glog.V(vEvent).Infof("Connected: %s", id)
+	if err := startConnection(conn); err != nil {
+		return nil, id.Wrap(fmt.Errorf("start connection: %w", err))
+	}
+	src := pcmSource{pcm: pcm, done: done}
+	if err := runSession(ctx, conn, SessionInfo{ID: NewSessionID(), Seq: 1, Settings: settings}, collector, src); err != nil {
+		return nil, id.Wrap(err)
+	}
+	if err := finishConnection(conn); err != nil {
+		return nil, id.Wrap(fmt.Errorf("finish connection: %w", err))
+	}
+	return collector, nil
+}
+
+// loadReplayTurns reads the turns of a recorded events.jsonl.
+func loadReplayTurns(path string) (replayTurns, error) {
+	var turns replayTurns
+	f, err := os.Open(path)
+	if err != nil {
+		return turns, fmt.Errorf("open recorded events: %w", err)
+	}
+	defer f.Close()
+	var reply strings.Builder
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var ev jsonEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return turns, fmt.Errorf("parse recorded event: %w", err)
+		}
+		switch ev.Type {
+		case "asr_final":
+			turns.User = append(turns.User, ev.Text)
+		case "bot_text":
+			reply.WriteString(ev.Text)
+		case "bot_text_end":
+			if reply.Len() > 0 {
+				turns.Bot = append(turns.Bot, reply.String())
+				reply.Reset()
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return turns, fmt.Errorf("read recorded events: %w", err)
+	}
+	return turns, nil
+}
+
+// replayCollector collects the turns of the replayed session.
+type replayCollector struct {
+	NopHandler
+	ended chan struct{}
+	once  sync.Once
+
+	mu        sync.Mutex
+	turns     replayTurns
+	reply     strings.Builder
+	activity  time.Time
+	speechEnd time.Time // of the user turn awaiting bot audio
+	latencies []time.Duration
+}
+
+func newReplayCollector() *replayCollector {
+	return &replayCollector{ended: make(chan struct{}), activity: time.Now()}
+}
+
+// Idle returns how long the bot and the recognizer have been silent.
+func (c *replayCollector) Idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.activity)
+}
+
+// Latencies returns the time from the end of each user turn to the first
+// bot audio of the reply.
+func (c *replayCollector) Latencies() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latencies
+}
+
+// Turns returns the collected turns.
+func (c *replayCollector) Turns() replayTurns {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.turns
+}
+
+func (c *replayCollector) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity = time.Now()
+}
+
+func (c *replayCollector) OnASRPartial(ASRResult) { c.touch() }
+
+func (c *replayCollector) OnASRFinal(result ASRResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity = time.Now()
+	c.turns.User = append(c.turns.User, result.Text)
+	c.turns.UserHypotheses = append(c.turns.UserHypotheses, result.Hypotheses())
+	glog.V(vEvent).Infof("Replay user: %s", redactText(result.Text))
+}
+
+func (c *replayCollector) OnBotText(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity = time.Now()
+	c.reply.WriteString(text)
+}
+
+func (c *replayCollector) OnBotTextEnd() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity = time.Now()
+	if c.reply.Len() > 0 {
+		c.turns.Bot = append(c.turns.Bot, c.reply.String())
+		glog.V(vEvent).Infof("Replay bot: %s", c.reply.String())
+		c.reply.Reset()
+	}
+}
+
+func (c *replayCollector) OnASREnd() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity, c.speechEnd = time.Now(), time.Now()
+}
+
+func (c *replayCollector) OnAudioChunk([]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity = time.Now()
+	if !c.speechEnd.IsZero() {
+		c.latencies = append(c.latencies, c.activity.Sub(c.speechEnd))
+		c.speechEnd = time.Time{}
+	}
+}
+
+func (c *replayCollector) OnSessionEnd(int32, []byte) {
+	c.once.Do(func() { close(c.ended) })
+}
+
+// diffReplay compares the recorded and replayed turns of each role.
+func diffReplay(recorded, replayed replayTurns, minSimilarity float64) []TurnDiff {
+	var diffs []TurnDiff
+	compare := func(role string, a, b []string) {
+		for i := range max(len(a), len(b)) {
+			d := TurnDiff{Role: role, Index: i + 1}
+			if i < len(a) {
+				d.Recorded = a[i]
+			}
+			if i < len(b) {
+				d.Replayed = b[i]
+			}
+			d.Similarity = similarity(d.Recorded, d.Replayed)
+			d.Changed = d.Similarity < minSimilarity
+			diffs = append(diffs, d)
+		}
+	}
+	compare("user", recorded.User, replayed.User)
+	compare("bot", recorded.Bot, replayed.Bot)
+	return diffs
+}
+
+// similarity returns 1 minus the edit distance of a and b, in runes,
+// relative to the longer one.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+func writeReplayDiff(w io.Writer, diffs []TurnDiff) {
+	for _, d := range diffs {
+		status := "same"
+		if d.Changed {
+			status = "CHANGED"
+		}
+		fmt.Fprintf(w, "%s #%d: %s (similarity %.2f)\n", d.Role, d.Index, status, d.Similarity)
+		if d.Changed || d.Recorded != d.Replayed {
+			fmt.Fprintf(w, "  - %s\n  + %s\n", d.Recorded, d.Replayed)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import "math"
+
+// resampler converts interleaved int16 audio from one sample rate to another
+// by linear interpolation. When downsampling, the input first goes through a
+// windowed-sinc low-pass below the output Nyquist frequency, so that higher
+// frequencies do not fold back into the band, e.g. from a 48 kHz microphone
+// to 16 kHz for recognition. It keeps state between calls, so a stream can
+// be converted chunk by chunk.
+type resampler struct {
+	step     float64 // input frames per output frame
+	channels int
+	pos      float64   // position of the next output frame, in input frames
+	last     []float64 // last input frame of the previous chunk, at index -1
+	// taps is the anti-aliasing low-pass, nil when upsampling.
+	taps []float64
+	// history holds the last len(taps)-1 input frames, filtered with the
+	// next chunk.
+	history []float64
+}
+
+// lowPassTransition is the transition band of the anti-aliasing low-pass, as
+// a fraction of the output sample rate: it passes up to 45% of the output
+// rate and stops from 55%, the aliases of which fall above the passband.
+const lowPassTransition = 0.1
+
+func newResampler(inRate, outRate, channels int) *resampler {
+	r := &resampler{
+		step:     float64(inRate) / float64(outRate),
+		channels: channels,
+		last:     make([]float64, channels),
+	}
+	if r.step > 1 {
+		// Blackman 窗的过渡带约为 5.5/阶数
+		half := int(math.Ceil(5.5 / lowPassTransition * r.step / 2))
+		r.taps = lowPassTaps(0.5/r.step, 2*half+1)
+		r.history = make([]float64, (len(r.taps)-1)*channels)
+	}
+	return r
+}
+
+// lowPassTaps returns a Blackman-windowed sinc low-pass of n taps with the
+// cutoff in cycles per sample, normalized to unity gain.
+func lowPassTaps(cutoff float64, n int) []float64 {
+	taps := make([]float64, n)
+	center := float64(n-1) / 2
+	sum := 0.0
+	for i := range taps {
+		x := float64(i) - center
+		h := 2 * cutoff
+		if x != 0 {
+			h = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		phase := 2 * math.Pi * float64(i) / float64(n-1)
+		taps[i] = h * (0.42 - 0.5*math.Cos(phase) + 0.08*math.Cos(2*phase))
+		sum += taps[i]
+	}
+	for i := range taps {
+		taps[i] /= sum
+	}
+	return taps
+}
+
+// Process resamples the interleaved frames of in.
+func (r *resampler) Process(in []int16) []int16 {
+	frames := len(in) / r.channels
+	if frames == 0 {
+		return nil
+	}
+	x := r.lowPass(in[:frames*r.channels])
+	sample := func(frame, ch int) float64 {
+		if frame < 0 {
+			return r.last[ch]
+		}
+		return x[frame*r.channels+ch]
+	}
+
+	out := make([]int16, 0, int(float64(frames)/r.step+1)*r.channels)
+	t := r.pos
+	for ; t < float64(frames-1); t += r.step {
+		i := int(math.Floor(t))
+		frac := t - float64(i)
+		for ch := 0; ch < r.channels; ch++ {
+			v := sample(i, ch)*(1-frac) + sample(i+1, ch)*frac
+			out = append(out, int16(max(min(math.Round(v), math.MaxInt16), math.MinInt16)))
+		}
+	}
+	r.pos = t - float64(frames)
+	copy(r.last, x[(frames-1)*r.channels:])
+	return out
+}
+
+// lowPass returns the frames of in filtered by the taps, delayed by half the
+// taps, or as they are without taps.
+func (r *resampler) lowPass(in []int16) []float64 {
+	out := make([]float64, len(in))
+	if r.taps == nil {
+		for i, s := range in {
+			out[i] = float64(s)
+		}
+		return out
+	}
+	buf := make([]float64, len(r.history), len(r.history)+len(in))
+	copy(buf, r.history)
+	for _, s := range in {
+		buf = append(buf, float64(s))
+	}
+	for f := range len(in) / r.channels {
+		for ch := 0; ch < r.channels; ch++ {
+			acc := 0.0
+			for k, tap := range r.taps {
+				acc += tap * buf[(f+k)*r.channels+ch]
+			}
+			out[f*r.channels+ch] = acc
+		}
+	}
+	copy(r.history, buf[len(buf)-len(r.history):])
+	return out
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestResamplerAntiAliasing downsamples tones from 48 kHz to 16 kHz in
+// chunks: a tone above the output Nyquist frequency must be attenuated
+// instead of folding back into the speech band.
+func TestResamplerAntiAliasing(t *testing.T) {
+	for _, tc := range []struct {
+		freq float64
+		gain float64 // of the output, relative to the input
+	}{
+		{1000, 1},      // 通带
+		{6000, 1},      // 通带内的高频
+		{12000, 0.001}, // 折叠到 4 kHz
+		{9000, 0.001},  // 折叠到 7 kHz
+	} {
+		const amplitude = 10000
+		r := newResampler(48000, 16000, 1)
+		in := make([]int16, 48000)
+		for i := range in {
+			in[i] = int16(amplitude * math.Sin(2*math.Pi*tc.freq*float64(i)/48000))
+		}
+		var out []int16
+		for chunk := range len(in) / 960 {
+			out = append(out, r.Process(in[chunk*960:(chunk+1)*960])...)
+		}
+		if len(out) < 15900 || len(out) > 16000 {
+			t.Fatalf("%v Hz: %d samples out of 48000 at 16 kHz", tc.freq, len(out))
+		}
+		// 跳过滤波器的启动阶段
+		sum := 0.0
+		for _, s := range out[1000:] {
+			sum += float64(s) * float64(s)
+		}
+		gain := math.Sqrt(sum/float64(len(out)-1000)) / (amplitude / math.Sqrt2)
+		if tc.gain == 1 && math.Abs(gain-1) > 0.02 || tc.gain < 1 && gain > tc.gain {
+			t.Errorf("%v Hz: gain %.4f, want %v", tc.freq, gain, tc.gain)
+		}
+	}
+}
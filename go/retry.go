@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 会话因服务端错误（MsgTypeError）失败时，按配置文件中的 retry_policy 决定
+// 处理方式：同一连接上退避后重试、重新读取凭证并重连后重试，或中止。规则按
+// 顺序匹配错误码，第一条匹配的规则生效。
+
+// Actions of a RetryRule.
+const (
+	retryActionRetry  = "retry"  // start a new session on the same connection
+	retryActionReauth = "reauth" // reload the credentials, reconnect and retry
+	retryActionAbort  = "abort"  // end the dialog with the error
+)
+
+// RetryRule maps a class of server error codes to the action taken when a
+// session fails with one of them.
+type RetryRule struct {
+	// Codes are error codes ("45000081"), prefixes ending with "*" ("55*"),
+	// or "*" for every code.
+	Codes  []string `json:"codes"`
+	Action string   `json:"action"`
+	// MaxAttempts limits the consecutive attempts under the rule; 0 means no
+	// limit. Once exceeded, the dialog is aborted.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff is the delay before the first attempt, doubled for each
+	// further one up to MaxBackoff.
+	Backoff    Duration `json:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty"`
+}
+
+// defaultRetryPolicy retries server-side failures (55xxxxxx) a few times and
+// aborts on the others.
+var defaultRetryPolicy = []RetryRule{
+	{Codes: []string{"55*"}, Action: retryActionRetry, MaxAttempts: 3, Backoff: Duration(time.Second), MaxBackoff: Duration(10 * time.Second)},
+}
+
+// Backoff of the failed sessions that no rule covers in -loop mode, counted
+// like the attempts of a rule.
+const (
+	loopBackoff    = time.Second
+	loopMaxBackoff = 30 * time.Second
+)
+
+// sessionRetry is the retry policy in effect, set by applyConfig.
+var sessionRetry = new(retryPolicy)
+
+// retryPolicy applies the rules and counts the consecutive attempts.
+type retryPolicy struct {
+	mu       sync.Mutex
+	rules    []RetryRule
+	attempts map[int]int // by rule index, -1 for the -loop fallback
+}
+
+// validateRetryRules checks the actions and codes of rules.
+func validateRetryRules(rules []RetryRule) error {
+	for i, r := range rules {
+		switch r.Action {
+		case retryActionRetry, retryActionReauth, retryActionAbort:
+		default:
+			return fmt.Errorf("retry rule %d: unknown action %q", i+1, r.Action)
+		}
+		if len(r.Codes) == 0 {
+			return fmt.Errorf("retry rule %d: no codes", i+1)
+		}
+		for _, c := range r.Codes {
+			if _, err := strconv.ParseUint(strings.TrimSuffix(c, "*"), 10, 32); err != nil && c != "*" {
+				return fmt.Errorf("retry rule %d: invalid code %q", i+1, c)
+			}
+		}
+	}
+	return nil
+}
+
+// SetRules replaces the rules, defaultRetryPolicy if none, and resets the
+// attempts.
+func (p *retryPolicy) SetRules(rules []RetryRule) {
+	if len(rules) == 0 {
+		rules = defaultRetryPolicy
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+	p.attempts = nil
+}
+
+// Reset clears the attempts after a successful session.
+func (p *retryPolicy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts = nil
+}
+
+// Decide returns the action for a session that failed with err, and the
+// delay before it. Errors other than ServerError and SessionFailedError
+// abort; a failed session has no error code and matches the rules for "*"
+// only. Codes without a rule abort, except in -loop mode, where a new session
+// starts after loopBackoff, doubled for each consecutive failure.
+func (p *retryPolicy) Decide(err error) (action string, delay time.Duration) {
+	var serverErr *ServerError
+	var failedErr *SessionFailedError
+	var code string
+	switch {
+	case errors.As(err, &serverErr):
+		code = strconv.FormatUint(uint64(serverErr.Code), 10)
+	case errors.As(err, &failedErr):
+	default:
+		return retryActionAbort, 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, r := range p.rules {
+		if !r.matches(code) {
+			continue
+		}
+		if r.Action == retryActionAbort {
+			return retryActionAbort, 0
+		}
+		n := p.attempt(i)
+		if r.MaxAttempts > 0 && n > r.MaxAttempts {
+			return retryActionAbort, 0
+		}
+		return r.Action, backoff(time.Duration(r.Backoff), time.Duration(r.MaxBackoff), n)
+	}
+	if *loopMode {
+		// 不在规则内的失败也不立即重开会话，以免服务端持续失败时空转
+		return retryActionRetry, backoff(loopBackoff, loopMaxBackoff, p.attempt(-1))
+	}
+	return retryActionAbort, 0
+}
+
+// attempt counts an attempt under the rule, -1 for the -loop fallback, and
+// returns the consecutive attempts. p.mu is held.
+func (p *retryPolicy) attempt(rule int) int {
+	if p.attempts == nil {
+		p.attempts = map[int]int{}
+	}
+	p.attempts[rule]++
+	return p.attempts[rule]
+}
+
+// backoff returns the delay before the nth attempt: d doubled for each
+// attempt after the first, up to maxDelay unless it is 0.
+func backoff(d, maxDelay time.Duration, n int) time.Duration {
+	for ; n > 1 && d > 0; n-- {
+		d *= 2
+		if maxDelay > 0 && d >= maxDelay {
+			return maxDelay
+		}
+	}
+	return d
+}
+
+// matches reports whether the rule covers the error code, "" for an error
+// without one.
+func (r RetryRule) matches(code string) bool {
+	for _, c := range r.Codes {
+		if c == "*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(c, "*"); code != "" && (ok && strings.HasPrefix(code, prefix) || c == code) {
+			return true
+		}
+	}
+	return false
+}
+
+// reauthError ends the connection so that the caller reloads the
+// credentials and reconnects after delay.
+type reauthError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *reauthError) Error() string { return fmt.Sprintf("re-authenticate: %v", e.err) }
+func (e *reauthError) Unwrap() error { return e.err }
+
+// sleepCtx waits for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDecide(t *testing.T) {
+	failed := fmt.Errorf("receive: %w", &SessionFailedError{Payload: []byte(`{"error":"x"}`)})
+	for _, tc := range []struct {
+		name   string
+		rules  []RetryRule
+		errs   []error
+		action string
+		delay  time.Duration
+	}{
+		{"默认策略重试 55 开头的错误码", nil, []error{&ServerError{Code: 55000001}}, retryActionRetry, time.Second},
+		{"退避加倍", nil, []error{&ServerError{Code: 55000001}, &ServerError{Code: 55000001}}, retryActionRetry, 2 * time.Second},
+		{"超过最大次数后中止", nil, []error{&ServerError{Code: 55000001}, &ServerError{Code: 55000001}, &ServerError{Code: 55000001}, &ServerError{Code: 55000001}}, retryActionAbort, 0},
+		{"没有规则的错误码中止", nil, []error{&ServerError{Code: 45000001}}, retryActionAbort, 0},
+		{"会话失败没有规则时中止", nil, []error{failed}, retryActionAbort, 0},
+		{"会话失败匹配 *", []RetryRule{{Codes: []string{"55*"}, Action: retryActionAbort}, {Codes: []string{"*"}, Action: retryActionRetry, Backoff: Duration(3 * time.Second)}}, []error{failed}, retryActionRetry, 3 * time.Second},
+		{"其他错误中止", []RetryRule{{Codes: []string{"*"}, Action: retryActionRetry}}, []error{errors.New("read: EOF")}, retryActionAbort, 0},
+	} {
+		var p retryPolicy
+		p.SetRules(tc.rules)
+		var action string
+		var delay time.Duration
+		for _, err := range tc.errs {
+			action, delay = p.Decide(err)
+		}
+		if action != tc.action || delay != tc.delay {
+			t.Errorf("%s: Decide = %s, %v, want %s, %v", tc.name, action, delay, tc.action, tc.delay)
+		}
+	}
+}
+
+// TestRetryPolicyLoop backs off the failures without a rule in -loop mode,
+// and starts the session after a successful one at once.
+func TestRetryPolicyLoop(t *testing.T) {
+	defer func(v bool) { *loopMode = v }(*loopMode)
+	*loopMode = true
+	var p retryPolicy
+	p.SetRules(nil)
+	failed := &SessionFailedError{}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if action, delay := p.Decide(failed); action != retryActionRetry || delay != want {
+			t.Errorf("Decide = %s, %v, want retry after %v", action, delay, want)
+		}
+	}
+	for range 10 {
+		p.Decide(failed)
+	}
+	if _, delay := p.Decide(failed); delay != loopMaxBackoff {
+		t.Errorf("delay %v after many failures, want %v", delay, loopMaxBackoff)
+	}
+	// 会话正常结束后重新从最短的退避开始
+	p.Reset()
+	if _, delay := p.Decide(failed); delay != loopBackoff {
+		t.Errorf("delay %v after a reset, want %v", delay, loopBackoff)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// ROS 2 集成通过 rosbridge（rosbridge_server 的 websocket JSON 协议）完成，
+// 不依赖 rclgo 等 cgo 绑定。
+
+var (
+	rosURL        = flag.String("ros-url", "ws://localhost:9090", "websocket URL of the rosbridge server")
+	rosNamespace  = flag.String("ros-namespace", "/dialog", "namespace of the topics published by the `ros` command")
+	rosAudioTopic = flag.String("ros-audio-topic", "/audio", "audio_common_msgs/AudioData topic with the user audio, in the input format")
+)
+
+// ROS 2 message types used by the bridge.
+const (
+	rosStringType = "std_msgs/msg/String"
+	rosEmptyType  = "std_msgs/msg/Empty"
+	rosAudioType  = "audio_common_msgs/msg/AudioData"
+)
+
+func init() {
+	commands["ros"] = runROS
+}
+
+// rosMessage is a rosbridge protocol operation.
+type rosMessage struct {
+	Op    string          `json:"op"`
+	Topic string          `json:"topic"`
+	Type  string          `json:"type,omitempty"`
+	Msg   json.RawMessage `json:"msg,omitempty"`
+}
+
+// rosAudioData is an audio_common_msgs/AudioData message. rosbridge encodes
+// uint8[] as base64, like encoding/json does for []byte.
+type rosAudioData struct {
+	Data []byte `json:"data"`
+}
+
+type rosString struct {
+	Data string `json:"data"`
+}
+
+// rosBridge is a connection to a rosbridge server.
+type rosBridge struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (r *rosBridge) send(op, topic, typ string, msg interface{}) error {
+	m := rosMessage{Op: op, Topic: topic, Type: typ}
+	if msg != nil {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("marshal %s message: %w", topic, err)
+		}
+		m.Msg = data
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.conn.WriteJSON(m); err != nil {
+		return fmt.Errorf("%s %s: %w", op, topic, err)
+	}
+	return nil
+}
+
+// runROS implements the `ros` subcommand: the user audio is read from a ROS 2
+// topic, and the recognized text, the bot replies and the bot audio are
+// published to topics under -ros-namespace.
+func runROS(ctx context.Context, cfg *Config) error {
+	ids, err := newSessionIDs(*sessionIDFlag)
+	if err != nil {
+		return err
+	}
+	rosConn, _, err := websocket.DefaultDialer.DialContext(ctx, *rosURL, nil)
+	if err != nil {
+		return fmt.Errorf("connect to rosbridge %s: %w", *rosURL, err)
+	}
+	defer rosConn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = rosConn.Close() })
+	defer stop()
+
+	bridge := &rosBridge{conn: rosConn}
+	pub := newROSPublisher(bridge, strings.TrimSuffix(*rosNamespace, "/"))
+	if err := pub.advertise(); err != nil {
+		return err
+	}
+	if err := bridge.send("subscribe", *rosAudioTopic, rosAudioType, nil); err != nil {
+		return err
+	}
+	glog.V(vEvent).Infof("Connected to rosbridge %s, listening on %s", *rosURL, *rosAudioTopic)
+
+	audioIn := make(chan []byte, 100)
+	go func() {
+		defer close(audioIn)
+		for {
+			var m rosMessage
+			if err := rosConn.ReadJSON(&m); err != nil {
+				if ctx.Err() == nil {
+					glog.Errorf("Read from rosbridge: %v", err)
+				}
+				return
+			}
+			if m.Op != "publish" || m.Topic != *rosAudioTopic {
+				continue
+			}
+			var audio rosAudioData
+			if err := json.Unmarshal(m.Msg, &audio); err != nil {
+				glog.Errorf("Unmarshal %s message: %v", m.Topic, err)
+				continue
+			}
+			select {
+			case audioIn <- audio.Data:
+			default:
+				glog.V(vFrame).Infof("Drop %d bytes of ROS audio: session is not keeping up", len(audio.Data))
+			}
+		}
+	}()
+
+	connectID := uuid.New().String()
+	conn, resp, err := dialDialogWithID(ctx, cfg, connectID)
+	id := newConnIdentity(resp, connectID)
+	if err != nil {
+		return id.Wrap(fmt.Errorf("websocket dial: %w", err))
+	}
+	defer conn.Close()
+	glog.V(vEvent).Infof("Connected: %s", id)
+	defer tagLogs(id)()
+	setConnectionMetrics(id)
+	return id.Wrap(realTimeDialog(ctx, conn, ids, pub, chanSource(audioIn)))
+}
+
+// rosPublisher publishes the dialog events to ROS 2 topics:
+//
+//	<ns>/asr           std_msgs/String  final recognition results
+//	<ns>/asr_partial   std_msgs/String  interim recognition results
+//	<ns>/reply         std_msgs/String  complete bot replies
+//	<ns>/interrupt     std_msgs/Empty   the user started speaking; stop playback
+//	<ns>/audio         AudioData        bot audio, in the output format
+type rosPublisher struct {
+	NopHandler
+	bridge *rosBridge
+	ns     string
+
+	mu    sync.Mutex
+	reply strings.Builder
+}
+
+func newROSPublisher(bridge *rosBridge, ns string) *rosPublisher {
+	return &rosPublisher{bridge: bridge, ns: ns}
+}
+
+func (p *rosPublisher) advertise() error {
+	topics := []struct{ name, typ string }{
+		{"asr", rosStringType},
+		{"asr_partial", rosStringType},
+		{"reply", rosStringType},
+		{"interrupt", rosEmptyType},
+		{"audio", rosAudioType},
+	}
+	for _, t := range topics {
+		if err := p.bridge.send("advertise", p.ns+"/"+t.name, t.typ, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *rosPublisher) publish(name string, msg interface{}) {
+	if err := p.bridge.send("publish", p.ns+"/"+name, "", msg); err != nil {
+		glog.Errorf("Publish to ROS: %v", err)
+	}
+}
+
+func (p *rosPublisher) OnASRStart(ASRInfoPayload) {
+	p.publish("interrupt", struct{}{})
+}
+
+func (p *rosPublisher) OnASRPartial(result ASRResult) {
+	p.publish("asr_partial", rosString{Data: result.Text})
+}
+
+func (p *rosPublisher) OnASRFinal(result ASRResult) {
+	p.publish("asr", rosString{Data: result.Text})
+}
+
+func (p *rosPublisher) OnBotText(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reply.WriteString(text)
+}
+
+func (p *rosPublisher) OnBotTextEnd() {
+	p.mu.Lock()
+	text := p.reply.String()
+	p.reply.Reset()
+	p.mu.Unlock()
+	if text != "" {
+		p.publish("reply", rosString{Data: text})
+	}
+}
+
+func (p *rosPublisher) OnAudioChunk(data []byte) {
+	p.publish("audio", rosAudioData{Data: data})
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+)
+
+// 脚本化对话：script 子命令读取一个按行书写的动作脚本，在真实会话中依次执行，
+// 逐条报告期望是否满足，用于机器人行为的自动化验收测试。动作有：
+//
+//	wait 2s
+//	speak greeting.wav
+//	send text "今天天气怎么样"
+//	expect asr containing "天气" within 10s
+//	expect bot containing "晴" within 20s
+//
+// speak 的文件相对脚本所在目录；expect 在上一次匹配之后收到的识别结果（asr，
+// 包括 -asr-alternatives 请求的备选）或机器人完整回复（bot）中查找，未写 within
+// 时等待 -script-timeout。
+
+var scriptTimeout = flag.Duration("script-timeout", 15*time.Second, "in the `script` command, how long an expect action waits when it has no within")
+
+func init() {
+	commands["script"] = runScript
+}
+
+// scriptAction is a line of a script.
+type scriptAction struct {
+	line     int
+	text     string // of the line
+	kind     string // wait, speak, text or expect
+	duration time.Duration
+	pcm      []byte // speak: in the input format
+	target   string // expect: asr or bot
+	value    string // text: the query; expect: the expected text
+}
+
+// ScriptResult is the outcome of an action of a script.
+type ScriptResult struct {
+	Line   int    `json:"line"`
+	Action string `json:"action"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// runScript implements the `script <file>` subcommand.
+func runScript(ctx context.Context, cfg *Config) error {
+	path := flag.Arg(1)
+	if path == "" {
+		return errors.New("usage: script <script file>")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open script: %w", err)
+	}
+	actions, err := parseScript(f, filepath.Dir(path))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	results, err := runScriptSession(ctx, cfg, actions)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if !r.Passed {
+			failed++
+		}
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		writeScriptResults(os.Stdout, results)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d actions failed", failed, len(results))
+	}
+	return nil
+}
+
+// parseScript reads the actions of a script, loading the audio of the speak
+// actions from dir.
+func parseScript(r io.Reader, dir string) ([]scriptAction, error) {
+	var actions []scriptAction
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		a, err := parseScriptAction(text, dir)
+		if err != nil {
+			return nil, fmt.Errorf("script line %d: %w", n, err)
+		}
+		a.line, a.text = n, text
+		actions = append(actions, a)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read script: %w", err)
+	}
+	return actions, nil
+}
+
+func parseScriptAction(text, dir string) (scriptAction, error) {
+	f, err := scriptFields(text)
+	if err != nil {
+		return scriptAction{}, err
+	}
+	a := scriptAction{kind: f[0]}
+	switch {
+	case f[0] == "wait" && len(f) == 2:
+		a.duration, err = time.ParseDuration(f[1])
+		return a, err
+	case f[0] == "speak" && len(f) == 2:
+		path := f[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		a.pcm, a.duration, err = loadInputWAV(path)
+		return a, err
+	case f[0] == "send" && len(f) == 3 && f[1] == "text":
+		a.kind, a.value = "text", f[2]
+		return a, nil
+	case f[0] == "expect" && (len(f) == 4 || len(f) == 6) && (f[1] == "asr" || f[1] == "bot") && f[2] == "containing":
+		a.target, a.value, a.duration = f[1], f[3], *scriptTimeout
+		if len(f) == 6 {
+			if f[4] != "within" {
+				break
+			}
+			a.duration, err = time.ParseDuration(f[5])
+		}
+		return a, err
+	}
+	return a, fmt.Errorf("invalid action %q", text)
+}
+
+// scriptFields splits a line into words and Go-quoted strings.
+func scriptFields(line string) ([]string, error) {
+	var fields []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string: %w", err)
+			}
+			s, _ := strconv.Unquote(quoted)
+			fields = append(fields, s)
+			line = line[len(quoted):]
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+	return fields, nil
+}
+
+// loadInputWAV reads a WAV file, converted to the input format.
+func loadInputWAV(path string) ([]byte, time.Duration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	samples, rate, channels, err := decodeWAV(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decode %s: %w", path, err)
+	}
+	duration := time.Duration(len(samples)/channels) * time.Second / time.Duration(rate)
+	return newInputConverter(rate, channels).convert(samples), duration, nil
+}
+
+// runScriptSession runs the actions in a new session on a new connection.
+func runScriptSession(ctx context.Context, cfg *Config, actions []scriptAction) ([]ScriptResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	connectID := uuid.New().String()
+	conn, resp, err := dialDialogWithID(ctx, cfg, connectID)
+	id := newConnIdentity(resp, connectID)
+	if err != nil {
+		return nil, id.Wrap(fmt.Errorf("websocket dial: %w", err))
+	}
+	defer conn.Close()
+	glog.V(vEvent).Infof("Connected: %s", id)
+	if err := startConnection(conn); err != nil {
+		return nil, id.Wrap(fmt.Errorf("start connection: %w", err))
+	}
+
+	d := &scriptDriver{
+		conn:      conn,
+		collector: newReplayCollector(),
+		src:       &scriptSource{done: make(chan struct{})},
+		started:   make(chan string, 1),
+	}
+	sessionErr := make(chan error, 1)
+	go func() {
+		sessionErr <- runSession(ctx, conn, SessionInfo{ID: NewSessionID(), Seq: 1}, multiHandler{d.collector, d}, d.src)
+	}()
+	select {
+	case d.sessionID = <-d.started:
+	case err := <-sessionErr:
+		if err == nil {
+			err = errors.New("session ended before it started")
+		}
+		return nil, id.Wrap(err)
+	}
+
+	var results []ScriptResult
+	for _, a := range actions {
+		r := d.run(ctx, a)
+		glog.V(vEvent).Infof("Script line %d passed=%v: %s %s", a.line, r.Passed, a.text, r.Detail)
+		results = append(results, r)
+	}
+	close(d.src.done)
+	if err := <-sessionErr; err != nil {
+		return nil, id.Wrap(err)
+	}
+	if err := finishConnection(conn); err != nil {
+		return nil, id.Wrap(fmt.Errorf("finish connection: %w", err))
+	}
+	return results, nil
+}
+
+// scriptDriver executes the actions of a script in a session.
+type scriptDriver struct {
+	NopHandler
+	conn      Transport
+	collector *replayCollector
+	src       *scriptSource
+	started   chan string
+	sessionID string
+	// matched are the numbers of user and bot turns consumed by the expect
+	// actions.
+	matched map[string]int
+}
+
+func (d *scriptDriver) OnSessionStart(session SessionInfo) {
+	d.started <- session.ID
+}
+
+func (d *scriptDriver) run(ctx context.Context, a scriptAction) ScriptResult {
+	r := ScriptResult{Line: a.line, Action: a.text, Passed: true}
+	switch a.kind {
+	case "wait":
+		sleepCtx(ctx, a.duration)
+	case "speak":
+		select {
+		case <-d.src.Speak(a.pcm):
+		case <-d.collector.ended:
+			r.Passed, r.Detail = false, "session ended"
+		case <-ctx.Done():
+		}
+	case "text":
+		if err := chatTextQuery(d.conn, d.sessionID, &ChatTextQueryPayload{Content: a.value}); err != nil {
+			r.Passed, r.Detail = false, err.Error()
+		}
+	case "expect":
+		r.Passed, r.Detail = d.expect(ctx, a)
+	}
+	if ctx.Err() != nil {
+		r.Passed, r.Detail = false, ctx.Err().Error()
+	}
+	return r
+}
+
+// expect waits for a user or bot turn after the last one matched to
+// contain the expected text.
+func (d *scriptDriver) expect(ctx context.Context, a scriptAction) (bool, string) {
+	if d.matched == nil {
+		d.matched = make(map[string]int)
+	}
+	deadline := time.NewTimer(a.duration)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var seen []string
+	for {
+		turns := d.collector.Turns()
+		seen = turns.User
+		if a.target == "bot" {
+			seen = turns.Bot
+		}
+		for i := d.matched[a.target]; i < len(seen); i++ {
+			// 识别结果的备选同样可以匹配
+			candidates := seen[i : i+1]
+			if a.target == "asr" && i < len(turns.UserHypotheses) {
+				candidates = turns.UserHypotheses[i]
+			}
+			for _, text := range candidates {
+				if strings.Contains(text, a.value) {
+					d.matched[a.target] = i + 1
+					return true, text
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err().Error()
+		case <-d.collector.ended:
+			return false, "session ended"
+		case <-deadline.C:
+			seen = seen[min(d.matched[a.target], len(seen)):]
+			if len(seen) == 0 {
+				return false, fmt.Sprintf("nothing received within %v", a.duration)
+			}
+			return false, fmt.Sprintf("received %q", seen)
+		case <-ticker.C:
+		}
+	}
+}
+
+// scriptSource streams the audio of the speak actions in real time, and
+// silence in between, until done is closed.
+type scriptSource struct {
+	done chan struct{}
+
+	mu     sync.Mutex
+	pcm    []byte
+	played chan struct{}
+}
+
+// Speak queues pcm, in the input format, and returns a channel closed once
+// it has been sent.
+func (s *scriptSource) Speak(pcm []byte) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(pcm) == 0 && s.played == nil {
+		played := make(chan struct{})
+		close(played)
+		return played
+	}
+	s.pcm = append(s.pcm, pcm...)
+	if s.played == nil {
+		s.played = make(chan struct{})
+	}
+	return s.played
+}
+
+func (s *scriptSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	chunk := audioSettings.InputSampleRate * audioSettings.InputChannels * 2 * audioSettings.InputBufferMs / 1000
+	silence := make([]byte, chunk)
+	ticker := time.NewTicker(time.Duration(audioSettings.InputBufferMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		data := silence
+		if len(s.pcm) > 0 {
+			data = s.pcm[:min(chunk, len(s.pcm))]
+			s.pcm = s.pcm[len(data):]
+			if len(s.pcm) == 0 {
+				close(s.played)
+				s.played = nil
+			}
+		}
+		s.mu.Unlock()
+		send(data)
+	}
+}
+
+func writeScriptResults(w io.Writer, results []ScriptResult) {
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s line %d: %s\n", status, r.Line, r.Action)
+		if r.Detail != "" && (!r.Passed || strings.HasPrefix(r.Action, "expect")) {
+			fmt.Fprintf(w, "  %s\n", r.Detail)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// serve 模式面向 Docker/Kubernetes 部署：全部配置来自环境变量，日志以 JSON
+// 写入标准输出，收到 SIGTERM 后先摘除就绪状态，等待已有连接结束再退出。
+
+func init() {
+	commands["serve"] = runServe
+}
+
+// getenv returns the value of the environment variable key, or def if it is
+// empty.
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// runServe implements the `serve` subcommand: the gateway, configured by the
+// environment, with health and metrics endpoints on the same address.
+//
+//	VOLC_APP_ID, VOLC_ACCESS_KEY, VOLC_APP_KEY  upstream credentials
+//	PORT or SERVE_ADDR                          listen address (default :8080)
+//	TENANTS_JSON or TENANTS_FILE                tenants of the gateway
+//	LOG_LEVEL                                   quiet, info, verbose or trace
+//	DRAIN_TIMEOUT                               how long to drain on SIGTERM (default 30s)
+//	ALLOWED_ORIGINS                             cross-origin browser pages allowed, like -gateway-origins
+func runServe(ctx context.Context, cfg *Config) error {
+	stopLog, err := logToJSON()
+	if err != nil {
+		return err
+	}
+	defer stopLog()
+	if err := setLogLevel(getenv("LOG_LEVEL", "info")); err != nil {
+		return err
+	}
+	addr := getenv("SERVE_ADDR", ":8080")
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	drain, err := time.ParseDuration(getenv("DRAIN_TIMEOUT", "30s"))
+	if err != nil {
+		return fmt.Errorf("DRAIN_TIMEOUT: %w", err)
+	}
+	var tenants []*Tenant
+	switch {
+	case os.Getenv("TENANTS_JSON") != "":
+		tenants, err = parseTenants([]byte(os.Getenv("TENANTS_JSON")))
+	case os.Getenv("TENANTS_FILE") != "":
+		tenants, err = loadTenants(os.Getenv("TENANTS_FILE"))
+	default:
+		err = errors.New("TENANTS_JSON or TENANTS_FILE is required")
+	}
+	if err != nil {
+		return err
+	}
+	origins, err := parseOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	if err != nil {
+		return fmt.Errorf("ALLOWED_ORIGINS: %w", err)
+	}
+
+	connCtx, closeConns := context.WithCancel(context.Background())
+	defer closeConns()
+	gw := newGateway(connCtx, cfg, tenants, origins)
+	var draining atomic.Bool
+	mux := http.NewServeMux()
+	mux.Handle("/", gw)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	glog.V(vEvent).Infof("Serving on %s for %d tenants", addr, len(tenants))
+	select {
+	case err := <-errc:
+		return fmt.Errorf("serve: %w", err)
+	case <-ctx.Done():
+	}
+
+	draining.Store(true)
+	glog.V(vEvent).Infof("Draining connections for up to %v...", drain)
+	drainCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		glog.Warningf("Shutdown server: %v", err)
+	}
+	drained := make(chan struct{})
+	go func() {
+		gw.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-drainCtx.Done():
+		glog.Warning("Drain timeout, closing the remaining connections")
+		closeConns()
+		<-drained
+	}
+	glog.V(vEvent).Info("Drained, exiting.")
+	return nil
+}
+
+// logToJSON makes glog log to stdout as one JSON object per line, through
+// the logRewriter installed at startup. The returned function restores the
+// text logs.
+func logToJSON() (func(), error) {
+	if logs == nil {
+		return nil, errors.New("logs are not redirected")
+	}
+	logs.json.Store(true)
+	return func() { logs.json.Store(false) }, nil
+}
@@ -2,63 +2,178 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"math"
-	"os"
-	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
+	"RealtimeDialog/dialog"
+	"RealtimeDialog/pcm"
 	"github.com/golang/glog"
-	"github.com/gordonklaus/portaudio"
-	"github.com/gorilla/websocket"
 )
 
 const (
-	sampleRate      = 24000
-	channels        = 1
-	framesPerBuffer = 512
-	bufferSeconds   = 100 // 最多缓冲100秒数据
+	bufferSeconds = 100 // 最多缓冲100秒数据
 )
 
 var (
-	audio      []byte
 	bufferLock sync.Mutex
-	buffer     = make([]float32, 0, sampleRate*bufferSeconds)
+	buffer     []float32
+	// jitter decides when buffer is played, stretch changes the speed of
+	// the audio buffered, fader smooths the flushes, and postprocess is
+	// -playback-chain; set by startPlayer.
+	jitter      *jitterBuffer
+	stretch     *timeStretcher
+	fader       *flushFader
+	postprocess processorChain
+
+	// savedAudio receives the bot audio played by startPlayer, nil without
+	// -save-audio. It has a lock of its own, apart from bufferLock, as
+	// switching files blocks on the file system; its sinks log the errors
+	// of their writes.
+	savedAudioMu sync.Mutex
+	savedAudio   AudioSink
 )
 
-func realtimeAPIOutputAudio(ctx context.Context, conn *websocket.Conn) {
-	go startPlayer(ctx)
+// ASRResponsePayload is the payload of the ASRResponse event.
+type ASRResponsePayload struct {
+	Results []ASRResult `json:"results"`
+}
+
+// ASRResult is a single recognition hypothesis of an ASRResponse event.
+// StartTime and EndTime locate the utterance in the uploaded audio when the
+// server reports them, in seconds from the start of the audio of the
+// session; Words times the words of Text likewise when it reports word
+// timing. Confidence, from 0 to 1, is 0 when the server does not report it.
+// Alternatives are the other hypotheses of the utterance, best first, when
+// requested with -asr-alternatives.
+type ASRResult struct {
+	Text         string           `json:"text"`
+	IsInterim    bool             `json:"is_interim"`
+	StartTime    float64          `json:"start_time,omitempty"`
+	EndTime      float64          `json:"end_time,omitempty"`
+	Words        []ASRWord        `json:"words,omitempty"`
+	Confidence   float64          `json:"confidence,omitempty"`
+	Alternatives []ASRAlternative `json:"alternatives,omitempty"`
+}
+
+// ASRAlternative is an alternative hypothesis of an ASRResult.
+type ASRAlternative struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// ASRWord is a word of an ASRResult with its timing.
+type ASRWord struct {
+	Text      string  `json:"text"`
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+}
+
+// Definite reports whether the result is final and will not be revised.
+func (r ASRResult) Definite() bool {
+	return !r.IsInterim
+}
+
+// Hypotheses returns the distinct texts of the result, Text first, then the
+// alternatives.
+func (r ASRResult) Hypotheses() []string {
+	texts := []string{r.Text}
+	for _, alt := range r.Alternatives {
+		if alt.Text != "" && !slices.Contains(texts, alt.Text) {
+			texts = append(texts, alt.Text)
+		}
+	}
+	return texts
+}
+
+// ASRInfoPayload is the payload of the ASRInfo event, sent when the server
+// detects the user starts speaking.
+type ASRInfoPayload struct {
+	QuestionID string `json:"question_id"`
+}
+
+// TTSSentencePayload is the payload of the TTSSentenceStart and TTSSentenceEnd
+// events, describing the sentence of the reply being spoken.
+type TTSSentencePayload struct {
+	TTSType string `json:"tts_type"`
+	Text    string `json:"text"`
+}
+
+// ChatResponsePayload is the payload of the ChatResponse event, carrying a
+// chunk of the bot reply text.
+type ChatResponsePayload struct {
+	Content string `json:"content"`
+}
+
+// errUnexpectedMessageType is returned when the server sends a message of a
+// type the client does not handle.
+var errUnexpectedMessageType = errors.New("unexpected message type")
+
+// ServerError is returned when the server sends an Error message.
+type ServerError struct {
+	Code    uint32
+	Payload []byte
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error (code=%d): %s", e.Code, e.Payload)
+}
+
+// SessionFailedError is returned when the server fails the session with a
+// SessionFailed event.
+type SessionFailedError struct {
+	Payload []byte
+}
+
+func (e *SessionFailedError) Error() string {
+	return fmt.Sprintf("session failed: %s", e.Payload)
+}
+
+func (e *SessionFailedError) Unwrap() error {
+	return dialog.ErrSessionFailed
+}
+
+// realtimeAPIOutputAudio handles the server messages of a session until the
+// session is finished or failed. A failed session, Error messages and
+// messages of unexpected types are returned as errors, leaving it to the
+// caller to retry or give up; the last two are also delivered to the handler.
+// It returns the context error once ctx is done.
+func realtimeAPIOutputAudio(ctx context.Context, conn Transport, handler Handler) error {
 	for {
-		glog.Infof("Waiting for message...")
-		msg, err := receiveMessage(conn)
+		glog.V(vFrame).Info("Waiting for message...")
+		msg, err := receiveMessage(ctx, conn)
 		if err != nil {
-			glog.Errorf("Receive message error: %v", err)
-			return
+			return fmt.Errorf("receive message: %w", err)
 		}
 		switch msg.Type {
-		case MsgTypeFullServer:
-			glog.Infof("Receive text message (event=%d, session_id=%s): %s", msg.Event, msg.SessionID, msg.Payload)
-			// session finished event
-			if msg.Event == 152 || msg.Event == 153 {
-				return
+		case dialog.MsgTypeFullServer:
+			glog.V(vEvent).Infof("Receive text message (event=%d, session_id=%s): %s", msg.Event, msg.SessionID, redactText(string(msg.Payload)))
+			if err := dispatchServerEvent(handler, msg); err != nil {
+				glog.Errorf("Dispatch server event error: %v", err)
 			}
-			// asr info event, clear audio buffer
-			if msg.Event == 450 {
-				audio = audio[:0]
-				buffer = buffer[:0]
+			switch msg.Event {
+			case dialog.EventSessionFinished:
+				return nil
+			case dialog.EventSessionFailed:
+				return &SessionFailedError{Payload: msg.Payload}
 			}
-		case MsgTypeAudioOnlyServer:
-			glog.Infof("Receive audio message (event=%d): session_id=%s", msg.Event, msg.SessionID)
-			handleIncomingAudio(msg.Payload)
-			audio = append(audio, msg.Payload...)
-		case MsgTypeError:
-			glog.Exitf("Receive Error message (code=%d): %s", msg.ErrorCode, msg.Payload)
-			return
+		case dialog.MsgTypeAudioOnlyServer:
+			glog.V(vFrame).Infof("Receive audio message (event=%d): session_id=%s", msg.Event, msg.SessionID)
+			if playbackGate != nil && !playbackGate() {
+				glog.V(vFrame).Info("Drop audio muted by the playback gate")
+				continue
+			}
+			handler.OnAudioChunk(msg.Payload)
+		case dialog.MsgTypeError:
+			err := &ServerError{Code: msg.ErrorCode, Payload: msg.Payload}
+			handler.OnError(err)
+			return err
 		default:
-			glog.Exitf("Received unexpected message type: %s", msg.Type)
-			return
+			err := fmt.Errorf("%w: %s", errUnexpectedMessageType, msg.Type)
+			handler.OnError(err)
+			return err
 		}
 	}
 }
@@ -82,100 +197,211 @@ func realtimeAPIOutputAudio(ctx context.Context, conn *websocket.Conn) {
  *     - (4 bytes)data len
  *     - data
  */
-func receiveMessage(conn *websocket.Conn) (*Message, error) {
-	mt, frame, err := conn.ReadMessage()
-	if err != nil {
-		return nil, err
+func receiveMessage(ctx context.Context, conn Transport) (*dialog.Message, error) {
+	return dialogClient(conn).Read(ctx)
+}
+
+// startPlayer plays the buffered bot audio until ctx is done, and saves the
+// received audio to -save-audio as it arrives.
+func startPlayer(ctx context.Context) error {
+	if *playbackSpeed < 0.5 || *playbackSpeed > 2 {
+		return fmt.Errorf("playback speed %v out of range [0.5, 2]", *playbackSpeed)
 	}
-	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
-		return nil, fmt.Errorf("unexpected Websocket message type: %d", mt)
+	if err := openSavedAudio(*saveAudio); err != nil {
+		return fmt.Errorf("save audio: %w", err)
 	}
+	defer closeSavedAudio()
 
-	framePrefix := frame
-	if len(frame) > 100 {
-		framePrefix = frame[:100]
-	}
-	glog.Infof("Receive frame prefix: %v", framePrefix)
-	msg, _, err := Unmarshal(frame, ContainsSequence)
+	outputDevice, err := outputDevice()
 	if err != nil {
-		if len(frame) > 500 {
-			frame = frame[:500]
+		return fmt.Errorf("get output device: %w", err)
+	}
+	glog.V(vEvent).Infof("Using output device: %s", outputDevice.Name)
+	channels := audioSettings.OutputChannels
+	var router *outputRouter
+	if *outputRoute != "" {
+		route, err := parseOutputRoute(*outputRoute)
+		if err != nil {
+			return err
+		}
+		router = newOutputRouter(channels, route)
+		if router.devChannels > outputDevice.MaxOutputChannels && outputDevice.MaxOutputChannels > 0 {
+			return fmt.Errorf("output device %s has %d channels, fewer than routed to", outputDevice.Name, outputDevice.MaxOutputChannels)
 		}
-		glog.Infof("Data response: %s", frame)
-		return nil, fmt.Errorf("unmarshal response message: %w", err)
 	}
-	return msg, nil
-}
-
-func startPlayer(ctx context.Context) {
-	outputDevice, err := portaudio.DefaultOutputDevice()
+	chain, err := newProcessorChain(*playbackChain, AudioFormat{audioSettings.OutputSampleRate, channels})
 	if err != nil {
-		glog.Errorf("Failed to get default output device: %v", err)
-		return
+		return fmt.Errorf("playback chain: %w", err)
 	}
-	outputParameters := portaudio.StreamParameters{
-		Output: portaudio.StreamDeviceParameters{
-			Device:   outputDevice,
-			Channels: channels,
-			Latency:  10 * time.Millisecond,
-		},
-		SampleRate:      float64(sampleRate),
-		FramesPerBuffer: framesPerBuffer,
+	deviceChannels := channels
+	if router != nil {
+		deviceChannels = router.devChannels
 	}
-	outputStream, err := portaudio.OpenStream(outputParameters, func(out []float32) {
+	drift := newDriftCompensator(audioSettings.OutputSampleRate)
+	plc := newConcealer(audioSettings.OutputSampleRate, channels)
+	duck := newDucker(audioSettings.OutputSampleRate, deviceChannels)
+	bufferLock.Lock()
+	jitter = newJitterBuffer(audioSettings.OutputSampleRate, *jitterMin, *jitterMax)
+	stretch = newTimeStretcher(*playbackSpeed, audioSettings.OutputSampleRate, channels)
+	fader = newFlushFader(audioSettings.OutputSampleRate, channels)
+	postprocess = chain
+	bufferLock.Unlock()
+	play := func(out []float32) {
 		bufferLock.Lock()
 		defer bufferLock.Unlock()
-		if len(buffer) < len(out) {
-			copy(out, buffer)
-			for i := len(buffer); i < len(out); i++ {
-				out[i] = 0
+		if n := fader.Drain(out); n > 0 {
+			// 打断后先播完淡出的音频
+			drift.Frames(len(out)/channels, 0)
+			clear(out[n:])
+			return
+		}
+		if !jitter.Ready(len(buffer)/channels, len(out)/channels) {
+			// 缓冲中：输出静音（欠载时隐藏丢包），设备时钟照常计入漂移估计
+			drift.Frames(len(out)/channels, 0)
+			if jitter.Starved() {
+				plc.Conceal(out)
+			} else {
+				plc.Reset()
+				clear(out)
 			}
-			buffer = buffer[:0]
+			return
+		}
+		take := drift.Frames(len(out)/channels, len(buffer)/channels) * channels
+		src := buffer[:min(len(buffer), take)]
+		buffer = buffer[len(src):]
+		copied := copy(out, src)
+		if take < len(out) && len(src) == take && copied >= channels {
+			// 插入一帧：重复最后一帧
+			copy(out[copied:], out[copied-channels:copied])
+			copied = len(out)
+		}
+		fader.FadeIn(out[:copied])
+		plc.Played(out[:copied])
+		if jitter.Starved() {
+			plc.Conceal(out[copied:])
+		} else {
+			clear(out[copied:])
+		}
+	}
+	rate := audioSettings.OutputSampleRate
+	return audioBackend.Play(ctx, outputDevice, rate, deviceChannels, rate*audioSettings.OutputBufferMs/1000, func(out []float32) {
+		if router != nil {
+			router.Play(out, play)
 		} else {
-			copy(out, buffer)
-			buffer = buffer[len(out):]
+			play(out)
 		}
+		duck.Apply(out)
+		botMeter.ProcessFloat(out)
 	})
-	if err != nil {
-		glog.Errorf("Failed to open PortAudio output stream: %v", err)
-		return
+}
+
+// waitPlayback waits until startPlayer has played the buffered audio.
+func waitPlayback(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		bufferLock.Lock()
+		empty := len(buffer) == 0
+		bufferLock.Unlock()
+		if empty {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
-	defer outputStream.Close()
+	// 设备缓冲中的音频
+	sleepCtx(ctx, 2*time.Duration(audioSettings.OutputBufferMs)*time.Millisecond)
+}
 
-	if err := outputStream.Start(); err != nil {
-		glog.Errorf("Failed to start PortAudio output stream: %v", err)
-		return
+// localPlayback plays the bot audio on the default output device, through
+// the buffer drained by startPlayer, and saves it to output.wav.
+type localPlayback struct {
+	NopHandler
+}
+
+// OnASRStart clears the audio buffer: the user interrupted the bot.
+func (localPlayback) OnASRStart(ASRInfoPayload) {
+	bufferLock.Lock()
+	defer bufferLock.Unlock()
+	fader.Flush(buffer, jitter.Playing())
+	buffer = buffer[:0]
+	jitter.Reset()
+	stretch.Reset()
+}
+
+func (localPlayback) OnAudioChunk(data []byte) {
+	handleIncomingAudio(data)
+}
+
+// OnBotSpeechEnd lets the rest of the reply play without waiting for the
+// jitter buffer to fill.
+func (localPlayback) OnBotSpeechEnd() {
+	bufferLock.Lock()
+	defer bufferLock.Unlock()
+	buffer = append(buffer, stretch.Flush()...)
+	jitter.EndReply()
+}
+
+// decodeOutputAudio decodes downlink audio in the configured output format.
+func decodeOutputAudio(data []byte) []float32 {
+	if audioSettings.outputBytesPerSample() == 2 {
+		return pcm.BytesInt16ToFloat32(data)
 	}
-	glog.Info("PortAudio output stream started for playback.")
-	<-ctx.Done()
-	saveAudioToPCMFile("output.pcm")
-	glog.Info("PortAudio output stream stopped.")
+	return pcm.BytesToFloat32(data)
 }
 
 func handleIncomingAudio(data []byte) {
-	glog.Infof("Received audio byte len: %d, float32 len: %d", len(data), len(data)/4)
-	sampleCount := len(data) / 4
-	samples := make([]float32, sampleCount)
-	for i := 0; i < sampleCount; i++ {
-		bits := binary.LittleEndian.Uint32(data[i*4 : (i+1)*4])
-		samples[i] = math.Float32frombits(bits)
-	}
+	samples := decodeOutputAudio(data)
+	glog.V(vFrame).Infof("Received audio byte len: %d, sample len: %d", len(data), len(samples))
 	// 将音频加载到缓冲区
+	maxSamples := audioSettings.OutputSampleRate * audioSettings.OutputChannels * bufferSeconds
 	bufferLock.Lock()
-	defer bufferLock.Unlock()
-	buffer = append(buffer, samples...)
-	if len(buffer) > sampleRate*bufferSeconds {
-		buffer = buffer[len(buffer)-(sampleRate*bufferSeconds):]
+	buffer = append(buffer, stretch.Process(postprocess.Process(samples))...)
+	jitter.Receive()
+	if len(buffer) > maxSamples {
+		buffer = buffer[len(buffer)-maxSamples:]
+	}
+	bufferLock.Unlock()
+
+	savedAudioMu.Lock()
+	defer savedAudioMu.Unlock()
+	if savedAudio != nil {
+		savedAudio.Write(data)
+	}
+}
+
+// openSavedAudio saves the bot audio, interrupted audio included, in the
+// output format to the WAV files named by template. The files are created
+// with the first audio, so no empty file is left.
+func openSavedAudio(template string) error {
+	if template == "" {
+		return nil
+	}
+	sink, err := newTemplatedSink(template, func(path string) (AudioSink, error) {
+		return newWAVSink(path, "")
+	})
+	if err != nil {
+		return err
 	}
+	savedAudioMu.Lock()
+	defer savedAudioMu.Unlock()
+	savedAudio = sink
+	return nil
 }
 
-func saveAudioToPCMFile(s string) {
-	if len(audio) == 0 {
-		glog.Info("No audio data to save.")
+// closeSavedAudio completes the saved audio file.
+func closeSavedAudio() {
+	savedAudioMu.Lock()
+	w := savedAudio
+	savedAudio = nil
+	savedAudioMu.Unlock()
+	if w == nil {
 		return
 	}
-	pcmPath := filepath.Join("./", s)
-	if err := os.WriteFile(pcmPath, audio, 0644); err != nil {
-		glog.Exitf("Save pcm file: %v", err)
+	if err := w.Close(); err != nil {
+		glog.Errorf("Save audio: %v", err)
 	}
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const maxSessionIDLen = 128
+
+var sessionIDFlag = flag.String("session-id", "", "session ID to use instead of a random one, so external systems can join logs on it; in -loop mode later sessions get a -<n> suffix")
+
+var errInvalidSessionID = errors.New("invalid session ID")
+
+// NewSessionID returns a new random session ID.
+func NewSessionID() string {
+	return uuid.New().String()
+}
+
+// ValidateSessionID checks that id is usable as a session ID: non-empty, at
+// most 128 bytes, and made of ASCII letters, digits and the characters
+// "-_.:".
+func ValidateSessionID(id string) error {
+	if id == "" || len(id) > maxSessionIDLen {
+		return fmt.Errorf("%w: length must be between 1 and %d: %q", errInvalidSessionID, maxSessionIDLen, id)
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return fmt.Errorf("%w: unexpected character %q in %q", errInvalidSessionID, r, id)
+		}
+	}
+	return nil
+}
+
+// SessionInfo identifies a session of the dialog.
+type SessionInfo struct {
+	// ID is the session ID sent to the server.
+	ID string
+	// Seq is the 1-based sequence number of the session on its connection.
+	Seq int
+	// Settings, if not nil, replace the current session settings, e.g. to
+	// run sessions with different settings side by side.
+	Settings *SessionSettings
+}
+
+// sessionIDs hands out the IDs of consecutive sessions. Without a base ID
+// every session gets a random ID; with one, the first session uses it as is
+// and later sessions append their sequence number, keeping them correlated.
+type sessionIDs struct {
+	mu   sync.Mutex
+	base string
+	seq  int
+}
+
+func newSessionIDs(base string) (*sessionIDs, error) {
+	if base != "" {
+		if err := ValidateSessionID(base); err != nil {
+			return nil, err
+		}
+	}
+	return &sessionIDs{base: base}, nil
+}
+
+// Next returns the info of the next session.
+func (s *sessionIDs) Next() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	switch {
+	case s.base == "":
+		return SessionInfo{ID: NewSessionID(), Seq: s.seq}
+	case s.seq == 1:
+		return SessionInfo{ID: s.base, Seq: s.seq}
+	default:
+		return SessionInfo{ID: fmt.Sprintf("%s-%d", s.base, s.seq), Seq: s.seq}
+	}
+}
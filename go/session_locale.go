@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// 语言与地区：-asr-language 与 -tts-language 指定识别与合成的语言，放在
+// StartSession 的 asr.extra 与 tts.extra 中。配置文件的 session.locales 可以定义
+// 多套语言设置（识别、合成语言以及音色与开场白），由 -locale 选择；多语言自助终端
+// 可以用 -locale-file 指定一个文件，界面把语言名称写入其中，-loop 模式下每个会话
+// 开始时重新读取，从下一个会话起切换语言。
+
+var (
+	asrLanguage = flag.String("asr-language", "", "language recognized by the ASR, e.g. zh-CN or en-US; empty for the service default")
+	ttsLanguage = flag.String("tts-language", "", "language and locale of the TTS, e.g. zh-CN or en-US; empty for the service default")
+	localeName  = flag.String("locale", "", "`name` of the session.locales entry of the config file to use")
+	localeFile  = flag.String("locale-file", "", "`file` holding the name of the session.locales entry to use, read at every session start so that the language can be switched between sessions in -loop mode")
+)
+
+// LocaleSettings are the settings of a language, overriding the session
+// settings when not empty.
+type LocaleSettings struct {
+	ASRLanguage string `json:"asr_language,omitempty"`
+	TTSLanguage string `json:"tts_language,omitempty"`
+	Speaker     string `json:"speaker,omitempty"`
+	// VoiceCloneID, like Speaker, replaces the voice of the session.
+	VoiceCloneID string `json:"voice_clone_id,omitempty"`
+	Greeting     string `json:"greeting,omitempty"`
+}
+
+// withLocale returns s with the settings of the named locale applied.
+func (s SessionSettings) withLocale(name string) (SessionSettings, error) {
+	if name == "" {
+		return s, nil
+	}
+	l, ok := s.Locales[name]
+	if !ok {
+		return s, fmt.Errorf("unknown locale %q", name)
+	}
+	if l.Speaker != "" || l.VoiceCloneID != "" {
+		s.Speaker, s.VoiceCloneID = l.Speaker, l.VoiceCloneID
+	}
+	for _, field := range []struct {
+		dst   *string
+		value string
+	}{
+		{&s.ASRLanguage, l.ASRLanguage},
+		{&s.TTSLanguage, l.TTSLanguage},
+		{&s.Greeting, l.Greeting},
+	} {
+		if field.value != "" {
+			*field.dst = field.value
+		}
+	}
+	s.Locale = name
+	return s, nil
+}
+
+// validateLocales checks the locale of s and the greeting templates of all
+// the locales.
+func validateLocales(s SessionSettings) error {
+	if _, err := s.withLocale(s.Locale); err != nil {
+		return err
+	}
+	for name := range s.Locales {
+		l, _ := s.withLocale(name)
+		if _, err := renderPersona(l); err != nil {
+			return fmt.Errorf("locale %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// localizeSession returns the settings of a new session: settings, or the
+// current session settings if nil, with the locale named by -locale-file, or
+// else by the settings, applied.
+func localizeSession(settings *SessionSettings) *SessionSettings {
+	if settings == nil {
+		settings = sessionSettings.Load()
+	}
+	if settings == nil {
+		return nil
+	}
+	name := settings.Locale
+	if *localeFile != "" {
+		data, err := os.ReadFile(*localeFile)
+		if err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Read the locale file: %v", err)
+		} else if s := strings.TrimSpace(string(data)); s != "" {
+			name = s
+		}
+	}
+	localized, err := settings.withLocale(name)
+	if err != nil {
+		glog.Errorf("Keep the locale %q: %v", settings.Locale, err)
+		return settings
+	}
+	if name != "" {
+		glog.V(vEvent).Infof("Session locale: %s", name)
+	}
+	return &localized
+}
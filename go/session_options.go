@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// defaultVoiceCloneCluster is the cluster of the cloned voices.
+const defaultVoiceCloneCluster = "volcano_icl"
+
+// maxASRAlternatives bounds -asr-alternatives.
+const maxASRAlternatives = 10
+
+var (
+	botName         = flag.String("bot-name", "豆包", "name of the bot persona")
+	systemRole      = flag.String("system-role", "", "background and personality of the bot persona")
+	speakingStyle   = flag.String("speaking-style", "", "speaking style of the bot persona")
+	speaker         = flag.String("speaker", "", "TTS voice of the bot, e.g. zh_female_vv_jupiter_bigtts; empty for the service default")
+	voiceCloneID    = flag.String("voice-clone-id", "", "`ID` of a cloned voice (ICL), e.g. S_xxxxxx, used instead of -speaker")
+	speechRate      = flag.Int("speech-rate", 0, "TTS speech rate, from -50 (slower) to 100 (faster)")
+	loudnessRate    = flag.Int("loudness-rate", 0, "TTS loudness, from -50 (quieter) to 100 (louder)")
+	strictAudit     = flag.Bool("strict-audit", false, "enable strict content audit of the dialog")
+	auditResponse   = flag.String("audit-response", "", "reply spoken by the bot when the audit blocks a request")
+	greeting        = flag.String("greeting", "", "text the bot greets the user with at the start of every session (SayHello)")
+	asrAlternatives = flag.Int("asr-alternatives", 0, "request this many alternative hypotheses of every ASR result (nbest in the ASR extra of StartSession), passed on in ASRResult.Alternatives (0 disables)")
+	dialogExtraSet  = make(dialogExtraFlag)
+
+	// sessionSettings holds the effective session settings, resolved from the
+	// flags and the config file. It is replaced when the config is reloaded
+	// and read at every session start.
+	sessionSettings atomic.Pointer[SessionSettings]
+)
+
+// SessionSettings are the voice, prosody, persona and audit settings sent at
+// the start of every session. The persona and the greeting are templates
+// rendered with Vars, see renderPersona.
+type SessionSettings struct {
+	BotName       string `json:"bot_name,omitempty"`
+	SystemRole    string `json:"system_role,omitempty"`
+	SpeakingStyle string `json:"speaking_style,omitempty"`
+	Speaker       string `json:"speaker,omitempty"`
+	// VoiceCloneID is the ID of a voice cloned from uploaded reference audio,
+	// used instead of Speaker, and VoiceCloneCluster the cluster serving it,
+	// defaultVoiceCloneCluster if empty.
+	VoiceCloneID      string            `json:"voice_clone_id,omitempty"`
+	VoiceCloneCluster string            `json:"voice_clone_cluster,omitempty"`
+	SpeechRate        int               `json:"speech_rate,omitempty"`
+	LoudnessRate      int               `json:"loudness_rate,omitempty"`
+	StrictAudit       *bool             `json:"strict_audit,omitempty"`
+	AuditResponse     string            `json:"audit_response,omitempty"`
+	Greeting          string            `json:"greeting,omitempty"`
+	Disclaimer        string            `json:"disclaimer,omitempty"`
+	Vars              map[string]string `json:"vars,omitempty"`
+	ASRLanguage       string            `json:"asr_language,omitempty"`
+	TTSLanguage       string            `json:"tts_language,omitempty"`
+	Locale            string            `json:"locale,omitempty"`
+	// ASRAlternatives is the number of alternative hypotheses requested for
+	// every ASR result.
+	ASRAlternatives int `json:"asr_alternatives,omitempty"`
+	// Locales are the named language settings, see withLocale.
+	Locales map[string]LocaleSettings `json:"locales,omitempty"`
+}
+
+// resolveSessionSettings merges the session settings of the config file with
+// the flags, with the same precedence as resolveAudioSettings.
+func resolveSessionSettings(file SessionSettings) (SessionSettings, error) {
+	s := file
+	pickString := func(dst *string, name string, value string) {
+		if flagIsSet(name) || *dst == "" {
+			*dst = value
+		}
+	}
+	pickInt := func(dst *int, name string, value int) {
+		if flagIsSet(name) {
+			*dst = value
+		}
+	}
+	pickString(&s.BotName, "bot-name", *botName)
+	pickString(&s.SystemRole, "system-role", *systemRole)
+	pickString(&s.SpeakingStyle, "speaking-style", *speakingStyle)
+	pickString(&s.Speaker, "speaker", *speaker)
+	pickString(&s.VoiceCloneID, "voice-clone-id", *voiceCloneID)
+	pickInt(&s.SpeechRate, "speech-rate", *speechRate)
+	pickInt(&s.LoudnessRate, "loudness-rate", *loudnessRate)
+	pickInt(&s.ASRAlternatives, "asr-alternatives", *asrAlternatives)
+	pickString(&s.AuditResponse, "audit-response", *auditResponse)
+	pickString(&s.Greeting, "greeting", *greeting)
+	pickString(&s.Disclaimer, "disclaimer", *disclaimer)
+	s.Vars = resolveTemplateVars(file.Vars)
+	pickString(&s.ASRLanguage, "asr-language", *asrLanguage)
+	pickString(&s.TTSLanguage, "tts-language", *ttsLanguage)
+	pickString(&s.Locale, "locale", *localeName)
+	if flagIsSet("strict-audit") || s.StrictAudit == nil {
+		s.StrictAudit = strictAudit
+	}
+
+	if s.SpeechRate < -50 || s.SpeechRate > 100 {
+		return s, fmt.Errorf("speech rate %d out of range [-50, 100]", s.SpeechRate)
+	}
+	if s.LoudnessRate < -50 || s.LoudnessRate > 100 {
+		return s, fmt.Errorf("loudness rate %d out of range [-50, 100]", s.LoudnessRate)
+	}
+	if s.ASRAlternatives < 0 || s.ASRAlternatives > maxASRAlternatives {
+		return s, fmt.Errorf("ASR alternatives %d out of range [0, %d]", s.ASRAlternatives, maxASRAlternatives)
+	}
+	if _, err := renderPersona(s); err != nil {
+		return s, err
+	}
+	if err := validateLocales(s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func init() {
+	flag.Var(dialogExtraSet, "dialog-extra", "set `key=value` in the dialog extra of StartSession (repeatable); the value is parsed as JSON when possible")
+	flag.Var(dialogExtraJSONFlag{dialogExtraSet}, "dialog-extra-json", "merge a JSON `object` into the dialog extra of StartSession")
+}
+
+// dialogExtraFlag collects dialog extra options given on the command line.
+type dialogExtraFlag map[string]interface{}
+
+func (f dialogExtraFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (f dialogExtraFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expect key=value, got %q", s)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		v = value
+	}
+	f[key] = v
+	return nil
+}
+
+// dialogExtraJSONFlag merges a JSON object into a dialogExtraFlag.
+type dialogExtraJSONFlag struct {
+	extra dialogExtraFlag
+}
+
+func (f dialogExtraJSONFlag) String() string { return "" }
+
+func (f dialogExtraJSONFlag) Set(s string) error {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &obj); err != nil {
+		return fmt.Errorf("parse dialog extra JSON: %w", err)
+	}
+	for k, v := range obj {
+		f.extra[k] = v
+	}
+	return nil
+}
+
+// newStartSessionPayload builds the StartSession payload from the
+// command-line options and settings, or the current session settings if nil.
+func newStartSessionPayload(settings *SessionSettings) *StartSessionPayload {
+	if settings == nil {
+		settings = sessionSettings.Load()
+	}
+	if settings == nil {
+		settings = &SessionSettings{BotName: *botName, StrictAudit: strictAudit}
+	}
+	if rendered, err := renderPersona(*settings); err != nil {
+		glog.Errorf("Render the persona: %v", err)
+	} else {
+		settings = &rendered
+	}
+	extra := map[string]interface{}{
+		"strict_audit": settings.StrictAudit != nil && *settings.StrictAudit,
+	}
+	if settings.AuditResponse != "" {
+		extra["audit_response"] = settings.AuditResponse
+	}
+	for k, v := range dialogExtraSet {
+		extra[k] = v
+	}
+	payload := &StartSessionPayload{
+		TTS: TTSPayload{
+			Speaker: settings.Speaker,
+			AudioConfig: AudioConfig{
+				Channel:      audioSettings.OutputChannels,
+				Format:       audioSettings.OutputFormat,
+				SampleRate:   audioSettings.OutputSampleRate,
+				SpeechRate:   settings.SpeechRate,
+				LoudnessRate: settings.LoudnessRate,
+			},
+		},
+		ASR: ASRPayload{
+			AudioInfo: &AudioConfig{
+				Channel:    audioSettings.InputChannels,
+				Format:     audioSettings.InputFormat,
+				SampleRate: audioSettings.InputSampleRate,
+			},
+		},
+		Dialog: DialogPayload{
+			BotName:       settings.BotName,
+			SystemRole:    settings.SystemRole,
+			SpeakingStyle: settings.SpeakingStyle,
+			Extra:         extra,
+		},
+	}
+	if settings.VoiceCloneID != "" {
+		payload.TTS.Speaker = settings.VoiceCloneID
+		payload.TTS.Cluster = settings.VoiceCloneCluster
+		if payload.TTS.Cluster == "" {
+			payload.TTS.Cluster = defaultVoiceCloneCluster
+		}
+	}
+	if settings.ASRLanguage != "" {
+		payload.ASR.Extra = map[string]interface{}{"language": settings.ASRLanguage}
+	}
+	if settings.ASRAlternatives > 0 {
+		if payload.ASR.Extra == nil {
+			payload.ASR.Extra = map[string]interface{}{}
+		}
+		payload.ASR.Extra["nbest"] = settings.ASRAlternatives + 1
+	}
+	if settings.TTSLanguage != "" {
+		payload.TTS.Extra = map[string]interface{}{"language": settings.TTSLanguage}
+	}
+	if history != nil {
+		payload.Dialog.DialogID, payload.Dialog.DialogContext = history.Context(*historyTurns)
+	}
+	return payload
+}
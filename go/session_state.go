@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Phases of a session, see sessionState.
+const (
+	sessionActive    int32 = iota // audio is being streamed
+	sessionFinishing              // the client sent FinishSession
+	sessionEnded                  // the server finished or failed the session
+)
+
+// sessionState is the state machine of a session shared by the capture and
+// receive goroutines. A session starts active and either the client finishes
+// it (active -> finishing -> ended) or the server ends it on its own
+// (active -> ended), in which case no FinishSession must be sent and the
+// capture must stop immediately.
+type sessionState struct {
+	phase   atomic.Int32
+	ended   chan struct{}
+	endOnce sync.Once
+}
+
+func newSessionState() *sessionState {
+	return &sessionState{ended: make(chan struct{})}
+}
+
+// Active reports whether audio may still be sent for the session.
+func (s *sessionState) Active() bool {
+	return s.phase.Load() == sessionActive
+}
+
+// BeginFinish moves an active session to finishing. It reports false if the
+// session is no longer active, in which case FinishSession must not be sent.
+func (s *sessionState) BeginFinish() bool {
+	return s.phase.CompareAndSwap(sessionActive, sessionFinishing)
+}
+
+// End marks the session as ended by the server.
+func (s *sessionState) End() {
+	s.phase.Store(sessionEnded)
+	s.endOnce.Do(func() { close(s.ended) })
+}
+
+// Ended returns a channel that is closed once the session has ended.
+func (s *sessionState) Ended() <-chan struct{} {
+	return s.ended
+}
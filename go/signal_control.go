@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"os/signal"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// 信号控制：无需控制端口即可操作后台运行的进程。SIGUSR1 切换麦克风静音，静音时
+// 照常向服务端发送等长的静音，会话不会因缺少音频而中断；SIGUSR2 把当前状态写入
+// 日志：连接状态、会话 ID、播放与各输出、文本请求及重连缓冲的深度，以及与
+// -metrics-addr 相同的会话、用量、延迟与播放指标。例如：
+//
+//	kill -USR1 $(pidof realtimedialog)
+//
+// 没有这两个信号的平台（Windows、浏览器）上不可用。
+
+// micMuted is set while the input audio is replaced with silence.
+var micMuted atomic.Bool
+
+func init() {
+	expvar.Publish("mic_muted", expvar.Func(func() any { return micMuted.Load() }))
+	bufferMetrics.Set("playback_ms", expvar.Func(func() any { return playbackBufferMs() }))
+}
+
+// playbackBufferMs returns the duration of the bot audio waiting to be
+// played, in milliseconds.
+func playbackBufferMs() int {
+	bufferLock.Lock()
+	defer bufferLock.Unlock()
+	if audioSettings.OutputSampleRate == 0 {
+		return 0
+	}
+	frames := len(buffer) / audioSettings.OutputChannels
+	return frames * 1000 / audioSettings.OutputSampleRate
+}
+
+// muteSource sends silence in place of the audio of src while micMuted or
+// pushToTalkIdle is set.
+type muteSource struct {
+	src AudioSource
+}
+
+func (m muteSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	return m.src.Stream(ctx, func(chunk []byte) {
+		if micMuted.Load() || pushToTalkIdle.Load() {
+			chunk = make([]byte, len(chunk))
+		}
+		send(chunk)
+	})
+}
+
+// watchControlSignals toggles the mute on SIGUSR1 and dumps the state on
+// SIGUSR2 until ctx is done.
+func watchControlSignals(ctx context.Context) {
+	mute, dump := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	notifyControl(mute, dump)
+	go func() {
+		defer signal.Stop(mute)
+		defer signal.Stop(dump)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-mute:
+				muted := !micMuted.Load()
+				micMuted.Store(muted)
+				if muted {
+					glog.V(vEvent).Info("Microphone muted")
+				} else {
+					glog.V(vEvent).Info("Microphone unmuted")
+				}
+			case <-dump:
+				dumpState()
+			}
+		}
+	}()
+}
+
+// dumpState logs the exported variables but the command line and the
+// memory statistics, whatever the verbosity: the user asked for them.
+func dumpState() {
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" || kv.Key == "memstats" {
+			return
+		}
+		glog.Infof("State %s: %s", kv.Key, kv.Value)
+	})
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyControl does nothing: there are no SIGUSR1 and SIGUSR2 here.
+func notifyControl(mute, dump chan<- os.Signal) {}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyControl relays SIGUSR1, the request to toggle the mute, to mute and
+// SIGUSR2, the request to dump the state, to dump.
+func notifyControl(mute, dump chan<- os.Signal) {
+	signal.Notify(mute, syscall.SIGUSR1)
+	signal.Notify(dump, syscall.SIGUSR2)
+}
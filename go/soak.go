@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 长稳测试：连续数小时背靠背地运行会话，定期采样协程数、堆大小与打开的文件
+// 描述符数，发现持续增长的趋势即判定为泄漏，用于验证客户端能否在常驻设备上
+// 长期运行。
+
+var (
+	soakDuration = flag.Duration("soak-duration", time.Hour, "in the `soak` command, how long to run sessions")
+	soakInterval = flag.Duration("soak-interval", time.Minute, "in the `soak` command, how often to sample the resources")
+)
+
+// soakWindows is the number of consecutive windows the samples are split
+// into: a resource leaks if its minimum grows from every window to the next.
+const soakWindows = 4
+
+func init() {
+	commands["soak"] = runSoak
+}
+
+// SoakSample is a measurement of the resources of the process.
+type SoakSample struct {
+	Time       time.Time `json:"time"`
+	Sessions   int       `json:"sessions"`
+	Failures   int       `json:"failures"`
+	Goroutines int       `json:"goroutines"`
+	HeapBytes  uint64    `json:"heap_bytes"`
+	// OpenFDs is -1 where it cannot be measured.
+	OpenFDs int `json:"open_fds"`
+}
+
+// SoakReport is the result of the `soak` command.
+type SoakReport struct {
+	Duration float64      `json:"duration_seconds"`
+	Sessions int          `json:"sessions"`
+	Failures int          `json:"failures"`
+	Samples  []SoakSample `json:"samples"`
+	// Leaks names the resources with an increasing trend.
+	Leaks []string `json:"leaks"`
+}
+
+// runSoak implements the `soak [audio.wav]` subcommand.
+func runSoak(ctx context.Context, cfg *Config) error {
+	pcm := probeChirp()
+	if path := flag.Arg(1); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read soak audio: %w", err)
+		}
+		samples, rate, channels, err := decodeWAV(data)
+		if err != nil {
+			return fmt.Errorf("decode soak audio: %w", err)
+		}
+		pcm = newInputConverter(rate, channels).convert(samples)
+	}
+	bytesPerSecond := audioSettings.InputSampleRate * audioSettings.InputChannels * 2
+	duration := time.Duration(len(pcm)) * time.Second / time.Duration(bytesPerSecond)
+
+	ctx, cancel := context.WithTimeout(ctx, *soakDuration)
+	defer cancel()
+	start := time.Now()
+	var report SoakReport
+	enc := json.NewEncoder(os.Stdout)
+	sample := func() {
+		s := sampleResources()
+		s.Sessions, s.Failures = report.Sessions, report.Failures
+		report.Samples = append(report.Samples, s)
+		glog.V(vEvent).Infof("Soak sample: %d sessions (%d failed), %d goroutines, %d heap bytes, %d open fds",
+			s.Sessions, s.Failures, s.Goroutines, s.HeapBytes, s.OpenFDs)
+		if *jsonOutput {
+			if err := enc.Encode(s); err != nil {
+				glog.Errorf("Write soak sample: %v", err)
+			}
+		}
+	}
+	sample()
+	next := time.Now().Add(*soakInterval)
+	for ctx.Err() == nil {
+		// 会话之间采样，此时没有进行中的会话，数值最稳定
+		if _, err := replaySession(ctx, cfg, nil, pcm, duration); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			report.Failures++
+			glog.Errorf("Soak session %d: %v", report.Sessions+1, err)
+			sleepCtx(ctx, time.Second)
+		}
+		report.Sessions++
+		if time.Now().After(next) {
+			sample()
+			next = time.Now().Add(*soakInterval)
+		}
+	}
+	sample()
+	report.Duration = time.Since(start).Round(time.Second).Seconds()
+	report.Leaks = soakLeaks(report.Samples)
+
+	if *jsonOutput {
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.WriteSummary(os.Stdout)
+	}
+	if len(report.Leaks) > 0 {
+		return fmt.Errorf("possible leak of %s", strings.Join(report.Leaks, ", "))
+	}
+	return nil
+}
+
+// sampleResources measures the resources of the process, after a garbage
+// collection so that the heap holds live objects only.
+func sampleResources() SoakSample {
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fds := -1
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fds = len(entries)
+	}
+	return SoakSample{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  mem.HeapAlloc,
+		OpenFDs:    fds,
+	}
+}
+
+// soakLeaks returns the resources whose minimum over each of soakWindows
+// consecutive windows of samples increases from every window to the next.
+// The first sample, taken before any session, is a warm-up and ignored.
+func soakLeaks(samples []SoakSample) []string {
+	leaks := []string{}
+	if len(samples) < soakWindows+1 {
+		return leaks
+	}
+	samples = samples[1:]
+	for _, resource := range []struct {
+		name  string
+		value func(SoakSample) float64
+	}{
+		{"goroutines", func(s SoakSample) float64 { return float64(s.Goroutines) }},
+		{"heap", func(s SoakSample) float64 { return float64(s.HeapBytes) }},
+		{"open fds", func(s SoakSample) float64 { return float64(s.OpenFDs) }},
+	} {
+		increasing := true
+		prev := -1.0
+		for w := range soakWindows {
+			window := samples[w*len(samples)/soakWindows : (w+1)*len(samples)/soakWindows]
+			low := resource.value(window[0])
+			for _, s := range window[1:] {
+				low = min(low, resource.value(s))
+			}
+			if low < 0 || low <= prev {
+				increasing = false
+				break
+			}
+			prev = low
+		}
+		if increasing {
+			leaks = append(leaks, resource.name)
+		}
+	}
+	return leaks
+}
+
+// WriteSummary writes the report to w in human-readable form.
+func (r *SoakReport) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "Soak: %v, %d sessions, %d failed\n", time.Duration(r.Duration*float64(time.Second)), r.Sessions, r.Failures)
+	if n := len(r.Samples); n > 0 {
+		first, last := r.Samples[0], r.Samples[n-1]
+		fmt.Fprintf(w, "  goroutines: %d -> %d\n", first.Goroutines, last.Goroutines)
+		fmt.Fprintf(w, "  heap: %d -> %d bytes\n", first.HeapBytes, last.HeapBytes)
+		fmt.Fprintf(w, "  open fds: %d -> %d\n", first.OpenFDs, last.OpenFDs)
+	}
+	if len(r.Leaks) == 0 {
+		fmt.Fprintln(w, "  no increasing trend")
+		return
+	}
+	fmt.Fprintf(w, "  increasing: %s\n", strings.Join(r.Leaks, ", "))
+}
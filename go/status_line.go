@@ -0,0 +1,156 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"RealtimeDialog/pcm"
+)
+
+// 状态行：在终端上显示实时字幕时，字幕下方有一行原地刷新的状态：连接状态、
+// 麦克风电平（静音时显示 muted）、待播放的缓冲时长与上一轮的首音频时延。此时
+// 日志只输出警告与错误，以免刷屏；用 -v、-verbose 等或配置文件的 log_level
+// 指定日志级别时以指定的为准。字幕行（识别中间结果、机器人回复）输出期间状态行
+// 暂不显示。-vu 在状态行中加上麦克风输入与机器人输出的电平条，一眼即可看出双向
+// 是否都有音频：本地播放时测量扬声器实际播放的音频，否则测量收到的音频。
+
+var (
+	statusLine = flag.Bool("status", true, "below the live transcript on a terminal, show a status line with the connection state, microphone level, playback buffer and last turn latency, and log only warnings and errors unless a log level is given")
+	statusVU   = flag.Bool("vu", true, "show level bars of the microphone input and the bot output in the -status line")
+)
+
+const (
+	// statusInterval is how often the status line is refreshed.
+	statusInterval = 100 * time.Millisecond
+	// vuWidth is the number of cells of the level bars, covering vuRange dB.
+	vuWidth = 10
+	vuRange = 60
+)
+
+// botMeter measures the level of the bot audio, for the level bars.
+var botMeter = &levelMeter{}
+
+// levelMeter measures the peak level of the input audio between reads.
+type levelMeter struct {
+	mu   sync.Mutex
+	peak float64   // RMS of the loudest chunk, full scale 1
+	buf  []float32 // samples of the last chunk, reused by Process
+}
+
+// Process takes a chunk of audio in the input format, from the capture
+// goroutine.
+func (m *levelMeter) Process(chunk []byte) {
+	m.buf = pcm.AppendBytesInt16Float32(m.buf[:0], chunk)
+	m.ProcessFloat(m.buf)
+}
+
+// ProcessFloat takes samples of full scale 1.
+func (m *levelMeter) ProcessFloat(samples []float32) {
+	if len(samples) == 0 {
+		return
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	m.add(math.Sqrt(sum / float64(len(samples))))
+}
+
+func (m *levelMeter) add(rms float64) {
+	m.mu.Lock()
+	m.peak = max(m.peak, rms)
+	m.mu.Unlock()
+}
+
+// Read returns the peak level since the last read, in dBFS.
+func (m *levelMeter) Read() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peak := m.peak
+	m.peak = 0
+	return max(20*math.Log10(peak), -90)
+}
+
+// vuBar renders a level in dBFS as a bar.
+func vuBar(level float64) string {
+	cells := int(math.Round((level + vuRange) / vuRange * vuWidth))
+	cells = min(max(cells, 0), vuWidth)
+	return strings.Repeat("█", cells) + strings.Repeat("░", vuWidth-cells)
+}
+
+// statusText returns the status line, with the microphone and the bot audio
+// at mic and bot dBFS.
+func statusText(mic, bot float64) string {
+	state := "disconnected"
+	if v, ok := connectionMetrics.Get("state").(*expvar.String); ok {
+		state = v.Value()
+	}
+	micText := fmt.Sprintf("%3.0f dBFS", mic)
+	switch {
+	case micMuted.Load():
+		micText = "muted"
+	case pushToTalkIdle.Load():
+		micText = "off (push to talk)"
+	}
+	latency := "-"
+	if v, ok := latencyMetrics.Get("last_first_audio_ms").(*expvar.Int); ok {
+		latency = fmt.Sprintf("%d ms", v.Value())
+	}
+	if *statusVU {
+		return fmt.Sprintf("%s | mic %s %s | bot %s | buffer %d ms | last turn %s", state, vuBar(mic), micText, vuBar(bot), playbackBufferMs(), latency)
+	}
+	return fmt.Sprintf("%s | mic %s | buffer %d ms | last turn %s", state, micText, playbackBufferMs(), latency)
+}
+
+// ShowStatus displays the line returned by text below the transcript,
+// refreshing it until the returned function is called. It needs cursor
+// control, p.color.
+func (p *transcriptPrinter) ShowStatus(text func() string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(statusInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				p.drawStatus(text())
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.endLine()
+	}
+}
+
+func (p *transcriptPrinter) drawStatus(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.partial || p.botLine {
+		return
+	}
+	fmt.Fprint(p.w, ansiClearLine+p.style(ansiDim, text))
+	p.status = true
+}
+
+// botLevelHandler measures the bot audio as it arrives, when it is not
+// played on the speaker.
+type botLevelHandler struct {
+	NopHandler
+}
+
+func (botLevelHandler) OnAudioChunk(data []byte) {
+	botMeter.ProcessFloat(decodeOutputAudio(data))
+}
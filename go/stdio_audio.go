@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+// 标准输入输出音频：-input stdin 从标准输入读取原始 PCM（s16le，输入采样率与
+// 声道数），-sink stdout 把机器人音频以原始 PCM（s16le，输出采样率与声道数）
+// 写到标准输出，便于与 arecord/aplay、ffmpeg 等通过管道组合，也可在没有 cgo
+// 的构建中使用。
+
+// stdinSource streams the raw PCM read from stdin, at most a chunk per
+// -input-buffer-ms, then silence once stdin is exhausted, as a muted
+// microphone would.
+type stdinSource struct {
+	chunks <-chan []byte
+}
+
+// newStdinSource starts reading stdin. The reader outlives the sessions, so
+// that no audio is lost between them.
+func newStdinSource() stdinSource {
+	chunk := audioSettings.InputSampleRate * audioSettings.InputChannels * 2 * audioSettings.InputBufferMs / 1000
+	chunks := make(chan []byte, 50)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, chunk)
+			n, err := io.ReadFull(os.Stdin, buf)
+			if n > 0 {
+				chunks <- buf[:n-n%2]
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					glog.Errorf("Read audio from stdin: %v", err)
+				}
+				glog.V(vEvent).Info("End of the audio on stdin")
+				return
+			}
+		}
+	}()
+	return stdinSource{chunks: chunks}
+}
+
+func (s stdinSource) Stream(ctx context.Context, send func(chunk []byte)) error {
+	chunk := audioSettings.InputSampleRate * audioSettings.InputChannels * 2 * audioSettings.InputBufferMs / 1000
+	silence := make([]byte, chunk)
+	ticker := time.NewTicker(time.Duration(audioSettings.InputBufferMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		select {
+		case data, ok := <-s.chunks:
+			if !ok {
+				send(silence)
+				continue
+			}
+			send(data)
+		default:
+			// 管道暂时没有数据：不补静音，以免积累延迟
+		}
+	}
+}
+
+// newStdoutSink writes the bot audio to stdout as raw PCM S16LE.
+func newStdoutSink() AudioSink {
+	return newQueuedSink("stdout", func(chunk []byte) error {
+		_, err := os.Stdout.Write(pcm.Int16ToBytes(pcm.Float32ToInt16(decodeOutputAudio(chunk))))
+		return err
+	}, nil)
+}
@@ -0,0 +1,395 @@
+//go:build telegram
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+	"layeh.com/gopus"
+)
+
+const (
+	telegramAPI = "https://api.telegram.org"
+	// telegramReplyTimeout bounds the session of a voice message.
+	telegramReplyTimeout = 2 * time.Minute
+)
+
+var telegramToken = flag.String("telegram-token", "", "Telegram bot token, overrides TELEGRAM_BOT_TOKEN")
+
+func init() {
+	commands["telegram"] = runTelegram
+}
+
+// runTelegram implements the `telegram` subcommand: a bot that answers every
+// voice message with the reply of a one-shot session, as text and as a voice
+// message.
+func runTelegram(ctx context.Context, cfg *Config) error {
+	token := *telegramToken
+	if token == "" {
+		token = os.Getenv("TELEGRAM_BOT_TOKEN")
+	}
+	if token == "" {
+		return errors.New("-telegram-token or TELEGRAM_BOT_TOKEN is required")
+	}
+	bot := &telegramBot{token: token, client: &http.Client{}}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	offset := int64(0)
+	glog.V(vEvent).Info("Telegram bot started, waiting for voice messages...")
+	for {
+		var updates []telegramUpdate
+		err := bot.call(ctx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         30,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			glog.Errorf("Get Telegram updates: %v", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(msg *telegramMessage) {
+				defer wg.Done()
+				if err := bot.answer(ctx, cfg, msg); err != nil {
+					glog.Errorf("Answer Telegram message %d of chat %d: %v", msg.MessageID, msg.Chat.ID, err)
+				}
+			}(u.Message)
+		}
+	}
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Voice *struct {
+		FileID   string `json:"file_id"`
+		Duration int    `json:"duration"`
+	} `json:"voice"`
+}
+
+type telegramFile struct {
+	FilePath string `json:"file_path"`
+}
+
+// telegramBot is a minimal client of the Telegram Bot API.
+type telegramBot struct {
+	token  string
+	client *http.Client
+}
+
+// do sends req and decodes the result of the API response into result.
+func (t *telegramBot) do(req *http.Request, result interface{}) error {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		// 错误信息中的 URL 含有 token，不要写入日志
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decode response: %w (status %s)", err, resp.Status)
+	}
+	if !body.OK {
+		return fmt.Errorf("telegram API error: %s", body.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body.Result, result)
+}
+
+func (t *telegramBot) call(ctx context.Context, method string, params, result interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("marshal %s params: %w", method, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPI+"/bot"+t.token+"/"+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := t.do(req, result); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	return nil
+}
+
+// download returns the content of a file sent to the bot.
+func (t *telegramBot) download(ctx context.Context, fileID string) ([]byte, error) {
+	var file telegramFile
+	if err := t.call(ctx, "getFile", map[string]string{"file_id": fileID}, &file); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, telegramAPI+"/file/bot"+t.token+"/"+file.FilePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("download file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download file: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (t *telegramBot) sendMessage(ctx context.Context, msg *telegramMessage, text string) error {
+	return t.call(ctx, "sendMessage", map[string]interface{}{
+		"chat_id":          msg.Chat.ID,
+		"text":             text,
+		"reply_parameters": map[string]int64{"message_id": msg.MessageID},
+	}, nil)
+}
+
+// sendVoice replies to msg with an Ogg/Opus voice message.
+func (t *telegramBot) sendVoice(ctx context.Context, msg *telegramMessage, ogg []byte) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("chat_id", strconv.FormatInt(msg.Chat.ID, 10))
+	_ = mw.WriteField("reply_parameters", fmt.Sprintf(`{"message_id":%d}`, msg.MessageID))
+	fw, err := mw.CreateFormFile("voice", "reply.ogg")
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(ogg); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPI+"/bot"+t.token+"/sendVoice", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if err := t.do(req, nil); err != nil {
+		return fmt.Errorf("sendVoice: %w", err)
+	}
+	return nil
+}
+
+// answer runs the voice message of msg through a one-shot session and sends
+// the reply back.
+func (t *telegramBot) answer(ctx context.Context, cfg *Config, msg *telegramMessage) error {
+	if msg.Voice == nil {
+		return t.sendMessage(ctx, msg, "请发送语音消息。")
+	}
+	glog.V(vEvent).Infof("Voice message %d from chat %d (%ds)", msg.MessageID, msg.Chat.ID, msg.Voice.Duration)
+	data, err := t.download(ctx, msg.Voice.FileID)
+	if err != nil {
+		return err
+	}
+	pcm, err := decodeVoiceMessage(data)
+	if err != nil {
+		return fmt.Errorf("decode voice message: %w", err)
+	}
+
+	sessionCtx, cancel := context.WithTimeout(ctx, telegramReplyTimeout)
+	defer cancel()
+	reply := newVoiceReply()
+	if err := runOneShot(sessionCtx, cfg, pcm, reply); err != nil {
+		return err
+	}
+
+	text, audio := reply.Result()
+	if text == "" && len(audio) == 0 {
+		return t.sendMessage(ctx, msg, "没有听清，请再说一遍。")
+	}
+	if text != "" {
+		if err := t.sendMessage(ctx, msg, text); err != nil {
+			return err
+		}
+	}
+	if len(audio) == 0 {
+		return nil
+	}
+	voice, err := encodeVoiceMessage(audio)
+	if err != nil {
+		return fmt.Errorf("encode voice message: %w", err)
+	}
+	return t.sendVoice(ctx, msg, voice)
+}
+
+// runOneShot runs a single session on a connection of its own, sending pcm
+// as the user audio and waiting for the bot to finish its reply.
+func runOneShot(ctx context.Context, cfg *Config, pcm []byte, reply *voiceReply) error {
+	conn, _, err := dialDialog(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("websocket dial: %w", err)
+	}
+	defer conn.Close()
+	if err := startConnection(conn); err != nil {
+		return fmt.Errorf("start connection: %w", err)
+	}
+	src := pcmSource{pcm: pcm, done: reply.done}
+	if err := runSession(ctx, conn, SessionInfo{ID: NewSessionID(), Seq: 1}, reply, src); err != nil {
+		return err
+	}
+	return finishConnection(conn)
+}
+
+// voiceReply collects the reply of a one-shot session.
+type voiceReply struct {
+	NopHandler
+	done chan struct{}
+	once sync.Once
+
+	mu    sync.Mutex
+	text  strings.Builder
+	audio []byte
+}
+
+func newVoiceReply() *voiceReply {
+	return &voiceReply{done: make(chan struct{})}
+}
+
+func (r *voiceReply) finish() {
+	r.once.Do(func() { close(r.done) })
+}
+
+func (r *voiceReply) OnASRFinal(result ASRResult) {
+	glog.V(vEvent).Infof("Voice message recognized: %s", redactText(result.Text))
+}
+
+func (r *voiceReply) OnBotText(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.text.WriteString(text)
+}
+
+func (r *voiceReply) OnAudioChunk(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.audio = append(r.audio, data...)
+}
+
+func (r *voiceReply) OnBotSpeechEnd()            { r.finish() }
+func (r *voiceReply) OnSessionEnd(int32, []byte) { r.finish() }
+func (r *voiceReply) OnError(error)              { r.finish() }
+
+// Result returns the reply text and audio, in the configured output format.
+func (r *voiceReply) Result() (string, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.text.String(), r.audio
+}
+
+// decodeVoiceMessage decodes an Ogg/Opus voice message into uplink audio.
+func decodeVoiceMessage(data []byte) ([]byte, error) {
+	packets, err := readOggPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) < 2 {
+		return nil, errors.New("missing Opus headers")
+	}
+	channels, err := opusHeadChannels(packets[0])
+	if err != nil {
+		return nil, err
+	}
+	if channels != 1 && channels != 2 {
+		return nil, fmt.Errorf("unsupported channel count %d", channels)
+	}
+	dec, err := gopus.NewDecoder(48000, channels)
+	if err != nil {
+		return nil, fmt.Errorf("create opus decoder: %w", err)
+	}
+	var samples []int16
+	for _, packet := range packets[2:] {
+		pcm, err := dec.Decode(packet, 5760, false)
+		if err != nil {
+			return nil, fmt.Errorf("decode opus packet: %w", err)
+		}
+		samples = append(samples, pcm...)
+	}
+	switch {
+	case channels == 2 && audioSettings.InputChannels == 1:
+		samples = pcm.Downmix(samples, 2)
+		channels = 1
+	case channels == 1 && audioSettings.InputChannels == 2:
+		stereo := make([]int16, len(samples)*2)
+		for i, s := range samples {
+			stereo[i*2], stereo[i*2+1] = s, s
+		}
+		samples, channels = stereo, 2
+	}
+	samples = newResampler(48000, audioSettings.InputSampleRate, channels).Process(samples)
+	return pcm.Int16ToBytes(samples), nil
+}
+
+// encodeVoiceMessage encodes bot audio into a mono Ogg/Opus voice message.
+func encodeVoiceMessage(audio []byte) ([]byte, error) {
+	samples := pcm.Float32ToInt16(decodeOutputAudio(audio))
+	if audioSettings.OutputChannels == 2 {
+		samples = pcm.Downmix(samples, 2)
+	}
+	samples = newResampler(audioSettings.OutputSampleRate, 48000, 1).Process(samples)
+
+	enc, err := gopus.NewEncoder(48000, 1, gopus.Voip)
+	if err != nil {
+		return nil, fmt.Errorf("create opus encoder: %w", err)
+	}
+	const frameSize = 960 // 20ms
+	var frames [][]byte
+	for off := 0; off < len(samples); off += frameSize {
+		frame := make([]int16, frameSize)
+		copy(frame, samples[off:])
+		packet, err := enc.Encode(frame, frameSize, 4000)
+		if err != nil {
+			return nil, fmt.Errorf("encode opus frame: %w", err)
+		}
+		frames = append(frames, packet)
+	}
+	return writeOggOpus(frames, 1, audioSettings.OutputSampleRate), nil
+}
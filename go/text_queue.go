@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 离线文本队列：其他子系统（例如工具调用的结果）请求机器人说话时，如果当前没有
+// 会话（正在重连或会话之间），请求先排队，新会话开始后依次发送；排队超过
+// -text-queue-ttl 的请求视为过期并丢弃。
+
+var textQueueTTL = flag.Duration("text-queue-ttl", 30*time.Second, "queue the SayHello and ChatTTSText requests made while no session is running, and send them once a session starts unless queued for longer than this (0 disables queueing)")
+
+// errNoSession is returned for text requests made without a session when
+// queueing is disabled.
+var errNoSession = errors.New("no session running")
+
+// textRequest is a queued SayHello or ChatTTSText request.
+type textRequest struct {
+	hello  bool
+	text   string
+	queued time.Time
+}
+
+// textQueue is a Handler sending text requests in the current session of the
+// dialog, and queueing them while there is none.
+type textQueue struct {
+	NopHandler
+
+	mu        sync.Mutex
+	conn      Transport
+	sessionID string
+	pending   []textRequest
+}
+
+func newTextQueue() *textQueue {
+	q := &textQueue{}
+	bufferMetrics.Set("text_requests", expvar.Func(func() any {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.pending)
+	}))
+	return q
+}
+
+// SetConnection sets the connection of the dialog, nil once it is closed.
+func (q *textQueue) SetConnection(conn Transport) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.conn, q.sessionID = conn, ""
+}
+
+// SayHello has the bot greet with text (SayHello).
+func (q *textQueue) SayHello(text string) error {
+	return q.request(textRequest{hello: true, text: text})
+}
+
+// Speak has the bot speak text (ChatTTSText).
+func (q *textQueue) Speak(text string) error {
+	return q.request(textRequest{text: text})
+}
+
+func (q *textQueue) request(r textRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.sessionID != "" && len(q.pending) == 0 {
+		err := q.send(r)
+		if err == nil || *textQueueTTL <= 0 {
+			return err
+		}
+		glog.Warningf("Send text request, queueing it: %v", err)
+	} else if *textQueueTTL <= 0 {
+		return errNoSession
+	}
+	r.queued = time.Now()
+	q.pending = append(q.pending, r)
+	glog.V(vEvent).Infof("Queued text request until a session starts: %s", redactText(r.text))
+	return nil
+}
+
+// send sends r in the current session.
+func (q *textQueue) send(r textRequest) error {
+	if r.hello {
+		return sayHello(q.conn, q.sessionID, &SayHelloPayload{Content: r.text})
+	}
+	return speakText(q.conn, q.sessionID, r.text)
+}
+
+// flush sends the pending requests that have not expired, in order, until
+// one fails.
+func (q *textQueue) flush() {
+	for len(q.pending) > 0 {
+		r := q.pending[0]
+		if age := time.Since(r.queued); age > *textQueueTTL {
+			glog.Warningf("Drop text request queued %v ago: %s", age.Round(time.Second), r.text)
+			q.pending = q.pending[1:]
+			continue
+		}
+		if err := q.send(r); err != nil {
+			glog.Errorf("Send queued text request: %v", err)
+			return
+		}
+		q.pending = q.pending[1:]
+	}
+	q.pending = nil
+}
+
+func (q *textQueue) OnSessionStart(session SessionInfo) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.conn == nil {
+		return
+	}
+	q.sessionID = session.ID
+	if n := len(q.pending); n > 0 {
+		glog.V(vEvent).Infof("Sending %d queued text requests", n)
+		q.flush()
+	}
+}
+
+func (q *textQueue) OnSessionEnd(int32, []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sessionID = ""
+}
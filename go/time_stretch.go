@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"time"
+)
+
+// 播放变速：用 WSOLA（波形相似叠加）在不改变音高的前提下加快或放慢机器人语音
+// 的播放，放慢便于听力不便的用户，加快则让熟练用户更快听完回复。只影响本地
+// 播放，保存的音频与其他输出保持原速。
+
+var playbackSpeed = flag.Float64("playback-speed", 1, "play the bot audio this much faster (>1) or slower (<1), from 0.5 to 2, without changing the pitch")
+
+const (
+	// stretchWindow is the length of the segments overlapped, half of it
+	// apart in the output.
+	stretchWindow = 20 * time.Millisecond
+	// stretchTolerance is how far from its nominal position a segment is
+	// searched for the best match with the preceding output.
+	stretchTolerance = 5 * time.Millisecond
+)
+
+// timeStretcher changes the speed of streamed audio by WSOLA. A nil or
+// unit-speed timeStretcher passes the audio through.
+type timeStretcher struct {
+	speed     float64
+	channels  int
+	size      int // frames per segment
+	hop       int // output frames per segment
+	tolerance int // frames
+	window    []float32
+	in        []float32 // input from frame base on, interleaved
+	base      int
+	pos       float64   // nominal start of the next segment
+	prev      int       // start of the previous segment; -1 before the first
+	overlap   []float32 // windowed second half of the previous segment
+}
+
+func newTimeStretcher(speed float64, rate, channels int) *timeStretcher {
+	frames := func(d time.Duration) int { return int(d.Seconds() * float64(rate)) }
+	s := &timeStretcher{speed: speed, channels: channels, hop: frames(stretchWindow) / 2, tolerance: frames(stretchTolerance)}
+	s.size = 2 * s.hop
+	// 周期 Hann 窗：相隔半个窗长叠加后增益恒为 1
+	s.window = make([]float32, s.size)
+	for i := range s.window {
+		s.window[i] = float32(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(s.size)))
+	}
+	s.overlap = make([]float32, s.hop*channels)
+	s.Reset()
+	return s
+}
+
+// Reset drops the audio held: the reply was interrupted.
+func (s *timeStretcher) Reset() {
+	if s == nil {
+		return
+	}
+	s.in, s.base, s.pos, s.prev = s.in[:0], 0, 0, -1
+	clear(s.overlap)
+}
+
+// Process takes the next samples of the reply and returns the stretched
+// samples that are complete.
+func (s *timeStretcher) Process(samples []float32) []float32 {
+	if s == nil || s.speed == 1 {
+		return samples
+	}
+	c := s.channels
+	s.in = append(s.in, samples...)
+	var out []float32
+	for {
+		p := int(s.pos)
+		end := p + s.tolerance + s.size
+		if s.prev >= 0 {
+			end = max(end, s.prev+s.hop+s.size)
+		}
+		if end-s.base > len(s.in)/c {
+			break
+		}
+		start := p
+		if s.prev >= 0 {
+			start = s.bestMatch(p)
+		}
+		seg := s.in[(start-s.base)*c : (start-s.base+s.size)*c]
+		for i := range s.hop {
+			for ch := range c {
+				out = append(out, s.overlap[i*c+ch]+seg[i*c+ch]*s.window[i])
+			}
+		}
+		for i := s.hop; i < s.size; i++ {
+			for ch := range c {
+				s.overlap[(i-s.hop)*c+ch] = seg[i*c+ch] * s.window[i]
+			}
+		}
+		s.prev = start
+		s.pos += float64(s.hop) * s.speed
+	}
+	if keep := min(int(s.pos)-s.tolerance, s.prev+s.hop); keep > s.base {
+		s.in = append(s.in[:0], s.in[(keep-s.base)*c:]...)
+		s.base = keep
+	}
+	return out
+}
+
+// Flush returns the rest of the reply, unstretched: the overlap pending is
+// completed by the input that follows the previous segment.
+func (s *timeStretcher) Flush() []float32 {
+	if s == nil || s.speed == 1 {
+		return nil
+	}
+	var out []float32
+	if s.prev < 0 {
+		out = append(out, s.in...)
+	} else {
+		out = append(out, s.in[(s.prev+s.hop-s.base)*s.channels:]...)
+	}
+	s.Reset()
+	return out
+}
+
+// bestMatch returns the start of the segment near p most similar to the
+// natural continuation of the previous segment.
+func (s *timeStretcher) bestMatch(p int) int {
+	c := s.channels
+	mono := func(frame int) float64 {
+		var v float32
+		for ch := range c {
+			v += s.in[(frame-s.base)*c+ch]
+		}
+		return float64(v)
+	}
+	target := s.prev + s.hop
+	best, bestScore := p, math.Inf(-1)
+	for start := max(p-s.tolerance, s.base); start <= p+s.tolerance; start++ {
+		var corr, energy float64
+		for i := range s.size {
+			v := mono(start + i)
+			corr += v * mono(target+i)
+			energy += v * v
+		}
+		if energy == 0 {
+			continue
+		}
+		if score := corr / math.Sqrt(energy); score > bestScore {
+			best, bestScore = start, score
+		}
+	}
+	return best
+}
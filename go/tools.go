@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var enableTools = flag.Bool("tools", false, "invoke the registered tools when the bot emits tool calls and speak their results")
+
+// ToolCall is a request of the bot to invoke a tool.
+type ToolCall struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// UnmarshalJSON decodes a call in the shape of the chat completions API,
+// {"id", "type": "function", "function": {"name", "arguments"}}, whose
+// arguments are JSON encoded in a string, or with the name and arguments at
+// the top level.
+func (c *ToolCall) UnmarshalJSON(data []byte) error {
+	type function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	var raw struct {
+		ID string `json:"id"`
+		function
+		Function *function `json:"function"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	f := raw.function
+	if raw.Function != nil {
+		f = *raw.Function
+	}
+	c.ID, c.Name, c.Arguments = raw.ID, f.Name, f.Arguments
+	// 参数是字符串时取出其中的 JSON
+	var s string
+	if json.Unmarshal(c.Arguments, &s) == nil {
+		c.Arguments = nil
+		if s != "" {
+			c.Arguments = json.RawMessage(s)
+		}
+	}
+	return nil
+}
+
+// ToolCallPayload is the part of a FullServer event payload carrying tool
+// calls.
+type ToolCallPayload struct {
+	ToolCalls []ToolCall `json:"tool_calls"`
+}
+
+// ToolFunc implements a tool. It receives the JSON arguments of the call and
+// returns the text to speak as the result.
+type ToolFunc func(ctx context.Context, args json.RawMessage) (string, error)
+
+// ToolRegistry maps tool names to their implementations.
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]ToolFunc
+}
+
+// NewToolRegistry returns an empty ToolRegistry.
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]ToolFunc)}
+}
+
+// Register attaches fn to the tool name, replacing any previous one.
+func (r *ToolRegistry) Register(name string, fn ToolFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tools[name] = fn
+}
+
+// Lookup returns the implementation of the tool name.
+func (r *ToolRegistry) Lookup(name string) (ToolFunc, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.tools[name]
+	return fn, ok
+}
+
+// Names returns the sorted names of the registered tools.
+func (r *ToolRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultTools returns the registry of the tools built into the demo.
+func defaultTools() *ToolRegistry {
+	r := NewToolRegistry()
+	r.Register("get_current_time", func(context.Context, json.RawMessage) (string, error) {
+		return time.Now().Format("现在是2006年1月2日15点04分。"), nil
+	})
+	return r
+}
+
+// toolDispatcher invokes the registered tools on the tool calls of the bot
+// and speaks their results in the current session, or the next one if the
+// session ended meanwhile. The tools run until ctx is done; Wait waits for
+// them.
+type toolDispatcher struct {
+	NopHandler
+
+	ctx    context.Context
+	speech *textQueue
+	tools  *ToolRegistry
+	calls  sync.WaitGroup // the tool calls in progress
+}
+
+func newToolDispatcher(ctx context.Context, speech *textQueue, tools *ToolRegistry) *toolDispatcher {
+	return &toolDispatcher{ctx: ctx, speech: speech, tools: tools}
+}
+
+func (d *toolDispatcher) OnToolCall(call ToolCall) {
+	if d.ctx.Err() != nil {
+		glog.Warningf("Skip tool call %s (id=%s) as the dialog is ending", call.Name, call.ID)
+		return
+	}
+	// Tools may be slow, so they must not block the receive loop.
+	d.calls.Add(1)
+	go func() {
+		defer d.calls.Done()
+		if err := d.invoke(call); err != nil {
+			glog.Errorf("Tool call %s (id=%s) error: %v", call.Name, call.ID, err)
+		}
+	}()
+}
+
+// Wait waits for the tool calls in progress.
+func (d *toolDispatcher) Wait() {
+	d.calls.Wait()
+}
+
+func (d *toolDispatcher) invoke(call ToolCall) error {
+	fn, ok := d.tools.Lookup(call.Name)
+	if !ok {
+		return fmt.Errorf("unknown tool, registered tools: %v", d.tools.Names())
+	}
+	glog.V(vEvent).Infof("Invoke tool %s (id=%s) with arguments: %s", call.Name, call.ID, call.Arguments)
+	result, err := fn(d.ctx, call.Arguments)
+	if err != nil {
+		return err
+	}
+	return d.speech.Speak(result)
+}
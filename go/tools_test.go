@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"RealtimeDialog/dialog"
+)
+
+// capturingTransport is a Transport keeping the client events written to it.
+type capturingTransport struct {
+	Transport
+
+	mu     sync.Mutex
+	events []*dialog.Message
+}
+
+func (t *capturingTransport) WriteMessage(messageType int, data []byte) error {
+	msg, _, err := dialog.Unmarshal(data, dialog.ContainsSequence)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, msg)
+	return nil
+}
+
+func TestToolCallDecode(t *testing.T) {
+	for payload, want := range map[string]ToolCall{
+		// 对话服务与 chat completions 接口的形式，参数为字符串
+		`{"id":"c1","type":"function","function":{"name":"f","arguments":"{\"a\":1}"}}`: {ID: "c1", Name: "f", Arguments: json.RawMessage(`{"a":1}`)},
+		`{"id":"c2","function":{"name":"f","arguments":{"a":1}}}`:                       {ID: "c2", Name: "f", Arguments: json.RawMessage(`{"a":1}`)},
+		`{"id":"c3","function":{"name":"f","arguments":""}}`:                            {ID: "c3", Name: "f"},
+		// 名称与参数在顶层
+		`{"id":"c4","name":"f","arguments":{"a":1}}`: {ID: "c4", Name: "f", Arguments: json.RawMessage(`{"a":1}`)},
+	} {
+		var call ToolCall
+		if err := json.Unmarshal([]byte(payload), &call); err != nil {
+			t.Errorf("%s: %v", payload, err)
+			continue
+		}
+		if call.ID != want.ID || call.Name != want.Name || string(call.Arguments) != string(want.Arguments) {
+			t.Errorf("%s decoded as %+v, want %+v", payload, call, want)
+		}
+	}
+}
+
+// TestToolDispatch invokes a registered tool on the tool call of a
+// ChatResponse, and speaks its result in the session.
+func TestToolDispatch(t *testing.T) {
+	conn := &capturingTransport{}
+	speech := newTextQueue()
+	speech.SetConnection(conn)
+	speech.OnSessionStart(SessionInfo{ID: "s1"})
+
+	tools := NewToolRegistry()
+	var args string
+	tools.Register("get_weather", func(ctx context.Context, a json.RawMessage) (string, error) {
+		args = string(a)
+		return "北京今天晴。", nil
+	})
+	d := newToolDispatcher(context.Background(), speech, tools)
+
+	msg, _ := dialog.NewMessage(dialog.MsgTypeFullServer, dialog.MsgTypeFlagWithEvent)
+	msg.Event = dialog.EventChatResponse
+	msg.Payload = []byte(`{"content":"","tool_calls":[{"id":"c1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"北京\"}"}}]}`)
+	if err := dispatchServerEvent(multiHandler{d}, msg); err != nil {
+		t.Fatal(err)
+	}
+	d.Wait()
+
+	if args != `{"city":"北京"}` {
+		t.Errorf("tool invoked with %s", args)
+	}
+	var spoken string
+	for _, ev := range conn.events {
+		var payload ChatTTSTextPayload
+		if ev.Event != dialog.EventChatTTSText || ev.SessionID != "s1" || json.Unmarshal(ev.Payload, &payload) != nil {
+			t.Errorf("unexpected event %d of session %q: %s", ev.Event, ev.SessionID, ev.Payload)
+			continue
+		}
+		spoken += payload.Content
+	}
+	if spoken != "北京今天晴。" {
+		t.Errorf("spoke %q", spoken)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	ansiReset     = "\033[0m"
+	ansiBold      = "\033[1m"
+	ansiDim       = "\033[2m"
+	ansiCyan      = "\033[36m"
+	ansiRed       = "\033[31m"
+	ansiGreen     = "\033[32m"
+	ansiClearLine = "\r\033[2K"
+)
+
+// transcriptPrinter renders a live transcript of the dialog: ASR partials are
+// printed dim and overwritten in place, ASR finals are printed bold, and the
+// bot reply is streamed in color as its chunks arrive.
+type transcriptPrinter struct {
+	NopHandler
+
+	mu    sync.Mutex
+	w     io.Writer
+	color bool
+
+	partial bool // a partial ASR line is currently displayed
+	botLine bool // the bot reply is being streamed on the current line
+	status  bool // the status line is displayed, see ShowStatus
+}
+
+func newTranscriptPrinter(w io.Writer, color bool) *transcriptPrinter {
+	return &transcriptPrinter{w: w, color: color}
+}
+
+// isTerminal reports whether f refers to a character device, and thus whether
+// ANSI escape sequences should be used when writing to it.
+func isTerminal(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *transcriptPrinter) style(code, text string) string {
+	if !p.color {
+		return text
+	}
+	return code + text + ansiReset
+}
+
+// endLine terminates whatever line is in progress so that the next output
+// starts on a fresh line.
+func (p *transcriptPrinter) endLine() {
+	switch {
+	case p.partial && p.color, p.status:
+		fmt.Fprint(p.w, ansiClearLine)
+	case p.partial, p.botLine:
+		fmt.Fprintln(p.w)
+	}
+	p.partial = false
+	p.botLine = false
+	p.status = false
+}
+
+func (p *transcriptPrinter) OnASRPartial(result ASRResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.botLine {
+		p.endLine()
+	}
+	if !p.color {
+		// Without cursor control partials cannot be overwritten, so only the
+		// final result is printed.
+		return
+	}
+	fmt.Fprint(p.w, ansiClearLine+p.style(ansiDim, "User: "+result.Text))
+	p.partial = true
+}
+
+func (p *transcriptPrinter) OnASRFinal(result ASRResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endLine()
+	line := p.style(ansiBold, "User: "+result.Text)
+	if label := confidenceLabel(result); label != "" {
+		line += p.style(ansiDim, label)
+	}
+	fmt.Fprintln(p.w, line)
+}
+
+func (p *transcriptPrinter) OnBotText(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.botLine {
+		p.endLine()
+		fmt.Fprint(p.w, p.style(ansiCyan, "Bot:  "))
+		p.botLine = true
+	}
+	fmt.Fprint(p.w, p.style(ansiCyan, text))
+}
+
+func (p *transcriptPrinter) OnBotTextEnd() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.botLine {
+		p.endLine()
+	}
+}
+
+// Close terminates the line in progress, if any.
+func (p *transcriptPrinter) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endLine()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 连接抽象：协议与会话代码只通过 Transport 收发 websocket 消息，具体实现由
+// -transport 选择：gorilla（gorilla/websocket，默认）或 nhooyr
+// （nhooyr.io/websocket，原生支持 context）。自定义实现注册到 transports 即可。
+// 两种实现都把收到的消息读入每个连接复用的缓冲区，不再为每个音频块重新分配并
+// 逐步扩大内存；返回的数据只在下一次 ReadMessage 之前有效。
+
+var transportName = flag.String("transport", "gorilla", "websocket implementation of the connections to the dialogue service: gorilla or nhooyr")
+
+// Message types of a Transport, as in the websocket protocol.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// Buffer sizes of the connections to the dialogue service.
+const (
+	// transportReadBufferSize is the size of the buffer reading from the
+	// socket, holding a bot audio chunk in one or two reads.
+	transportReadBufferSize = 16 << 10
+	// messageBufferSize is the initial capacity of the buffer receiving the
+	// messages, grown as needed by larger ones.
+	messageBufferSize = 64 << 10
+)
+
+// Transport is a websocket connection. ReadMessage is called from one
+// goroutine at a time; WriteMessage and Close may be called concurrently
+// with each other and with ReadMessage.
+type Transport interface {
+	// ReadMessage returns the type and data of the next message. The data
+	// is only valid until the next call. Once ctx is done it returns the
+	// context error, and the connection cannot be read from anymore.
+	ReadMessage(ctx context.Context) (messageType int, data []byte, err error)
+	// WriteMessage sends a message.
+	WriteMessage(messageType int, data []byte) error
+	// Close closes the connection without a closing handshake.
+	Close() error
+}
+
+// TransportDialer opens a Transport to url with the given handshake header.
+// The handshake response is returned, if any, even on error.
+type TransportDialer func(ctx context.Context, url string, header http.Header) (Transport, *http.Response, error)
+
+// transports are the Transport implementations by -transport name.
+var transports = map[string]TransportDialer{
+	"gorilla": dialGorilla,
+}
+
+// errUnknownTransport is returned by dialTransport for a -transport without
+// an implementation.
+var errUnknownTransport = errors.New("unknown transport")
+
+// dialTransport dials url with the -transport implementation.
+func dialTransport(ctx context.Context, url string, header http.Header) (Transport, *http.Response, error) {
+	dial, ok := transports[*transportName]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w %q", errUnknownTransport, *transportName)
+	}
+	return dial(ctx, url, header)
+}
+
+// gorillaTransport is a Transport over a gorilla/websocket connection.
+type gorillaTransport struct {
+	conn *websocket.Conn
+	// message holds the last message read, overwritten by the next one.
+	message bytes.Buffer
+	// writeMu serializes the writes, as gorilla/websocket supports only one
+	// concurrent writer.
+	writeMu sync.Mutex
+}
+
+func newGorillaTransport(conn *websocket.Conn) *gorillaTransport {
+	t := &gorillaTransport{conn: conn}
+	t.message.Grow(messageBufferSize)
+	return t
+}
+
+func dialGorilla(ctx context.Context, url string, header http.Header) (Transport, *http.Response, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.ReadBufferSize = transportReadBufferSize
+	conn, resp, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, resp, err
+	}
+	return newGorillaTransport(conn), resp, nil
+}
+
+// ReadMessage honors the ctx deadline. As the read is aborted through the
+// read deadline, the connection cannot be read from after ctx is done.
+func (t *gorillaTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = t.conn.SetReadDeadline(deadline)
+		defer t.conn.SetReadDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = t.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	mt, r, err := t.conn.NextReader()
+	var data []byte
+	if err == nil {
+		data, err = readMessage(&t.message, r)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, nil, ctxErr
+		}
+		return 0, nil, err
+	}
+	return mt, data, nil
+}
+
+// readMessage reads the message of r into buf, replacing its content, and
+// returns it.
+func readMessage(buf *bytes.Buffer, r io.Reader) ([]byte, error) {
+	buf.Reset()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *gorillaTransport) WriteMessage(messageType int, data []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.conn.WriteMessage(messageType, data)
+}
+
+func (t *gorillaTransport) Close() error {
+	return t.conn.Close()
+}
+
+// disconnectError is an error of the connection itself, failing to dial it or
+// to read or write a message, after which the dialog reconnects.
+type disconnectError struct {
+	err  error
+	dial bool // the dial failed, rather than an established connection
+}
+
+func (e *disconnectError) Error() string { return e.err.Error() }
+
+func (e *disconnectError) Unwrap() error { return e.err }
+
+// disconnectTransport returns the read and write errors of a Transport as
+// *disconnectError. Reads aborted by their context return the context error
+// as before.
+type disconnectTransport struct {
+	Transport
+}
+
+func (t disconnectTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	mt, data, err := t.Transport.ReadMessage(ctx)
+	if err != nil && ctx.Err() == nil {
+		err = &disconnectError{err: err}
+	}
+	return mt, data, err
+}
+
+func (t disconnectTransport) WriteMessage(messageType int, data []byte) error {
+	if err := t.Transport.WriteMessage(messageType, data); err != nil {
+		return &disconnectError{err: err}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+//go:build !js
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+
+	nhooyr "nhooyr.io/websocket"
+)
+
+// nhooyrReadLimit is the largest message read, as nhooyr.io/websocket
+// defaults to 32 KiB and the bot audio comes in larger chunks.
+const nhooyrReadLimit = 16 << 20
+
+func init() {
+	transports["nhooyr"] = dialNhooyr
+}
+
+// nhooyrTransport is a Transport over a nhooyr.io/websocket connection,
+// which is context-native and safe for concurrent writes.
+type nhooyrTransport struct {
+	conn *nhooyr.Conn
+	// message holds the last message read, overwritten by the next one.
+	message bytes.Buffer
+}
+
+func dialNhooyr(ctx context.Context, url string, header http.Header) (Transport, *http.Response, error) {
+	conn, resp, err := nhooyr.Dial(ctx, url, &nhooyr.DialOptions{HTTPHeader: header})
+	if err != nil {
+		return nil, resp, err
+	}
+	conn.SetReadLimit(nhooyrReadLimit)
+	t := &nhooyrTransport{conn: conn}
+	t.message.Grow(messageBufferSize)
+	return t, resp, nil
+}
+
+// ReadMessage closes the connection if ctx is done during the read.
+func (t *nhooyrTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	mt, r, err := t.conn.Reader(ctx)
+	var data []byte
+	if err == nil {
+		data, err = readMessage(&t.message, r)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, nil, ctxErr
+		}
+		return 0, nil, err
+	}
+	switch mt {
+	case nhooyr.MessageText:
+		return TextMessage, data, nil
+	case nhooyr.MessageBinary:
+		return BinaryMessage, data, nil
+	}
+	return int(mt), data, nil
+}
+
+func (t *nhooyrTransport) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case TextMessage:
+		return t.conn.Write(context.Background(), nhooyr.MessageText, data)
+	case BinaryMessage:
+		return t.conn.Write(context.Background(), nhooyr.MessageBinary, data)
+	}
+	return fmt.Errorf("unsupported message type %d", messageType)
+}
+
+func (t *nhooyrTransport) Close() error {
+	return t.conn.CloseNow()
+}
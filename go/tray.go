@@ -0,0 +1,245 @@
+//go:build tray
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"fyne.io/systray"
+	"github.com/golang/glog"
+)
+
+// 托盘模式：以 go build -tags tray 构建后，tray 子命令在系统托盘（通知区域）
+// 中运行，作为后台的桌面助手。菜单可以开始与停止对话、静音麦克风、打开对话记录
+// 以及退出；对话记录追加写入 -tray-transcript 文件，用系统默认的程序打开。对话
+// 按 -loop 运行，一个会话结束后开始下一个，停止对话时照常结束当前会话。图标的
+// 颜色表示状态：绿色对话中，红色已静音，灰色已停止。Linux 上需要支持
+// StatusNotifierItem 的桌面环境。
+
+var trayTranscript = flag.String("tray-transcript", filepath.Join(os.TempDir(), "realtimedialog-transcript.txt"), "`file` the tray mode appends the transcript to, opened by its Open transcript menu item")
+
+// trayStateInterval is how often the tray reflects changes made outside its
+// menu, such as a mute toggled by SIGUSR1.
+const trayStateInterval = time.Second
+
+func init() {
+	commands["tray"] = runTray
+}
+
+// runTray implements the `tray` subcommand: it runs the dialog controlled
+// from a system tray icon until Quit is chosen or ctx is done.
+func runTray(ctx context.Context, cfg *Config) error {
+	ids, err := newSessionIDs(*sessionIDFlag)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*trayTranscript, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open transcript: %w", err)
+	}
+	defer f.Close()
+	*loopMode = true
+	serveMetrics()
+
+	t := &trayApp{ctx: ctx, cfg: cfg, ids: ids, transcript: newTranscriptPrinter(f, false)}
+	stopQuit := context.AfterFunc(ctx, systray.Quit)
+	defer stopQuit()
+	// systray.Run 必须在主 goroutine 上运行（macOS），直到 systray.Quit 返回
+	systray.Run(t.onReady, t.stop)
+	return nil
+}
+
+// trayApp runs the dialog as its tray menu asks.
+type trayApp struct {
+	ctx        context.Context
+	cfg        *Config
+	ids        *sessionIDs
+	transcript *transcriptPrinter
+
+	startItem, stopItem, muteItem, openItem, quitItem *systray.MenuItem
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // of the running dialog, nil when stopped
+	done   chan struct{}      // closed when the running dialog returns
+}
+
+func (t *trayApp) onReady() {
+	systray.SetTitle("RealtimeDialog")
+	t.startItem = systray.AddMenuItem("Start dialog", "Start talking with the bot")
+	t.stopItem = systray.AddMenuItem("Stop dialog", "Finish the current session")
+	t.muteItem = systray.AddMenuItemCheckbox("Mute microphone", "Send silence instead of the microphone audio", micMuted.Load())
+	t.openItem = systray.AddMenuItem("Open transcript", "Open "+*trayTranscript)
+	systray.AddSeparator()
+	t.quitItem = systray.AddMenuItem("Quit", "Stop the dialog and quit")
+	t.start()
+	go t.handleMenu()
+}
+
+func (t *trayApp) handleMenu() {
+	ticker := time.NewTicker(trayStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.startItem.ClickedCh:
+			t.start()
+		case <-t.stopItem.ClickedCh:
+			t.stop()
+		case <-t.muteItem.ClickedCh:
+			micMuted.Store(!micMuted.Load())
+			t.update()
+		case <-t.openItem.ClickedCh:
+			if err := openWithDefaultApp(*trayTranscript); err != nil {
+				glog.Errorf("Open transcript: %v", err)
+			}
+		case <-t.quitItem.ClickedCh:
+			systray.Quit()
+			return
+		case <-ticker.C:
+			t.update()
+		}
+	}
+}
+
+// start runs the dialog unless it is running.
+func (t *trayApp) start() {
+	t.mu.Lock()
+	if t.cancel != nil {
+		t.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(t.ctx)
+	done := make(chan struct{})
+	t.cancel, t.done = cancel, done
+	t.mu.Unlock()
+	go func() {
+		defer close(done)
+		defer cancel()
+		err := runDialog(ctx, t.cfg, t.ids, t.transcript)
+		if err != nil && ctx.Err() == nil {
+			glog.Errorf("Dialog error: %v", err)
+		}
+		// 对话自行结束（出错）时回到停止状态
+		t.mu.Lock()
+		if t.done == done {
+			t.cancel, t.done = nil, nil
+		}
+		t.mu.Unlock()
+		t.update()
+	}()
+	t.update()
+}
+
+// stop finishes the dialog, if running, and waits for it.
+func (t *trayApp) stop() {
+	t.mu.Lock()
+	cancel, done := t.cancel, t.done
+	t.cancel, t.done = nil, nil
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	t.update()
+}
+
+// update reflects the state of the dialog in the icon and the menu.
+func (t *trayApp) update() {
+	if t.startItem == nil {
+		return
+	}
+	t.mu.Lock()
+	running := t.cancel != nil
+	t.mu.Unlock()
+	muted := micMuted.Load()
+	switch {
+	case !running:
+		systray.SetIcon(trayIcon(color.RGBA{0x9e, 0x9e, 0x9e, 0xff}))
+		systray.SetTooltip("RealtimeDialog: stopped")
+		t.startItem.Enable()
+		t.stopItem.Disable()
+	case muted:
+		systray.SetIcon(trayIcon(color.RGBA{0xe5, 0x39, 0x35, 0xff}))
+		systray.SetTooltip("RealtimeDialog: muted")
+	default:
+		systray.SetIcon(trayIcon(color.RGBA{0x43, 0xa0, 0x47, 0xff}))
+		systray.SetTooltip("RealtimeDialog: listening")
+	}
+	if running {
+		t.startItem.Disable()
+		t.stopItem.Enable()
+	}
+	if muted {
+		t.muteItem.Check()
+	} else {
+		t.muteItem.Uncheck()
+	}
+}
+
+var (
+	trayIconsMu sync.Mutex
+	trayIcons   = map[color.RGBA][]byte{}
+)
+
+// trayIcon returns a disc of color c as an icon: a PNG, in an ICO on
+// Windows.
+func trayIcon(c color.RGBA) []byte {
+	trayIconsMu.Lock()
+	defer trayIconsMu.Unlock()
+	if icon, ok := trayIcons[c]; ok {
+		return icon
+	}
+	const size = 32
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := range size {
+		for x := range size {
+			dx, dy := float64(x)-size/2+0.5, float64(y)-size/2+0.5
+			if dx*dx+dy*dy <= (size/2-2)*(size/2-2) {
+				img.Set(x, y, c)
+			}
+		}
+	}
+	var b bytes.Buffer
+	_ = png.Encode(&b, img)
+	icon := b.Bytes()
+	if runtime.GOOS == "windows" {
+		// ICO 文件可以直接包含 PNG 图像
+		ico := []byte{0, 0, 1, 0, 1, 0, size, size, 0, 0, 1, 0, 32, 0}
+		ico = binary.LittleEndian.AppendUint32(ico, uint32(len(icon)))
+		ico = binary.LittleEndian.AppendUint32(ico, 22)
+		icon = append(ico, icon...)
+	}
+	trayIcons[c] = icon
+	return icon
+}
+
+// openWithDefaultApp opens path with the program the desktop associates with
+// it.
+func openWithDefaultApp(path string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", path)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
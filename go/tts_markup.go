@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 合成文本中的情感与风格标记：ChatTTSText 的内容可以带
+// <emotion name="happy">…</emotion>、<style name="whisper">…</style> 与
+// <break time="500ms"/> 标记，原样发给服务端，由服务端决定如何演绎。发送前检查
+// 标记是否成对、嵌套是否正确；tts 子命令切分句子时不会切开标记内的文本。
+// TTSMarkup 用于在代码中拼出带标记的文本。
+
+// ttsTagPattern matches a complete markup tag: its closing slash, name,
+// attributes and self-closing slash.
+var ttsTagPattern = regexp.MustCompile(`^<(/?)(emotion|style|break)\b([^<>]*?)(/?)>`)
+
+// ttsTagStart matches the start of what should be a markup tag.
+var ttsTagStart = regexp.MustCompile(`^</?(emotion|style|break)\b`)
+
+// ttsTagAttr matches the attributes of the opening tags.
+var ttsTagAttr = regexp.MustCompile(`^\s+(name|time)="([^"]+)"\s*$`)
+
+// TTSMarkup composes ChatTTSText content with emotion, style and pause
+// markup. The zero value is empty text.
+type TTSMarkup struct {
+	b strings.Builder
+}
+
+// Text appends plain text.
+func (m *TTSMarkup) Text(s string) *TTSMarkup {
+	m.b.WriteString(s)
+	return m
+}
+
+// Emotion appends text spoken with an emotion, e.g. happy or sad.
+func (m *TTSMarkup) Emotion(name, text string) *TTSMarkup {
+	fmt.Fprintf(&m.b, `<emotion name="%s">%s</emotion>`, name, text)
+	return m
+}
+
+// Style appends text spoken in a style, e.g. whisper.
+func (m *TTSMarkup) Style(name, text string) *TTSMarkup {
+	fmt.Fprintf(&m.b, `<style name="%s">%s</style>`, name, text)
+	return m
+}
+
+// Break appends a pause.
+func (m *TTSMarkup) Break(d time.Duration) *TTSMarkup {
+	fmt.Fprintf(&m.b, `<break time="%s"/>`, d)
+	return m
+}
+
+func (m *TTSMarkup) String() string {
+	return m.b.String()
+}
+
+// ttsTag is a markup tag parsed from text.
+type ttsTag struct {
+	name    string
+	closing bool
+	empty   bool // self-closing
+	attr    string
+	value   string
+	length  int // in bytes
+}
+
+// parseTTSTag parses the markup tag at the start of s. ok is false if s does
+// not start with a tag; a malformed tag is an error.
+func parseTTSTag(s string) (tag ttsTag, ok bool, err error) {
+	if !ttsTagStart.MatchString(s) {
+		return tag, false, nil
+	}
+	m := ttsTagPattern.FindStringSubmatch(s)
+	if m == nil {
+		return tag, true, fmt.Errorf("unterminated tag %q", truncateTag(s))
+	}
+	tag = ttsTag{name: m[2], closing: m[1] == "/", empty: m[4] == "/", length: len(m[0])}
+	attrs := m[3]
+	switch {
+	case tag.closing:
+		if tag.empty || strings.TrimSpace(attrs) != "" {
+			return tag, true, fmt.Errorf("malformed closing tag %q", m[0])
+		}
+		return tag, true, nil
+	case tag.name == "break" && !tag.empty, tag.name != "break" && tag.empty:
+		return tag, true, fmt.Errorf("malformed tag %q", m[0])
+	}
+	am := ttsTagAttr.FindStringSubmatch(attrs)
+	want := "name"
+	if tag.name == "break" {
+		want = "time"
+	}
+	if am == nil || am[1] != want {
+		return tag, true, fmt.Errorf("tag %q needs a %s attribute", m[0], want)
+	}
+	tag.attr, tag.value = am[1], am[2]
+	if tag.name == "break" {
+		if _, err := time.ParseDuration(tag.value); err != nil {
+			return tag, true, fmt.Errorf("tag %q: invalid time: %w", m[0], err)
+		}
+	}
+	return tag, true, nil
+}
+
+func truncateTag(s string) string {
+	if i := strings.IndexAny(s[1:], "<\n"); i >= 0 {
+		s = s[:i+1]
+	}
+	if len(s) > 32 {
+		s = s[:32] + "..."
+	}
+	return s
+}
+
+// validateTTSMarkup checks that the markup tags of text are well formed and
+// balanced. A "<" that does not start a markup tag is plain text.
+func validateTTSMarkup(text string) error {
+	var open []string
+	for i := strings.IndexByte(text, '<'); i >= 0; {
+		tag, ok, err := parseTTSTag(text[i:])
+		if err != nil {
+			return err
+		}
+		next := i + 1
+		if ok {
+			switch {
+			case tag.empty:
+			case !tag.closing:
+				open = append(open, tag.name)
+			case len(open) == 0 || open[len(open)-1] != tag.name:
+				return fmt.Errorf("unexpected </%s>", tag.name)
+			default:
+				open = open[:len(open)-1]
+			}
+			next = i + tag.length
+		}
+		j := strings.IndexByte(text[next:], '<')
+		if j < 0 {
+			break
+		}
+		i = next + j
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unclosed <%s>", open[len(open)-1])
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"golang.org/x/sync/errgroup"
+)
+
+// 流控的文本合成队列：长文本按句切分，以 ChatTTSText（事件 500）分段发送，第一段
+// 带 start、最后以 end 结束；已发送但尚未合成完毕的句子不超过 -tts-window 句，
+// 由服务端的 TTSSentenceEnd 推进，超过 -tts-stall 没有任何合成进展时照常发送下一
+// 句，任意长度的文本都不会压垮会话；情感与风格标记（见 tts_markup.go）内的文本
+// 不切分。tts 子命令用它朗读一个文本文件，或者边读标准输入边合成（tts -），机器人
+// 音频送往 -sink。
+
+var (
+	ttsWindow = flag.Int("tts-window", 2, "sentences sent with ChatTTSText ahead of the audio synthesized")
+	ttsStall  = flag.Duration("tts-stall", 5*time.Second, "send the next ChatTTSText sentence anyway after this long without synthesis progress")
+)
+
+// ttsMaxSentence is the length, in runes, beyond which a sentence without
+// punctuation is split.
+const ttsMaxSentence = 200
+
+func init() {
+	commands["tts"] = runTTS
+}
+
+// ttsStream speaks text of any length in a session with ChatTTSText
+// segments, paced by the progress of the synthesis. It is a Handler of the
+// dialog.
+type ttsStream struct {
+	NopHandler
+
+	mu        sync.Mutex
+	conn      Transport
+	sessionID string
+	ended     bool          // the session ended
+	pending   string        // text not yet split into sentences
+	started   bool          // the start segment was sent
+	sent      int           // sentences sent
+	done      int           // sentences synthesized
+	spoken    bool          // TTSEnded was received since the end segment
+	progress  chan struct{} // closed and replaced on every change
+}
+
+func newTTSStream(conn Transport) *ttsStream {
+	return &ttsStream{conn: conn, progress: make(chan struct{})}
+}
+
+// notify wakes the waiters; the caller holds mu.
+func (s *ttsStream) notify() {
+	close(s.progress)
+	s.progress = make(chan struct{})
+}
+
+// wait waits until ready returns true, holding mu, or returns errNoSession
+// once the session has ended. With a stall timeout, it also returns after
+// that long without progress.
+func (s *ttsStream) wait(ctx context.Context, stall time.Duration, ready func() bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !ready() {
+		if s.ended {
+			return errNoSession
+		}
+		var timeout <-chan time.Time
+		if stall > 0 {
+			timeout = time.After(stall)
+		}
+		progress := s.progress
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			return ctx.Err()
+		case <-timeout:
+			s.mu.Lock()
+			glog.Warningf("No synthesis progress in %v, going on", stall)
+			return nil
+		case <-progress:
+		}
+		s.mu.Lock()
+	}
+	return nil
+}
+
+// Write queues text and sends the complete sentences, blocking while
+// -tts-window sentences await synthesis.
+func (s *ttsStream) Write(ctx context.Context, text string) error {
+	s.mu.Lock()
+	sentences, rest := splitSentences(s.pending+text, false)
+	s.pending = rest
+	s.mu.Unlock()
+	return s.sendSentences(ctx, sentences)
+}
+
+// Close sends the rest of the text and the end segment.
+func (s *ttsStream) Close(ctx context.Context) error {
+	s.mu.Lock()
+	sentences, _ := splitSentences(s.pending, true)
+	s.pending = ""
+	s.mu.Unlock()
+	if err := s.sendSentences(ctx, sentences); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return nil
+	}
+	s.spoken = false
+	return chatTTSText(s.conn, s.sessionID, &ChatTTSTextPayload{End: true})
+}
+
+// Wait waits until the text sent is synthesized.
+func (s *ttsStream) Wait(ctx context.Context) error {
+	return s.wait(ctx, *ttsStall, func() bool { return s.spoken || !s.started })
+}
+
+func (s *ttsStream) sendSentences(ctx context.Context, sentences []string) error {
+	for _, sentence := range sentences {
+		err := s.wait(ctx, *ttsStall, func() bool {
+			return s.sessionID != "" && s.sent-s.done < max(*ttsWindow, 1)
+		})
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.sessionID == "" {
+			// 会话开始前超时
+			s.mu.Unlock()
+			if err := s.wait(ctx, 0, func() bool { return s.sessionID != "" }); err != nil {
+				return err
+			}
+			s.mu.Lock()
+		}
+		err = chatTTSText(s.conn, s.sessionID, &ChatTTSTextPayload{Start: !s.started, Content: sentence})
+		if err == nil {
+			s.started = true
+			s.sent++
+			glog.V(vEvent).Infof("Sent sentence %d for synthesis: %s", s.sent, sentence)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ttsStream) OnSessionStart(session SessionInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessionID = session.ID
+	s.notify()
+}
+
+func (s *ttsStream) OnBotSentenceEnd(TTSSentencePayload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = min(s.done+1, s.sent)
+	s.notify()
+}
+
+func (s *ttsStream) OnAudioChunk([]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notify()
+}
+
+func (s *ttsStream) OnBotSpeechEnd() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done, s.spoken = s.sent, true
+	s.notify()
+}
+
+func (s *ttsStream) OnSessionEnd(int32, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessionID, s.ended = "", true
+	s.notify()
+}
+
+// splitSentences splits text after the sentence punctuation and line
+// breaks, and the sentences longer than ttsMaxSentence, but not within
+// markup tags or the text they enclose. Unless final, the text after the
+// last complete sentence is returned as rest.
+func splitSentences(text string, final bool) (sentences []string, rest string) {
+	runes := []rune(text)
+	start := 0
+	add := func(end int) {
+		if s := strings.TrimSpace(string(runes[start:end])); s != "" {
+			sentences = append(sentences, s)
+		}
+		start = end
+	}
+	depth := 0 // of the markup elements open at i
+	pause := 0 // after the last pause punctuation outside markup
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '<' {
+			s := string(runes[i:min(i+64, len(runes))])
+			if tag, ok, err := parseTTSTag(s); ok && err == nil {
+				switch {
+				case tag.empty:
+				case tag.closing:
+					depth = max(depth-1, 0)
+				default:
+					depth++
+				}
+				i += utf8.RuneCountInString(s[:tag.length]) - 1
+				continue
+			}
+		}
+		if depth > 0 {
+			continue
+		}
+		switch r := runes[i]; {
+		case strings.ContainsRune("。！？；…\n!?;", r):
+			add(i + 1)
+		case r == '.':
+			// 英文句号后须有空白，以免切开小数与缩写
+			if i+1 < len(runes) && unicode.IsSpace(runes[i+1]) {
+				add(i + 1)
+			} else if i+1 == len(runes) && final {
+				add(i + 1)
+			}
+		case i-start >= ttsMaxSentence:
+			if pause > start {
+				add(pause)
+			} else {
+				add(i)
+			}
+		case strings.ContainsRune("，、,： ", r):
+			pause = i + 1
+		}
+	}
+	if final {
+		add(len(runes))
+		return sentences, ""
+	}
+	return sentences, string(runes[start:])
+}
+
+// runTTS implements the `tts <text file>` subcommand: the bot speaks the
+// text, to the -sink. With -, the text read from stdin is sent as it arrives.
+func runTTS(ctx context.Context, cfg *Config) error {
+	path := flag.Arg(1)
+	if path == "" {
+		return errors.New("usage: tts <text file or ->")
+	}
+	if path == "-" {
+		return speakDocument(ctx, cfg, func(ctx context.Context, s *ttsStream) error {
+			chunks := readTextChunks(os.Stdin)
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case chunk, ok := <-chunks:
+					if !ok {
+						return nil
+					}
+					if err := s.Write(ctx, chunk); err != nil {
+						return err
+					}
+				}
+			}
+		})
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read text: %w", err)
+	}
+	if err := validateTTSMarkup(string(text)); err != nil {
+		return fmt.Errorf("text markup: %w", err)
+	}
+	return speakDocument(ctx, cfg, func(ctx context.Context, s *ttsStream) error {
+		return s.Write(ctx, string(text))
+	})
+}
+
+// readTextChunks sends the text read from r as it arrives, without splitting
+// UTF-8 sequences, until EOF.
+func readTextChunks(r io.Reader) <-chan string {
+	chunks := make(chan string)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 4096)
+		var carry []byte
+		for {
+			n, err := r.Read(buf)
+			data := append(carry, buf[:n]...)
+			cut := len(data)
+			for i := max(len(data)-utf8.UTFMax+1, 0); i < len(data); i++ {
+				if utf8.RuneStart(data[i]) && !utf8.FullRune(data[i:]) {
+					cut = i
+					break
+				}
+			}
+			if cut > 0 {
+				chunks <- string(data[:cut])
+			}
+			carry = append([]byte(nil), data[cut:]...)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					glog.Errorf("Read text: %v", err)
+				}
+				return
+			}
+		}
+	}()
+	return chunks
+}
+
+// speakDocument has the bot speak the text that write gives a ttsStream, in
+// a session of its own, and waits for the audio to be played.
+func speakDocument(ctx context.Context, cfg *Config, write func(context.Context, *ttsStream) error) error {
+	sinks, speaker, err := openSinks()
+	if err != nil {
+		return err
+	}
+	defer closeSinks(sinks)
+	if speaker {
+		if audioBackend, err = openAudioBackend(); err != nil {
+			return err
+		}
+		defer func() {
+			err := audioBackend.Close()
+			if err != nil {
+				glog.Errorf("Failed to close the audio backend: %v", err)
+			}
+		}()
+	}
+	conn, _, err := dialDialog(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("websocket dial: %w", err)
+	}
+	defer conn.Close()
+	stream := newTTSStream(conn)
+	handlers := multiHandler{stream, sinkFanout{sinks: sinks}}
+
+	g, gctx := errgroup.WithContext(ctx)
+	playerCtx, stopPlayer := context.WithCancel(gctx)
+	defer stopPlayer()
+	if speaker {
+		g.Go(func() error {
+			return startPlayer(playerCtx)
+		})
+	}
+	done := make(chan struct{})
+	g.Go(func() error {
+		ids, _ := newSessionIDs("")
+		err := realTimeDialog(gctx, conn, ids, handlers, pcmSource{done: done})
+		if err == nil && speaker {
+			waitPlayback(gctx)
+		}
+		stopPlayer()
+		return err
+	})
+	g.Go(func() error {
+		// 朗读完毕后结束会话
+		defer close(done)
+		if err := write(gctx, stream); err != nil {
+			return err
+		}
+		if err := stream.Close(gctx); err != nil {
+			return err
+		}
+		return stream.Wait(gctx)
+	})
+	return g.Wait()
+}
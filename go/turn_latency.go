@@ -0,0 +1,126 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 每轮对话的响应时延：以服务端 VAD 判定用户说完（ASREnded）为起点，分别记录
+// 首个最终识别结果与首个机器人音频到达的时间。首音频时延是语音助手体验最关键
+// 的指标。
+
+// latencyMetrics exports the latency of the last turn and the totals, in
+// milliseconds.
+var latencyMetrics = expvar.NewMap("latency")
+
+// TurnLatency is the latency of a user turn, from the end of the user speech.
+type TurnLatency struct {
+	Turn int
+	// ASRFinal is the time to the first final recognition result; zero if it
+	// arrived before the end of speech was detected.
+	ASRFinal time.Duration
+	// FirstAudio is the time to the first byte of the bot audio reply.
+	FirstAudio time.Duration
+}
+
+// latencyTracker is a Handler measuring the TurnLatency of every user turn.
+type latencyTracker struct {
+	NopHandler
+
+	mu        sync.Mutex
+	turn      int
+	speechEnd time.Time
+	asrFinal  time.Time
+	waiting   bool // end of speech seen, first audio not yet
+	turns     []TurnLatency
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{}
+}
+
+func (t *latencyTracker) OnSessionStart(SessionInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.turn, t.turns, t.waiting = 0, nil, false
+	t.speechEnd, t.asrFinal = time.Time{}, time.Time{}
+}
+
+func (t *latencyTracker) OnASRStart(ASRInfoPayload) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.waiting {
+		// 机器人回复前用户又开口：上一轮没有首音频
+		glog.V(vEvent).Infof("Turn %d: no bot audio before the user spoke again", t.turn)
+	}
+	t.waiting = false
+	t.speechEnd, t.asrFinal = time.Time{}, time.Time{}
+}
+
+func (t *latencyTracker) OnASRFinal(ASRResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.asrFinal.IsZero() {
+		t.asrFinal = time.Now()
+	}
+}
+
+func (t *latencyTracker) OnASREnd() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.waiting || !t.speechEnd.IsZero() {
+		return
+	}
+	t.turn++
+	t.speechEnd, t.waiting = time.Now(), true
+}
+
+func (t *latencyTracker) OnAudioChunk([]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.waiting {
+		return
+	}
+	t.waiting = false
+	l := TurnLatency{Turn: t.turn, FirstAudio: time.Since(t.speechEnd)}
+	if !t.asrFinal.IsZero() {
+		l.ASRFinal = max(t.asrFinal.Sub(t.speechEnd), 0)
+	}
+	t.turns = append(t.turns, l)
+	glog.V(vEvent).Infof("Turn %d latency: ASR final %v, first audio %v", l.Turn, l.ASRFinal.Round(time.Millisecond), l.FirstAudio.Round(time.Millisecond))
+
+	asrMs, audioMs := l.ASRFinal.Milliseconds(), l.FirstAudio.Milliseconds()
+	latencyMetrics.Add("turns", 1)
+	latencyMetrics.Add("asr_final_ms_total", asrMs)
+	latencyMetrics.Add("first_audio_ms_total", audioMs)
+	for key, value := range map[string]int64{"last_asr_final_ms": asrMs, "last_first_audio_ms": audioMs} {
+		v := new(expvar.Int)
+		v.Set(value)
+		latencyMetrics.Set(key, v)
+	}
+	if v, ok := latencyMetrics.Get("max_first_audio_ms").(*expvar.Int); !ok || v.Value() < audioMs {
+		v := new(expvar.Int)
+		v.Set(audioMs)
+		latencyMetrics.Set("max_first_audio_ms", v)
+	}
+}
+
+func (t *latencyTracker) OnSessionEnd(int32, []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.turns) == 0 {
+		return
+	}
+	var asr, audio, maxAudio time.Duration
+	for _, l := range t.turns {
+		asr += l.ASRFinal
+		audio += l.FirstAudio
+		maxAudio = max(maxAudio, l.FirstAudio)
+	}
+	n := time.Duration(len(t.turns))
+	glog.V(vEvent).Infof("Session latency: %d turns, ASR final avg %v, first audio avg %v, max %v",
+		len(t.turns), (asr / n).Round(time.Millisecond), (audio / n).Round(time.Millisecond), maxAudio.Round(time.Millisecond))
+}
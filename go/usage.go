@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// UsagePayload is the payload of the UsageResponse event.
+type UsagePayload struct {
+	Usage Usage `json:"usage"`
+}
+
+// Usage maps usage items reported by the server, such as input_audio_tokens
+// or output_text_tokens, to their amounts.
+type Usage map[string]float64
+
+// Add adds every item of other to u.
+func (u Usage) Add(other Usage) {
+	for k, v := range other {
+		u[k] += v
+	}
+}
+
+func (u Usage) String() string {
+	keys := make([]string, 0, len(u))
+	for k := range u {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]string, len(keys))
+	for i, k := range keys {
+		items[i] = fmt.Sprintf("%s=%g", k, u[k])
+	}
+	return strings.Join(items, " ")
+}
+
+// usageTracker aggregates the usage of each session and of the whole
+// process, and exports the totals as metrics.
+type usageTracker struct {
+	NopHandler
+
+	mu      sync.Mutex
+	session Usage
+	total   Usage
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{session: make(Usage), total: make(Usage)}
+}
+
+func (t *usageTracker) OnUsage(usage Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.session.Add(usage)
+	t.total.Add(usage)
+	for k, v := range usage {
+		usageMetrics.AddFloat(k, v)
+	}
+}
+
+func (t *usageTracker) OnSessionEnd(int32, []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.session) > 0 {
+		glog.V(vEvent).Infof("Session usage: %s", t.session)
+	}
+	t.session = make(Usage)
+}
+
+// Report writes the usage totals of the process to w.
+func (t *usageTracker) Report(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.total) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Total usage: %s\n", t.total)
+}
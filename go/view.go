@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"RealtimeDialog/dialog"
+	"RealtimeDialog/pcm"
+	"github.com/golang/glog"
+)
+
+// 事件日志查看：view 子命令读取 -json 输出或录制目录中的 events.jsonl，在终端上
+// 按时间线显示对话：用户的话、机器人回复、每轮的响应时延、用户打断机器人以及
+// 错误，最后给出汇总。参数为录制目录时，-view-play 同时在扬声器上播放其中的
+// mixed.wav，时间线随播放进度逐条显示。
+
+var viewPlay = flag.Bool("view-play", false, "in the `view` command, play the mixed.wav of the recording bundle and show the timeline in sync with it")
+
+// viewPoll is how often the timeline catches up with the playback.
+const viewPoll = 20 * time.Millisecond
+
+func init() {
+	commands["view"] = runView
+}
+
+// timelineEntry is a line of the timeline of a dialog.
+type timelineEntry struct {
+	At   time.Duration // from the start of the log
+	Kind string        // session, user, bot, latency, interrupt or error
+	Text string
+}
+
+// timelineSummary counts the events of a timeline.
+type timelineSummary struct {
+	Turns         int
+	Latencies     []float64 // to the first bot audio, in seconds
+	Interruptions int
+	Errors        int
+}
+
+// runView implements the `view <events.jsonl | bundle>` subcommand.
+func runView(ctx context.Context, cfg *Config) error {
+	path := flag.Arg(1)
+	if path == "" {
+		return errors.New("usage: view <events.jsonl or recording bundle directory>")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	bundle := ""
+	var data []byte
+	if info.IsDir() {
+		bundle = path
+		data, _, err = readBundleFile(bundle, "events.jsonl")
+	} else {
+		if data, err = os.ReadFile(path); err == nil {
+			data, err = openBytes(data)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("read events: %w", err)
+	}
+	events, err := parseEvents(data)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("no events in %s", path)
+	}
+
+	// 录制目录的 mixed.wav 从 metadata.json 的 started_at 开始
+	start := events[0].Time
+	if bundle != "" {
+		if meta, err := os.ReadFile(filepath.Join(bundle, "metadata.json")); err == nil {
+			var m RecordingMetadata
+			if json.Unmarshal(meta, &m) == nil && !m.StartedAt.IsZero() {
+				start = m.StartedAt
+			}
+		}
+	}
+	entries, summary := buildTimeline(events, start)
+	color := isTerminal(os.Stdout)
+	if !*viewPlay {
+		for _, e := range entries {
+			writeTimelineEntry(os.Stdout, e, color)
+		}
+	} else {
+		if bundle == "" {
+			return errors.New("-view-play needs a recording bundle directory")
+		}
+		if err := playTimeline(ctx, bundle, entries, color); err != nil {
+			return err
+		}
+	}
+	l := latencyStats(summary.Latencies)
+	fmt.Printf("%d turns, %d interruptions, %d errors", summary.Turns, summary.Interruptions, summary.Errors)
+	if l.Count > 0 {
+		fmt.Printf(", first audio mean %.3fs, p90 %.3fs, max %.3fs", l.Mean, l.P90, l.Max)
+	}
+	fmt.Println()
+	return nil
+}
+
+// parseEvents parses the lines of an event log.
+func parseEvents(data []byte) ([]jsonEvent, error) {
+	var events []jsonEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var ev jsonEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("parse event: %w", err)
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read events: %w", err)
+	}
+	return events, nil
+}
+
+// buildTimeline returns the timeline of events, from start.
+func buildTimeline(events []jsonEvent, start time.Time) ([]timelineEntry, timelineSummary) {
+	var entries []timelineEntry
+	var summary timelineSummary
+	add := func(at time.Time, kind, text string) {
+		entries = append(entries, timelineEntry{At: at.Sub(start), Kind: kind, Text: text})
+	}
+	var speechEnd, asrFinal, replyAt time.Time
+	var reply []byte
+	botSpeaking := false
+	for _, ev := range events {
+		switch ev.Type {
+		case "session_start":
+			add(ev.Time, "session", "session started "+ev.SessionID)
+		case "asr_start":
+			if botSpeaking {
+				add(ev.Time, "interrupt", "the user interrupted the bot")
+				summary.Interruptions++
+				botSpeaking = false
+			}
+		case "asr_final":
+			add(ev.Time, "user", ev.Text)
+			summary.Turns++
+			if asrFinal.IsZero() {
+				asrFinal = ev.Time
+			}
+		case "asr_end":
+			speechEnd = ev.Time
+		case "bot_text":
+			if len(reply) == 0 {
+				replyAt = ev.Time
+			}
+			reply = append(reply, ev.Text...)
+		case "bot_text_end":
+			if len(reply) > 0 {
+				add(replyAt, "bot", string(reply))
+				reply = reply[:0]
+			}
+		case "audio_chunk_meta":
+			botSpeaking = true
+			if !speechEnd.IsZero() {
+				first := ev.Time.Sub(speechEnd)
+				text := fmt.Sprintf("first audio after %v", first.Round(time.Millisecond))
+				if !asrFinal.IsZero() {
+					text += fmt.Sprintf(", ASR final after %v", max(asrFinal.Sub(speechEnd), 0).Round(time.Millisecond))
+				}
+				add(ev.Time, "latency", text)
+				summary.Latencies = append(summary.Latencies, first.Round(time.Millisecond).Seconds())
+				speechEnd, asrFinal = time.Time{}, time.Time{}
+			}
+		case "bot_speech_end":
+			botSpeaking = false
+		case "error":
+			add(ev.Time, "error", ev.Text)
+			summary.Errors++
+		case "session_end":
+			text := fmt.Sprintf("session ended (event %d)", ev.Event)
+			if len(ev.Payload) > 0 && ev.Event == dialog.EventSessionFailed {
+				text += ": " + string(ev.Payload)
+			}
+			add(ev.Time, "session", text)
+		}
+	}
+	if len(reply) > 0 {
+		add(replyAt, "bot", string(reply))
+	}
+	// 回复在首个文本块处显示，可能早于其前的时延等条目
+	sortTimeline(entries)
+	return entries, summary
+}
+
+// sortTimeline orders entries by time, keeping the order of simultaneous
+// entries.
+func sortTimeline(entries []timelineEntry) {
+	for i := 1; i < len(entries); i++ {
+		for j := i; j > 0 && entries[j].At < entries[j-1].At; j-- {
+			entries[j], entries[j-1] = entries[j-1], entries[j]
+		}
+	}
+}
+
+func writeTimelineEntry(w io.Writer, e timelineEntry, color bool) {
+	style := func(code, text string) string {
+		if !color {
+			return text
+		}
+		return code + text + ansiReset
+	}
+	stamp := fmt.Sprintf("[%8.3fs] ", e.At.Seconds())
+	switch e.Kind {
+	case "user":
+		fmt.Fprintln(w, stamp+style(ansiBold, "User: "+e.Text))
+	case "bot":
+		fmt.Fprintln(w, stamp+style(ansiCyan, "Bot:  "+e.Text))
+	case "interrupt", "error":
+		fmt.Fprintln(w, stamp+style(ansiRed, e.Kind+": "+e.Text))
+	default:
+		fmt.Fprintln(w, stamp+style(ansiDim, e.Text))
+	}
+}
+
+// playTimeline plays the mixed.wav of bundle on the speaker and writes the
+// entries as the playback reaches them.
+func playTimeline(ctx context.Context, bundle string, entries []timelineEntry, color bool) error {
+	data, path, err := readBundleFile(bundle, "mixed.wav")
+	if err != nil {
+		return fmt.Errorf("read mixed audio (bundles recorded with -format flac cannot be played): %w", err)
+	}
+	samples, rate, channels, err := decodeWAV(data)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	if audioBackend, err = openAudioBackend(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := audioBackend.Close(); err != nil {
+			glog.Errorf("Failed to close the audio backend: %v", err)
+		}
+	}()
+	device, err := outputDevice()
+	if err != nil {
+		return fmt.Errorf("get output device: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var played atomic.Int64 // samples
+	done := make(chan error, 1)
+	go func() {
+		done <- audioBackend.Play(ctx, device, rate, channels, rate/50, func(out []float32) {
+			pos := int(played.Load())
+			n := copy(out, pcm.Int16ToFloat32(samples[min(pos, len(samples)):min(pos+len(out), len(samples))]))
+			clear(out[n:])
+			played.Add(int64(len(out)))
+		})
+	}()
+	ticker := time.NewTicker(viewPoll)
+	defer ticker.Stop()
+	for len(entries) > 0 || int(played.Load()) < len(samples) {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-done:
+			return err
+		case <-ticker.C:
+		}
+		at := time.Duration(played.Load()/int64(channels)) * time.Second / time.Duration(rate)
+		for len(entries) > 0 && entries[0].At <= at {
+			writeTimelineEntry(os.Stdout, entries[0], color)
+			entries = entries[1:]
+		}
+	}
+	return nil
+}
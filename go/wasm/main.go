@@ -0,0 +1,103 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"errors"
+	"syscall/js"
+
+	"RealtimeDialog/dialog"
+)
+
+// 浏览器中的协议编解码：GOOS=js GOARCH=wasm go build ./wasm 构建的模块把
+// dialog 包中二进制协议的 Marshal/Unmarshal 注册为全局对象
+// realtimeDialogProtocol，浏览器前端与网关通信时可复用同一份帧格式代码。模块
+// 只导入 dialog 包，不含命令行客户端。
+
+func main() {
+	js.Global().Set("realtimeDialogProtocol", js.ValueOf(map[string]any{
+		"marshal":   js.FuncOf(jsMarshal),
+		"unmarshal": js.FuncOf(jsUnmarshal),
+	}))
+	select {}
+}
+
+// jsMarshal implements realtimeDialogProtocol.marshal(message): message has
+// the fields of Message, as returned by unmarshal, with a Uint8Array or a
+// string payload. It returns {data: Uint8Array} or {error: string}.
+func jsMarshal(_ js.Value, args []js.Value) any {
+	if len(args) != 1 || args[0].Type() != js.TypeObject {
+		return jsError(errors.New("marshal takes a message object"))
+	}
+	m := args[0]
+	msg, err := dialog.NewMessage(dialog.MsgType(jsInt(m, "type")), dialog.MsgTypeFlagBits(jsInt(m, "flags")))
+	if err != nil {
+		return jsError(err)
+	}
+	msg.Event = int32(jsInt(m, "event"))
+	msg.SessionID = jsString(m, "sessionId")
+	msg.ConnectID = jsString(m, "connectId")
+	msg.Sequence = int32(jsInt(m, "sequence"))
+	msg.ErrorCode = uint32(jsInt(m, "errorCode"))
+	switch p := m.Get("payload"); p.Type() {
+	case js.TypeString:
+		msg.Payload = []byte(p.String())
+	case js.TypeObject:
+		msg.Payload = make([]byte, p.Get("length").Int())
+		js.CopyBytesToGo(msg.Payload, p)
+	}
+	data, err := dialog.Marshal(msg)
+	if err != nil {
+		return jsError(err)
+	}
+	return map[string]any{"data": jsBytes(data)}
+}
+
+// jsUnmarshal implements realtimeDialogProtocol.unmarshal(data): data is a
+// Uint8Array holding a frame. It returns {message: {...}} or {error: string}.
+func jsUnmarshal(_ js.Value, args []js.Value) any {
+	if len(args) != 1 || args[0].Type() != js.TypeObject {
+		return jsError(errors.New("unmarshal takes a Uint8Array"))
+	}
+	data := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(data, args[0])
+	msg, _, err := dialog.Unmarshal(data, dialog.ContainsSequence)
+	if err != nil {
+		return jsError(err)
+	}
+	return map[string]any{"message": map[string]any{
+		"type":      int(msg.Type),
+		"typeName":  msg.Type.String(),
+		"flags":     int(msg.TypeFlag()),
+		"event":     int(msg.Event),
+		"sessionId": msg.SessionID,
+		"connectId": msg.ConnectID,
+		"sequence":  int(msg.Sequence),
+		"errorCode": int(msg.ErrorCode),
+		"payload":   jsBytes(msg.Payload),
+	}}
+}
+
+func jsInt(v js.Value, name string) int {
+	if f := v.Get(name); f.Type() == js.TypeNumber {
+		return f.Int()
+	}
+	return 0
+}
+
+func jsString(v js.Value, name string) string {
+	if f := v.Get(name); f.Type() == js.TypeString {
+		return f.String()
+	}
+	return ""
+}
+
+func jsBytes(b []byte) js.Value {
+	a := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(a, b)
+	return a
+}
+
+func jsError(err error) any {
+	return map[string]any{"error": err.Error()}
+}